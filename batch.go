@@ -0,0 +1,45 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Entry holds a single entry to be written by SetMulti.
+type Entry struct {
+	Key    string
+	Value  []byte
+	Expire time.Time
+}
+
+// MultiSetter is implemented by stores that can write several entries
+// in a single operation.
+type MultiSetter interface {
+	Store
+
+	// SetMulti sets all the given entries, as if by calling Set
+	// for each one in turn. Implementations document whether the
+	// entries are written atomically.
+	SetMulti(ctx context.Context, entries []Entry) error
+}
+
+// SetMulti sets all the given entries in the store. If kv implements
+// MultiSetter, its SetMulti method is used; otherwise the entries are
+// set one at a time and an error may leave only some of them written.
+func SetMulti(ctx context.Context, kv Store, entries []Entry) error {
+	if kv, ok := kv.(MultiSetter); ok {
+		return errgo.Mask(kv.SetMulti(ctx, entries), errgo.Any)
+	}
+	for _, e := range entries {
+		if err := kv.Set(ctx, e.Key, e.Value, e.Expire); err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot set %q", e.Key), errgo.Any)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/mocksimplekv"
+)
+
+func TestSetMultiFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	expire := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := mocksimplekv.New()
+	m.ExpectSet("a", []byte("a-value")).WithExpire(expire)
+	m.ExpectSet("b", []byte("b-value")).ReturnError(errgo.New("test error"))
+
+	err := simplekv.SetMulti(ctx, m, []simplekv.Entry{{
+		Key:    "a",
+		Value:  []byte("a-value"),
+		Expire: expire,
+	}, {
+		Key:   "b",
+		Value: []byte("b-value"),
+	}, {
+		Key:   "c",
+		Value: []byte("c-value"),
+	}})
+	c.Assert(err, qt.ErrorMatches, `cannot set "b": test error`)
+	c.Assert(m.Verify(), qt.Equals, nil)
+}
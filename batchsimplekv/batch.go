@@ -0,0 +1,337 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package batchsimplekv provides a simplekv.Store that buffers the
+// values set within a context returned by its Context method and
+// writes them to another store as a single batch when the context is
+// closed.
+package batchsimplekv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/internal/wrapkv"
+)
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages, including failures to write a batch when a context is
+// closed, to the given logger.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// NewStore returns a store that uses kv for storage. When the store's
+// Context method is called, values set with the returned context are
+// held in memory and written to kv with simplekv.SetMulti when the
+// context's close function is called, so a store that implements
+// simplekv.MultiSetter can write them all in one round trip. Operations
+// made with any other context go directly to kv.
+//
+// Values held in a batch are visible to Get and Exists calls made with
+// the same context. Any other operation made with the context writes
+// the batch first. The close function cannot return an error, so
+// callers that need to know whether the batch was written should call
+// Flush before closing the context.
+//
+// The returned store implements simplekv.KeyLister and
+// simplekv.Counter if kv implements simplekv.KeyLister, and
+// simplekv.Iterable if kv does.
+func NewStore(kv simplekv.Store, opts ...Option) simplekv.Store {
+	s := &kvStore{
+		kv:     kv,
+		logger: nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return wrapkv.NewStore(s, kv)
+}
+
+// Flush writes any values held in the batch associated with ctx to the
+// underlying store. It does nothing if ctx was not returned from the
+// Context method of a store created by NewStore.
+func Flush(ctx context.Context) error {
+	b, _ := ctx.Value(batchKey{}).(*batch)
+	if b == nil {
+		return nil
+	}
+	return errgo.Mask(b.flush(ctx), errgo.Any)
+}
+
+type kvStore struct {
+	kv     simplekv.Store
+	logger simplekv.Logger
+}
+
+// batchKey is the context key used to hold the current batch.
+type batchKey struct{}
+
+// batch holds the values set within a context.
+type batch struct {
+	kv simplekv.Store
+
+	mu      sync.Mutex
+	entries []simplekv.Entry
+	// index maps each key in entries to its position.
+	index map[string]int
+}
+
+// set adds the given entry to the batch, replacing any entry
+// already held for the same key.
+func (b *batch) set(e simplekv.Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i, ok := b.index[e.Key]; ok {
+		b.entries[i] = e
+		return
+	}
+	b.index[e.Key] = len(b.entries)
+	b.entries = append(b.entries, e)
+}
+
+// get returns the entry held in the batch for the given key.
+func (b *batch) get(key string) (simplekv.Entry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, ok := b.index[key]
+	if !ok {
+		return simplekv.Entry{}, false
+	}
+	return b.entries[i], true
+}
+
+// flush writes the entries held in the batch to the underlying store
+// and empties the batch. If the write fails, the entries are
+// discarded.
+func (b *batch) flush(ctx context.Context) error {
+	b.mu.Lock()
+	entries := b.entries
+	b.entries = nil
+	b.index = make(map[string]int)
+	b.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := simplekv.SetMulti(ctx, b.kv, entries); err != nil {
+		return errgo.Notef(err, "cannot write batch of %d entries", len(entries))
+	}
+	return nil
+}
+
+// batch returns the batch associated with the given context, or nil
+// if there is none.
+func (s *kvStore) batch(ctx context.Context) *batch {
+	b, _ := ctx.Value(batchKey{}).(*batch)
+	if b == nil || b.kv != s.kv {
+		return nil
+	}
+	return b
+}
+
+// flush writes the batch associated with the given context, if any.
+func (s *kvStore) flush(ctx context.Context) error {
+	if b := s.batch(ctx); b != nil {
+		return errgo.Mask(b.flush(ctx), errgo.Any)
+	}
+	return nil
+}
+
+// Context implements simplekv.Store.Context by associating a new batch
+// with the context returned by the underlying store. The returned close
+// function writes the batch before closing the underlying context. If
+// ctx already holds a batch for the store, it is returned unchanged
+// with a nop close function.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	if s.batch(ctx) != nil {
+		return ctx, func() {}
+	}
+	ctx, kvClose := s.kv.Context(ctx)
+	b := &batch{
+		kv:    s.kv,
+		index: make(map[string]int),
+	}
+	ctx = context.WithValue(ctx, batchKey{}, b)
+	return ctx, func() {
+		if err := b.flush(ctx); err != nil {
+			s.logger.Debugf("%v", err)
+		}
+		kvClose()
+	}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if b := s.batch(ctx); b != nil {
+		if e, ok := b.get(key); ok {
+			if expired(e, time.Now()) {
+				return nil, simplekv.KeyNotFoundError(key)
+			}
+			return e.Value, nil
+		}
+	}
+	v, err := s.kv.Get(ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if b := s.batch(ctx); b != nil {
+		if e, ok := b.get(key); ok {
+			return !expired(e, time.Now()), nil
+		}
+	}
+	ok, err := s.kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set by adding the value to the batch
+// associated with ctx, or by setting it in the underlying store if
+// there is no batch.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	b := s.batch(ctx)
+	if b == nil {
+		return errgo.Mask(s.kv.Set(ctx, key, value, expire), errgo.Any)
+	}
+	if err := s.checkEntry(key, value); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge), errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	b.set(simplekv.Entry{
+		Key:    key,
+		Value:  value,
+		Expire: simplekv.NormalizeExpire(expire),
+	})
+	return nil
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by adding the
+// entries to the batch associated with ctx, or by setting them in the
+// underlying store if there is no batch.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	b := s.batch(ctx)
+	if b == nil {
+		return errgo.Mask(simplekv.SetMulti(ctx, s.kv, entries), errgo.Any)
+	}
+	for _, e := range entries {
+		if err := s.checkEntry(e.Key, e.Value); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge), errgo.Is(simplekv.ErrValueTooLarge))
+		}
+	}
+	for _, e := range entries {
+		if e.Value == nil {
+			e.Value = []byte{}
+		}
+		e.Expire = simplekv.NormalizeExpire(e.Expire)
+		b.set(e)
+	}
+	return nil
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := s.flush(ctx); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.kv.Update(ctx, key, expire, getVal), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the underlying store.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	if err := s.flush(ctx); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(simplekv.SetIfEquals(ctx, s.kv, key, oldVal, newVal, expire), errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := s.flush(ctx); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.kv.Touch(ctx, key, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := s.flush(ctx); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.kv.Delete(ctx, key), errgo.Any)
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen by returning the
+// limit of the underlying store.
+func (s *kvStore) MaxKeyLen() int {
+	return simplekv.KeyLimit(s.kv)
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+// checkEntry checks that the underlying store would accept the given
+// key and value, so that errors are reported when a value is added to
+// a batch rather than when the batch is written.
+func (s *kvStore) checkEntry(key string, value []byte) error {
+	if err := simplekv.CheckKeyLen(key, simplekv.KeyLimit(s.kv)); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if maxLen := simplekv.MaxValueLen(s.kv); maxLen > 0 {
+		return errgo.Mask(simplekv.CheckValue(value, maxLen), errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return nil
+}
+
+// ListKeys implements wrapkv.Lister.ListKeys by writing the batch
+// before listing the keys of the underlying store.
+func (s *kvStore) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	if err := s.flush(ctx); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	keys, err := s.kv.(simplekv.KeyLister).KeysWithPrefix(ctx, prefix)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// CountKeys implements wrapkv.Counter.CountKeys by writing the batch
+// before counting the keys of the underlying store.
+func (s *kvStore) CountKeys(ctx context.Context, prefix string) (int, error) {
+	if err := s.flush(ctx); err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	n, err := simplekv.CountWithPrefix(ctx, s.kv.(simplekv.KeyLister), prefix)
+	return n, errgo.Mask(err, errgo.Any)
+}
+
+// IterateEntries implements wrapkv.Iterable.IterateEntries by writing
+// the batch before iterating over the underlying store.
+func (s *kvStore) IterateEntries(ctx context.Context, prefix string) (simplekv.Iterator, error) {
+	if err := s.flush(ctx); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	iter, err := s.kv.(simplekv.Iterable).Iterate(ctx, prefix)
+	return iter, errgo.Mask(err, errgo.Any)
+}
+
+// expired reports whether the given entry has expired at the given
+// time.
+func expired(e simplekv.Entry, now time.Time) bool {
+	return !e.Expire.IsZero() && !now.Before(e.Expire)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
@@ -0,0 +1,114 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package batchsimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/batchsimplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestBatchStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return batchsimplekv.NewStore(memsimplekv.NewStore()), nil
+	})
+}
+
+// multiSetCounter counts the calls to SetMulti on the underlying store.
+type multiSetCounter struct {
+	simplekv.Store
+	calls int
+}
+
+func (s *multiSetCounter) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	s.calls++
+	return simplekv.SetMulti(ctx, s.Store, entries)
+}
+
+func TestSetsWrittenOnClose(t *testing.T) {
+	c := qt.New(t)
+	mem := memsimplekv.NewStore()
+	counter := &multiSetCounter{Store: mem}
+	kv := batchsimplekv.NewStore(counter)
+
+	ctx, close := kv.Context(context.Background())
+	err := kv.Set(ctx, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "b", []byte("2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "a", []byte("3"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// The values are visible through the batch context...
+	v, err := kv.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "3")
+	// ... but have not been written yet.
+	_, err = mem.Get(ctx, "a")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// Nested contexts share the outer batch.
+	ctx1, close1 := kv.Context(ctx)
+	err = kv.Set(ctx1, "c", []byte("4"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	close1()
+	_, err = mem.Get(ctx, "c")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	close()
+	c.Assert(counter.calls, qt.Equals, 1)
+	for key, want := range map[string]string{"a": "3", "b": "2", "c": "4"} {
+		v, err := mem.Get(context.Background(), key)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, want)
+	}
+}
+
+func TestOtherOperationsFlushBatch(t *testing.T) {
+	c := qt.New(t)
+	mem := memsimplekv.NewStore()
+	kv := batchsimplekv.NewStore(mem)
+	ctx, close := kv.Context(context.Background())
+	defer close()
+
+	err := kv.Set(ctx, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Update(ctx, "a", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, "1")
+		return []byte("2"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	v, err := mem.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "2")
+
+	err = kv.Set(ctx, "b", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = batchsimplekv.Flush(ctx)
+	c.Assert(err, qt.Equals, nil)
+	v, err = mem.Get(ctx, "b")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "1")
+}
+
+func TestSetWithoutBatch(t *testing.T) {
+	c := qt.New(t)
+	mem := memsimplekv.NewStore()
+	kv := batchsimplekv.NewStore(mem)
+	ctx := context.Background()
+
+	err := kv.Set(ctx, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := mem.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "1")
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// CompareAndSwapper is implemented by stores that can conditionally
+// set a value without the round trips needed by Update.
+type CompareAndSwapper interface {
+	Store
+
+	// SetIfEquals sets the value for the given key to newVal only if
+	// its current value is equal to oldVal. A nil oldVal matches only
+	// a key that does not exist; an empty non-nil oldVal matches a
+	// key with an empty value. If the current value does not match,
+	// an error with a cause of ErrConflict is returned.
+	//
+	// If the expire time is non-zero then the entry may be garbage
+	// collected at some point after that time.
+	SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error
+}
+
+// KeyConflictError creates a new error with a cause of ErrConflict and
+// an appropriate message.
+func KeyConflictError(key string) error {
+	err := errgo.WithCausef(nil, ErrConflict, "key %s does not have the expected value", key)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
+// SetIfEquals sets the value for the given key to newVal if its
+// current value is equal to oldVal, as described in
+// CompareAndSwapper.SetIfEquals. If kv implements CompareAndSwapper,
+// its SetIfEquals method is used; otherwise the comparison is made
+// inside kv.Update.
+func SetIfEquals(ctx context.Context, kv Store, key string, oldVal, newVal []byte, expire time.Time) error {
+	if kv, ok := kv.(CompareAndSwapper); ok {
+		return errgo.Mask(kv.SetIfEquals(ctx, key, oldVal, newVal, expire), errgo.Is(ErrConflict), errgo.Is(ErrKeyTooLarge), errgo.Is(ErrValueTooLarge), IsContention)
+	}
+	err := kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		if (old == nil) != (oldVal == nil) || !bytes.Equal(old, oldVal) {
+			return nil, KeyConflictError(key)
+		}
+		return newVal, nil
+	})
+	return errgo.Mask(err, errgo.Is(ErrConflict), errgo.Is(ErrKeyTooLarge), errgo.Is(ErrValueTooLarge), IsContention)
+}
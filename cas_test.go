@@ -0,0 +1,41 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/mocksimplekv"
+)
+
+func TestSetIfEqualsFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	m := mocksimplekv.New()
+	m.ExpectUpdate("a", []byte("old"), []byte("new"))
+	m.ExpectUpdate("b", []byte("other"), nil)
+	m.ExpectUpdate("c", nil, []byte("new"))
+	m.ExpectUpdate("d", []byte{}, nil)
+
+	err := simplekv.SetIfEquals(ctx, m, "a", []byte("old"), []byte("new"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekv.SetIfEquals(ctx, m, "b", []byte("old"), []byte("new"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+	c.Assert(err, qt.ErrorMatches, `key b does not have the expected value`)
+
+	err = simplekv.SetIfEquals(ctx, m, "c", nil, []byte("new"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekv.SetIfEquals(ctx, m, "d", nil, []byte("new"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+
+	c.Assert(m.Verify(), qt.Equals, nil)
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrStoreClosed is the error cause used when a store is used after
+// it has been closed.
+var ErrStoreClosed = errgo.New("store closed")
+
+// Closer is implemented by stores that hold resources that must be
+// released when the store is no longer needed.
+//
+// A store that wraps other stores never closes them: whoever created
+// a store is responsible for closing it, so that it can be shared by
+// several wrappers. A wrapper implements Closer only if it holds
+// resources of its own, such as a background goroutine.
+type Closer interface {
+	Store
+
+	// Close releases the resources held by the store. After Close
+	// has been called, the store's other methods return an error
+	// with a cause of ErrStoreClosed, and calling Close again
+	// returns nil.
+	Close() error
+}
+
+// Close releases any resources held by the given store. If kv
+// implements Closer, its Close method is called; otherwise Close
+// does nothing. Generic code that owns a store should call Close
+// when it has finished with it.
+func Close(kv Store) error {
+	if kv, ok := kv.(Closer); ok {
+		return errgo.Mask(kv.Close(), errgo.Any)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestClose(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(simplekv.Close(memsimplekv.NewStore()), qt.Equals, nil)
+
+	testErr := errgo.New("test error")
+	kv := &closerStore{Store: memsimplekv.NewStore(), err: testErr}
+	err := simplekv.Close(kv)
+	c.Assert(errgo.Cause(err), qt.Equals, testErr)
+	c.Assert(kv.closed, qt.Equals, true)
+}
+
+type closerStore struct {
+	simplekv.Store
+	err    error
+	closed bool
+}
+
+func (s *closerStore) Close() error {
+	s.closed = true
+	return s.err
+}
@@ -0,0 +1,234 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// The simplekv-admin command performs administrative tasks on a
+// simplekv store.
+//
+// Usage:
+//
+//	simplekv-admin [flags] command dsn [args...]
+//
+// The commands are:
+//
+//	migrate          create the store's schema, or migrate it to
+//	                 the current version
+//	check            check that the store's schema is up to date,
+//	                 without changing it
+//	count [prefix]   print the number of keys, optionally only
+//	                 those starting with the given prefix
+//	advise           print the maintenance recommended for an SQL
+//	                 store's table
+//	purge            delete the expired entries from an SQL store's
+//	                 table
+//	vacuum           vacuum a Postgres store's table so that the
+//	                 space used by deleted rows can be reused
+//	rebuild-indexes  rebuild the indexes of a Postgres store's table
+//	                 or a MongoDB store's collection
+//	stats            print the number of entries and expired
+//	                 entries, and the space used, by an SQL or
+//	                 MongoDB store
+//
+// The dsn selects the backend:
+//
+//	mem:                      an in-memory store
+//	postgres://...            sqlsimplekv (see -table)
+//	mongodb://host/database   mgosimplekv (see -collection)
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	mgo "github.com/juju/mgo/v2"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/mgosimplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+var (
+	table      = flag.String("table", "simplekv", "table name to use for SQL stores")
+	collection = flag.String("collection", "simplekv", "collection name to use for MongoDB stores")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: simplekv-admin [flags] migrate|check|count|advise|purge|vacuum|rebuild-indexes|stats dsn [args...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(os.Stdout, flag.Arg(0), flag.Arg(1), flag.Args()[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "simplekv-admin: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(out io.Writer, cmd, dsn string, args []string) error {
+	switch cmd {
+	case "migrate":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: migrate dsn")
+		}
+		_, closeStore, err := openStore(dsn, *table, *collection, true)
+		if err != nil {
+			return err
+		}
+		closeStore()
+		fmt.Fprintln(out, "schema is up to date")
+		return nil
+	case "check":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: check dsn")
+		}
+		_, closeStore, err := openStore(dsn, *table, *collection, false)
+		if err != nil {
+			return err
+		}
+		closeStore()
+		fmt.Fprintln(out, "schema is up to date")
+		return nil
+	case "count":
+		if len(args) > 1 {
+			return fmt.Errorf("usage: count dsn [prefix]")
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		kv, closeStore, err := openStore(dsn, *table, *collection, false)
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+		return count(out, kv, prefix)
+	case "advise", "purge", "vacuum", "rebuild-indexes", "stats":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: %s dsn", cmd)
+		}
+		if isMongo(dsn) {
+			coll, closeColl, err := openCollection(dsn, *collection)
+			if err != nil {
+				return err
+			}
+			defer closeColl()
+			return maintainCollection(out, cmd, coll)
+		}
+		driverName, db, err := openDB(dsn)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return maintain(out, cmd, driverName, db, *table)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func count(out io.Writer, kv simplekv.Store, prefix string) error {
+	kl, ok := kv.(simplekv.KeyLister)
+	if !ok {
+		return fmt.Errorf("store does not support counting keys")
+	}
+	ctx, close := kv.Context(context.Background())
+	defer close()
+	n, err := simplekv.CountWithPrefix(ctx, kl, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, n)
+	return nil
+}
+
+// maintain runs the given maintenance command on the table used by an
+// SQL store.
+func maintain(out io.Writer, cmd, driverName string, db *sql.DB, table string) error {
+	ctx := context.Background()
+	var action sqlsimplekv.Action
+	switch cmd {
+	case "advise":
+		report, err := sqlsimplekv.AdviseMaintenance(ctx, driverName, db, table)
+		if err != nil {
+			return err
+		}
+		if len(report.Recommendations) == 0 {
+			fmt.Fprintln(out, "no maintenance needed")
+		}
+		for _, rec := range report.Recommendations {
+			fmt.Fprintf(out, "%v: %s\n", rec.Action, rec.Reason)
+		}
+		return nil
+	case "stats":
+		report, err := sqlsimplekv.AdviseMaintenance(ctx, driverName, db, table)
+		if err != nil {
+			return err
+		}
+		printTableStats(out, report.Stats)
+		return nil
+	case "purge":
+		action = sqlsimplekv.DeleteExpired
+	case "vacuum":
+		action = sqlsimplekv.Vacuum
+	case "rebuild-indexes":
+		action = sqlsimplekv.RebuildIndexes
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if err := sqlsimplekv.RunMaintenance(ctx, driverName, db, table, []sqlsimplekv.Action{action}); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%v done\n", action)
+	return nil
+}
+
+// maintainCollection runs the given maintenance command on the
+// collection used by a MongoDB store.
+func maintainCollection(out io.Writer, cmd string, coll *mgo.Collection) error {
+	switch cmd {
+	case "rebuild-indexes":
+		if err := mgosimplekv.RebuildIndexes(coll); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "rebuild-indexes done")
+		return nil
+	case "stats":
+		stats, err := mgosimplekv.Stats(coll)
+		if err != nil {
+			return err
+		}
+		printCollectionStats(out, stats)
+		return nil
+	}
+	return fmt.Errorf("%s is not supported with MongoDB stores", cmd)
+}
+
+// printTableStats prints the given statistics, omitting those that
+// the database does not report.
+func printTableStats(out io.Writer, stats sqlsimplekv.TableStats) {
+	fmt.Fprintf(out, "rows: %d\n", stats.Rows)
+	fmt.Fprintf(out, "expired rows: %d\n", stats.ExpiredRows)
+	if stats.DeadRows > 0 {
+		fmt.Fprintf(out, "dead rows: %d\n", stats.DeadRows)
+	}
+	fmt.Fprintf(out, "bytes: %d\n", stats.Bytes)
+	if stats.FreeBytes > 0 {
+		fmt.Fprintf(out, "free bytes: %d\n", stats.FreeBytes)
+	}
+	if !stats.LastVacuum.IsZero() {
+		fmt.Fprintf(out, "last vacuum: %s\n", stats.LastVacuum.UTC().Format(time.RFC3339))
+	}
+}
+
+// printCollectionStats prints the given statistics.
+func printCollectionStats(out io.Writer, stats *mgosimplekv.CollectionStats) {
+	fmt.Fprintf(out, "entries: %d\n", stats.Entries)
+	fmt.Fprintf(out, "expired entries: %d\n", stats.ExpiredEntries)
+	fmt.Fprintf(out, "bytes: %d\n", stats.Bytes)
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/mgosimplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+func TestRun(t *testing.T) {
+	c := qt.New(t)
+	for _, cmd := range []string{"migrate", "check"} {
+		var out bytes.Buffer
+		err := run(&out, cmd, "mem:", nil)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(out.String(), qt.Equals, "schema is up to date\n")
+	}
+
+	err := run(&bytes.Buffer{}, "frobnicate", "mem:", nil)
+	c.Assert(err, qt.ErrorMatches, `unknown command "frobnicate"`)
+
+	err = run(&bytes.Buffer{}, "check", "other:", nil)
+	c.Assert(err, qt.ErrorMatches, `unrecognised DSN "other:"`)
+
+	err = run(&bytes.Buffer{}, "count", "mem:", []string{"a", "b"})
+	c.Assert(err, qt.ErrorMatches, `usage: count dsn \[prefix\]`)
+
+	for _, cmd := range []string{"advise", "purge", "vacuum", "rebuild-indexes", "stats"} {
+		err = run(&bytes.Buffer{}, cmd, "mem:", nil)
+		c.Assert(err, qt.ErrorMatches, `DSN "mem:" does not describe an SQL store`)
+
+		err = run(&bytes.Buffer{}, cmd, "postgres://localhost/db", []string{"x"})
+		c.Assert(err, qt.ErrorMatches, `usage: `+cmd+` dsn`)
+	}
+}
+
+func TestCount(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		err := kv.Set(ctx, key, []byte("x"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	var out bytes.Buffer
+	err := count(&out, kv, "")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(out.String(), qt.Equals, "3\n")
+
+	out.Reset()
+	err = count(&out, kv, "a/")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(out.String(), qt.Equals, "2\n")
+}
+
+func TestPrintStats(t *testing.T) {
+	c := qt.New(t)
+	var out bytes.Buffer
+	printTableStats(&out, sqlsimplekv.TableStats{
+		Rows:        100,
+		ExpiredRows: 10,
+		DeadRows:    5,
+		Bytes:       8192,
+		LastVacuum:  time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	c.Assert(out.String(), qt.Equals, `rows: 100
+expired rows: 10
+dead rows: 5
+bytes: 8192
+last vacuum: 2018-01-02T03:04:05Z
+`)
+
+	out.Reset()
+	printTableStats(&out, sqlsimplekv.TableStats{
+		Rows:      100,
+		Bytes:     8192,
+		FreeBytes: 4096,
+	})
+	c.Assert(out.String(), qt.Equals, `rows: 100
+expired rows: 0
+bytes: 8192
+free bytes: 4096
+`)
+
+	out.Reset()
+	printCollectionStats(&out, &mgosimplekv.CollectionStats{
+		Entries:        100,
+		ExpiredEntries: 10,
+		Bytes:          8192,
+	})
+	c.Assert(out.String(), qt.Equals, `entries: 100
+expired entries: 10
+bytes: 8192
+`)
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	mgo "github.com/juju/mgo/v2"
+	_ "github.com/lib/pq"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/mgosimplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+// openStore opens the store described by the given DSN. If
+// createSchema is true, the backend creates or migrates its schema as
+// necessary; otherwise it only checks that the schema is up to date.
+// The returned function must be called to release any resources held
+// by the store.
+func openStore(dsn, table, collection string, createSchema bool) (simplekv.Store, func(), error) {
+	switch {
+	case dsn == "mem:":
+		return memsimplekv.NewStore(), func() {}, nil
+	case isPostgres(dsn):
+		_, db, err := openDB(dsn)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		var opts []sqlsimplekv.Option
+		if !createSchema {
+			opts = append(opts, sqlsimplekv.WithoutSchemaCreation())
+		}
+		kv, err := sqlsimplekv.NewStore("postgres", db, table, opts...)
+		if err != nil {
+			db.Close()
+			return nil, nil, errgo.Mask(err)
+		}
+		return kv, func() { db.Close() }, nil
+	case isMongo(dsn):
+		coll, closeColl, err := openCollection(dsn, collection)
+		if err != nil {
+			return nil, nil, errgo.Mask(err)
+		}
+		var opts []mgosimplekv.Option
+		if !createSchema {
+			opts = append(opts, mgosimplekv.WithoutSchemaCreation())
+		}
+		kv, err := mgosimplekv.NewStore(coll, opts...)
+		if err != nil {
+			closeColl()
+			return nil, nil, errgo.Mask(err)
+		}
+		return kv, closeColl, nil
+	}
+	return nil, nil, fmt.Errorf("unrecognised DSN %q", dsn)
+}
+
+// openDB opens the SQL database described by the given DSN and
+// returns it along with the name of the sqlsimplekv driver to use
+// with it. The returned database must be closed after use.
+func openDB(dsn string) (string, *sql.DB, error) {
+	if !isPostgres(dsn) {
+		return "", nil, fmt.Errorf("DSN %q does not describe an SQL store", dsn)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return "", nil, errgo.Notef(err, "cannot open database")
+	}
+	return "postgres", db, nil
+}
+
+// openCollection dials the MongoDB server described by the given DSN
+// and returns the collection with the given name in the DSN's
+// database. The returned function must be called to close the
+// session.
+func openCollection(dsn, collection string) (*mgo.Collection, func(), error) {
+	session, err := mgo.Dial(dsn)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot dial MongoDB")
+	}
+	return session.DB("").C(collection), session.Close, nil
+}
+
+// isMongo reports whether the given DSN describes a MongoDB database.
+func isMongo(dsn string) bool {
+	return strings.HasPrefix(dsn, "mongodb://")
+}
+
+// isPostgres reports whether the given DSN describes a Postgres
+// database.
+func isPostgres(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
@@ -0,0 +1,21 @@
+module github.com/juju/simplekv/cmd/simplekv-soak
+
+go 1.13
+
+require (
+	github.com/frankban/quicktest v1.14.0
+	github.com/juju/mgo/v2 v2.0.0-20210302023703-70d5d206e208
+	github.com/juju/simplekv v0.0.0-20261015053811-8a53b2fa50dd
+	github.com/juju/simplekv/mgosimplekv v0.0.0-20261015053811-8a53b2fa50dd
+	github.com/juju/simplekv/sqlsimplekv v0.0.0-20261015053811-8a53b2fa50dd
+	github.com/lib/pq v1.10.3
+	gopkg.in/errgo.v1 v1.0.1
+)
+
+// The replace directives build against the local checkout; they are
+// ignored when this module is required from elsewhere.
+replace (
+	github.com/juju/simplekv => ../../
+	github.com/juju/simplekv/mgosimplekv => ../../mgosimplekv
+	github.com/juju/simplekv/sqlsimplekv => ../../sqlsimplekv
+)
@@ -0,0 +1,88 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// The simplekv-soak command runs a mixed workload against a simplekv
+// store for a long period, reporting error rates and client memory
+// use, and checking that no writes are lost. It is intended for
+// qualifying backends before release.
+//
+// Usage:
+//
+//	simplekv-soak [flags] dsn
+//
+// The dsn selects the backend:
+//
+//	mem:                      an in-memory store
+//	postgres://...            sqlsimplekv (see -table)
+//	mongodb://host/database   mgosimplekv (see -collection)
+//
+// The command exits with a non-zero status if any invariant
+// violation is found.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+var (
+	duration   = flag.Duration("duration", time.Hour, "how long to run the workload for")
+	workers    = flag.Int("workers", 8, "number of concurrent workers")
+	numKeys    = flag.Int("keys", 1000, "number of keys used by each worker")
+	interval   = flag.Duration("report", time.Minute, "interval between progress reports")
+	table      = flag.String("table", "simplekv_soak", "table name to use for SQL stores")
+	collection = flag.String("collection", "simplekv_soak", "collection name to use for MongoDB stores")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: simplekv-soak [flags] dsn\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "simplekv-soak: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(dsn string) error {
+	kv, closeStore, err := openStore(dsn, *table, *collection)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	w := &workload{
+		kv:       kv,
+		workers:  *workers,
+		numKeys:  *numKeys,
+		interval: *interval,
+		out:      os.Stdout,
+	}
+	stats, err := w.run(ctx)
+	if err != nil {
+		return err
+	}
+	if stats.violations > 0 {
+		return fmt.Errorf("%d invariant violations found", stats.violations)
+	}
+	return nil
+}
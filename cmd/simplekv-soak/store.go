@@ -0,0 +1,51 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	mgo "github.com/juju/mgo/v2"
+	_ "github.com/lib/pq"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/mgosimplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+// openStore opens the store described by the given DSN. The returned
+// function must be called to release any resources held by the store.
+func openStore(dsn, table, collection string) (simplekv.Store, func(), error) {
+	switch {
+	case dsn == "mem:":
+		return memsimplekv.NewStore(), func() {}, nil
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "cannot open database")
+		}
+		kv, err := sqlsimplekv.NewStore("postgres", db, table)
+		if err != nil {
+			db.Close()
+			return nil, nil, errgo.Notef(err, "cannot create store")
+		}
+		return kv, func() { db.Close() }, nil
+	case strings.HasPrefix(dsn, "mongodb://"):
+		session, err := mgo.Dial(dsn)
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "cannot dial MongoDB")
+		}
+		kv, err := mgosimplekv.NewStore(session.DB("").C(collection))
+		if err != nil {
+			session.Close()
+			return nil, nil, errgo.Notef(err, "cannot create store")
+		}
+		return kv, session.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unrecognised DSN %q", dsn)
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// numCounters holds the number of counter keys shared between all
+// workers.
+const numCounters = 4
+
+type opKind int
+
+const (
+	opGet opKind = iota
+	opSet
+	opIncrement
+	numOpKinds
+)
+
+var opNames = [numOpKinds]string{
+	opGet:       "get",
+	opSet:       "set",
+	opIncrement: "increment",
+}
+
+// workload runs a mixed workload against a store.
+//
+// Each worker sets and gets keys of its own, checking that it always
+// reads back the value it last wrote. All workers also increment a
+// small set of shared counters with Update; at the end of the run the
+// counters are checked to make sure that no increments were lost.
+type workload struct {
+	kv       simplekv.Store
+	workers  int
+	numKeys  int
+	interval time.Duration
+	out      io.Writer
+
+	start time.Time
+	stats stats
+}
+
+// stats holds statistics about a running workload. All fields are
+// accessed atomically.
+type stats struct {
+	ops        [numOpKinds]int64
+	errors     [numOpKinds]int64
+	violations int64
+
+	// increments holds the number of successful increments
+	// of each counter, and uncertain holds the number of
+	// increments that failed with an error and so may or may
+	// not have been applied.
+	increments [numCounters]int64
+	uncertain  [numCounters]int64
+}
+
+// run runs the workload until the given context is done, and returns
+// the final statistics.
+func (w *workload) run(ctx context.Context) (*stats, error) {
+	w.start = time.Now()
+	initial, err := w.readCounters()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read initial counter values")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < w.workers; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.worker(ctx, i)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			w.report()
+		case <-done:
+			break loop
+		}
+	}
+	final, err := w.readCounters()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read final counter values")
+	}
+	for i := range final {
+		got := final[i] - initial[i]
+		min := atomic.LoadInt64(&w.stats.increments[i])
+		max := min + atomic.LoadInt64(&w.stats.uncertain[i])
+		if got < min || got > max {
+			w.violation("counter %d increased by %d; expected between %d and %d", i, got, min, max)
+		}
+	}
+	w.report()
+	return &w.stats, nil
+}
+
+// worker runs the operations for a single worker until ctx is done.
+// Operations use their own context so that they are not interrupted
+// when the workload ends.
+func (w *workload) worker(ctx context.Context, id int) {
+	opCtx, close := w.kv.Context(context.Background())
+	defer close()
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
+	// written holds the last value written to each of the worker's keys.
+	written := make(map[int]string)
+	seq := 0
+	for ctx.Err() == nil {
+		n := rnd.Intn(w.numKeys)
+		key := fmt.Sprintf("soak/worker%d/key%d", id, n)
+		switch kind := opKind(rnd.Intn(int(numOpKinds))); kind {
+		case opGet:
+			v, err := w.kv.Get(opCtx, key)
+			if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+				w.failed(kind, err)
+				continue
+			}
+			w.succeeded(kind)
+			want, ok := written[n]
+			if !ok {
+				continue
+			}
+			if err != nil {
+				w.violation("key %q not found after being set to %q", key, want)
+			} else if string(v) != want {
+				w.violation("key %q has value %q; want %q", key, v, want)
+			}
+		case opSet:
+			seq++
+			val := fmt.Sprintf("worker%d-%d", id, seq)
+			if err := w.kv.Set(opCtx, key, []byte(val), time.Time{}); err != nil {
+				// We don't know whether the set succeeded or not.
+				delete(written, n)
+				w.failed(kind, err)
+				continue
+			}
+			w.succeeded(kind)
+			written[n] = val
+		case opIncrement:
+			c := rnd.Intn(numCounters)
+			err := w.kv.Update(opCtx, counterKey(c), time.Time{}, func(old []byte) ([]byte, error) {
+				n, err := parseCounter(old)
+				if err != nil {
+					return nil, errgo.Mask(err)
+				}
+				return []byte(strconv.FormatInt(n+1, 10)), nil
+			})
+			if err != nil {
+				atomic.AddInt64(&w.stats.uncertain[c], 1)
+				w.failed(kind, err)
+				continue
+			}
+			atomic.AddInt64(&w.stats.increments[c], 1)
+			w.succeeded(kind)
+		}
+	}
+}
+
+func (w *workload) succeeded(kind opKind) {
+	atomic.AddInt64(&w.stats.ops[kind], 1)
+}
+
+func (w *workload) failed(kind opKind, err error) {
+	atomic.AddInt64(&w.stats.ops[kind], 1)
+	if atomic.AddInt64(&w.stats.errors[kind], 1) == 1 {
+		fmt.Fprintf(w.out, "first %s error: %v\n", opNames[kind], err)
+	}
+}
+
+func (w *workload) violation(f string, a ...interface{}) {
+	atomic.AddInt64(&w.stats.violations, 1)
+	fmt.Fprintf(w.out, "INVARIANT VIOLATION: %s\n", fmt.Sprintf(f, a...))
+}
+
+// report prints a summary of the workload's progress.
+func (w *workload) report() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(w.out, "%v:", time.Since(w.start).Round(time.Second))
+	for i := opKind(0); i < numOpKinds; i++ {
+		ops := atomic.LoadInt64(&w.stats.ops[i])
+		errs := atomic.LoadInt64(&w.stats.errors[i])
+		rate := 0.0
+		if ops > 0 {
+			rate = 100 * float64(errs) / float64(ops)
+		}
+		fmt.Fprintf(w.out, " %s %d (%.2f%% errors);", opNames[i], ops, rate)
+	}
+	fmt.Fprintf(w.out, " heap %dKiB; goroutines %d; violations %d\n",
+		m.HeapAlloc/1024,
+		runtime.NumGoroutine(),
+		atomic.LoadInt64(&w.stats.violations),
+	)
+}
+
+// readCounters reads the current value of all the counters.
+func (w *workload) readCounters() ([numCounters]int64, error) {
+	var counters [numCounters]int64
+	ctx, close := w.kv.Context(context.Background())
+	defer close()
+	for i := range counters {
+		v, err := w.kv.Get(ctx, counterKey(i))
+		if err != nil {
+			if errgo.Cause(err) == simplekv.ErrNotFound {
+				continue
+			}
+			return counters, errgo.Mask(err)
+		}
+		counters[i], err = parseCounter(v)
+		if err != nil {
+			return counters, errgo.Mask(err)
+		}
+	}
+	return counters, nil
+}
+
+func counterKey(i int) string {
+	return fmt.Sprintf("soak/counter%d", i)
+}
+
+func parseCounter(v []byte) (int64, error) {
+	if v == nil {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return 0, errgo.Notef(err, "invalid counter value")
+	}
+	return n, nil
+}
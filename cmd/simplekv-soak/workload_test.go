@@ -0,0 +1,44 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWorkload(t *testing.T) {
+	c := qt.New(t)
+	kv, closeStore, err := openStore("mem:", "", "")
+	c.Assert(err, qt.Equals, nil)
+	defer closeStore()
+
+	var out bytes.Buffer
+	w := &workload{
+		kv:       kv,
+		workers:  4,
+		numKeys:  10,
+		interval: time.Hour,
+		out:      &out,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	stats, err := w.run(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(stats.violations, qt.Equals, int64(0), qt.Commentf("%s", out.Bytes()))
+	for i, n := range stats.ops {
+		c.Check(n > 0, qt.Equals, true, qt.Commentf("%s", opNames[i]))
+	}
+	c.Assert(out.String(), qt.Matches, `(?s).*violations 0\n`)
+}
+
+func TestOpenStoreUnknownDSN(t *testing.T) {
+	c := qt.New(t)
+	_, _, err := openStore("foo://bar", "", "")
+	c.Assert(err, qt.ErrorMatches, `unrecognised DSN "foo://bar"`)
+}
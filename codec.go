@@ -0,0 +1,232 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Codec converts Go values to and from the byte slices held in a
+// Store.
+type Codec interface {
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes values as JSON.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encodes values with encoding/gob. Each value is
+	// encoded independently, so type information is included in
+	// every value.
+	GobCodec Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// TypedStore stores Go values in a Store, encoding them with a Codec.
+type TypedStore struct {
+	kv    Store
+	codec Codec
+}
+
+// NewTypedStore returns a TypedStore that stores values in kv using
+// the given codec.
+func NewTypedStore(kv Store, codec Codec) *TypedStore {
+	return &TypedStore{
+		kv:    kv,
+		codec: codec,
+	}
+}
+
+// Get decodes the value associated with the given key into the value
+// pointed to by v. If there is no such key an error with a cause of
+// ErrNotFound will be returned.
+func (s *TypedStore) Get(ctx context.Context, key string, v interface{}) error {
+	data, err := s.kv.Get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := s.codec.Unmarshal(data, v); err != nil {
+		return errgo.Notef(err, "cannot decode value of key %s", key)
+	}
+	return nil
+}
+
+// Set encodes v and stores it with the given key, as described by
+// Store.Set.
+func (s *TypedStore) Set(ctx context.Context, key string, v interface{}, expire time.Time) error {
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return errgo.Notef(err, "cannot encode value of key %s", key)
+	}
+	return errgo.Mask(s.kv.Set(ctx, key, data, expire), errgo.Any)
+}
+
+// Update atomically updates the value associated with the given key,
+// as described by Store.Update. The argument v must be a pointer. Each
+// time the update function is called, the value pointed to by v holds
+// the old value (or the zero value if exists is false); the function
+// should modify it in place, and the result is stored.
+func (s *TypedStore) Update(ctx context.Context, key string, expire time.Time, v interface{}, update func(exists bool) error) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errgo.Newf("Update called with non-pointer %T", v)
+	}
+	err := s.kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		if old != nil {
+			if err := s.codec.Unmarshal(old, v); err != nil {
+				return nil, errgo.Notef(err, "cannot decode value of key %s", key)
+			}
+		}
+		if err := update(old != nil); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		data, err := s.codec.Marshal(v)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot encode value of key %s", key)
+		}
+		return data, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// errUnchanged is returned from an update function to abandon the
+// update when it would not change the stored value.
+var errUnchanged = errgo.New("unchanged")
+
+// AddToSet atomically appends to the list stored at the given key each
+// of the given values that it does not already hold. The argument
+// values must be a slice, and the list is stored as a slice of the
+// same type; a key with no value holds an empty list. Elements are
+// compared with reflect.DeepEqual.
+func (s *TypedStore) AddToSet(ctx context.Context, key string, expire time.Time, values interface{}) error {
+	rv := reflect.ValueOf(values)
+	if rv.Kind() != reflect.Slice {
+		return errgo.Newf("AddToSet called with non-slice %T", values)
+	}
+	p := reflect.New(rv.Type())
+	err := s.Update(ctx, key, expire, p.Interface(), func(exists bool) error {
+		list := p.Elem()
+		changed := !exists
+		for i := 0; i < rv.Len(); i++ {
+			if v := rv.Index(i); indexOf(list, v) < 0 {
+				list = reflect.Append(list, v)
+				changed = true
+			}
+		}
+		if !changed {
+			return errUnchanged
+		}
+		p.Elem().Set(list)
+		return nil
+	})
+	if errgo.Cause(err) == errUnchanged {
+		return nil
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// RemoveFromList atomically removes every element equal to any of the
+// given values from the list stored at the given key. The argument
+// values must be a slice of the same type as the stored list. Elements
+// are compared with reflect.DeepEqual. If there is no such key, or
+// none of the values is in the list, the store is left unchanged.
+func (s *TypedStore) RemoveFromList(ctx context.Context, key string, expire time.Time, values interface{}) error {
+	rv := reflect.ValueOf(values)
+	if rv.Kind() != reflect.Slice {
+		return errgo.Newf("RemoveFromList called with non-slice %T", values)
+	}
+	p := reflect.New(rv.Type())
+	err := s.Update(ctx, key, expire, p.Interface(), func(exists bool) error {
+		if !exists {
+			return errUnchanged
+		}
+		list := p.Elem()
+		kept := reflect.MakeSlice(list.Type(), 0, list.Len())
+		for i := 0; i < list.Len(); i++ {
+			if v := list.Index(i); indexOf(rv, v) < 0 {
+				kept = reflect.Append(kept, v)
+			}
+		}
+		if kept.Len() == list.Len() {
+			return errUnchanged
+		}
+		p.Elem().Set(kept)
+		return nil
+	})
+	if errgo.Cause(err) == errUnchanged {
+		return nil
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// MergeMap atomically sets each of the entries of m in the map stored
+// at the given key, leaving its other entries unchanged. The argument
+// m must be a map, and the stored map has the same type; a key with no
+// value holds an empty map.
+func (s *TypedStore) MergeMap(ctx context.Context, key string, expire time.Time, m interface{}) error {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() != reflect.Map {
+		return errgo.Newf("MergeMap called with non-map %T", m)
+	}
+	p := reflect.New(rv.Type())
+	err := s.Update(ctx, key, expire, p.Interface(), func(exists bool) error {
+		stored := p.Elem()
+		if stored.IsNil() {
+			stored.Set(reflect.MakeMapWithSize(rv.Type(), rv.Len()))
+		}
+		iter := rv.MapRange()
+		for iter.Next() {
+			stored.SetMapIndex(iter.Key(), iter.Value())
+		}
+		return nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// indexOf returns the index of the first element of the slice list
+// that is deeply equal to v, or -1 if there is none.
+func indexOf(list, v reflect.Value) int {
+	for i := 0; i < list.Len(); i++ {
+		if reflect.DeepEqual(list.Index(i).Interface(), v.Interface()) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+type session struct {
+	User   string
+	Visits int
+	Tags   []string
+}
+
+func TestTypedStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	for _, test := range []struct {
+		about string
+		codec simplekv.Codec
+	}{{
+		about: "json",
+		codec: simplekv.JSONCodec,
+	}, {
+		about: "gob",
+		codec: simplekv.GobCodec,
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			kv := memsimplekv.NewStore()
+			s := simplekv.NewTypedStore(kv, test.codec)
+
+			var got session
+			err := s.Get(ctx, "session", &got)
+			c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+			err = s.Set(ctx, "session", session{User: "bob", Tags: []string{"a"}}, time.Time{})
+			c.Assert(err, qt.Equals, nil)
+			err = s.Get(ctx, "session", &got)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(got, qt.DeepEquals, session{User: "bob", Tags: []string{"a"}})
+
+			var sess session
+			err = s.Update(ctx, "session", time.Time{}, &sess, func(exists bool) error {
+				c.Check(exists, qt.Equals, true)
+				sess.Visits++
+				return nil
+			})
+			c.Assert(err, qt.Equals, nil)
+
+			err = s.Update(ctx, "new", time.Time{}, &sess, func(exists bool) error {
+				c.Check(exists, qt.Equals, false)
+				c.Check(sess, qt.DeepEquals, session{})
+				sess.User = "alice"
+				return nil
+			})
+			c.Assert(err, qt.Equals, nil)
+
+			err = s.Get(ctx, "session", &got)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(got, qt.DeepEquals, session{User: "bob", Visits: 1, Tags: []string{"a"}})
+			var got1 session
+			err = s.Get(ctx, "new", &got1)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(got1, qt.DeepEquals, session{User: "alice"})
+		})
+	}
+}
+
+func TestTypedStoreErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	s := simplekv.NewTypedStore(kv, simplekv.JSONCodec)
+
+	err := kv.Set(ctx, "bad", []byte("{"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	var v session
+	err = s.Get(ctx, "bad", &v)
+	c.Assert(err, qt.ErrorMatches, `cannot decode value of key bad: unexpected end of JSON input`)
+
+	err = s.Set(ctx, "bad", func() {}, time.Time{})
+	c.Assert(err, qt.ErrorMatches, `cannot encode value of key bad: json: unsupported type: func\(\)`)
+
+	err = s.Update(ctx, "bad", time.Time{}, v, func(bool) error { return nil })
+	c.Assert(err, qt.ErrorMatches, `Update called with non-pointer simplekv_test.session`)
+
+	testErr := errgo.New("test error")
+	err = s.Update(ctx, "other", time.Time{}, &v, func(bool) error { return testErr })
+	c.Assert(errgo.Cause(err), qt.Equals, testErr)
+}
+
+func TestTypedStoreCollections(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	for _, test := range []struct {
+		about string
+		codec simplekv.Codec
+	}{{
+		about: "json",
+		codec: simplekv.JSONCodec,
+	}, {
+		about: "gob",
+		codec: simplekv.GobCodec,
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			kv := memsimplekv.NewStore()
+			s := simplekv.NewTypedStore(kv, test.codec)
+
+			err := s.AddToSet(ctx, "set", time.Time{}, []string{"a", "b"})
+			c.Assert(err, qt.Equals, nil)
+			err = s.AddToSet(ctx, "set", time.Time{}, []string{"b", "c", "c"})
+			c.Assert(err, qt.Equals, nil)
+			var list []string
+			err = s.Get(ctx, "set", &list)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(list, qt.DeepEquals, []string{"a", "b", "c"})
+
+			err = s.RemoveFromList(ctx, "set", time.Time{}, []string{"a", "c", "x"})
+			c.Assert(err, qt.Equals, nil)
+			err = s.Get(ctx, "set", &list)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(list, qt.DeepEquals, []string{"b"})
+
+			// Removing from a list that does not exist does not
+			// create it.
+			err = s.RemoveFromList(ctx, "none", time.Time{}, []string{"a"})
+			c.Assert(err, qt.Equals, nil)
+			_, err = kv.Get(ctx, "none")
+			c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+			err = s.MergeMap(ctx, "map", time.Time{}, map[string]int{"a": 1, "b": 2})
+			c.Assert(err, qt.Equals, nil)
+			err = s.MergeMap(ctx, "map", time.Time{}, map[string]int{"b": 3, "c": 4})
+			c.Assert(err, qt.Equals, nil)
+			var m map[string]int
+			err = s.Get(ctx, "map", &m)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(m, qt.DeepEquals, map[string]int{"a": 1, "b": 3, "c": 4})
+		})
+	}
+}
+
+func TestTypedStoreCollectionErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := simplekv.NewTypedStore(memsimplekv.NewStore(), simplekv.JSONCodec)
+
+	err := s.AddToSet(ctx, "k", time.Time{}, "a")
+	c.Assert(err, qt.ErrorMatches, `AddToSet called with non-slice string`)
+	err = s.RemoveFromList(ctx, "k", time.Time{}, map[string]int{})
+	c.Assert(err, qt.ErrorMatches, `RemoveFromList called with non-slice map\[string\]int`)
+	err = s.MergeMap(ctx, "k", time.Time{}, []string{})
+	c.Assert(err, qt.ErrorMatches, `MergeMap called with non-map \[\]string`)
+}
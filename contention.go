@@ -0,0 +1,59 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"errors"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ContentionError is the error cause used when an operation gives up
+// because of too many concurrent modifications. It holds a hint of
+// how long the caller should wait before trying again.
+type ContentionError struct {
+	// RetryAfter holds the suggested delay before retrying the
+	// operation.
+	RetryAfter time.Duration
+
+	// Attempts holds the number of attempts made before the
+	// operation gave up, or zero if it is not known.
+	Attempts int
+}
+
+// Error implements the error interface.
+func (e *ContentionError) Error() string {
+	return "too many concurrent modifications"
+}
+
+// NewContentionError returns an error with the given message and a
+// cause of type *ContentionError holding the given retry hint.
+func NewContentionError(retryAfter time.Duration, format string, args ...interface{}) error {
+	err := errgo.WithCausef(nil, &ContentionError{
+		RetryAfter: retryAfter,
+	}, format, args...)
+	err.(*errgo.Err).SetLocation(1)
+	return err
+}
+
+// IsContention reports whether err is a *ContentionError. It can be
+// passed to errgo.Mask to preserve contention error causes.
+func IsContention(err error) bool {
+	_, ok := err.(*ContentionError)
+	return ok
+}
+
+// RetryAfter returns the retry hint held by the cause of the given
+// error, and reports whether the cause is a *ContentionError. Errors
+// returned by stores can also be inspected with errors.As, but
+// RetryAfter also finds the cause when the error has since been wrapped
+// by gopkg.in/errgo.v1, which does not support errors.As.
+func RetryAfter(err error) (time.Duration, bool) {
+	var cerr *ContentionError
+	if errors.As(errgo.Cause(err), &cerr) {
+		return cerr.RetryAfter, true
+	}
+	return 0, false
+}
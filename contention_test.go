@@ -0,0 +1,31 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+)
+
+func TestContentionError(t *testing.T) {
+	c := qt.New(t)
+	err := simplekv.NewContentionError(time.Second, "cannot update key %s", "k")
+	c.Assert(err, qt.ErrorMatches, `cannot update key k`)
+
+	// The hint survives masking.
+	err = errgo.NoteMask(errgo.Mask(err, errgo.Any), "outer", errgo.Any)
+	d, ok := simplekv.RetryAfter(err)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(d, qt.Equals, time.Second)
+
+	_, ok = simplekv.RetryAfter(errgo.New("other"))
+	c.Assert(ok, qt.Equals, false)
+	_, ok = simplekv.RetryAfter(nil)
+	c.Assert(ok, qt.Equals, false)
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+var contextKeys struct {
+	mu   sync.Mutex
+	keys []interface{}
+}
+
+// RegisterContextKey registers a key that a backend uses to attach
+// values (a database session, for example) to the contexts returned
+// from its Context method. It is usually called from an init
+// function.
+//
+// Registering a key allows stores that wrap other stores to forward
+// such values with CopyContextValues when they need to operate on
+// the underlying store with a context other than the one they were
+// given.
+//
+// As with context.WithValue, the key must be comparable; it panics
+// otherwise.
+func RegisterContextKey(key interface{}) {
+	if key == nil {
+		panic("simplekv: nil context key")
+	}
+	if !reflect.TypeOf(key).Comparable() {
+		panic("simplekv: context key is not comparable")
+	}
+	contextKeys.mu.Lock()
+	defer contextKeys.mu.Unlock()
+	for _, k := range contextKeys.keys {
+		if k == key {
+			return
+		}
+	}
+	contextKeys.keys = append(contextKeys.keys, key)
+}
+
+// CopyContextValues returns a context derived from dst that holds
+// the values associated with all registered context keys in src.
+// Values already present in dst are overridden.
+func CopyContextValues(dst, src context.Context) context.Context {
+	contextKeys.mu.Lock()
+	keys := contextKeys.keys
+	contextKeys.mu.Unlock()
+	for _, k := range keys {
+		if v := src.Value(k); v != nil {
+			dst = context.WithValue(dst, k, v)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+)
+
+type registeredKey struct{}
+
+type unregisteredKey struct{}
+
+func TestCopyContextValues(t *testing.T) {
+	c := qt.New(t)
+	simplekv.RegisterContextKey(registeredKey{})
+	simplekv.RegisterContextKey(registeredKey{})
+
+	src := context.WithValue(context.Background(), registeredKey{}, "session")
+	src = context.WithValue(src, unregisteredKey{}, "other")
+	ctx := simplekv.CopyContextValues(context.Background(), src)
+	c.Assert(ctx.Value(registeredKey{}), qt.Equals, "session")
+	c.Assert(ctx.Value(unregisteredKey{}), qt.IsNil)
+}
+
+func TestRegisterContextKeyNotComparable(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(func() {
+		simplekv.RegisterContextKey([]string{"key"})
+	}, qt.PanicMatches, `simplekv: context key is not comparable`)
+	c.Assert(func() {
+		simplekv.RegisterContextKey(nil)
+	}, qt.PanicMatches, `simplekv: nil context key`)
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Counter is implemented by stores that can count their keys without
+// listing them.
+type Counter interface {
+	KeyLister
+
+	// Count returns the number of stored keys.
+	Count(ctx context.Context) (int, error)
+
+	// CountWithPrefix returns the number of stored keys that start
+	// with the given prefix.
+	CountWithPrefix(ctx context.Context, prefix string) (int, error)
+}
+
+// CountWithPrefix returns the number of keys in the store that start
+// with the given prefix; use the empty prefix to count all keys. If
+// kv implements Counter, its CountWithPrefix method is used;
+// otherwise the keys are listed and counted.
+func CountWithPrefix(ctx context.Context, kv KeyLister, prefix string) (int, error) {
+	if kv, ok := kv.(Counter); ok {
+		n, err := kv.CountWithPrefix(ctx, prefix)
+		return n, errgo.Mask(err, errgo.Any)
+	}
+	keys, err := kv.KeysWithPrefix(ctx, prefix)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Any)
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Increment atomically adds delta to the counter stored at the given
+// key and returns the new value. A key with no value counts as zero.
+//
+// Counters are stored as decimal integers, so they can also be read
+// and written with Get and Set. If the existing value is not a decimal
+// integer, or the result would overflow an int64, an error is returned
+// and the value is left unchanged.
+func Increment(ctx context.Context, kv Store, key string, delta int64, expire time.Time) (int64, error) {
+	var n int64
+	err := kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		n = 0
+		if old != nil {
+			v, err := strconv.ParseInt(string(old), 10, 64)
+			if err != nil {
+				return nil, errgo.Newf("value of key %s is not an integer", key)
+			}
+			n = v
+		}
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			return nil, errgo.Newf("counter %s would overflow", key)
+		}
+		n += delta
+		return strconv.AppendInt(nil, n, 10), nil
+	})
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Is(ErrKeyTooLarge), errgo.Is(ErrValueTooLarge), IsContention)
+	}
+	return n, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestIncrement(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+
+	n, err := simplekv.Increment(ctx, kv, "counter", 5, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, int64(5))
+
+	n, err = simplekv.Increment(ctx, kv, "counter", -7, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, int64(-2))
+
+	v, err := kv.Get(ctx, "counter")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "-2")
+
+	err = kv.Set(ctx, "counter", []byte("x"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, err = simplekv.Increment(ctx, kv, "counter", 1, time.Time{})
+	c.Assert(err, qt.ErrorMatches, `value of key counter is not an integer`)
+
+	err = kv.Set(ctx, "counter", []byte("9223372036854775807"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, err = simplekv.Increment(ctx, kv, "counter", 1, time.Time{})
+	c.Assert(err, qt.ErrorMatches, `counter counter would overflow`)
+	n, err = simplekv.Increment(ctx, kv, "counter", math.MinInt64, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, int64(-1))
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := simplekv.Increment(ctx, kv, "counter", 1, time.Time{})
+				c.Check(err, qt.Equals, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	v, err := kv.Get(ctx, "counter")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "1000")
+}
+
+func TestIncrementContention(t *testing.T) {
+	c := qt.New(t)
+	kv := contendedStore{memsimplekv.NewStore()}
+	_, err := simplekv.Increment(context.Background(), kv, "counter", 1, time.Time{})
+	c.Assert(err, qt.ErrorMatches, `cannot update key counter`)
+	c.Assert(simplekv.IsContention(errgo.Cause(err)), qt.Equals, true)
+	d, ok := simplekv.RetryAfter(err)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(d, qt.Equals, time.Second)
+}
+
+type contendedStore struct {
+	simplekv.Store
+}
+
+func (contendedStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	return simplekv.NewContentionError(time.Second, "cannot update key %s", key)
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package countsimplekv provides a simplekv.Store that maintains a
+// running count of its keys, so that counting all the keys does not
+// need to scan the underlying store.
+package countsimplekv
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/internal/wrapkv"
+)
+
+// DefaultShards holds the number of counter keys used when the
+// WithShards option is not given.
+const DefaultShards = 16
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithShards returns an option that spreads the count over n counter
+// keys. Each write updates only one of them, so using more shards
+// reduces contention between concurrent writers at the cost of more
+// reads when counting.
+func WithShards(n int) Option {
+	return func(s *kvStore) {
+		s.shards = n
+	}
+}
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages, including failures to update the count, to the given
+// logger.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// NewStore returns a store that uses kv for storage and keeps a count
+// of its keys in counter keys held in the counters store, which should
+// not be used for anything else. The returned store implements
+// simplekv.Counter; counting all keys reads only the counter keys,
+// while counting the keys with a non-empty prefix is passed on to kv.
+// It also implements simplekv.Iterable if kv does.
+//
+// The count is approximate. It is adjusted after each successful write,
+// so it may be briefly out of date, and entries that expire are not
+// subtracted from it. Recount can be used to correct it.
+//
+// To know whether a key is new, Set is implemented with kv.Update,
+// which may be more expensive than kv.Set for some stores.
+func NewStore(kv simplekv.KeyLister, counters simplekv.Store, opts ...Option) simplekv.Store {
+	s := &kvStore{
+		kv:       kv,
+		counters: counters,
+		shards:   DefaultShards,
+		logger:   nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.shards < 1 {
+		s.shards = 1
+	}
+	return wrapkv.NewStore(s, kv)
+}
+
+// Recount sets the count maintained by kv, which must have been
+// returned by NewStore, to the number of keys currently held in the
+// underlying store. Writes made while Recount is running may not be
+// reflected in the result.
+func Recount(ctx context.Context, kv simplekv.Store) error {
+	s, ok := wrapkv.Base(kv).(interface {
+		recount(ctx context.Context) error
+	})
+	if !ok {
+		return errgo.Newf("store was not created by countsimplekv.NewStore")
+	}
+	return errgo.Mask(s.recount(ctx), errgo.Any)
+}
+
+type kvStore struct {
+	kv       simplekv.KeyLister
+	counters simplekv.Store
+	shards   int
+	logger   simplekv.Logger
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.kv.Get(ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	ok, err := s.kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set by updating the key in the
+// underlying store and incrementing the count if it did not exist.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	err := s.Update(ctx, key, expire, func([]byte) ([]byte, error) {
+		return value, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Update implements simplekv.Store.Update, incrementing the count if
+// the key did not exist.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	var existed bool
+	err := s.kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		existed = old != nil
+		return getVal(old)
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if !existed && !expired(expire) {
+		s.adjust(ctx, key, 1)
+	}
+	return nil
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the underlying store, incrementing
+// the count if oldVal is nil.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	if err := simplekv.SetIfEquals(ctx, s.kv, key, oldVal, newVal, expire); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if oldVal == nil && !expired(expire) {
+		s.adjust(ctx, key, 1)
+	}
+	return nil
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	return errgo.Mask(s.kv.Touch(ctx, key, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete, decrementing the count if
+// the key was deleted.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := s.kv.Delete(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.adjust(ctx, key, -1)
+	return nil
+}
+
+// count returns the count of all keys by adding up the counter keys.
+func (s *kvStore) count(ctx context.Context) (int, error) {
+	total := 0
+	for i := 0; i < s.shards; i++ {
+		v, err := s.counters.Get(ctx, shardKey(i))
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, errgo.Notef(err, "cannot read count")
+		}
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return 0, errgo.Newf("value of key %s is not an integer", shardKey(i))
+		}
+		total += int(n)
+	}
+	if total < 0 {
+		// Writes made concurrently with Recount can leave
+		// the count slightly too low.
+		total = 0
+	}
+	return total, nil
+}
+
+// CountKeys implements wrapkv.Counter.CountKeys. The count is only
+// maintained for all keys, so counting the keys with a non-empty
+// prefix calls simplekv.CountWithPrefix on the underlying store.
+func (s *kvStore) CountKeys(ctx context.Context, prefix string) (int, error) {
+	if prefix == "" {
+		n, err := s.count(ctx)
+		return n, errgo.Mask(err)
+	}
+	n, err := simplekv.CountWithPrefix(ctx, s.kv, prefix)
+	return n, errgo.Mask(err, errgo.Any)
+}
+
+// adjust adds delta to the counter key for the given key. The change
+// to the underlying store has already been made, so a failure is
+// logged rather than returned.
+func (s *kvStore) adjust(ctx context.Context, key string, delta int64) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	counter := shardKey(int(h.Sum32() % uint32(s.shards)))
+	if _, err := simplekv.Increment(ctx, s.counters, counter, delta, time.Time{}); err != nil {
+		s.logger.Debugf("cannot update key count: %v", err)
+	}
+}
+
+// recount implements Recount.
+func (s *kvStore) recount(ctx context.Context) error {
+	n, err := simplekv.CountWithPrefix(ctx, s.kv, "")
+	if err != nil {
+		return errgo.Notef(err, "cannot count keys")
+	}
+	entries := make([]simplekv.Entry, s.shards)
+	for i := range entries {
+		entries[i] = simplekv.Entry{
+			Key:   shardKey(i),
+			Value: []byte("0"),
+		}
+	}
+	entries[0].Value = []byte(strconv.Itoa(n))
+	if err := simplekv.SetMulti(ctx, s.counters, entries); err != nil {
+		return errgo.Notef(err, "cannot set count")
+	}
+	return nil
+}
+
+// expired reports whether an entry written with the given expiry time
+// has already expired.
+func expired(expire time.Time) bool {
+	return !expire.IsZero() && !time.Now().Before(expire)
+}
+
+// shardKey returns the counter key for the given shard.
+func shardKey(i int) string {
+	return fmt.Sprintf("count-%d", i)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
@@ -0,0 +1,84 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package countsimplekv_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/countsimplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestCountStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return countsimplekv.NewStore(memsimplekv.NewStore().(simplekv.KeyLister), memsimplekv.NewStore()), nil
+	})
+}
+
+func TestCountMaintained(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	counters := memsimplekv.NewStore().(simplekv.KeyLister)
+	kv := countsimplekv.NewStore(memsimplekv.NewStore().(simplekv.KeyLister), counters, countsimplekv.WithShards(4)).(simplekv.Counter)
+
+	for i := 0; i < 10; i++ {
+		err := kv.Set(ctx, fmt.Sprint("key", i), []byte("v"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	// Overwriting an existing key does not change the count.
+	err := kv.Set(ctx, "key0", []byte("v2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Update(ctx, "key1", time.Time{}, func(old []byte) ([]byte, error) {
+		return []byte("v2"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetIfEquals(ctx, kv, "new", nil, []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Delete(ctx, "key2")
+	c.Assert(err, qt.Equals, nil)
+
+	n, err := kv.Count(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 10)
+	n, err = kv.CountWithPrefix(ctx, "key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 9)
+
+	// The count is spread over the shards.
+	keys, err := counters.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(len(keys) > 1, qt.Equals, true)
+	c.Assert(len(keys) <= 4, qt.Equals, true)
+}
+
+func TestRecount(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore().(simplekv.KeyLister)
+	err := mem.Set(ctx, "existing", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	kv := countsimplekv.NewStore(mem, memsimplekv.NewStore())
+	err = kv.Set(ctx, "new", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	n, err := simplekv.CountWithPrefix(ctx, kv.(simplekv.KeyLister), "")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 1)
+
+	err = countsimplekv.Recount(ctx, kv)
+	c.Assert(err, qt.Equals, nil)
+	n, err = simplekv.CountWithPrefix(ctx, kv.(simplekv.KeyLister), "")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+
+	err = countsimplekv.Recount(ctx, mem)
+	c.Assert(err, qt.ErrorMatches, `store was not created by countsimplekv.NewStore`)
+}
@@ -0,0 +1,240 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package dryrunsimplekv provides a simplekv.Store that reports the
+// changes that would be made to another store instead of making them.
+// It is useful for checking what a migration script or administrative
+// tool would do before running it against a production store.
+package dryrunsimplekv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/internal/wrapkv"
+)
+
+// Op identifies the kind of change reported by the store.
+type Op string
+
+// The operations that can be reported in Change.Op.
+const (
+	OpSet    Op = "set"
+	OpUpdate Op = "update"
+	OpTouch  Op = "touch"
+	OpDelete Op = "delete"
+)
+
+// Change describes a change that would have been made to the
+// underlying store.
+type Change struct {
+	// Op holds the operation that would have made the change.
+	Op Op
+
+	// Key holds the key that would have changed.
+	Key string
+
+	// Existed reports whether the key had a value before the
+	// change. It is always true for OpTouch and OpDelete.
+	Existed bool
+
+	// OldLen holds the length of the value before the change. It
+	// is zero if the key did not have a value.
+	OldLen int
+
+	// NewLen holds the length of the value after the change. It is
+	// zero for OpDelete.
+	NewLen int
+
+	// Expire holds the expiry time that would have been set. It is
+	// zero for OpDelete and for entries that would not expire.
+	Expire time.Time
+}
+
+// String returns a one-line description of the change.
+func (c Change) String() string {
+	var sizes string
+	switch {
+	case c.Op == OpDelete:
+		sizes = fmt.Sprintf("%d bytes", c.OldLen)
+	case c.Existed:
+		sizes = fmt.Sprintf("%d -> %d bytes", c.OldLen, c.NewLen)
+	default:
+		sizes = fmt.Sprintf("new, %d bytes", c.NewLen)
+	}
+	s := fmt.Sprintf("%s %q (%s)", c.Op, c.Key, sizes)
+	if !c.Expire.IsZero() {
+		s += " expires " + c.Expire.UTC().Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+// NewStore returns a store that reads from kv but, instead of writing
+// to it, calls report with a description of each change that would
+// have been made. Values that would have been written are not visible
+// to later reads.
+//
+// The returned store implements simplekv.KeyLister and
+// simplekv.Counter if kv implements simplekv.KeyLister, and
+// simplekv.Iterable if kv does.
+func NewStore(kv simplekv.Store, report func(Change)) simplekv.Store {
+	s := &kvStore{
+		kv:     kv,
+		report: report,
+	}
+	return wrapkv.NewStore(s, kv)
+}
+
+type kvStore struct {
+	kv     simplekv.Store
+	report func(Change)
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.kv.Get(ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	ok, err := s.kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set by reporting the change.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	return errgo.Mask(s.set(ctx, OpSet, key, value, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update by calling getVal with the
+// current value and reporting the change.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	old, err := s.get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	value, err := getVal(old)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := s.checkValue(value); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	s.reportChange(OpUpdate, key, old, value, expire)
+	return nil
+}
+
+// Touch implements simplekv.Store.Touch by reporting the change.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	old, err := s.kv.Get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.reportChange(OpTouch, key, old, old, expire)
+	return nil
+}
+
+// Delete implements simplekv.Store.Delete by reporting the change.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	old, err := s.kv.Get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.reportChange(OpDelete, key, old, nil, time.Time{})
+	return nil
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// comparing the current value and reporting the change.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	old, err := s.get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if (old == nil) != (oldVal == nil) || !bytes.Equal(old, oldVal) {
+		return simplekv.KeyConflictError(key)
+	}
+	if err := s.checkValue(newVal); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	s.reportChange(OpSet, key, old, newVal, expire)
+	return nil
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by reporting
+// each change in turn.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	for _, e := range entries {
+		if err := simplekv.CheckKey(e.Key); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+		}
+		if err := s.checkValue(e.Value); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+	}
+	for _, e := range entries {
+		if err := s.set(ctx, OpSet, e.Key, e.Value, e.Expire); err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot set %q", e.Key), errgo.Any)
+		}
+	}
+	return nil
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+// set reports the change made by setting the given key to value.
+func (s *kvStore) set(ctx context.Context, op Op, key string, value []byte, expire time.Time) error {
+	if err := s.checkValue(value); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	old, err := s.get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.reportChange(op, key, old, value, expire)
+	return nil
+}
+
+// get returns the current value of the given key, or nil if it does
+// not exist.
+func (s *kvStore) get(ctx context.Context, key string) ([]byte, error) {
+	old, err := s.kv.Get(ctx, key)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	return old, errgo.Mask(err, errgo.Any)
+}
+
+// checkValue checks that the underlying store would accept the given
+// value.
+func (s *kvStore) checkValue(value []byte) error {
+	if maxLen := simplekv.MaxValueLen(s.kv); maxLen > 0 {
+		return errgo.Mask(simplekv.CheckValue(value, maxLen), errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return nil
+}
+
+func (s *kvStore) reportChange(op Op, key string, old, value []byte, expire time.Time) {
+	s.report(Change{
+		Op:      op,
+		Key:     key,
+		Existed: old != nil,
+		OldLen:  len(old),
+		NewLen:  len(value),
+		Expire:  simplekv.NormalizeExpire(expire),
+	})
+}
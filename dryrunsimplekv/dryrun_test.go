@@ -0,0 +1,130 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package dryrunsimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/dryrunsimplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestChangesReportedNotWritten(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore().(simplekv.KeyLister)
+	err := mem.Set(ctx, "existing", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	var changes []dryrunsimplekv.Change
+	kv := dryrunsimplekv.NewStore(mem, func(ch dryrunsimplekv.Change) {
+		changes = append(changes, ch)
+	})
+	expire := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err = kv.Set(ctx, "new", []byte("abc"), expire)
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Update(ctx, "existing", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, "value")
+		return []byte("new value"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Touch(ctx, "existing", expire)
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Delete(ctx, "existing")
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetIfEquals(ctx, kv, "existing", []byte("value"), []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	c.Assert(changes, qt.DeepEquals, []dryrunsimplekv.Change{{
+		Op:     dryrunsimplekv.OpSet,
+		Key:    "new",
+		NewLen: 3,
+		Expire: expire,
+	}, {
+		Op:      dryrunsimplekv.OpUpdate,
+		Key:     "existing",
+		Existed: true,
+		OldLen:  5,
+		NewLen:  9,
+	}, {
+		Op:      dryrunsimplekv.OpTouch,
+		Key:     "existing",
+		Existed: true,
+		OldLen:  5,
+		NewLen:  5,
+		Expire:  expire,
+	}, {
+		Op:      dryrunsimplekv.OpDelete,
+		Key:     "existing",
+		Existed: true,
+		OldLen:  5,
+	}, {
+		Op:      dryrunsimplekv.OpSet,
+		Key:     "existing",
+		Existed: true,
+		OldLen:  5,
+		NewLen:  1,
+	}})
+
+	// Nothing was written.
+	snap, err := simplekv.Snapshot(ctx, mem)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{
+		"existing": []byte("value"),
+	})
+}
+
+func TestErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := dryrunsimplekv.NewStore(memsimplekv.NewStore(), func(ch dryrunsimplekv.Change) {
+		c.Errorf("unexpected change %v", ch)
+	})
+
+	err := kv.Delete(ctx, "missing")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	err = kv.Touch(ctx, "missing", time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	err = simplekv.SetIfEquals(ctx, kv, "missing", []byte("x"), []byte("y"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+
+	testErr := errgo.New("test error")
+	err = kv.Update(ctx, "missing", time.Time{}, func(old []byte) ([]byte, error) {
+		return nil, testErr
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, testErr)
+}
+
+func TestChangeString(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range []struct {
+		change dryrunsimplekv.Change
+		expect string
+	}{{
+		change: dryrunsimplekv.Change{Op: dryrunsimplekv.OpSet, Key: "k", NewLen: 3},
+		expect: `set "k" (new, 3 bytes)`,
+	}, {
+		change: dryrunsimplekv.Change{
+			Op:      dryrunsimplekv.OpUpdate,
+			Key:     "k",
+			Existed: true,
+			OldLen:  3,
+			NewLen:  4,
+			Expire:  time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		expect: `update "k" (3 -> 4 bytes) expires 2030-01-01T00:00:00Z`,
+	}, {
+		change: dryrunsimplekv.Change{Op: dryrunsimplekv.OpDelete, Key: "k", Existed: true, OldLen: 3},
+		expect: `delete "k" (3 bytes)`,
+	}} {
+		c.Check(test.change.String(), qt.Equals, test.expect)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package epochsimplekv provides a simplekv.Store whose entries can
+// all be invalidated at once by moving to a new epoch, which is useful
+// for cache-style data held in backends where deleting many entries is
+// slow.
+package epochsimplekv
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/namespacesimplekv"
+)
+
+// epochKey holds the key, relative to the store's prefix, that holds
+// the current epoch. Entries are held under keys starting with the
+// decimal epoch followed by "/", so they cannot clash with it.
+const epochKey = "epoch"
+
+// maxEpochLen holds the maximum length of the decimal representation
+// of an epoch, including its "/" separator.
+const maxEpochLen = 20
+
+// Store is implemented by the stores returned by NewStore.
+type Store interface {
+	simplekv.Store
+
+	// Epoch returns the current epoch. The epoch of a store that
+	// has never been bumped is zero.
+	Epoch(ctx context.Context) (int64, error)
+
+	// BumpEpoch moves the store to a new epoch and returns it.
+	// Entries written in earlier epochs are no longer visible
+	// through the store, although they remain in the underlying
+	// store.
+	BumpEpoch(ctx context.Context) (int64, error)
+}
+
+// NewStore returns a store that holds its entries in kv under keys
+// starting with the given prefix. The prefix should be chosen so that
+// it is not a prefix of any other key in kv that is not managed by the
+// returned store.
+//
+// Every operation reads the current epoch from kv before accessing the
+// entry, so it costs one extra round trip. An operation that is in
+// progress while the epoch is bumped may act on the old epoch.
+//
+// Entries from old epochs are not removed, so they should be given
+// expiry times or removed from kv by other means.
+//
+// The returned store always implements simplekv.KeyLister and
+// simplekv.Iterable, but listing keys or iterating returns an error if
+// kv does not implement the corresponding interface.
+func NewStore(kv simplekv.Store, prefix string) Store {
+	return &kvStore{
+		kv:        kv,
+		prefix:    prefix,
+		maxKeyLen: simplekv.KeyLimit(kv) - len(prefix) - maxEpochLen,
+	}
+}
+
+type kvStore struct {
+	kv        simplekv.Store
+	prefix    string
+	maxKeyLen int
+}
+
+// Epoch implements Store.Epoch.
+func (s *kvStore) Epoch(ctx context.Context) (int64, error) {
+	data, err := s.kv.Get(ctx, s.prefix+epochKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot get epoch")
+	}
+	epoch, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, errgo.Newf("invalid epoch %q", data)
+	}
+	return epoch, nil
+}
+
+// BumpEpoch implements Store.BumpEpoch.
+func (s *kvStore) BumpEpoch(ctx context.Context) (int64, error) {
+	epoch, err := simplekv.Increment(ctx, s.kv, s.prefix+epochKey, 1, time.Time{})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot bump epoch")
+	}
+	return epoch, nil
+}
+
+// current returns a store that holds the entries of the current
+// epoch, after checking that the given key can be used with the
+// store.
+func (s *kvStore) current(ctx context.Context, key string) (simplekv.Store, error) {
+	if err := simplekv.CheckKeyLen(key, s.maxKeyLen); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	epoch, err := s.Epoch(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return namespacesimplekv.NewStore(s.kv, s.prefix+strconv.FormatInt(epoch, 10)+"/"), nil
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	kv, err := s.current(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	v, err := kv.Get(ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	kv, err := s.current(ctx, key)
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	ok, err := kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	kv, err := s.current(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(kv.Set(ctx, key, value, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	kv, err := s.current(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(kv.Update(ctx, key, expire, getVal), errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	kv, err := s.current(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(kv.Touch(ctx, key, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	kv, err := s.current(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(kv.Delete(ctx, key), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the underlying store.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	kv, err := s.current(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(simplekv.SetIfEquals(ctx, kv, key, oldVal, newVal, expire), errgo.Any)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by calling
+// simplekv.SetMulti on the underlying store.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	for _, e := range entries {
+		if err := simplekv.CheckKeyLen(e.Key, s.maxKeyLen); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+		}
+	}
+	kv, err := s.current(ctx, "")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(simplekv.SetMulti(ctx, kv, entries), errgo.Any)
+}
+
+// Txn implements simplekv.Transactor.Txn by calling simplekv.Txn on
+// the underlying store. All the keys in the transaction belong to the
+// epoch that was current when it started.
+func (s *kvStore) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	kv, err := s.current(ctx, "")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(simplekv.Txn(ctx, kv, f), errgo.Any)
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen. The limit
+// allows room for the prefix and the largest possible epoch.
+func (s *kvStore) MaxKeyLen() int {
+	return s.maxKeyLen
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	return s.KeysWithPrefix(ctx, "")
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix by
+// listing the keys of the current epoch. It returns an error if the
+// underlying store does not implement simplekv.KeyLister.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	if _, ok := s.kv.(simplekv.KeyLister); !ok {
+		return nil, errgo.Newf("cannot list keys: underlying store does not implement simplekv.KeyLister")
+	}
+	kv, err := s.current(ctx, "")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	keys, err := kv.(simplekv.KeyLister).KeysWithPrefix(ctx, prefix)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// Iterate implements simplekv.Iterable.Iterate by iterating over the
+// entries of the current epoch. It returns an error if the underlying
+// store does not implement simplekv.Iterable.
+func (s *kvStore) Iterate(ctx context.Context, prefix string) (simplekv.Iterator, error) {
+	if _, ok := s.kv.(simplekv.Iterable); !ok {
+		return nil, errgo.Newf("cannot iterate: underlying store does not implement simplekv.Iterable")
+	}
+	kv, err := s.current(ctx, "")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	iter, err := kv.(simplekv.Iterable).Iterate(ctx, prefix)
+	return iter, errgo.Mask(err, errgo.Any)
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package epochsimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/epochsimplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestEpochStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return epochsimplekv.NewStore(memsimplekv.NewStore(), "cache/"), nil
+	})
+}
+
+func TestBumpEpoch(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore()
+	kv := epochsimplekv.NewStore(mem, "cache/")
+
+	epoch, err := kv.Epoch(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(epoch, qt.Equals, int64(0))
+
+	err = kv.Set(ctx, "a", []byte("a0"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "b", []byte("b0"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	epoch, err = kv.BumpEpoch(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(epoch, qt.Equals, int64(1))
+
+	// Entries from the old epoch are no longer visible.
+	_, err = kv.Get(ctx, "a")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	keys, err := kv.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 0)
+
+	err = kv.Set(ctx, "a", []byte("a1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := kv.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a1")
+
+	// The old entries remain in the underlying store.
+	v, err = mem.Get(ctx, "cache/0/b")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "b0")
+	v, err = mem.Get(ctx, "cache/1/a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a1")
+
+	// Another store with the same prefix sees the same epoch.
+	epoch, err = epochsimplekv.NewStore(mem, "cache/").Epoch(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(epoch, qt.Equals, int64(1))
+}
+
+func TestMaxKeyLen(t *testing.T) {
+	c := qt.New(t)
+	kv := epochsimplekv.NewStore(memsimplekv.NewStore(), "cache/")
+	c.Assert(simplekv.KeyLimit(kv), qt.Equals, simplekv.MaxKeyLen-len("cache/")-20)
+}
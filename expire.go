@@ -0,0 +1,51 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"time"
+)
+
+// ExpirePrecision holds the precision with which stores record expiry
+// times. It is the coarsest precision supported by any of the
+// backends (MongoDB stores times to the millisecond).
+const ExpirePrecision = time.Millisecond
+
+// NormalizeExpire returns the given expiry time as it should be
+// stored: in UTC, truncated to ExpirePrecision and without a
+// monotonic clock reading. The zero time, meaning no expiry, is
+// returned unchanged. Stores call this on every expiry time they are
+// given so that entries expire at the same instant whichever backend
+// is used.
+func NormalizeExpire(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.UTC().Truncate(ExpirePrecision)
+}
+
+// ExpireAfter returns the expiry time of an entry written at the given
+// time with the given TTL. It returns the zero time, meaning no
+// expiry, if ttl is zero.
+func ExpireAfter(now time.Time, ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// ExpiryReader is implemented by stores that can report the expiry
+// time of an entry. Stores are not required to implement it, as some
+// backends only record expiry times in a form that cannot be read
+// back.
+type ExpiryReader interface {
+	Store
+
+	// GetExpiry returns the expiry time of the entry with the given
+	// key, normalized as by NormalizeExpire, or the zero time if the
+	// entry does not expire. If the entry does not exist, an error
+	// with a cause of ErrNotFound is returned.
+	GetExpiry(ctx context.Context, key string) (time.Time, error)
+}
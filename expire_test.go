@@ -0,0 +1,38 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+)
+
+func TestNormalizeExpire(t *testing.T) {
+	c := qt.New(t)
+	loc := time.FixedZone("test", -5*60*60)
+
+	c.Assert(simplekv.NormalizeExpire(time.Time{}).IsZero(), qt.Equals, true)
+
+	t0 := time.Date(2018, 1, 1, 7, 0, 0, 123456789, loc)
+	got := simplekv.NormalizeExpire(t0)
+	c.Assert(got, qt.DeepEquals, time.Date(2018, 1, 1, 12, 0, 0, 123000000, time.UTC))
+	c.Assert(got.Location(), qt.Equals, time.UTC)
+
+	// The monotonic clock reading is removed, so normalized times can
+	// be compared with ==.
+	now := time.Now()
+	c.Assert(simplekv.NormalizeExpire(now) == simplekv.NormalizeExpire(now.Round(0)), qt.Equals, true)
+}
+
+func TestExpireAfter(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Assert(simplekv.ExpireAfter(now, 0).IsZero(), qt.Equals, true)
+	c.Assert(simplekv.ExpireAfter(now, time.Minute), qt.Equals, now.Add(time.Minute))
+	c.Assert(simplekv.ExpireAfter(now, -time.Minute), qt.Equals, now.Add(-time.Minute))
+}
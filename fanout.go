@@ -0,0 +1,87 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"sync"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// StoreValue holds a value read by GetFreshest from one of several
+// stores.
+type StoreValue struct {
+	// Index holds the index of the store that the value was read
+	// from.
+	Index int
+
+	// Value holds the value.
+	Value []byte
+
+	// Revision holds the revision of the value, as returned by
+	// GetWithRevision.
+	Revision string
+}
+
+// GetFreshest reads the given key from all of the given stores
+// concurrently, for example from several regional replicas, and
+// returns the freshest of the values found. The newer function reports
+// whether a is fresher than b; it might compare a timestamp held in
+// the values, or revisions if all the stores issue revisions from a
+// common sequence.
+//
+// Stores that do not hold the key are ignored. If any store holds the
+// key, the freshest value is returned even if reading from other
+// stores failed. Otherwise, if reading from any store failed, one of
+// the errors is returned; if no store holds the key, an error with a
+// cause of ErrNotFound is returned.
+func GetFreshest(ctx context.Context, stores []Store, key string, newer func(a, b StoreValue) bool) (StoreValue, error) {
+	type result struct {
+		v   StoreValue
+		err error
+	}
+	results := make([]result, len(stores))
+	var wg sync.WaitGroup
+	for i, kv := range stores {
+		i, kv := i, kv
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, rev, err := GetWithRevision(ctx, kv, key)
+			results[i] = result{
+				v: StoreValue{
+					Index:    i,
+					Value:    value,
+					Revision: rev,
+				},
+				err: err,
+			}
+		}()
+	}
+	wg.Wait()
+	var (
+		freshest StoreValue
+		found    bool
+		firstErr error
+	)
+	for _, r := range results {
+		switch {
+		case errgo.Cause(r.err) == ErrNotFound:
+		case r.err != nil:
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		case !found || newer(r.v, freshest):
+			freshest, found = r.v, true
+		}
+	}
+	switch {
+	case found:
+		return freshest, nil
+	case firstErr != nil:
+		return StoreValue{}, errgo.NoteMask(firstErr, "cannot read from all stores", errgo.Is(ErrKeyTooLarge), errgo.Is(ErrStoreClosed), IsContention)
+	}
+	return StoreValue{}, KeyNotFoundError(key)
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+// newerValue compares values that hold a timestamp in RFC 3339 form.
+func newerValue(a, b simplekv.StoreValue) bool {
+	return string(a.Value) > string(b.Value)
+}
+
+type failingStore struct {
+	simplekv.Store
+}
+
+func (failingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errgo.New("store unavailable")
+}
+
+func TestGetFreshest(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	stores := []simplekv.Store{
+		memsimplekv.NewStore(),
+		memsimplekv.NewStore(),
+		memsimplekv.NewStore(),
+	}
+	for i, v := range []string{"2018-01-02T00:00:00Z", "2018-01-03T00:00:00Z"} {
+		err := stores[i].Set(ctx, "k", []byte(v), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	v, err := simplekv.GetFreshest(ctx, stores, "k", newerValue)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v.Index, qt.Equals, 1)
+	c.Assert(string(v.Value), qt.Equals, "2018-01-03T00:00:00Z")
+	c.Assert(v.Revision, qt.Not(qt.Equals), "")
+
+	// A failing store does not prevent a value being returned.
+	stores[2] = failingStore{stores[2]}
+	v, err = simplekv.GetFreshest(ctx, stores, "k", newerValue)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v.Index, qt.Equals, 1)
+
+	// When no store holds the key, the failure is reported.
+	_, err = simplekv.GetFreshest(ctx, stores, "other", newerValue)
+	c.Assert(err, qt.ErrorMatches, `cannot read from all stores: store unavailable`)
+
+	_, err = simplekv.GetFreshest(ctx, stores[:2], "other", newerValue)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `key other not found`)
+}
@@ -0,0 +1,641 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package firestoresimplekv provides a simplekv.Store that stores each
+// entry as a document in a Google Cloud Firestore collection, using
+// the Firestore REST API.
+//
+// Each document holds the key of its entry in the "key" field, the
+// value in the "value" field and, if the entry has an expiry time,
+// the expiry time in the "expire" field. Entries without an expiry
+// time have no "expire" field, so a Firestore TTL policy on the
+// "expire" field of the collection removes expired entries without
+// touching the others. Firestore may take some time to remove expired
+// documents, so expiry times are also checked when entries are read.
+//
+// Document IDs are derived from keys, because keys may hold
+// characters that are not allowed in document IDs.
+package firestoresimplekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+const (
+	// defaultEndpoint holds the URL of the Firestore API.
+	defaultEndpoint = "https://firestore.googleapis.com"
+
+	// maxValueLen holds the maximum length of a value. Firestore
+	// documents are limited to 1MiB, including the document name
+	// and the other fields.
+	maxValueLen = 1<<20 - 4096
+
+	// queryLimit holds the number of documents fetched by each
+	// query made when listing keys.
+	queryLimit = 1000
+)
+
+// maxAttempts holds the number of times a transaction is attempted
+// when it is aborted because of concurrent modifications.
+const maxAttempts = 10
+
+// retryAfter holds the delay suggested to callers when an operation
+// fails after maxAttempts attempts.
+const retryAfter = 100 * time.Millisecond
+
+// errAborted is the error cause used when Firestore aborts a
+// transaction because of concurrent modifications.
+var errAborted = errgo.New("transaction aborted")
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithDatabase returns an option that selects the database used by
+// the store. The default is "(default)".
+func WithDatabase(database string) Option {
+	return func(s *kvStore) {
+		s.database = database
+	}
+}
+
+// WithEndpoint returns an option that sends requests to the given URL
+// instead of the Firestore API, for example to use the Firestore
+// emulator.
+func WithEndpoint(endpoint string) Option {
+	return func(s *kvStore) {
+		s.endpoint = endpoint
+	}
+}
+
+// WithClock returns an option that makes the store use the given
+// clock to decide whether entries have expired.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// NewStore returns a new Store that stores entries in the given
+// collection of the given Google Cloud project. Requests are sent with
+// the given client, which is responsible for authorizing them (for
+// example, a client returned by golang.org/x/oauth2/google.DefaultClient).
+//
+// Update, Touch and Delete use Firestore transactions, which are
+// retried when Firestore aborts them because of concurrent
+// modifications.
+//
+// The returned store implements simplekv.KeyLister,
+// simplekv.KeyLimiter and simplekv.ValueLimiter.
+func NewStore(client *http.Client, projectID, collection string, opts ...Option) (simplekv.Store, error) {
+	if projectID == "" || strings.Contains(projectID, "/") {
+		return nil, errgo.Newf("invalid project ID %q", projectID)
+	}
+	if collection == "" || strings.Contains(collection, "/") {
+		return nil, errgo.Newf("invalid collection ID %q", collection)
+	}
+	s := &kvStore{
+		client:     client,
+		endpoint:   defaultEndpoint,
+		project:    projectID,
+		database:   "(default)",
+		collection: collection,
+		clock:      systemClock{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.endpoint = strings.TrimSuffix(s.endpoint, "/")
+	return s, nil
+}
+
+type kvStore struct {
+	client     *http.Client
+	endpoint   string
+	project    string
+	database   string
+	collection string
+	clock      simplekv.Clock
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	doc, err := s.getDocument(ctx, key, "", "value", "expire")
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get key %s", key)
+	}
+	if !s.alive(doc) {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	v, err := doc.value()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get key %s", key)
+	}
+	return v, nil
+}
+
+// Exists implements simplekv.Store.Exists without fetching the value.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Any)
+	}
+	doc, err := s.getDocument(ctx, key, "", "expire")
+	if err != nil {
+		return false, errgo.Notef(err, "cannot get key %s", key)
+	}
+	return s.alive(doc), nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := simplekv.CheckValue(value, maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	if err := s.commit(ctx, "", []write{s.updateWrite(key, value, expire)}); err != nil {
+		return errgo.Notef(err, "cannot set key %s", key)
+	}
+	return nil
+}
+
+// Update implements simplekv.Store.Update by reading the old value and
+// writing the new one in a transaction.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err := s.runTransaction(ctx, key, nil, func(doc *document) ([]write, error) {
+		var old []byte
+		if s.alive(doc) {
+			var err error
+			old, err = doc.value()
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		value, err := getVal(old)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if err := simplekv.CheckValue(value, maxValueLen); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+		return []write{s.updateWrite(key, value, expire)}, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch by changing only the "expire"
+// field of the document.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err := s.runTransaction(ctx, key, []string{"expire"}, func(doc *document) ([]write, error) {
+		if !s.alive(doc) {
+			return nil, simplekv.KeyNotFoundError(key)
+		}
+		fields := make(map[string]value)
+		if !expire.IsZero() {
+			fields["expire"] = timestampValue(expire)
+		}
+		// The "expire" field is in the update mask, so it is
+		// removed when it is not set.
+		return []write{{
+			Update: &document{
+				Name:   s.documentName(key),
+				Fields: fields,
+			},
+			UpdateMask: &documentMask{
+				FieldPaths: []string{"expire"},
+			},
+		}}, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err := s.runTransaction(ctx, key, []string{"expire"}, func(doc *document) ([]write, error) {
+		if !s.alive(doc) {
+			return nil, simplekv.KeyNotFoundError(key)
+		}
+		return []write{{
+			Delete: s.documentName(key),
+		}}, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	keys, err := s.KeysWithPrefix(ctx, "")
+	return keys, errgo.Mask(err)
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix by
+// querying for documents in key order, starting at the prefix.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	q := &structuredQuery{
+		Select: &projection{
+			Fields: []fieldReference{{"key"}, {"expire"}},
+		},
+		From: []collectionSelector{{
+			CollectionID: s.collection,
+		}},
+		Where: &filter{
+			FieldFilter: &fieldFilter{
+				Field: fieldReference{"key"},
+				Op:    "GREATER_THAN_OR_EQUAL",
+				Value: stringValue(prefix),
+			},
+		},
+		OrderBy: []order{{
+			Field:     fieldReference{"key"},
+			Direction: "ASCENDING",
+		}},
+		Limit: queryLimit,
+	}
+	for {
+		var results []struct {
+			Document *document `json:"document"`
+		}
+		err := s.do(ctx, http.MethodPost, s.documentsURL()+":runQuery", map[string]interface{}{
+			"structuredQuery": q,
+		}, &results)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot list keys")
+		}
+		n := 0
+		for _, r := range results {
+			if r.Document == nil {
+				continue
+			}
+			n++
+			key := r.Document.Fields["key"].StringValue
+			if key == nil || !strings.HasPrefix(*key, prefix) {
+				return keys, nil
+			}
+			if s.alive(r.Document) {
+				keys = append(keys, *key)
+			}
+			q.StartAt = &cursor{
+				Values: []value{stringValue(*key)},
+			}
+		}
+		if n < queryLimit {
+			return keys, nil
+		}
+	}
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen.
+func (s *kvStore) MaxKeyLen() int {
+	return simplekv.MaxKeyLen
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen.
+func (s *kvStore) MaxValueLen() int {
+	return maxValueLen
+}
+
+// runTransaction runs f in a transaction with the document holding
+// the given key, which is nil if there is no such document, and
+// commits the writes it returns. If any fields are given, only those
+// fields of the document are fetched. The transaction is retried if it is
+// aborted. Errors returned by f are returned with their cause
+// unchanged.
+func (s *kvStore) runTransaction(ctx context.Context, key string, fields []string, f func(doc *document) ([]write, error)) error {
+	for i := 0; i < maxAttempts; i++ {
+		var resp struct {
+			Transaction string `json:"transaction"`
+		}
+		if err := s.do(ctx, http.MethodPost, s.documentsURL()+":beginTransaction", map[string]interface{}{}, &resp); err != nil {
+			return errgo.Notef(err, "cannot begin transaction")
+		}
+		tx := resp.Transaction
+		doc, err := s.getDocument(ctx, key, tx, fields...)
+		if err != nil {
+			s.rollback(ctx, tx)
+			return errgo.Notef(err, "cannot get key %s", key)
+		}
+		writes, err := f(doc)
+		if err != nil {
+			s.rollback(ctx, tx)
+			return errgo.Mask(err, errgo.Any)
+		}
+		err = s.commit(ctx, tx, writes)
+		if errgo.Cause(err) == errAborted {
+			continue
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot commit transaction")
+		}
+		return nil
+	}
+	return simplekv.NewContentionError(retryAfter, "cannot update key %s: too many concurrent modifications", key)
+}
+
+// getDocument returns the document holding the given key, or nil if
+// there is no such document. If tx is non-empty, the document is read
+// in that transaction. If any fields are given, only those fields are
+// fetched.
+func (s *kvStore) getDocument(ctx context.Context, key string, tx string, fields ...string) (*document, error) {
+	params := make(url.Values)
+	if tx != "" {
+		params.Set("transaction", tx)
+	}
+	for _, field := range fields {
+		params.Add("mask.fieldPaths", field)
+	}
+	u := s.endpoint + "/v1/" + s.documentName(key)
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	var doc document
+	err := s.do(ctx, http.MethodGet, u, nil, &doc)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &doc, nil
+}
+
+// commit commits the given writes. If tx is empty, the writes are
+// committed without a transaction.
+func (s *kvStore) commit(ctx context.Context, tx string, writes []write) error {
+	req := struct {
+		Writes      []write `json:"writes"`
+		Transaction string  `json:"transaction,omitempty"`
+	}{writes, tx}
+	return errgo.Mask(s.do(ctx, http.MethodPost, s.documentsURL()+":commit", req, nil), errgo.Is(errAborted))
+}
+
+// rollback rolls back the given transaction. Failures are ignored,
+// because Firestore expires abandoned transactions.
+func (s *kvStore) rollback(ctx context.Context, tx string) {
+	s.do(ctx, http.MethodPost, s.documentsURL()+":rollback", map[string]string{
+		"transaction": tx,
+	}, nil)
+}
+
+// updateWrite returns a write that replaces the document holding the
+// given key.
+func (s *kvStore) updateWrite(key string, v []byte, expire time.Time) write {
+	if v == nil {
+		// A nil slice would be encoded as null.
+		v = []byte{}
+	}
+	fields := map[string]value{
+		"key":   stringValue(key),
+		"value": {BytesValue: &v},
+	}
+	if !expire.IsZero() {
+		fields["expire"] = timestampValue(expire)
+	}
+	return write{
+		Update: &document{
+			Name:   s.documentName(key),
+			Fields: fields,
+		},
+	}
+}
+
+// alive reports whether doc holds an entry that has not expired.
+func (s *kvStore) alive(doc *document) bool {
+	if doc == nil {
+		return false
+	}
+	expire := doc.Fields["expire"].TimestampValue
+	return expire == nil || expire.After(s.clock.Now())
+}
+
+// documentsURL returns the URL of the root of the documents in the
+// database.
+func (s *kvStore) documentsURL() string {
+	return s.endpoint + "/v1/projects/" + s.project + "/databases/" + s.database + "/documents"
+}
+
+// documentName returns the name of the document holding the given
+// key.
+func (s *kvStore) documentName(key string) string {
+	return "projects/" + s.project + "/databases/" + s.database + "/documents/" + s.collection + "/" + documentID(key)
+}
+
+// documentID returns the ID of the document holding the given key.
+// Keys are hex encoded, because document IDs cannot contain '/',
+// cannot be "." or "..", and cannot both start and end with "__".
+func documentID(key string) string {
+	return hex.EncodeToString([]byte(key))
+}
+
+// checkKey checks that the given key can be stored in a string field.
+func checkKey(key string) error {
+	return simplekv.ValidateKey(key, simplekv.KeyRules{
+		Allowed: func(rune) bool { return true },
+	})
+}
+
+// do sends a request to the given URL with the given JSON body, if
+// any, and unmarshals the response into resp, if it is non-nil.
+// Errors returned by Firestore with a status of NOT_FOUND have a cause
+// of simplekv.ErrNotFound, and those with a status of ABORTED have a
+// cause of errAborted.
+func (s *kvStore) do(ctx context.Context, method, u string, body, resp interface{}) error {
+	var r *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		r = bytes.NewReader(data)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpResp, err := s.client.Do(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer httpResp.Body.Close()
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return errgo.Notef(err, "cannot read response body")
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return responseError(httpResp.StatusCode, data)
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return errgo.Notef(err, "cannot unmarshal response")
+	}
+	return nil
+}
+
+// apiError holds an error returned by the Firestore API.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+// Error implements the error interface.
+func (e *apiError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("unexpected status %d", e.Code)
+	}
+	return e.Status + ": " + e.Message
+}
+
+// responseError returns the error described by a response with the
+// given status code and body.
+func responseError(code int, data []byte) error {
+	var resp struct {
+		Error apiError `json:"error"`
+	}
+	// The body may not describe the error (for example, when the
+	// response comes from a proxy), so ignore failures.
+	json.Unmarshal(data, &resp)
+	e := &resp.Error
+	e.Code = code
+	switch e.Status {
+	case "NOT_FOUND":
+		return errgo.WithCausef(e, simplekv.ErrNotFound, "")
+	case "ABORTED":
+		return errgo.WithCausef(e, errAborted, "")
+	}
+	return e
+}
+
+// document holds a Firestore document.
+type document struct {
+	Name   string           `json:"name,omitempty"`
+	Fields map[string]value `json:"fields,omitempty"`
+}
+
+// value returns the value held in the document.
+func (doc *document) value() ([]byte, error) {
+	v := doc.Fields["value"].BytesValue
+	if v == nil {
+		return nil, errgo.Newf("document %s has no value", doc.Name)
+	}
+	if *v == nil {
+		// Always return a non-nil value, so that callers can
+		// distinguish an empty value from a missing one.
+		return []byte{}, nil
+	}
+	return *v, nil
+}
+
+// value holds a Firestore value. Only the types used by the store are
+// represented.
+type value struct {
+	StringValue    *string    `json:"stringValue,omitempty"`
+	BytesValue     *[]byte    `json:"bytesValue,omitempty"`
+	TimestampValue *time.Time `json:"timestampValue,omitempty"`
+}
+
+func stringValue(s string) value {
+	return value{StringValue: &s}
+}
+
+func timestampValue(t time.Time) value {
+	t = t.UTC()
+	return value{TimestampValue: &t}
+}
+
+// write holds a write in a commit request.
+type write struct {
+	Update     *document     `json:"update,omitempty"`
+	Delete     string        `json:"delete,omitempty"`
+	UpdateMask *documentMask `json:"updateMask,omitempty"`
+}
+
+type documentMask struct {
+	FieldPaths []string `json:"fieldPaths"`
+}
+
+// structuredQuery holds a query in a runQuery request.
+type structuredQuery struct {
+	Select  *projection          `json:"select,omitempty"`
+	From    []collectionSelector `json:"from"`
+	Where   *filter              `json:"where,omitempty"`
+	OrderBy []order              `json:"orderBy,omitempty"`
+	StartAt *cursor              `json:"startAt,omitempty"`
+	Limit   int                  `json:"limit,omitempty"`
+}
+
+type projection struct {
+	Fields []fieldReference `json:"fields"`
+}
+
+type collectionSelector struct {
+	CollectionID string `json:"collectionId"`
+}
+
+type filter struct {
+	FieldFilter *fieldFilter `json:"fieldFilter,omitempty"`
+}
+
+type fieldFilter struct {
+	Field fieldReference `json:"field"`
+	Op    string         `json:"op"`
+	Value value          `json:"value"`
+}
+
+type fieldReference struct {
+	FieldPath string `json:"fieldPath"`
+}
+
+type order struct {
+	Field     fieldReference `json:"field"`
+	Direction string         `json:"direction"`
+}
+
+// cursor holds a query cursor. Before is always false, so that
+// results start after the cursor position.
+type cursor struct {
+	Values []value `json:"values"`
+	Before bool    `json:"before"`
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,491 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package firestoresimplekv_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/firestoresimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestFirestoreStore(t *testing.T) {
+	srv := newFakeFirestore()
+	defer srv.Close()
+	n := 0
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		n++
+		return firestoresimplekv.NewStore(http.DefaultClient, "project", "kv"+strconv.Itoa(n), firestoresimplekv.WithEndpoint(srv.URL))
+	})
+}
+
+func TestDocuments(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeFirestore()
+	defer srv.Close()
+	kv, err := firestoresimplekv.NewStore(http.DefaultClient, "project", "kv", firestoresimplekv.WithEndpoint(srv.URL), firestoresimplekv.WithDatabase("db"))
+	c.Assert(err, qt.Equals, nil)
+
+	const name = "projects/project/databases/db/documents/kv/612f62"
+	err = kv.Set(ctx, "a/b", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.document(name), qt.DeepEquals, map[string]string{
+		"key":   "a/b",
+		"value": "value",
+	})
+
+	// A non-zero expiry time is held in the "expire" field, which
+	// can be used by a TTL policy.
+	expire := time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = kv.Touch(ctx, "a/b", expire)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.document(name), qt.DeepEquals, map[string]string{
+		"key":    "a/b",
+		"value":  "value",
+		"expire": "2100-01-02T03:04:05Z",
+	})
+
+	// A zero expiry time removes the field.
+	err = kv.Update(ctx, "a/b", time.Time{}, func(old []byte) ([]byte, error) {
+		return append(old, '!'), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.document(name), qt.DeepEquals, map[string]string{
+		"key":   "a/b",
+		"value": "value!",
+	})
+
+	err = kv.Delete(ctx, "a/b")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.document(name), qt.IsNil)
+}
+
+func TestExpiryCheckedOnRead(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeFirestore()
+	defer srv.Close()
+	clock := &testClock{now: time.Now()}
+	kv, err := firestoresimplekv.NewStore(http.DefaultClient, "project", "kv", firestoresimplekv.WithEndpoint(srv.URL), firestoresimplekv.WithClock(clock))
+	c.Assert(err, qt.Equals, nil)
+
+	err = kv.Set(ctx, "k", []byte("v"), clock.now.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	clock.now = clock.now.Add(2 * time.Hour)
+
+	// The document has not been removed by a TTL policy yet, but the
+	// entry has expired.
+	c.Assert(srv.document("projects/project/databases/(default)/documents/kv/6b"), qt.Not(qt.IsNil))
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	err = kv.Touch(ctx, "k", time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	keys, err := kv.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 0)
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(old, qt.IsNil)
+		return []byte("new"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestUpdateRetriesAbortedTransaction(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeFirestore()
+	defer srv.Close()
+	kv, err := firestoresimplekv.NewStore(http.DefaultClient, "project", "kv", firestoresimplekv.WithEndpoint(srv.URL))
+	c.Assert(err, qt.Equals, nil)
+
+	calls := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			err := kv.Set(ctx, "k", []byte("other"), time.Time{})
+			c.Check(err, qt.Equals, nil)
+		}
+		return append(old, '!'), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(calls, qt.Equals, 2)
+	v, err := kv.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "other!")
+
+	// An update that is always aborted eventually gives up.
+	n := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		n++
+		err := kv.Set(ctx, "k", []byte(fmt.Sprint(n)), time.Time{})
+		c.Check(err, qt.Equals, nil)
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot update key k: too many concurrent modifications`)
+	_, ok := simplekv.RetryAfter(err)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(srv.transactionCount(), qt.Equals, 0)
+}
+
+func TestErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeFirestore()
+	defer srv.Close()
+
+	kv, err := firestoresimplekv.NewStore(http.DefaultClient, "other-project", "kv", firestoresimplekv.WithEndpoint(srv.URL))
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `cannot set key k: PERMISSION_DENIED: Missing or insufficient permissions.`)
+
+	_, err = kv.Get(ctx, "\xff")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey)
+
+	_, err = firestoresimplekv.NewStore(http.DefaultClient, "project", "a/b")
+	c.Assert(err, qt.ErrorMatches, `invalid collection ID "a/b"`)
+	_, err = firestoresimplekv.NewStore(http.DefaultClient, "", "kv")
+	c.Assert(err, qt.ErrorMatches, `invalid project ID ""`)
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// fakeFirestore implements the small subset of the Firestore REST API
+// used by firestoresimplekv. Transactions are optimistic: a commit
+// is aborted if any document read in the transaction has changed.
+type fakeFirestore struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	docs         map[string]*fakeDocument
+	transactions map[string]map[string]int
+	nextTx       int
+	version      int
+}
+
+type fakeDocument struct {
+	fields  map[string]fsValue
+	version int
+}
+
+type fsValue struct {
+	StringValue    *string    `json:"stringValue,omitempty"`
+	BytesValue     *[]byte    `json:"bytesValue,omitempty"`
+	TimestampValue *time.Time `json:"timestampValue,omitempty"`
+}
+
+type fsDocument struct {
+	Name   string             `json:"name"`
+	Fields map[string]fsValue `json:"fields,omitempty"`
+}
+
+func newFakeFirestore() *fakeFirestore {
+	srv := &fakeFirestore{
+		docs:         make(map[string]*fakeDocument),
+		transactions: make(map[string]map[string]int),
+	}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	return srv
+}
+
+// document returns the fields of the document with the given name,
+// in string form, or nil if there is no such document.
+func (srv *fakeFirestore) document(name string) map[string]string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	doc := srv.docs[name]
+	if doc == nil {
+		return nil
+	}
+	fields := make(map[string]string)
+	for k, v := range doc.fields {
+		switch {
+		case v.StringValue != nil:
+			fields[k] = *v.StringValue
+		case v.BytesValue != nil:
+			fields[k] = string(*v.BytesValue)
+		case v.TimestampValue != nil:
+			fields[k] = v.TimestampValue.Format(time.RFC3339Nano)
+		}
+	}
+	return fields
+}
+
+// transactionCount returns the number of transactions that have been
+// neither committed nor rolled back.
+func (srv *fakeFirestore) transactionCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.transactions)
+}
+
+func (srv *fakeFirestore) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	if !strings.HasPrefix(path, "projects/project/") {
+		writeError(w, http.StatusForbidden, "PERMISSION_DENIED", "Missing or insufficient permissions.")
+		return
+	}
+	if req.Method == "GET" {
+		srv.get(w, req, path)
+		return
+	}
+	i := strings.LastIndex(path, ":")
+	if req.Method != "POST" || i == -1 {
+		writeError(w, http.StatusNotImplemented, "UNIMPLEMENTED", "unsupported request")
+		return
+	}
+	root, method := path[:i], path[i+1:]
+	var body json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
+		return
+	}
+	switch method {
+	case "beginTransaction":
+		srv.nextTx++
+		tx := fmt.Sprintf("tx%d", srv.nextTx)
+		srv.transactions[tx] = make(map[string]int)
+		writeJSON(w, map[string]string{"transaction": tx})
+	case "rollback":
+		var r struct {
+			Transaction string `json:"transaction"`
+		}
+		json.Unmarshal(body, &r)
+		delete(srv.transactions, r.Transaction)
+		writeJSON(w, struct{}{})
+	case "commit":
+		srv.commit(w, body)
+	case "runQuery":
+		srv.runQuery(w, root, body)
+	default:
+		writeError(w, http.StatusNotImplemented, "UNIMPLEMENTED", "unsupported request")
+	}
+}
+
+func (srv *fakeFirestore) get(w http.ResponseWriter, req *http.Request, name string) {
+	doc := srv.docs[name]
+	if tx := req.URL.Query().Get("transaction"); tx != "" {
+		reads, ok := srv.transactions[tx]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid transaction")
+			return
+		}
+		reads[name] = 0
+		if doc != nil {
+			reads[name] = doc.version
+		}
+	}
+	if doc == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Document \""+name+"\" not found.")
+		return
+	}
+	writeJSON(w, fsDocument{
+		Name:   name,
+		Fields: selectFields(doc.fields, req.URL.Query()["mask.fieldPaths"]),
+	})
+}
+
+func (srv *fakeFirestore) commit(w http.ResponseWriter, body json.RawMessage) {
+	var r struct {
+		Writes []struct {
+			Update     *fsDocument `json:"update"`
+			Delete     string      `json:"delete"`
+			UpdateMask *struct {
+				FieldPaths []string `json:"fieldPaths"`
+			} `json:"updateMask"`
+		} `json:"writes"`
+		Transaction string `json:"transaction"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
+		return
+	}
+	if r.Transaction != "" {
+		reads, ok := srv.transactions[r.Transaction]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid transaction")
+			return
+		}
+		delete(srv.transactions, r.Transaction)
+		for name, version := range reads {
+			current := 0
+			if doc := srv.docs[name]; doc != nil {
+				current = doc.version
+			}
+			if current != version {
+				writeError(w, http.StatusConflict, "ABORTED", "Transaction lock timeout.")
+				return
+			}
+		}
+	}
+	for _, wr := range r.Writes {
+		srv.version++
+		if wr.Delete != "" {
+			delete(srv.docs, wr.Delete)
+			continue
+		}
+		fields := wr.Update.Fields
+		if doc := srv.docs[wr.Update.Name]; doc != nil && wr.UpdateMask != nil {
+			fields = make(map[string]fsValue)
+			for k, v := range doc.fields {
+				fields[k] = v
+			}
+			for _, path := range wr.UpdateMask.FieldPaths {
+				if v, ok := wr.Update.Fields[path]; ok {
+					fields[path] = v
+				} else {
+					delete(fields, path)
+				}
+			}
+		}
+		srv.docs[wr.Update.Name] = &fakeDocument{
+			fields:  fields,
+			version: srv.version,
+		}
+	}
+	writeJSON(w, struct{}{})
+}
+
+func (srv *fakeFirestore) runQuery(w http.ResponseWriter, root string, body json.RawMessage) {
+	type fieldReference struct {
+		FieldPath string `json:"fieldPath"`
+	}
+	var r struct {
+		StructuredQuery struct {
+			Select struct {
+				Fields []fieldReference `json:"fields"`
+			} `json:"select"`
+			From []struct {
+				CollectionID string `json:"collectionId"`
+			} `json:"from"`
+			Where struct {
+				FieldFilter struct {
+					Field fieldReference `json:"field"`
+					Op    string         `json:"op"`
+					Value fsValue        `json:"value"`
+				} `json:"fieldFilter"`
+			} `json:"where"`
+			OrderBy []struct {
+				Field     fieldReference `json:"field"`
+				Direction string         `json:"direction"`
+			} `json:"orderBy"`
+			StartAt *struct {
+				Values []fsValue `json:"values"`
+				Before bool      `json:"before"`
+			} `json:"startAt"`
+			Limit int `json:"limit"`
+		} `json:"structuredQuery"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
+		return
+	}
+	q := r.StructuredQuery
+	// Only the queries made by firestoresimplekv are supported.
+	if len(q.From) != 1 ||
+		q.Where.FieldFilter.Field.FieldPath != "key" ||
+		q.Where.FieldFilter.Op != "GREATER_THAN_OR_EQUAL" ||
+		len(q.OrderBy) != 1 ||
+		q.OrderBy[0].Field.FieldPath != "key" ||
+		q.OrderBy[0].Direction != "ASCENDING" ||
+		q.StartAt != nil && (q.StartAt.Before || len(q.StartAt.Values) != 1) {
+		writeError(w, http.StatusNotImplemented, "UNIMPLEMENTED", "unsupported query")
+		return
+	}
+	var paths []string
+	for _, f := range q.Select.Fields {
+		paths = append(paths, f.FieldPath)
+	}
+	type result struct {
+		Document *fsDocument `json:"document,omitempty"`
+		ReadTime string      `json:"readTime"`
+	}
+	prefix := root + "/" + q.From[0].CollectionID + "/"
+	var results []result
+	for name, doc := range srv.docs {
+		if !strings.HasPrefix(name, prefix) || strings.Contains(name[len(prefix):], "/") {
+			continue
+		}
+		key := doc.fields["key"].StringValue
+		if key == nil || *key < *q.Where.FieldFilter.Value.StringValue {
+			continue
+		}
+		if q.StartAt != nil && *key <= *q.StartAt.Values[0].StringValue {
+			continue
+		}
+		results = append(results, result{
+			Document: &fsDocument{
+				Name:   name,
+				Fields: selectFields(doc.fields, paths),
+			},
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return *results[i].Document.Fields["key"].StringValue < *results[j].Document.Fields["key"].StringValue
+	})
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	if len(results) == 0 {
+		// Firestore returns a single result without a document
+		// when there are no matches.
+		results = []result{{}}
+	}
+	for i := range results {
+		results[i].ReadTime = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	writeJSON(w, results)
+}
+
+func selectFields(fields map[string]fsValue, paths []string) map[string]fsValue {
+	if len(paths) == 0 {
+		return fields
+	}
+	selected := make(map[string]fsValue)
+	for _, path := range paths {
+		if v, ok := fields[path]; ok {
+			selected[path] = v
+		}
+	}
+	return selected
+}
+
+func writeError(w http.ResponseWriter, code int, status, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  status,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,463 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package followersimplekv provides a simplekv.Store that keeps a local
+// copy of a remote store and serves reads from it, so that, for
+// example, edge nodes can read centrally managed data quickly.
+//
+// The local copy is kept up to date by periodically copying the whole
+// of the remote store into the local store. Reads are served from the
+// local store as long as the last successful sync started less than a
+// given time ago; otherwise they go to the remote store, so the
+// staleness of reads is bounded.
+//
+// Writes go to the remote store and, once they have succeeded, are
+// also applied to the local store, so a follower sees its own writes
+// immediately. Writes made through other stores are seen after the
+// next sync.
+package followersimplekv
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/kvmaint"
+)
+
+const (
+	// DefaultSyncInterval holds the default interval between
+	// syncs.
+	DefaultSyncInterval = time.Minute
+
+	// DefaultMaxStaleness holds the default maximum age of the
+	// last sync for reads to be served from the local store.
+	DefaultMaxStaleness = 5 * time.Minute
+)
+
+// Store is the store returned by NewStore.
+type Store interface {
+	simplekv.KeyLister
+
+	// Sync copies the contents of the remote store to the local
+	// store. Syncs do not run concurrently; if a sync is already in
+	// progress, Sync waits for it to finish and then starts
+	// another.
+	Sync(ctx context.Context) error
+
+	// LastSync returns the time at which the last successful sync
+	// started, or the zero time if no sync has succeeded.
+	LastSync() time.Time
+
+	// Close implements simplekv.Closer.Close by stopping the
+	// background syncs. The remote and local stores are not
+	// closed.
+	Close() error
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithSyncInterval returns an option that sets the interval between
+// syncs. If the interval is zero, the store never syncs by itself and
+// Sync must be called explicitly. By default DefaultSyncInterval is
+// used.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(s *kvStore) {
+		s.syncInterval = interval
+	}
+}
+
+// WithMaxStaleness returns an option that sets the maximum age of the
+// last successful sync for reads to be served from the local store. By
+// default DefaultMaxStaleness is used.
+func WithMaxStaleness(d time.Duration) Option {
+	return func(s *kvStore) {
+		s.maxStaleness = d
+	}
+}
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages to the given logger, including failed syncs and failures
+// to apply writes to the local store.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// WithClock returns an option that makes the store use the given
+// clock to decide whether the local store is fresh enough to read
+// from. By default the system clock is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// WithMaintenanceWindow returns an option that restricts the
+// background syncs to the times when the given window is open and not
+// paused. A background sync in progress when the window closes or is
+// paused is abandoned. Calls to Sync are not affected. While no syncs
+// run, reads go to the remote store once the last sync is older than
+// the maximum staleness. By default background syncs run at any time.
+func WithMaintenanceWindow(w *kvmaint.Window) Option {
+	return func(s *kvStore) {
+		s.window = w
+	}
+}
+
+// NewStore returns a store that follows remote, keeping a copy of its
+// contents in local as described in the package documentation. The
+// local store should be empty or hold a copy made by an earlier
+// follower, and must not be written to by anything else.
+//
+// Syncs copy values but not expiry times, which cannot be read from a
+// store: an entry that expires in the remote store is removed from
+// the local store by the next sync.
+//
+// Update is applied to the local store with the value returned by
+// the last call to its getVal function. If a write succeeds in the
+// remote store but fails in the local store, the failure is logged
+// and the local store is corrected by the next sync.
+//
+// Unless the sync interval is zero, the first sync starts
+// immediately in the background. The returned store must be closed
+// when it is no longer needed.
+func NewStore(remote, local simplekv.KeyLister, opts ...Option) Store {
+	s := &kvStore{
+		remote:       remote,
+		local:        local,
+		syncInterval: DefaultSyncInterval,
+		maxStaleness: DefaultMaxStaleness,
+		logger:       nopLogger{},
+		clock:        systemClock{},
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.syncInterval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+	return s
+}
+
+type kvStore struct {
+	remote       simplekv.KeyLister
+	local        simplekv.KeyLister
+	syncInterval time.Duration
+	maxStaleness time.Duration
+	logger       simplekv.Logger
+	clock        simplekv.Clock
+	window       *kvmaint.Window
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// syncMu is held while a sync is in progress.
+	syncMu sync.Mutex
+
+	// mu guards the fields below it. It is also held while the
+	// local store is written, so that a sync cannot overwrite a
+	// newer value written by the follower itself.
+	mu sync.Mutex
+
+	// lastSync holds the time at which the last successful sync
+	// started.
+	lastSync time.Time
+
+	// written holds the keys written by the follower since the
+	// current sync started, or nil if no sync is in progress. The
+	// sync leaves those keys alone.
+	written map[string]bool
+}
+
+// run syncs the store at the sync interval until the store is closed.
+func (s *kvStore) run() {
+	defer close(s.done)
+	t := time.NewTicker(s.syncInterval)
+	defer t.Stop()
+	for {
+		err := s.window.Run(context.Background(), s.Sync)
+		if errgo.Cause(err) == kvmaint.ErrClosed {
+			s.logger.Debugf("not syncing outside maintenance window")
+		} else if err != nil {
+			s.logger.Debugf("cannot sync: %v", err)
+		}
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Sync implements Store.Sync.
+func (s *kvStore) Sync(ctx context.Context) error {
+	if err := s.checkClosed(); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	start := s.clock.Now()
+	s.mu.Lock()
+	s.written = make(map[string]bool)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.written = nil
+		s.mu.Unlock()
+	}()
+
+	entries, err := simplekv.Snapshot(ctx, s.remote)
+	if err != nil {
+		return errgo.Notef(err, "cannot read remote store")
+	}
+	keys, err := s.local.Keys(ctx)
+	if err != nil {
+		return errgo.Notef(err, "cannot list local keys")
+	}
+	for _, key := range keys {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+		err := s.applyLocal(key, true, func() error {
+			return s.local.Delete(ctx, key)
+		})
+		if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+			return errgo.Notef(err, "cannot delete local key %s", key)
+		}
+	}
+	for key, v := range entries {
+		err := s.applyLocal(key, true, func() error {
+			old, err := s.local.Get(ctx, key)
+			if err == nil && bytes.Equal(old, v) {
+				return nil
+			}
+			if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+				return errgo.Mask(err)
+			}
+			return errgo.Mask(s.local.Set(ctx, key, v, time.Time{}))
+		})
+		if err != nil {
+			return errgo.Notef(err, "cannot set local key %s", key)
+		}
+	}
+	s.mu.Lock()
+	s.lastSync = start
+	s.mu.Unlock()
+	return nil
+}
+
+// LastSync implements Store.LastSync.
+func (s *kvStore) LastSync() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSync
+}
+
+// applyLocal calls f, which writes the given key to the local store,
+// with s.mu held. If bySync is true, f is called only if the key has
+// not been written by the follower since the current sync started;
+// otherwise the key is recorded as written.
+func (s *kvStore) applyLocal(key string, bySync bool, f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bySync {
+		if s.written[key] {
+			return nil
+		}
+	} else if s.written != nil {
+		s.written[key] = true
+	}
+	return errgo.Mask(f(), errgo.Any)
+}
+
+// writeLocal applies a write that has succeeded in the remote store
+// to the local store. Failures are logged rather than returned,
+// because the next sync corrects the local store.
+func (s *kvStore) writeLocal(key string, f func() error) {
+	err := s.applyLocal(key, false, f)
+	if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		s.logger.Debugf("cannot apply write to local key %s: %v", key, err)
+	}
+}
+
+// reader returns the store that reads should be served from.
+func (s *kvStore) reader() simplekv.KeyLister {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lastSync.IsZero() && s.clock.Now().Sub(s.lastSync) <= s.maxStaleness {
+		return s.local
+	}
+	return s.remote
+}
+
+// Context implements simplekv.Store.Context by returning a context
+// suitable for both the remote and the local store.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	ctx, closeRemote := s.remote.Context(ctx)
+	ctx, closeLocal := s.local.Context(ctx)
+	return ctx, func() {
+		closeLocal()
+		closeRemote()
+	}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	v, err := s.reader().Get(ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := s.checkClosed(); err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	ok, err := s.reader().Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	keys, err := s.reader().Keys(ctx)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	keys, err := s.reader().KeysWithPrefix(ctx, prefix)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := s.checkClosed(); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	if err := s.remote.Set(ctx, key, value, expire); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.writeLocal(key, func() error {
+		return s.local.Set(ctx, key, value, expire)
+	})
+	return nil
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := s.checkClosed(); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	var value []byte
+	err := s.remote.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		v, err := getVal(old)
+		value = v
+		return v, err
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.writeLocal(key, func() error {
+		return s.local.Set(ctx, key, value, expire)
+	})
+	return nil
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := s.checkClosed(); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	if err := s.remote.Touch(ctx, key, expire); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.writeLocal(key, func() error {
+		return s.local.Touch(ctx, key, expire)
+	})
+	return nil
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := s.checkClosed(); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	if err := s.remote.Delete(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	s.writeLocal(key, func() error {
+		return s.local.Delete(ctx, key)
+	})
+	return nil
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen by returning the
+// smaller of the limits of the two stores.
+func (s *kvStore) MaxKeyLen() int {
+	n := simplekv.KeyLimit(s.remote)
+	if m := simplekv.KeyLimit(s.local); m < n {
+		n = m
+	}
+	return n
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the smaller of the limits of the two stores, ignoring
+// stores that do not advertise a limit.
+func (s *kvStore) MaxValueLen() int {
+	n := simplekv.MaxValueLen(s.remote)
+	if m := simplekv.MaxValueLen(s.local); m != 0 && (n == 0 || m < n) {
+		n = m
+	}
+	return n
+}
+
+// Close implements simplekv.Closer.Close by stopping the background
+// syncs.
+func (s *kvStore) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return nil
+}
+
+// checkClosed returns an error with a cause of simplekv.ErrStoreClosed
+// if the store has been closed.
+func (s *kvStore) checkClosed() error {
+	select {
+	case <-s.stop:
+		return errgo.WithCausef(nil, simplekv.ErrStoreClosed, "")
+	default:
+		return nil
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
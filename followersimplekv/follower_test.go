@@ -0,0 +1,218 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package followersimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/followersimplekv"
+	"github.com/juju/simplekv/kvmaint"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestFollowerStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		// Sync often, so that the tests exercise syncs running
+		// concurrently with writes.
+		return followersimplekv.NewStore(
+			memsimplekv.NewStore().(simplekv.KeyLister),
+			memsimplekv.NewStore().(simplekv.KeyLister),
+			followersimplekv.WithSyncInterval(time.Millisecond),
+		), nil
+	})
+}
+
+func TestReadsServedLocally(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	remote := memsimplekv.NewStore().(simplekv.KeyLister)
+	local := memsimplekv.NewStore().(simplekv.KeyLister)
+	kv := followersimplekv.NewStore(remote, local,
+		followersimplekv.WithSyncInterval(0),
+		followersimplekv.WithMaxStaleness(time.Minute),
+		followersimplekv.WithClock(clock),
+	)
+	defer kv.Close()
+
+	err := remote.Set(ctx, "a", []byte("a1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = remote.Set(ctx, "b", []byte("b1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// Before the first sync, reads go to the remote store.
+	c.Assert(kv.LastSync().IsZero(), qt.Equals, true)
+	v, err := kv.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a1")
+
+	err = kv.Sync(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(kv.LastSync(), qt.DeepEquals, clock.now)
+	snap, err := simplekv.Snapshot(ctx, local)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{
+		"a": []byte("a1"),
+		"b": []byte("b1"),
+	})
+
+	// Changes made directly to the remote store are not seen until
+	// the next sync.
+	err = remote.Set(ctx, "a", []byte("a2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = remote.Delete(ctx, "b")
+	c.Assert(err, qt.Equals, nil)
+	v, err = kv.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a1")
+	keys, err := kv.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 2)
+
+	// Writes made through the follower are seen immediately.
+	err = kv.Set(ctx, "c", []byte("c1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err = kv.Get(ctx, "c")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "c1")
+
+	// Once the last sync is too old, reads go to the remote store.
+	clock.now = clock.now.Add(2 * time.Minute)
+	v, err = kv.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a2")
+
+	err = kv.Sync(ctx)
+	c.Assert(err, qt.Equals, nil)
+	snap, err = simplekv.Snapshot(ctx, local)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{
+		"a": []byte("a2"),
+		"c": []byte("c1"),
+	})
+	_, err = kv.Get(ctx, "b")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func TestWritesAppliedLocally(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	remote := memsimplekv.NewStore().(simplekv.KeyLister)
+	local := memsimplekv.NewStore().(simplekv.KeyLister)
+	kv := followersimplekv.NewStore(remote, local, followersimplekv.WithSyncInterval(0))
+	defer kv.Close()
+
+	err := kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		return []byte("v1"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	v, err := local.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "v1")
+
+	// A failed update is not applied.
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		return nil, errgo.New("failed")
+	})
+	c.Assert(err, qt.ErrorMatches, "failed")
+	v, err = local.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "v1")
+
+	err = kv.Delete(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	_, err = local.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// Entries that have not reached the local store yet are
+	// written to the remote store as usual.
+	err = remote.Set(ctx, "other", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Touch(ctx, "other", time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Delete(ctx, "other")
+	c.Assert(err, qt.Equals, nil)
+	ok, err := remote.Exists(ctx, "other")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+}
+
+func TestBackgroundSync(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	remote := memsimplekv.NewStore().(simplekv.KeyLister)
+	local := memsimplekv.NewStore().(simplekv.KeyLister)
+	err := remote.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	kv := followersimplekv.NewStore(remote, local, followersimplekv.WithSyncInterval(time.Millisecond))
+	for a := 0; kv.LastSync().IsZero(); a++ {
+		if a > 5000 {
+			c.Fatalf("store not synced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	v, err := local.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "v")
+
+	// Closing the store stops the syncs but leaves both stores
+	// open.
+	err = kv.Close()
+	c.Assert(err, qt.Equals, nil)
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrStoreClosed)
+	err = kv.Sync(ctx)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrStoreClosed)
+	_, err = remote.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	_, err = local.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	remote := memsimplekv.NewStore().(simplekv.KeyLister)
+	local := memsimplekv.NewStore().(simplekv.KeyLister)
+	err := remote.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	window, err := kvmaint.NewWindow("* * * * *", time.Hour)
+	c.Assert(err, qt.Equals, nil)
+
+	// While the window is paused, no background syncs run.
+	window.Pause()
+	kv := followersimplekv.NewStore(remote, local,
+		followersimplekv.WithSyncInterval(time.Millisecond),
+		followersimplekv.WithMaintenanceWindow(window),
+	)
+	defer kv.Close()
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(kv.LastSync().IsZero(), qt.Equals, true)
+
+	window.Resume()
+	for a := 0; kv.LastSync().IsZero(); a++ {
+		if a > 5000 {
+			c.Fatalf("store not synced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	v, err := local.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "v")
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
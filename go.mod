@@ -1,22 +1,8 @@
 module github.com/juju/simplekv
 
-go 1.12
+go 1.13
 
 require (
 	github.com/frankban/quicktest v1.14.0
-	github.com/juju/clock v0.0.0-20190205081909-9c5c9712527c // indirect
-	github.com/juju/errors v0.0.0-20190207033735-e65537c515d7 // indirect
-	github.com/juju/loggo v0.0.0-20190212223446-d976af380377 // indirect
-	github.com/juju/mgo/v2 v2.0.0-20210302023703-70d5d206e208
-	github.com/juju/mgotest v1.0.2
-	github.com/juju/postgrestest v1.1.1
-	github.com/juju/retry v0.0.0-20180821225755-9058e192b216 // indirect
-	github.com/juju/testing v0.0.0-20180920084828-472a3e8b2073 // indirect
-	github.com/juju/utils v0.0.0-20180820210520-bf9cc5bdd62d
-	github.com/juju/version v0.0.0-20180108022336-b64dbd566305 // indirect
-	github.com/lib/pq v1.10.3
-	golang.org/x/crypto v0.0.0-20190313024323-a1f597ede03a // indirect
 	gopkg.in/errgo.v1 v1.0.1
-	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce // indirect
-	gopkg.in/retry.v1 v1.0.3
 )
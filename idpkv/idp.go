@@ -0,0 +1,162 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package idpkv provides the storage used by identity services such as
+// candid on top of a simplekv.Store: a private namespace of data for
+// each identity provider, and short-lived discharge tokens.
+package idpkv
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/namespacesimplekv"
+	"github.com/juju/simplekv/ttlsimplekv"
+)
+
+const (
+	// DefaultTokenTTL holds the default time for which a discharge
+	// token is kept.
+	DefaultTokenTTL = 10 * time.Minute
+
+	providerPrefix = "idp/"
+	tokenPrefix    = "discharge-token/"
+)
+
+// Option represents an option that can be passed to New.
+type Option func(*Store)
+
+// WithTokenTTL returns an option that makes discharge tokens expire
+// after the given duration. By default DefaultTokenTTL is used.
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(s *Store) {
+		s.tokenTTL = ttl
+	}
+}
+
+// WithProviderDataTTL returns an option that makes provider data
+// written without an expiry time expire after the given duration. By
+// default such data never expires.
+func WithProviderDataTTL(ttl time.Duration) Option {
+	return func(s *Store) {
+		s.dataTTL = ttl
+	}
+}
+
+// Store holds the data of an identity service.
+type Store struct {
+	kv       simplekv.Store
+	tokenTTL time.Duration
+	dataTTL  time.Duration
+}
+
+// DischargeToken holds a token that can be used to complete a
+// discharge, as returned by an identity provider's login flow.
+type DischargeToken struct {
+	// Kind holds the kind of the token.
+	Kind string `json:"kind"`
+
+	// Value holds the token itself.
+	Value []byte `json:"value"`
+}
+
+// New returns a Store that holds its data in kv. Entries are held
+// under the "idp/" and "discharge-token/" prefixes, so kv may be
+// shared with other data that does not use those prefixes.
+func New(kv simplekv.Store, opts ...Option) *Store {
+	s := &Store{
+		kv:       kv,
+		tokenTTL: DefaultTokenTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// checkName checks that name can be used as the name of an identity
+// provider.
+func checkName(name string) error {
+	err := simplekv.ValidateKey(name, simplekv.KeyRules{
+		Allowed: func(r rune) bool {
+			return r != '/'
+		},
+	})
+	if err != nil {
+		return errgo.NoteMask(err, "invalid identity provider name", errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return nil
+}
+
+// ProviderStore returns a store holding the data of the identity
+// provider with the given name, which must not be empty or contain
+// a "/". Each provider's store is separate from every other
+// provider's.
+func (s *Store) ProviderStore(name string) (simplekv.Store, error) {
+	if err := checkName(name); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	kv := namespacesimplekv.NewStore(s.kv, providerPrefix+name+"/")
+	if s.dataTTL > 0 {
+		kv = ttlsimplekv.NewStore(kv, s.dataTTL)
+	}
+	return kv, nil
+}
+
+// ProviderTypedStore is like ProviderStore except that it returns a
+// store that holds values encoded as JSON.
+func (s *Store) ProviderTypedStore(name string) (*simplekv.TypedStore, error) {
+	kv, err := s.ProviderStore(name)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return simplekv.NewTypedStore(kv, simplekv.JSONCodec), nil
+}
+
+// PutDischargeToken stores the given token with the given id for the
+// store's token TTL. If a token with that id is already stored, an
+// error with a cause of simplekv.ErrDuplicateKey is returned.
+func (s *Store) PutDischargeToken(ctx context.Context, id string, tok DischargeToken) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = simplekv.UpdateTTL(ctx, s.kv, tokenPrefix+id, s.tokenTTL, func(old []byte) ([]byte, error) {
+		if old != nil {
+			return nil, errgo.WithCausef(nil, simplekv.ErrDuplicateKey, "discharge token %q already exists", id)
+		}
+		return data, nil
+	})
+	return errgo.Mask(err, errgo.Is(simplekv.ErrDuplicateKey), errgo.Is(simplekv.ErrKeyTooLarge))
+}
+
+// DischargeToken returns the token stored with the given id. If there
+// is no such token, or it has expired, an error with a cause of
+// simplekv.ErrNotFound is returned.
+func (s *Store) DischargeToken(ctx context.Context, id string) (*DischargeToken, error) {
+	data, err := s.kv.Get(ctx, tokenPrefix+id)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "discharge token %q not found", id)
+	}
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	var tok DischargeToken
+	if err := json.Unmarshal(data, &tok); err != nil {
+		return nil, errgo.Notef(err, "cannot decode discharge token %q", id)
+	}
+	return &tok, nil
+}
+
+// DeleteDischargeToken removes the token stored with the given id. It
+// is not an error if there is no such token.
+func (s *Store) DeleteDischargeToken(ctx context.Context, id string) error {
+	err := s.kv.Delete(ctx, tokenPrefix+id)
+	if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package idpkv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/idpkv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestProviderStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	s := idpkv.New(kv)
+
+	a, err := s.ProviderStore("a")
+	c.Assert(err, qt.Equals, nil)
+	b, err := s.ProviderStore("b")
+	c.Assert(err, qt.Equals, nil)
+
+	err = a.Set(ctx, "k", []byte("a-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, err = b.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// The data is held in the underlying store under the
+	// provider's prefix.
+	v, err := kv.Get(ctx, "idp/a/k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a-value")
+
+	for _, name := range []string{"", "a/b"} {
+		_, err := s.ProviderStore(name)
+		c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey, qt.Commentf("name %q", name))
+	}
+}
+
+func TestProviderTypedStore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := idpkv.New(memsimplekv.NewStore())
+
+	type user struct {
+		Name   string
+		Groups []string
+	}
+	ts, err := s.ProviderTypedStore("idp")
+	c.Assert(err, qt.Equals, nil)
+	err = ts.Set(ctx, "bob", user{Name: "bob", Groups: []string{"g1"}}, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	var u user
+	err = ts.Get(ctx, "bob", &u)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(u, qt.DeepEquals, user{Name: "bob", Groups: []string{"g1"}})
+}
+
+func TestProviderDataTTL(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := idpkv.New(memsimplekv.NewStore(memsimplekv.WithClock(clock)), idpkv.WithProviderDataTTL(time.Hour))
+
+	kv, err := s.ProviderStore("idp")
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	clock.now = clock.now.Add(2 * time.Hour)
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func TestDischargeTokens(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := idpkv.New(memsimplekv.NewStore(memsimplekv.WithClock(clock)), idpkv.WithTokenTTL(time.Minute))
+
+	_, err := s.DischargeToken(ctx, "id1")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `discharge token "id1" not found`)
+
+	tok := idpkv.DischargeToken{
+		Kind:  "test",
+		Value: []byte("token"),
+	}
+	err = s.PutDischargeToken(ctx, "id1", tok)
+	c.Assert(err, qt.Equals, nil)
+	err = s.PutDischargeToken(ctx, "id1", tok)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrDuplicateKey)
+
+	got, err := s.DischargeToken(ctx, "id1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(*got, qt.DeepEquals, tok)
+
+	err = s.DeleteDischargeToken(ctx, "id1")
+	c.Assert(err, qt.Equals, nil)
+	err = s.DeleteDischargeToken(ctx, "id1")
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.DischargeToken(ctx, "id1")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// Tokens expire after the token TTL.
+	err = s.PutDischargeToken(ctx, "id2", tok)
+	c.Assert(err, qt.Equals, nil)
+	clock.now = clock.now.Add(2 * time.Minute)
+	_, err = s.DischargeToken(ctx, "id2")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
@@ -0,0 +1,390 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package indexkv maintains a secondary index over entries in a
+// simplekv.Store, mapping index values (for example email addresses)
+// to the keys of the entries that hold them (for example user ids).
+//
+// A store cannot update several keys atomically, so the index is
+// maintained on a best-effort basis and checked when it is read:
+// Lookup only returns an entry whose current value still produces the
+// index value being looked up. Each write records a journal entry
+// before changing anything and removes it when the index has been
+// updated, so that Repair can restore index entries lost when a
+// writer stops part way through.
+//
+// The index uses keys starting with the index name followed by a
+// slash, which must not be used for other entries in the store.
+package indexkv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// IndexFunc returns the index values for an entry with the given key
+// and value. Each index value should be held by only one entry at a
+// time; if several entries hold the same index value, Lookup returns
+// the one that was written most recently.
+type IndexFunc func(key string, value []byte) []string
+
+// Index maintains a secondary index over entries in a store.
+type Index struct {
+	kv            simplekv.Store
+	indexPrefix   string
+	journalPrefix string
+	indexFunc     IndexFunc
+}
+
+// New returns an Index with the given name that indexes entries in kv
+// using the given function. All changes to the indexed entries must
+// be made through the returned Index.
+func New(kv simplekv.Store, name string, f IndexFunc) *Index {
+	return &Index{
+		kv:            kv,
+		indexPrefix:   name + "/i/",
+		journalPrefix: name + "/j/",
+		indexFunc:     f,
+	}
+}
+
+// Set sets the entry with the given key and updates the index to
+// match.
+func (ix *Index) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	journal, err := ix.writeJournal(ctx, key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var old []byte
+	err = ix.kv.Update(ctx, key, expire, func(v []byte) ([]byte, error) {
+		old = v
+		return value, nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	newValues := ix.indexFunc(key, value)
+	for _, v := range newValues {
+		if err := ix.kv.Set(ctx, ix.indexPrefix+v, []byte(key), expire); err != nil {
+			return errgo.Notef(err, "cannot set index entry for %q", v)
+		}
+	}
+	if old != nil {
+		for _, v := range difference(ix.indexFunc(key, old), newValues) {
+			if err := ix.deleteIndexEntry(ctx, v, key); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	return errgo.Mask(ix.kv.Delete(ctx, journal))
+}
+
+// SetUnique is like Set except that it fails with an error with a
+// cause of simplekv.ErrDuplicateKey if another entry already holds any
+// of the index values of the new value. In that case the entry is
+// restored to its previous value and any index values claimed for it
+// are released. The previous expiry time of the entry is not known, so
+// a restored entry does not expire.
+func (ix *Index) SetUnique(ctx context.Context, key string, value []byte, expire time.Time) error {
+	journal, err := ix.writeJournal(ctx, key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var old []byte
+	err = ix.kv.Update(ctx, key, expire, func(v []byte) ([]byte, error) {
+		old = v
+		return value, nil
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var oldValues []string
+	if old != nil {
+		oldValues = ix.indexFunc(key, old)
+	}
+	newValues := ix.indexFunc(key, value)
+	for i, v := range newValues {
+		err := ix.reserve(ctx, v, key, expire)
+		if err == nil {
+			continue
+		}
+		// Roll back the entry, then release the index values
+		// claimed so far that the old entry did not hold.
+		if err := ix.rollback(ctx, key, value, old); err != nil {
+			return errgo.Notef(err, "cannot roll back after failing to reserve %q", v)
+		}
+		for _, claimed := range difference(newValues[:i], oldValues) {
+			if err := ix.deleteIndexEntry(ctx, claimed, key); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		if err := ix.kv.Delete(ctx, journal); err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(err, errgo.Is(simplekv.ErrDuplicateKey), simplekv.IsContention)
+	}
+	for _, v := range difference(oldValues, newValues) {
+		if err := ix.deleteIndexEntry(ctx, v, key); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(ix.kv.Delete(ctx, journal))
+}
+
+// ReserveUnique claims the given index value for the entry with the
+// given key, whose value must already produce it. If another entry
+// whose current value produces the index value holds the claim, it
+// returns an error with a cause of simplekv.ErrDuplicateKey. Claims
+// held by entries that no longer produce the index value are taken
+// over.
+//
+// Most callers should use SetUnique, which writes the entry and claims
+// all its index values, rolling back on failure.
+func (ix *Index) ReserveUnique(ctx context.Context, indexValue, ownerKey string) error {
+	return errgo.Mask(ix.reserve(ctx, indexValue, ownerKey, time.Time{}), errgo.Is(simplekv.ErrDuplicateKey), simplekv.IsContention)
+}
+
+// maxAttempts holds the number of times reserve tries to claim an
+// index value when other claims are made concurrently.
+const maxAttempts = 10
+
+// retryAfter holds the delay suggested to callers when reserve fails
+// after maxAttempts attempts.
+const retryAfter = 100 * time.Millisecond
+
+// reserve implements ReserveUnique, giving the index entry the given
+// expiry time.
+func (ix *Index) reserve(ctx context.Context, indexValue, ownerKey string, expire time.Time) error {
+	entry := ix.indexPrefix + indexValue
+	var holder []byte
+	for i := 0; i < maxAttempts; i++ {
+		err := simplekv.SetIfEquals(ctx, ix.kv, entry, holder, []byte(ownerKey), expire)
+		if err == nil {
+			return nil
+		}
+		if errgo.Cause(err) != simplekv.ErrConflict {
+			return errgo.Mask(err)
+		}
+		holder, err = ix.kv.Get(ctx, entry)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			holder = nil
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if string(holder) == ownerKey {
+			// Make sure the index entry has the right expiry time.
+			return errgo.Mask(ix.kv.Set(ctx, entry, holder, expire))
+		}
+		holds, err := ix.holds(ctx, string(holder), indexValue)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if holds {
+			return errgo.WithCausef(nil, simplekv.ErrDuplicateKey, "index value %s is already taken", indexValue)
+		}
+		// The claim is stale, so try to take it over from holder.
+	}
+	return simplekv.NewContentionError(retryAfter, "cannot reserve %s: too many concurrent modifications", indexValue)
+}
+
+// holds reports whether the entry with the given key currently
+// produces the given index value.
+func (ix *Index) holds(ctx context.Context, key, indexValue string) (bool, error) {
+	value, err := ix.kv.Get(ctx, key)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return contains(ix.indexFunc(key, value), indexValue), nil
+}
+
+// rollback restores the entry with the given key from value to old,
+// deleting it if old is nil. The entry is left alone if it has been
+// changed since it was set to value.
+func (ix *Index) rollback(ctx context.Context, key string, value, old []byte) error {
+	if old != nil {
+		err := simplekv.SetIfEquals(ctx, ix.kv, key, value, old, time.Time{})
+		if errgo.Cause(err) == simplekv.ErrConflict {
+			return nil
+		}
+		return errgo.Mask(err)
+	}
+	err := ix.kv.Delete(ctx, key)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil
+	}
+	return errgo.Mask(err)
+}
+
+// Delete deletes the entry with the given key and its index entries.
+// If there is no such entry, it returns an error with a cause of
+// simplekv.ErrNotFound.
+func (ix *Index) Delete(ctx context.Context, key string) error {
+	old, err := ix.kv.Get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	journal, err := ix.writeJournal(ctx, key)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := ix.kv.Delete(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for _, v := range ix.indexFunc(key, old) {
+		if err := ix.deleteIndexEntry(ctx, v, key); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return errgo.Mask(ix.kv.Delete(ctx, journal))
+}
+
+// Lookup returns the key and value of the entry that has the given
+// index value. If there is no such entry, it returns an error with a
+// cause of simplekv.ErrNotFound.
+func (ix *Index) Lookup(ctx context.Context, indexValue string) (key string, value []byte, err error) {
+	k, err := ix.kv.Get(ctx, ix.indexPrefix+indexValue)
+	if err != nil {
+		return "", nil, errgo.Mask(err, errgo.Any)
+	}
+	key = string(k)
+	value, err = ix.kv.Get(ctx, key)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return "", nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "index value %s not found", indexValue)
+	}
+	if err != nil {
+		return "", nil, errgo.Mask(err)
+	}
+	if !contains(ix.indexFunc(key, value), indexValue) {
+		// The index entry is out of date.
+		return "", nil, errgo.WithCausef(nil, simplekv.ErrNotFound, "index value %s not found", indexValue)
+	}
+	return key, value, nil
+}
+
+// Repair completes any changes to the index that were interrupted,
+// as recorded in the journal, and removes index entries that no longer
+// match their entries. The store must implement simplekv.KeyLister.
+//
+// Repair should be called when no other changes are being made
+// through the index, for example when a service starts.
+func (ix *Index) Repair(ctx context.Context) error {
+	kv, ok := ix.kv.(simplekv.KeyLister)
+	if !ok {
+		return errgo.Newf("store does not support listing keys")
+	}
+	journals, err := kv.KeysWithPrefix(ctx, ix.journalPrefix)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, journal := range journals {
+		k, err := kv.Get(ctx, journal)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		key := string(k)
+		value, err := kv.Get(ctx, key)
+		switch {
+		case errgo.Cause(err) == simplekv.ErrNotFound:
+		case err != nil:
+			return errgo.Mask(err)
+		default:
+			// The expiry time of the entry is not known, so the
+			// index entries do not expire; they are removed by
+			// a later Repair once the entry has gone.
+			for _, v := range ix.indexFunc(key, value) {
+				if err := kv.Set(ctx, ix.indexPrefix+v, []byte(key), time.Time{}); err != nil {
+					return errgo.Notef(err, "cannot set index entry for %q", v)
+				}
+			}
+		}
+		if err := kv.Delete(ctx, journal); err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+			return errgo.Mask(err)
+		}
+	}
+	entries, err := kv.KeysWithPrefix(ctx, ix.indexPrefix)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, entry := range entries {
+		indexValue := entry[len(ix.indexPrefix):]
+		_, _, err := ix.Lookup(ctx, indexValue)
+		if errgo.Cause(err) != simplekv.ErrNotFound {
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			continue
+		}
+		if err := kv.Delete(ctx, entry); err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// writeJournal records that the index entries for the given key are
+// about to change, and returns the key of the journal entry.
+func (ix *Index) writeJournal(ctx context.Context, key string) (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	journal := ix.journalPrefix + hex.EncodeToString(buf[:])
+	if err := ix.kv.Set(ctx, journal, []byte(key), time.Time{}); err != nil {
+		return "", errgo.Notef(err, "cannot write journal")
+	}
+	return journal, nil
+}
+
+// deleteIndexEntry deletes the index entry for the given index value
+// if it refers to the given key.
+func (ix *Index) deleteIndexEntry(ctx context.Context, indexValue, key string) error {
+	k, err := ix.kv.Get(ctx, ix.indexPrefix+indexValue)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if string(k) != key {
+		// Another entry has since taken the index value.
+		return nil
+	}
+	err = ix.kv.Delete(ctx, ix.indexPrefix+indexValue)
+	if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		return errgo.Notef(err, "cannot delete index entry for %q", indexValue)
+	}
+	return nil
+}
+
+// difference returns the elements of a that are not in b.
+func difference(a, b []string) []string {
+	var d []string
+	for _, s := range a {
+		if !contains(b, s) {
+			d = append(d, s)
+		}
+	}
+	return d
+}
+
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package indexkv_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/indexkv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+// emails indexes entries of the form "name,email,email...".
+func emails(key string, value []byte) []string {
+	return strings.Split(string(value), ",")[1:]
+}
+
+func TestSetAndLookup(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	ix := indexkv.New(kv, "email", emails)
+
+	err := ix.Set(ctx, "user/1", []byte("alice,a@example.com,alice@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = ix.Set(ctx, "user/2", []byte("bob,b@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	key, value, err := ix.Lookup(ctx, "alice@example.com")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.Equals, "user/1")
+	c.Assert(string(value), qt.Equals, "alice,a@example.com,alice@example.com")
+
+	// Changing the entry removes index values it no longer has.
+	err = ix.Set(ctx, "user/1", []byte("alice,alice@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, _, err = ix.Lookup(ctx, "a@example.com")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	_, err = kv.Get(ctx, "email/i/a@example.com")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = ix.Delete(ctx, "user/2")
+	c.Assert(err, qt.Equals, nil)
+	_, _, err = ix.Lookup(ctx, "b@example.com")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = ix.Delete(ctx, "user/2")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// No journal entries are left behind.
+	keys, err := kv.(simplekv.KeyLister).KeysWithPrefix(ctx, "email/j/")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 0)
+}
+
+func TestLookupIgnoresStaleEntries(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	ix := indexkv.New(kv, "email", emails)
+
+	err := ix.Set(ctx, "user/1", []byte("alice,a@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// Simulate a writer that changed the entry but stopped before
+	// updating the index.
+	err = kv.Set(ctx, "user/1", []byte("alice,alice@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "email/j/interrupted", []byte("user/1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	_, _, err = ix.Lookup(ctx, "a@example.com")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	_, _, err = ix.Lookup(ctx, "alice@example.com")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = ix.Repair(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	key, _, err := ix.Lookup(ctx, "alice@example.com")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.Equals, "user/1")
+	snap, err := simplekv.Snapshot(ctx, kv.(simplekv.KeyLister))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{
+		"user/1":                    []byte("alice,alice@example.com"),
+		"email/i/alice@example.com": []byte("user/1"),
+	})
+}
+
+func TestSetUnique(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	ix := indexkv.New(kv, "email", emails)
+
+	err := ix.SetUnique(ctx, "user/1", []byte("alice,a@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = ix.SetUnique(ctx, "user/2", []byte("bob,b@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// Taking another entry's index value fails and rolls back.
+	err = ix.SetUnique(ctx, "user/2", []byte("bob,bob@example.com,a@example.com"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrDuplicateKey)
+	c.Assert(err, qt.ErrorMatches, `index value a@example.com is already taken`)
+	err = ix.SetUnique(ctx, "user/3", []byte("carol,a@example.com"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrDuplicateKey)
+
+	snap, err := simplekv.Snapshot(ctx, kv.(simplekv.KeyLister))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{
+		"user/1":                []byte("alice,a@example.com"),
+		"user/2":                []byte("bob,b@example.com"),
+		"email/i/a@example.com": []byte("user/1"),
+		"email/i/b@example.com": []byte("user/2"),
+	})
+
+	// Once the value is released it can be taken.
+	err = ix.SetUnique(ctx, "user/1", []byte("alice,alice@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = ix.SetUnique(ctx, "user/2", []byte("bob,b@example.com,a@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	key, _, err := ix.Lookup(ctx, "a@example.com")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.Equals, "user/2")
+}
+
+func TestReserveUnique(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	ix := indexkv.New(kv, "email", emails)
+
+	err := kv.Set(ctx, "user/1", []byte("alice,a@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = ix.ReserveUnique(ctx, "a@example.com", "user/1")
+	c.Assert(err, qt.Equals, nil)
+
+	// Reserving again for the same owner succeeds.
+	err = ix.ReserveUnique(ctx, "a@example.com", "user/1")
+	c.Assert(err, qt.Equals, nil)
+
+	err = kv.Set(ctx, "user/2", []byte("bob,a@example.com"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = ix.ReserveUnique(ctx, "a@example.com", "user/2")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrDuplicateKey)
+
+	// A stale claim is taken over.
+	err = kv.Set(ctx, "user/1", []byte("alice"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = ix.ReserveUnique(ctx, "a@example.com", "user/2")
+	c.Assert(err, qt.Equals, nil)
+	key, _, err := ix.Lookup(ctx, "a@example.com")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(key, qt.Equals, "user/2")
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package envelope provides a common encoding for backends that have
+// no native support for expiry or metadata. The expiry time and
+// metadata are recorded alongside the value in an envelope, and a
+// Reaper removes expired entries in the background.
+package envelope
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+const (
+	version1 = 1
+
+	// flagExpire is set when the envelope holds an expiry time.
+	flagExpire = 1 << 0
+
+	// flagMetadata is set when the envelope holds metadata, which
+	// follows the expiry time as a count of items followed by each
+	// key and value in key order, all prefixed by their lengths as
+	// uvarints.
+	flagMetadata = 1 << 1
+
+	headerLen = 2
+	expireLen = 12
+)
+
+// PrefixLen holds the maximum length of the part of an envelope that
+// precedes the metadata and value. DecodeExpiry needs no more than
+// this many bytes of an envelope.
+const PrefixLen = headerLen + expireLen
+
+// Encode returns the envelope for the given value and expiry time.
+// A zero expiry time means that the value never expires.
+func Encode(value []byte, expire time.Time) []byte {
+	return EncodeWithMetadata(value, expire, nil)
+}
+
+// EncodeWithMetadata is like Encode except that the envelope also
+// holds the given metadata, if it is not empty.
+func EncodeWithMetadata(value []byte, expire time.Time, md map[string]string) []byte {
+	n := headerLen + len(value)
+	if !expire.IsZero() {
+		n += expireLen
+	}
+	keys := make([]string, 0, len(md))
+	for k, v := range md {
+		keys = append(keys, k)
+		n += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+	data := make([]byte, headerLen, n)
+	data[0] = version1
+	if !expire.IsZero() {
+		data[1] |= flagExpire
+		var buf [expireLen]byte
+		binary.BigEndian.PutUint64(buf[0:8], uint64(expire.Unix()))
+		binary.BigEndian.PutUint32(buf[8:12], uint32(expire.Nanosecond()))
+		data = append(data, buf[:]...)
+	}
+	if len(md) > 0 {
+		data[1] |= flagMetadata
+		data = appendUvarint(data, uint64(len(keys)))
+		for _, k := range keys {
+			data = appendString(data, k)
+			data = appendString(data, md[k])
+		}
+	}
+	return append(data, value...)
+}
+
+// Decode decodes an envelope produced by Encode. The returned value
+// refers to the same underlying memory as data. A value stored as
+// nil is returned as an empty, non-nil slice. Any metadata in the
+// envelope is ignored.
+func Decode(data []byte) (value []byte, expire time.Time, err error) {
+	value, expire, _, err = DecodeWithMetadata(data)
+	return value, expire, err
+}
+
+// DecodeWithMetadata is like Decode except that it also returns the
+// metadata held in the envelope, or nil if there is none.
+func DecodeWithMetadata(data []byte) (value []byte, expire time.Time, md map[string]string, err error) {
+	flags, expire, data, err := decodePrefix(data)
+	if err != nil {
+		return nil, time.Time{}, nil, errgo.Mask(err)
+	}
+	if flags&flagMetadata != 0 {
+		md, data, err = decodeMetadata(data)
+		if err != nil {
+			return nil, time.Time{}, nil, errgo.Mask(err)
+		}
+	}
+	return data[:len(data):len(data)], expire, md, nil
+}
+
+// DecodeExpiry returns the expiry time held in an envelope produced by
+// Encode or EncodeWithMetadata. Only the first PrefixLen bytes of the
+// envelope are needed, so data may be truncated after that.
+func DecodeExpiry(data []byte) (time.Time, error) {
+	_, expire, _, err := decodePrefix(data)
+	return expire, errgo.Mask(err)
+}
+
+// decodePrefix decodes the header and expiry time at the start of an
+// envelope and returns the flags and expiry time along with the rest
+// of data.
+func decodePrefix(data []byte) (flags byte, expire time.Time, rest []byte, err error) {
+	if len(data) < headerLen {
+		return 0, time.Time{}, nil, errgo.Newf("envelope too short")
+	}
+	if data[0] != version1 {
+		return 0, time.Time{}, nil, errgo.Newf("unknown envelope version %d", data[0])
+	}
+	flags = data[1]
+	if flags&^(flagExpire|flagMetadata) != 0 {
+		return 0, time.Time{}, nil, errgo.Newf("unknown envelope flags %#x", flags)
+	}
+	data = data[headerLen:]
+	if flags&flagExpire != 0 {
+		if len(data) < expireLen {
+			return 0, time.Time{}, nil, errgo.Newf("envelope too short for expiry time")
+		}
+		secs := int64(binary.BigEndian.Uint64(data[0:8]))
+		nsecs := binary.BigEndian.Uint32(data[8:12])
+		if nsecs >= 1e9 {
+			return 0, time.Time{}, nil, errgo.Newf("invalid expiry time in envelope")
+		}
+		expire = time.Unix(secs, int64(nsecs)).UTC()
+		data = data[expireLen:]
+	}
+	return flags, expire, data, nil
+}
+
+// decodeMetadata decodes the metadata section at the start of data and
+// returns it along with the rest of data.
+func decodeMetadata(data []byte) (map[string]string, []byte, error) {
+	n, data, ok := readUvarint(data)
+	// Each item takes at least two bytes.
+	if !ok || n == 0 || n > uint64(len(data)/2) {
+		return nil, nil, errgo.Newf("invalid metadata in envelope")
+	}
+	md := make(map[string]string, n)
+	prev := ""
+	for i := uint64(0); i < n; i++ {
+		var k, v string
+		k, data, ok = readString(data)
+		if ok {
+			v, data, ok = readString(data)
+		}
+		// Keys must be in strictly increasing order so that each
+		// metadata map has only one encoding.
+		if !ok || (i > 0 && k <= prev) {
+			return nil, nil, errgo.Newf("invalid metadata in envelope")
+		}
+		md[k] = v
+		prev = k
+	}
+	return md, data, nil
+}
+
+func appendUvarint(data []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func appendString(data []byte, s string) []byte {
+	return append(appendUvarint(data, uint64(len(s))), s...)
+}
+
+func readUvarint(data []byte) (uint64, []byte, bool) {
+	x, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return x, data[n:], true
+}
+
+func readString(data []byte) (string, []byte, bool) {
+	n, data, ok := readUvarint(data)
+	if !ok || n > uint64(len(data)) {
+		return "", nil, false
+	}
+	return string(data[:n]), data[n:], true
+}
+
+// Expired reports whether an entry with the given expiry time has
+// expired at the given time.
+func Expired(expire, now time.Time) bool {
+	return !expire.IsZero() && !now.Before(expire)
+}
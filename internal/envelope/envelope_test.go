@@ -0,0 +1,244 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package envelope_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv/internal/envelope"
+)
+
+var roundTripTests = []struct {
+	about  string
+	value  []byte
+	expire time.Time
+}{{
+	about: "no expiry",
+	value: []byte("hello"),
+}, {
+	about:  "with expiry",
+	value:  []byte("hello"),
+	expire: time.Date(2018, 2, 3, 4, 5, 6, 789, time.UTC),
+}, {
+	about:  "empty value",
+	value:  []byte{},
+	expire: time.Date(2018, 2, 3, 4, 5, 6, 0, time.UTC),
+}, {
+	about:  "expiry before the epoch",
+	value:  []byte("x"),
+	expire: time.Date(1900, 1, 1, 0, 0, 0, 1, time.UTC),
+}, {
+	about:  "distant expiry",
+	value:  []byte("x"),
+	expire: time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC),
+}}
+
+func TestRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range roundTripTests {
+		c.Run(test.about, func(c *qt.C) {
+			value, expire, err := envelope.Decode(envelope.Encode(test.value, test.expire))
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(value, qt.DeepEquals, test.value)
+			c.Assert(expire.Equal(test.expire), qt.Equals, true, qt.Commentf("got %v", expire))
+		})
+	}
+}
+
+func TestRoundTripWithMetadata(t *testing.T) {
+	c := qt.New(t)
+	md := map[string]string{
+		"owner":        "bob",
+		"content-type": "text/plain",
+		"":             "",
+	}
+	for _, test := range roundTripTests {
+		c.Run(test.about, func(c *qt.C) {
+			data := envelope.EncodeWithMetadata(test.value, test.expire, md)
+			value, expire, md1, err := envelope.DecodeWithMetadata(data)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(value, qt.DeepEquals, test.value)
+			c.Assert(expire.Equal(test.expire), qt.Equals, true, qt.Commentf("got %v", expire))
+			c.Assert(md1, qt.DeepEquals, md)
+
+			// Decode ignores the metadata.
+			value, expire, err = envelope.Decode(data)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(value, qt.DeepEquals, test.value)
+			c.Assert(expire.Equal(test.expire), qt.Equals, true, qt.Commentf("got %v", expire))
+		})
+	}
+	// Empty metadata is not recorded.
+	c.Assert(envelope.EncodeWithMetadata([]byte("x"), time.Time{}, map[string]string{}), qt.DeepEquals, envelope.Encode([]byte("x"), time.Time{}))
+	_, _, md1, err := envelope.DecodeWithMetadata(envelope.Encode([]byte("x"), time.Time{}))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md1, qt.IsNil)
+}
+
+func TestDecodeExpiry(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range roundTripTests {
+		c.Run(test.about, func(c *qt.C) {
+			data := envelope.EncodeWithMetadata(test.value, test.expire, map[string]string{"k": "v"})
+			if len(data) > envelope.PrefixLen {
+				data = data[:envelope.PrefixLen]
+			}
+			expire, err := envelope.DecodeExpiry(data)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(expire.Equal(test.expire), qt.Equals, true, qt.Commentf("got %v", expire))
+		})
+	}
+	_, err := envelope.DecodeExpiry([]byte{1, 1, 0})
+	c.Assert(err, qt.ErrorMatches, `envelope too short for expiry time`)
+}
+
+func TestDecodeNilValue(t *testing.T) {
+	c := qt.New(t)
+	value, _, err := envelope.Decode(envelope.Encode(nil, time.Time{}))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(value, qt.Not(qt.IsNil))
+	c.Assert(value, qt.HasLen, 0)
+}
+
+var decodeErrorTests = []struct {
+	about       string
+	data        []byte
+	expectError string
+}{{
+	about:       "empty",
+	data:        nil,
+	expectError: `envelope too short`,
+}, {
+	about:       "unknown version",
+	data:        []byte{2, 0},
+	expectError: `unknown envelope version 2`,
+}, {
+	about:       "unknown flags",
+	data:        []byte{1, 6},
+	expectError: `unknown envelope flags 0x6`,
+}, {
+	about:       "truncated expiry",
+	data:        []byte{1, 1, 0, 0, 0},
+	expectError: `envelope too short for expiry time`,
+}, {
+	about:       "invalid nanoseconds",
+	data:        []byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff},
+	expectError: `invalid expiry time in envelope`,
+}, {
+	about:       "empty metadata",
+	data:        []byte{1, 2, 0},
+	expectError: `invalid metadata in envelope`,
+}, {
+	about:       "truncated metadata",
+	data:        []byte{1, 2, 1, 1, 'k', 5, 'v'},
+	expectError: `invalid metadata in envelope`,
+}, {
+	about:       "unordered metadata",
+	data:        []byte{1, 2, 2, 1, 'b', 0, 1, 'a', 0},
+	expectError: `invalid metadata in envelope`,
+}}
+
+func TestDecodeError(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range decodeErrorTests {
+		c.Run(test.about, func(c *qt.C) {
+			_, _, err := envelope.Decode(test.data)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &mapBackend{
+		data: map[string][]byte{
+			"expired":   envelope.Encode([]byte("a"), now.Add(-time.Second)),
+			"just-now":  envelope.Encode([]byte("b"), now),
+			"later":     envelope.Encode([]byte("c"), now.Add(time.Second)),
+			"never":     envelope.Encode([]byte("d"), time.Time{}),
+			"malformed": []byte{99},
+		},
+	}
+	n, err := envelope.Reap(b, now)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+	c.Assert(b.keys(), qt.DeepEquals, map[string]bool{
+		"later":     true,
+		"never":     true,
+		"malformed": true,
+	})
+}
+
+func TestReaper(t *testing.T) {
+	c := qt.New(t)
+	b := &mapBackend{
+		data: map[string][]byte{
+			"expired": envelope.Encode([]byte("a"), time.Now().Add(-time.Second)),
+			"never":   envelope.Encode([]byte("b"), time.Time{}),
+		},
+	}
+	r := envelope.NewReaper(b, time.Millisecond, systemClock{}, nopLogger{})
+	defer r.Stop()
+	for a := 0; ; a++ {
+		if len(b.keys()) == 1 {
+			break
+		}
+		if a > 5000 {
+			c.Fatalf("expired entry not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r.Stop()
+	c.Assert(b.keys(), qt.DeepEquals, map[string]bool{"never": true})
+}
+
+type mapBackend struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (b *mapBackend) Walk(f func(key string, data []byte) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, v := range b.data {
+		if err := f(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *mapBackend) DeleteIf(key string, cond func(data []byte) bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.data[key]; ok && cond(v) {
+		delete(b.data, key)
+	}
+	return nil
+}
+
+func (b *mapBackend) keys() map[string]bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make(map[string]bool)
+	for k := range b.data {
+		keys[k] = true
+	}
+	return keys
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
@@ -0,0 +1,43 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build go1.18
+// +build go1.18
+
+package envelope_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juju/simplekv/internal/envelope"
+)
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(envelope.Encode([]byte("value"), time.Time{}))
+	f.Add(envelope.Encode([]byte("value"), time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC)))
+	f.Add(envelope.EncodeWithMetadata([]byte("value"), time.Time{}, map[string]string{"a": "b", "c": ""}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, expire, md, err := envelope.DecodeWithMetadata(data)
+		if err != nil {
+			return
+		}
+		// Anything that decodes must survive a round trip.
+		value1, expire1, md1, err := envelope.DecodeWithMetadata(envelope.EncodeWithMetadata(value, expire, md))
+		if err != nil {
+			t.Fatalf("cannot decode re-encoded envelope: %v", err)
+		}
+		if !bytes.Equal(value1, value) {
+			t.Fatalf("value mismatch after round trip; got %q want %q", value1, value)
+		}
+		if !expire1.Equal(expire) {
+			t.Fatalf("expiry mismatch after round trip; got %v want %v", expire1, expire)
+		}
+		if !reflect.DeepEqual(md1, md) {
+			t.Fatalf("metadata mismatch after round trip; got %v want %v", md1, md)
+		}
+	})
+}
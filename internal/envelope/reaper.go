@@ -0,0 +1,116 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package envelope
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Backend is implemented by backends that store envelopes and want
+// expired entries removed by a Reaper.
+type Backend interface {
+	// Walk calls f with each stored key and its envelope, which
+	// may be truncated to its first PrefixLen bytes. If f returns
+	// an error, Walk stops and returns it.
+	Walk(f func(key string, data []byte) error) error
+
+	// DeleteIf deletes the given key if its current envelope,
+	// which may also be truncated, satisfies cond. The check and
+	// the deletion must be atomic with respect to other writes of
+	// the key.
+	DeleteIf(key string, cond func(data []byte) bool) error
+}
+
+// Reap removes all entries from b that have expired at the given
+// time and returns the number of entries removed. Entries that are
+// rewritten between being found and being removed are left alone,
+// as are entries whose envelope cannot be decoded.
+func Reap(b Backend, now time.Time) (int, error) {
+	isExpired := func(data []byte) bool {
+		expire, err := DecodeExpiry(data)
+		return err == nil && Expired(expire, now)
+	}
+	var keys []string
+	if err := b.Walk(func(key string, data []byte) error {
+		if isExpired(data) {
+			keys = append(keys, key)
+		}
+		return nil
+	}); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	n := 0
+	for _, key := range keys {
+		removed := false
+		if err := b.DeleteIf(key, func(data []byte) bool {
+			removed = isExpired(data)
+			return removed
+		}); err != nil {
+			return n, errgo.Notef(err, "cannot remove %q", key)
+		}
+		if removed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// A Reaper periodically removes expired entries from a backend.
+type Reaper struct {
+	b        Backend
+	clock    simplekv.Clock
+	logger   simplekv.Logger
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewReaper starts a Reaper that calls Reap on b at the given
+// interval, using clock to find out the current time. Errors are
+// reported to logger. The Reaper must be stopped with Stop when it
+// is no longer needed.
+func NewReaper(b Backend, interval time.Duration, clock simplekv.Clock, logger simplekv.Logger) *Reaper {
+	r := &Reaper{
+		b:      b,
+		clock:  clock,
+		logger: logger,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go r.run(interval)
+	return r
+}
+
+func (r *Reaper) run(interval time.Duration) {
+	defer close(r.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-r.stop:
+			return
+		}
+		n, err := Reap(r.b, r.clock.Now())
+		if err != nil {
+			r.logger.Debugf("cannot remove expired entries: %v", err)
+		}
+		if n > 0 {
+			r.logger.Debugf("removed %d expired entries", n)
+		}
+	}
+}
+
+// Stop stops the reaper and waits for any reap in progress to
+// finish. It is safe to call Stop more than once.
+func (r *Reaper) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	<-r.done
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package errgo is a drop-in replacement for the parts of
+// gopkg.in/errgo.v1 used by simplekv. The errors it returns behave
+// exactly like those of gopkg.in/errgo.v1, so errgo.Cause and
+// errgo.Details work with them as before, but they also implement the
+// Unwrap method used by the standard errors package. Unwrap returns the
+// error's cause or, when it has none, the error it wraps, so errors.Is
+// and errors.As can see through Notef and Mask as they do through
+// fmt.Errorf with %w. Masking still hides a cause from errgo.Cause.
+package errgo
+
+import (
+	"fmt"
+	"runtime"
+
+	errgo "gopkg.in/errgo.v1"
+)
+
+// Err is the error type returned by the functions in this package. It
+// embeds errgo.Err, so it implements errgo.Causer, errgo.Wrapper and
+// errgo.Locationer.
+type Err struct {
+	errgo.Err
+}
+
+// Unwrap returns the cause of the error, or the underlying error if
+// there is no cause, so that errors.Is and errors.As can find it.
+func (e *Err) Unwrap() error {
+	if e.Cause_ != nil {
+		return e.Cause_
+	}
+	return e.Underlying_
+}
+
+// SetLocation records the source location of the error at callDepth
+// stack frames above the call.
+func (e *Err) SetLocation(callDepth int) {
+	_, file, line, _ := runtime.Caller(callDepth + 1)
+	e.File, e.Line = file, line
+}
+
+// New is like errgo.New.
+func New(s string) error {
+	err := &Err{errgo.Err{Message_: s}}
+	err.SetLocation(1)
+	return err
+}
+
+// Newf is like errgo.Newf.
+func Newf(f string, a ...interface{}) error {
+	err := &Err{errgo.Err{Message_: fmt.Sprintf(f, a...)}}
+	err.SetLocation(1)
+	return err
+}
+
+// Is is like errgo.Is.
+func Is(err error) func(error) bool {
+	return errgo.Is(err)
+}
+
+// Any is like errgo.Any.
+func Any(err error) bool {
+	return true
+}
+
+// Cause is like errgo.Cause.
+func Cause(err error) error {
+	return errgo.Cause(err)
+}
+
+// Mask is like errgo.Mask.
+func Mask(underlying error, pass ...func(error) bool) error {
+	if underlying == nil {
+		return nil
+	}
+	err := noteMask(underlying, "", pass...)
+	err.SetLocation(1)
+	return err
+}
+
+// NoteMask is like errgo.NoteMask.
+func NoteMask(underlying error, msg string, pass ...func(error) bool) error {
+	err := noteMask(underlying, msg, pass...)
+	err.SetLocation(1)
+	return err
+}
+
+// Notef is like errgo.Notef.
+func Notef(underlying error, f string, a ...interface{}) error {
+	err := noteMask(underlying, fmt.Sprintf(f, a...))
+	err.SetLocation(1)
+	return err
+}
+
+// WithCausef is like errgo.WithCausef.
+func WithCausef(underlying, cause error, f string, a ...interface{}) error {
+	var msg string
+	if underlying == nil && f == "" && len(a) == 0 && cause != nil {
+		msg = cause.Error()
+	} else {
+		msg = fmt.Sprintf(f, a...)
+	}
+	err := &Err{errgo.Err{
+		Underlying_: underlying,
+		Cause_:      cause,
+		Message_:    msg,
+	}}
+	err.SetLocation(1)
+	return err
+}
+
+// noteMask returns an error wrapping underlying with the given message,
+// keeping the cause of underlying if any of the pass functions allow it.
+func noteMask(underlying error, msg string, pass ...func(error) bool) *Err {
+	err := &Err{errgo.Err{
+		Underlying_: underlying,
+		Message_:    msg,
+	}}
+	if len(pass) > 0 {
+		cause := errgo.Cause(underlying)
+		for _, f := range pass {
+			if f(cause) {
+				err.Cause_ = cause
+				break
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package errgo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	upstream "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv/internal/errgo"
+)
+
+type customError struct{}
+
+func (*customError) Error() string {
+	return "custom"
+}
+
+func TestCausesVisibleToErrorsPackage(t *testing.T) {
+	c := qt.New(t)
+	errSentinel := errgo.New("sentinel")
+
+	err := errgo.Mask(errgo.WithCausef(nil, errSentinel, "first"), errgo.Is(errSentinel))
+	err = errgo.NoteMask(err, "second", errgo.Any)
+	c.Assert(err, qt.ErrorMatches, `second: first`)
+	c.Assert(errors.Is(err, errSentinel), qt.Equals, true)
+	c.Assert(errgo.Cause(err), qt.Equals, errSentinel)
+	c.Assert(upstream.Cause(err), qt.Equals, errSentinel)
+
+	// A masked cause is hidden from errgo.Cause, but errors.Is
+	// still finds it through the underlying error.
+	err = errgo.Mask(err)
+	c.Assert(errors.Is(err, errSentinel), qt.Equals, true)
+	c.Assert(errgo.Cause(err), qt.Equals, err)
+
+	err = errgo.Mask(errgo.WithCausef(nil, &customError{}, "with custom cause"), errgo.Any)
+	var cerr *customError
+	c.Assert(errors.As(err, &cerr), qt.Equals, true)
+}
+
+func TestErrorsIsThroughNotef(t *testing.T) {
+	c := qt.New(t)
+	err := errgo.Notef(context.DeadlineExceeded, "cannot read table columns")
+	c.Assert(err, qt.ErrorMatches, `cannot read table columns: context deadline exceeded`)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.Equals, true)
+	c.Assert(errgo.Cause(err), qt.Equals, err)
+
+	errSentinel := errgo.New("sentinel")
+	err = errgo.Notef(errgo.WithCausef(nil, errSentinel, "inner"), "cannot touch blob")
+	c.Assert(errors.Is(err, errSentinel), qt.Equals, true)
+
+	err = errgo.Notef(errgo.Mask(errgo.WithCausef(nil, &customError{}, "")), "outer")
+	var cerr *customError
+	c.Assert(errors.As(err, &cerr), qt.Equals, true)
+
+	c.Assert(errors.Unwrap(errgo.New("plain")), qt.IsNil)
+}
+
+func TestCompatibleWithUpstream(t *testing.T) {
+	c := qt.New(t)
+	errSentinel := errgo.New("sentinel")
+	err := upstream.Mask(errgo.Mask(errSentinel, errgo.Any), upstream.Is(errSentinel))
+	c.Assert(upstream.Cause(err), qt.Equals, errSentinel)
+
+	err = errgo.Mask(upstream.WithCausef(nil, errSentinel, "upstream"), errgo.Is(errSentinel))
+	c.Assert(errgo.Cause(err), qt.Equals, errSentinel)
+	c.Assert(errors.Is(err, errSentinel), qt.Equals, true)
+
+	err = errgo.New("located")
+	c.Assert(upstream.Details(err), qt.Matches, `\[\{.*errgo_test.go:[0-9]+: located\}\]`)
+}
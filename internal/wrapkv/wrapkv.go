@@ -0,0 +1,238 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package wrapkv helps implement stores that wrap another store and
+// should support listing and iteration only when the wrapped store
+// does.
+package wrapkv
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Lister is implemented by a store passed to NewStore that lists keys
+// itself rather than passing KeysWithPrefix through to the wrapped
+// store.
+type Lister interface {
+	ListKeys(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Counter is implemented by a store passed to NewStore that counts
+// keys itself. Otherwise keys are counted with
+// simplekv.CountWithPrefix.
+type Counter interface {
+	CountKeys(ctx context.Context, prefix string) (int, error)
+}
+
+// Iterable is implemented by a store passed to NewStore that
+// iterates over entries itself rather than passing Iterate through to
+// the wrapped store.
+type Iterable interface {
+	IterateEntries(ctx context.Context, prefix string) (simplekv.Iterator, error)
+}
+
+// NewStore returns a store that implements the methods of s, which
+// wraps kv, and also implements simplekv.KeyLister and
+// simplekv.Counter if kv implements simplekv.KeyLister, and
+// simplekv.Iterable if kv implements simplekv.Iterable. Keys are
+// listed, counted and iterated by calling the methods of the Lister,
+// Counter and Iterable interfaces in this package if s implements
+// them, and by calling kv otherwise.
+//
+// If kv implements neither interface, s is returned unchanged.
+// Otherwise the other optional interfaces in the simplekv package are
+// implemented by calling the corresponding simplekv helper functions
+// on s, which use s's own method when it has one and are equivalent
+// to calling them on s otherwise. simplekv.Closer,
+// simplekv.MetadataStore and simplekv.ExpiryReader are not
+// implemented.
+func NewStore(s, kv simplekv.Store) simplekv.Store {
+	base := &store{
+		Store: s,
+		kv:    kv,
+	}
+	_, isKeyLister := kv.(simplekv.KeyLister)
+	_, isIterable := kv.(simplekv.Iterable)
+	switch {
+	case isKeyLister && isIterable:
+		return &keyListerIterableStore{&keyListerStore{base}}
+	case isKeyLister:
+		return &keyListerStore{base}
+	case isIterable:
+		return &iterableStore{base}
+	}
+	return s
+}
+
+// Base returns the store that was passed as s to NewStore to create
+// kv, or kv itself if it was not created by NewStore.
+func Base(kv simplekv.Store) simplekv.Store {
+	if kv, ok := kv.(interface {
+		base() simplekv.Store
+	}); ok {
+		return kv.base()
+	}
+	return kv
+}
+
+// store forwards the optional simplekv interfaces to the simplekv
+// helper functions.
+type store struct {
+	simplekv.Store
+	kv simplekv.Store
+}
+
+func (s *store) base() simplekv.Store {
+	return s.Store
+}
+
+// SetTTL implements simplekv.TTLSetter.SetTTL.
+func (s *store) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return errgo.Mask(simplekv.SetTTL(ctx, s.Store, key, value, ttl), errgo.Any)
+}
+
+// UpdateTTL implements simplekv.TTLSetter.UpdateTTL.
+func (s *store) UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	return errgo.Mask(simplekv.UpdateTTL(ctx, s.Store, key, ttl, getVal), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals.
+func (s *store) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	return errgo.Mask(simplekv.SetIfEquals(ctx, s.Store, key, oldVal, newVal, expire), errgo.Any)
+}
+
+// GetWithRevision implements simplekv.Revisioner.GetWithRevision.
+func (s *store) GetWithRevision(ctx context.Context, key string) ([]byte, string, error) {
+	v, rev, err := simplekv.GetWithRevision(ctx, s.Store, key)
+	return v, rev, errgo.Mask(err, errgo.Any)
+}
+
+// SetWithRevision implements simplekv.Revisioner.SetWithRevision.
+func (s *store) SetWithRevision(ctx context.Context, key string, value []byte, expire time.Time) (string, error) {
+	rev, err := simplekv.SetWithRevision(ctx, s.Store, key, value, expire)
+	return rev, errgo.Mask(err, errgo.Any)
+}
+
+// UpdateWithRevision implements simplekv.Revisioner.UpdateWithRevision.
+func (s *store) UpdateWithRevision(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) (string, error) {
+	rev, err := simplekv.UpdateWithRevision(ctx, s.Store, key, expire, getVal)
+	return rev, errgo.Mask(err, errgo.Any)
+}
+
+// SetAt implements simplekv.Revisioner.SetAt.
+func (s *store) SetAt(ctx context.Context, key string, value []byte, expire time.Time, rev string) (string, error) {
+	newRev, err := simplekv.SetAt(ctx, s.Store, key, value, expire, rev)
+	return newRev, errgo.Mask(err, errgo.Any)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti.
+func (s *store) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	return errgo.Mask(simplekv.SetMulti(ctx, s.Store, entries), errgo.Any)
+}
+
+// Txn implements simplekv.Transactor.Txn.
+func (s *store) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	return errgo.Mask(simplekv.Txn(ctx, s.Store, f), errgo.Any)
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead.
+func (s *store) SnapshotRead(ctx context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	return errgo.Mask(simplekv.SnapshotRead(ctx, s.Store, f), errgo.Any)
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen.
+func (s *store) MaxKeyLen() int {
+	return simplekv.KeyLimit(s.Store)
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen.
+func (s *store) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.Store)
+}
+
+// keyListerStore is used when the wrapped store implements
+// simplekv.KeyLister.
+type keyListerStore struct {
+	*store
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *keyListerStore) Keys(ctx context.Context) ([]string, error) {
+	return s.KeysWithPrefix(ctx, "")
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *keyListerStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	if l, ok := s.Store.(Lister); ok {
+		keys, err := l.ListKeys(ctx, prefix)
+		return keys, errgo.Mask(err, errgo.Any)
+	}
+	keys, err := s.kv.(simplekv.KeyLister).KeysWithPrefix(ctx, prefix)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// Count implements simplekv.Counter.Count.
+func (s *keyListerStore) Count(ctx context.Context) (int, error) {
+	return s.CountWithPrefix(ctx, "")
+}
+
+// CountWithPrefix implements simplekv.Counter.CountWithPrefix.
+func (s *keyListerStore) CountWithPrefix(ctx context.Context, prefix string) (int, error) {
+	if c, ok := s.Store.(Counter); ok {
+		n, err := c.CountKeys(ctx, prefix)
+		return n, errgo.Mask(err, errgo.Any)
+	}
+	if _, ok := s.Store.(Lister); ok {
+		keys, err := s.KeysWithPrefix(ctx, prefix)
+		return len(keys), errgo.Mask(err, errgo.Any)
+	}
+	n, err := simplekv.CountWithPrefix(ctx, s.kv.(simplekv.KeyLister), prefix)
+	return n, errgo.Mask(err, errgo.Any)
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead. If s
+// does not implement it, the snapshot lists keys with
+// s.KeysWithPrefix.
+func (s *keyListerStore) SnapshotRead(ctx context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	if _, ok := s.Store.(simplekv.SnapshotReader); ok {
+		return errgo.Mask(s.store.SnapshotRead(ctx, f), errgo.Any)
+	}
+	// Hide all but the KeyLister methods, so that SnapshotRead
+	// falls back to reading from s directly.
+	kv := struct {
+		simplekv.KeyLister
+	}{s}
+	return errgo.Mask(simplekv.SnapshotRead(ctx, kv, f), errgo.Any)
+}
+
+// iterableStore is used when the wrapped store implements
+// simplekv.Iterable.
+type iterableStore struct {
+	*store
+}
+
+// Iterate implements simplekv.Iterable.Iterate.
+func (s *iterableStore) Iterate(ctx context.Context, prefix string) (simplekv.Iterator, error) {
+	if it, ok := s.Store.(Iterable); ok {
+		iter, err := it.IterateEntries(ctx, prefix)
+		return iter, errgo.Mask(err, errgo.Any)
+	}
+	iter, err := s.kv.(simplekv.Iterable).Iterate(ctx, prefix)
+	return iter, errgo.Mask(err, errgo.Any)
+}
+
+// keyListerIterableStore is used when the wrapped store implements
+// both simplekv.KeyLister and simplekv.Iterable.
+type keyListerIterableStore struct {
+	*keyListerStore
+}
+
+// Iterate implements simplekv.Iterable.Iterate.
+func (s *keyListerIterableStore) Iterate(ctx context.Context, prefix string) (simplekv.Iterator, error) {
+	iter, err := (&iterableStore{s.store}).Iterate(ctx, prefix)
+	return iter, errgo.Mask(err, errgo.Any)
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package wrapkv_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/internal/wrapkv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		kv := memsimplekv.NewStore()
+		return wrapkv.NewStore(passStore{kv}, kv), nil
+	})
+}
+
+func TestNewStoreWithoutListing(t *testing.T) {
+	c := qt.New(t)
+	kv := passStore{memsimplekv.NewStore()}
+	s := passStore{kv}
+	c.Assert(wrapkv.NewStore(s, kv), qt.Equals, simplekv.Store(s))
+}
+
+func TestNewStoreCapabilities(t *testing.T) {
+	c := qt.New(t)
+	mem := memsimplekv.NewStore()
+	s := passStore{mem}
+	kv := wrapkv.NewStore(s, mem)
+	c.Assert(wrapkv.Base(kv), qt.Equals, simplekv.Store(s))
+	c.Assert(wrapkv.Base(mem), qt.Equals, mem)
+	_, ok := kv.(simplekv.Counter)
+	c.Assert(ok, qt.Equals, true)
+	_, ok = kv.(simplekv.Iterable)
+	c.Assert(ok, qt.Equals, true)
+	_, ok = kv.(simplekv.Transactor)
+	c.Assert(ok, qt.Equals, true)
+	_, ok = kv.(simplekv.Closer)
+	c.Assert(ok, qt.Equals, false)
+
+	kv = wrapkv.NewStore(s, listerOnly{mem.(simplekv.KeyLister)})
+	_, ok = kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, true)
+	_, ok = kv.(simplekv.Iterable)
+	c.Assert(ok, qt.Equals, false)
+}
+
+func TestListHooks(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore()
+	for _, key := range []string{"a", "b", "c"} {
+		err := mem.Set(ctx, key, []byte(key), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	kv := wrapkv.NewStore(upperStore{passStore{mem}}, mem)
+
+	keys, err := kv.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.DeepEquals, []string{"A", "B", "C"})
+
+	// Counting uses ListKeys when there is no CountKeys method.
+	n, err := kv.(simplekv.Counter).Count(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 3)
+
+	// The snapshot fallback lists keys with ListKeys too.
+	err = simplekv.SnapshotRead(ctx, kv, func(tx simplekv.SnapshotTx) error {
+		keys, err := tx.KeysWithPrefix("")
+		c.Check(keys, qt.DeepEquals, []string{"A", "B", "C"})
+		return err
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+// passStore passes all the simplekv.Store methods through to the
+// store it wraps, hiding any others.
+type passStore struct {
+	simplekv.Store
+}
+
+// listerOnly hides all but the simplekv.KeyLister methods of the store
+// it wraps.
+type listerOnly struct {
+	simplekv.KeyLister
+}
+
+// upperStore lists the keys of the store it wraps in upper case.
+type upperStore struct {
+	passStore
+}
+
+func (s upperStore) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.Store.(simplekv.KeyLister).KeysWithPrefix(ctx, prefix)
+	for i, key := range keys {
+		keys[i] = strings.ToUpper(key)
+	}
+	sort.Strings(keys)
+	return keys, err
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package keygen generates collision-resistant keys suitable for use
+// with a simplekv.Store, for example for sessions or jobs.
+//
+// ULID and KSUID keys start with their creation time, so keys created
+// later sort after keys created earlier (to the precision of the
+// timestamp) and a range of creation times can be found with
+// simplekv.Iterable.Iterate. Random keys have no ordering.
+package keygen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Generator is the type of a function that generates a new key.
+// ULID, KSUID and Random are all Generators.
+type Generator func() (string, error)
+
+var (
+	_ Generator = ULID
+	_ Generator = KSUID
+	_ Generator = Random
+)
+
+// Random returns a key made of 128 random bits, encoded as 32
+// hexadecimal digits.
+func Random() (string, error) {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", errgo.Notef(err, "cannot read random bytes")
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// crockford holds the alphabet used to encode ULIDs. It is in ASCII
+// order, so encoded ULIDs sort in the same order as their values.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID returns a new ULID (see https://github.com/ulid/spec) for the
+// current time: a 48-bit millisecond timestamp followed by 80 random
+// bits, encoded as 26 characters.
+func ULID() (string, error) {
+	return ULIDAt(time.Now(), rand.Reader)
+}
+
+// ULIDAt returns a ULID with the given timestamp, reading its random
+// bits from the given reader.
+func ULIDAt(t time.Time, entropy io.Reader) (string, error) {
+	ms := t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+	if ms < 0 || ms >= 1<<48 {
+		return "", errgo.Newf("time %v out of range for ULID", t)
+	}
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(ms)<<16)
+	if _, err := io.ReadFull(entropy, buf[6:]); err != nil {
+		return "", errgo.Notef(err, "cannot read random bytes")
+	}
+	return encode(buf[:], crockford, 26), nil
+}
+
+// ULIDTime returns the timestamp of the given ULID.
+func ULIDTime(id string) (time.Time, error) {
+	if len(id) != 26 {
+		return time.Time{}, errgo.Newf("invalid ULID %q", id)
+	}
+	buf, err := decode(strings.ToUpper(id), crockford, 16)
+	if err != nil {
+		return time.Time{}, errgo.Newf("invalid ULID %q", id)
+	}
+	ms := int64(binary.BigEndian.Uint64(buf[:8]) >> 16)
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC(), nil
+}
+
+// base62 holds the alphabet used to encode KSUIDs. It is in ASCII
+// order, so encoded KSUIDs sort in the same order as their values.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ksuidEpoch holds the start of the KSUID epoch, in seconds since the
+// Unix epoch.
+const ksuidEpoch = 1400000000
+
+// KSUID returns a new KSUID (see https://github.com/segmentio/ksuid)
+// for the current time: a 32-bit timestamp in seconds followed by 128
+// random bits, encoded as 27 characters.
+func KSUID() (string, error) {
+	return KSUIDAt(time.Now(), rand.Reader)
+}
+
+// KSUIDAt returns a KSUID with the given timestamp, reading its
+// random bits from the given reader.
+func KSUIDAt(t time.Time, entropy io.Reader) (string, error) {
+	secs := t.Unix() - ksuidEpoch
+	if secs < 0 || secs >= 1<<32 {
+		return "", errgo.Newf("time %v out of range for KSUID", t)
+	}
+	var buf [20]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(secs))
+	if _, err := io.ReadFull(entropy, buf[4:]); err != nil {
+		return "", errgo.Notef(err, "cannot read random bytes")
+	}
+	return encode(buf[:], base62, 27), nil
+}
+
+// KSUIDTime returns the timestamp of the given KSUID.
+func KSUIDTime(id string) (time.Time, error) {
+	if len(id) != 27 {
+		return time.Time{}, errgo.Newf("invalid KSUID %q", id)
+	}
+	buf, err := decode(id, base62, 20)
+	if err != nil {
+		return time.Time{}, errgo.Newf("invalid KSUID %q", id)
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(buf[:4]))+ksuidEpoch, 0).UTC(), nil
+}
+
+// encode encodes the big-endian number in buf as exactly n digits in
+// the given alphabet.
+func encode(buf []byte, alphabet string, n int) string {
+	x := new(big.Int).SetBytes(buf)
+	base := big.NewInt(int64(len(alphabet)))
+	digit := new(big.Int)
+	out := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		x.DivMod(x, base, digit)
+		out[i] = alphabet[digit.Int64()]
+	}
+	return string(out)
+}
+
+// decode decodes the digits in s from the given alphabet into a
+// big-endian number of n bytes.
+func decode(s, alphabet string, n int) ([]byte, error) {
+	x := new(big.Int)
+	base := big.NewInt(int64(len(alphabet)))
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(alphabet, s[i])
+		if d < 0 {
+			return nil, errgo.Newf("invalid character %q", s[i])
+		}
+		x.Mul(x, base)
+		x.Add(x, big.NewInt(int64(d)))
+	}
+	b := x.Bytes()
+	if len(b) > n {
+		return nil, errgo.Newf("value out of range")
+	}
+	buf := make([]byte, n)
+	copy(buf[n-len(b):], b)
+	return buf, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package keygen_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv/keygen"
+)
+
+func TestULID(t *testing.T) {
+	c := qt.New(t)
+	id, err := keygen.ULIDAt(time.Unix(0, 0), bytes.NewReader(make([]byte, 10)))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id, qt.Equals, "00000000000000000000000000")
+
+	// The largest valid ULID.
+	id, err = keygen.ULIDAt(time.Unix((1<<48-1)/1000, 655*int64(time.Millisecond)), bytes.NewReader(bytes.Repeat([]byte{0xff}, 10)))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id, qt.Equals, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ")
+
+	t0 := time.Date(2018, 1, 1, 12, 0, 0, 123000000, time.UTC)
+	id, err = keygen.ULIDAt(t0, bytes.NewReader(bytes.Repeat([]byte{0xff}, 10)))
+	c.Assert(err, qt.Equals, nil)
+	id1, err := keygen.ULIDAt(t0.Add(time.Millisecond), bytes.NewReader(make([]byte, 10)))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id < id1, qt.Equals, true)
+
+	got, err := keygen.ULIDTime(id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.DeepEquals, t0)
+
+	_, err = keygen.ULIDTime("invalid")
+	c.Assert(err, qt.ErrorMatches, `invalid ULID "invalid"`)
+
+	id, err = keygen.ULID()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id, qt.HasLen, 26)
+}
+
+func TestKSUID(t *testing.T) {
+	c := qt.New(t)
+	// The example from the KSUID documentation.
+	payload, err := hex.DecodeString("B5A1CD34B5F99D1154FB6853345C9735")
+	c.Assert(err, qt.Equals, nil)
+	t0 := time.Unix(107608047+1400000000, 0).UTC()
+	id, err := keygen.KSUIDAt(t0, bytes.NewReader(payload))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id, qt.Equals, "0ujtsYcgvSTl8PAuAdqWYSMnLOv")
+
+	got, err := keygen.KSUIDTime(id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.DeepEquals, t0)
+
+	id1, err := keygen.KSUIDAt(t0.Add(time.Second), bytes.NewReader(make([]byte, 16)))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id < id1, qt.Equals, true)
+
+	_, err = keygen.KSUIDAt(time.Unix(0, 0), bytes.NewReader(payload))
+	c.Assert(err, qt.ErrorMatches, `time .* out of range for KSUID`)
+
+	id, err = keygen.KSUID()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id, qt.HasLen, 27)
+}
+
+func TestRandom(t *testing.T) {
+	c := qt.New(t)
+	id0, err := keygen.Random()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id0, qt.HasLen, 32)
+	id1, err := keygen.Random()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id1, qt.Not(qt.Equals), id0)
+}
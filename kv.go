@@ -7,7 +7,7 @@ import (
 	"context"
 	"time"
 
-	errgo "gopkg.in/errgo.v1"
+	errgo "github.com/juju/simplekv/internal/errgo"
 )
 
 var (
@@ -18,8 +18,38 @@ var (
 	// ErrDuplicateKey is the error cause used when SetKeyOnce
 	// tries to set a duplicate key.
 	ErrDuplicateKey = errgo.New("duplicate key")
+
+	// ErrConflict is the error cause used when SetIfEquals finds
+	// that a key does not have the expected value.
+	ErrConflict = errgo.New("conflict")
+
+	// ErrKeyTooLarge is the error cause used when a key is longer
+	// than MaxKeyLen.
+	ErrKeyTooLarge = errgo.New("key too large")
 )
 
+// MaxKeyLen holds the maximum length of a key in bytes. Backends have
+// various limits of their own (for example MongoDB limits the size of
+// index entries and Postgres the size of btree index rows), so a
+// common limit that all of them can support is enforced instead.
+const MaxKeyLen = 512
+
+// CheckKey returns an error with a cause of ErrKeyTooLarge if the
+// given key is longer than MaxKeyLen. Store implementations call it
+// before using a key.
+func CheckKey(key string) error {
+	return errgo.Mask(CheckKeyLen(key, MaxKeyLen), errgo.Is(ErrKeyTooLarge))
+}
+
+// CheckKeyLen is like CheckKey except that it checks the key against
+// the given maximum length.
+func CheckKeyLen(key string, maxLen int) error {
+	if len(key) > maxLen {
+		return errgo.WithCausef(nil, ErrKeyTooLarge, "key of %d bytes exceeds maximum length of %d", len(key), maxLen)
+	}
+	return nil
+}
+
 // KeyNotFoundError creates a new error with a cause of ErrNotFound and
 // an appropriate message.
 func KeyNotFoundError(key string) error {
@@ -28,6 +58,18 @@ func KeyNotFoundError(key string) error {
 	return err
 }
 
+// Clock is used by stores that need to know the current time, for
+// example to determine whether an entry has expired.
+type Clock interface {
+	Now() time.Time
+}
+
+// Logger is used by stores to log diagnostic messages. It is
+// implemented by loggo.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+}
+
 // Store holds the interface implemented by the various backend implementations.
 type Store interface {
 	// Context returns a context that is suitable for passing to the
@@ -44,8 +86,15 @@ type Store interface {
 	// Get retrieves the value associated with the given key. If
 	// there is no such key an error with a cause of ErrNotFound will
 	// be returned.
+	//
+	// All methods that take a key return an error with a cause of
+	// ErrKeyTooLarge if the key is longer than MaxKeyLen.
 	Get(ctx context.Context, key string) ([]byte, error)
 
+	// Exists reports whether there is a value associated with the
+	// given key. It is cheaper than Get when the value is large.
+	Exists(ctx context.Context, key string) (bool, error)
+
 	// Set updates the given key to have the specified value.
 	//
 	// If the expire time is non-zero then the entry may be garbage
@@ -69,6 +118,16 @@ type Store interface {
 	// collected at some point after that time. Clients should not
 	// rely on the value being removed at the given time.
 	Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error
+
+	// Touch changes the expiry time of the given key without
+	// changing its value. If there is no such key an error with a
+	// cause of ErrNotFound will be returned.
+	Touch(ctx context.Context, key string, expire time.Time) error
+
+	// Delete removes the given key and its value. If there is no
+	// such key an error with a cause of ErrNotFound will be
+	// returned.
+	Delete(ctx context.Context, key string) error
 }
 
 // KeyLister holds the interface used to list keys store in the Store.
@@ -77,6 +136,60 @@ type KeyLister interface {
 
 	// Keys returns a distinct list of stored keys.
 	Keys(ctx context.Context) ([]string, error)
+
+	// KeysWithPrefix returns a distinct list of stored keys that
+	// start with the given prefix.
+	KeysWithPrefix(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Iterable is implemented by stores that can stream their entries,
+// which scales to stores too large to list with KeyLister.Keys.
+type Iterable interface {
+	Store
+
+	// Iterate returns an iterator over all entries with keys that
+	// start with the given prefix, in lexical order of key.
+	// The iterator must be closed after use.
+	//
+	// Entries that are changed while the iteration is in progress
+	// may or may not be seen.
+	Iterate(ctx context.Context, prefix string) (Iterator, error)
+}
+
+// Iterator iterates over the entries of a store. The usual pattern
+// is:
+//
+//	iter, err := kv.Iterate(ctx, prefix)
+//	if err != nil {
+//		...
+//	}
+//	defer iter.Close()
+//	for iter.Next() {
+//		key, value := iter.Key(), iter.Value()
+//		...
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+type Iterator interface {
+	// Next advances the iterator to the next entry. It returns
+	// false when there are no more entries or an error has
+	// occurred.
+	Next() bool
+
+	// Key returns the key of the current entry.
+	Key() string
+
+	// Value returns the value of the current entry. The
+	// returned slice must not be modified.
+	Value() []byte
+
+	// Err returns any error encountered during the iteration.
+	Err() error
+
+	// Close releases the resources associated with the iterator
+	// and returns any error encountered during the iteration.
+	Close() error
 }
 
 // SetKeyOnce is like Store.Set except that if the key already
@@ -89,5 +202,5 @@ func SetKeyOnce(ctx context.Context, kv Store, key string, value []byte, expire
 		}
 		return value, nil
 	})
-	return errgo.Mask(err, errgo.Is(ErrDuplicateKey))
+	return errgo.Mask(err, errgo.Is(ErrDuplicateKey), errgo.Is(ErrKeyTooLarge), errgo.Is(ErrValueTooLarge), IsContention)
 }
@@ -0,0 +1,37 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestErrorsMatchWithErrorsPackage(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+
+	_, err := kv.Get(ctx, "a")
+	c.Assert(errors.Is(err, simplekv.ErrNotFound), qt.Equals, true)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = simplekv.SetKeyOnce(ctx, kv, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetKeyOnce(ctx, kv, "a", []byte("1"), time.Time{})
+	c.Assert(errors.Is(err, simplekv.ErrDuplicateKey), qt.Equals, true)
+	c.Assert(errors.Is(err, simplekv.ErrNotFound), qt.Equals, false)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrDuplicateKey)
+
+	err = simplekv.SetIfEquals(ctx, kv, "a", []byte("2"), []byte("3"), time.Time{})
+	c.Assert(errors.Is(err, simplekv.ErrConflict), qt.Equals, true)
+}
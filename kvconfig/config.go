@@ -0,0 +1,217 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package kvconfig publishes sets of related configuration values to a
+// simplekv.Store so that readers always see a consistent set.
+//
+// Each published set of values is written under keys unique to that
+// publication, and a single manifest key records which publication is
+// current. Publishing switches the manifest atomically once all the
+// values have been written, so a reader that loads the values named by
+// the manifest never sees values from two different publications.
+package kvconfig
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/keygen"
+)
+
+// maxLoadAttempts holds the number of times Load will retry when the
+// values it is reading are replaced by a concurrent Publish.
+const maxLoadAttempts = 10
+
+// ErrNotPublished is the error cause used when Load is called before
+// any configuration has been published.
+var ErrNotPublished = errgo.New("configuration not published")
+
+// Option represents an option that can be passed to New.
+type Option func(*Config)
+
+// WithLogger returns an option that makes the configuration report
+// failures to remove superseded values to the given logger. By
+// default such failures are not reported.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(c *Config) {
+		c.logger = logger
+	}
+}
+
+// Config publishes and loads a set of configuration values.
+type Config struct {
+	kv     simplekv.Store
+	prefix string
+	logger simplekv.Logger
+}
+
+// Snapshot holds a consistent set of configuration values.
+type Snapshot struct {
+	// Version holds the version of the configuration. It is
+	// incremented each time the configuration is published.
+	Version int64
+
+	// Values holds the configuration values, keyed by name.
+	Values map[string][]byte
+}
+
+// manifest holds the value of the manifest key.
+type manifest struct {
+	Version    int64    `json:"version"`
+	Generation string   `json:"generation"`
+	Names      []string `json:"names"`
+}
+
+// New returns a Config that stores its values in kv under keys that
+// start with the given prefix. The manifest is stored in the key
+// prefix+"manifest" and values in keys starting with prefix+"v/".
+func New(kv simplekv.Store, prefix string, opts ...Option) *Config {
+	c := &Config{
+		kv:     kv,
+		prefix: prefix,
+		logger: nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Publish replaces the configuration with the given values and returns
+// the new version. Readers will see either all of the new values or
+// none of them. If several calls to Publish run concurrently, the last
+// one to complete wins.
+func (c *Config) Publish(ctx context.Context, values map[string][]byte) (int64, error) {
+	gen, err := keygen.Random()
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	m := manifest{
+		Generation: gen,
+		Names:      make([]string, 0, len(values)),
+	}
+	entries := make([]simplekv.Entry, 0, len(values))
+	for name, value := range values {
+		m.Names = append(m.Names, name)
+		entries = append(entries, simplekv.Entry{
+			Key:   c.valueKey(gen, name),
+			Value: value,
+		})
+	}
+	sort.Strings(m.Names)
+	if err := simplekv.SetMulti(ctx, c.kv, entries); err != nil {
+		c.remove(ctx, gen, m.Names)
+		return 0, errgo.Notef(err, "cannot write configuration values")
+	}
+	for {
+		oldData, old, err := c.manifest(ctx)
+		if err != nil && errgo.Cause(err) != ErrNotPublished {
+			c.remove(ctx, gen, m.Names)
+			return 0, errgo.Mask(err)
+		}
+		m.Version = old.Version + 1
+		data, err := json.Marshal(m)
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+		err = simplekv.SetIfEquals(ctx, c.kv, c.manifestKey(), oldData, data, time.Time{})
+		if errgo.Cause(err) == simplekv.ErrConflict {
+			// Another publisher got there first; try again
+			// on top of their version.
+			continue
+		}
+		if err != nil {
+			c.remove(ctx, gen, m.Names)
+			return 0, errgo.Notef(err, "cannot update manifest")
+		}
+		if old.Generation != "" {
+			c.remove(ctx, old.Generation, old.Names)
+		}
+		return m.Version, nil
+	}
+}
+
+// Load returns a consistent snapshot of the current configuration. If
+// no configuration has been published, it returns an error with a
+// cause of ErrNotPublished.
+func (c *Config) Load(ctx context.Context) (*Snapshot, error) {
+	for i := 0; i < maxLoadAttempts; i++ {
+		_, m, err := c.manifest(ctx)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrNotPublished))
+		}
+		snap, err := c.load(ctx, m)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			// The values have been removed by a concurrent
+			// Publish, so there is a newer manifest to read.
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return snap, nil
+	}
+	return nil, errgo.Newf("configuration changed too often to load")
+}
+
+// load reads the values named by the given manifest.
+func (c *Config) load(ctx context.Context, m manifest) (*Snapshot, error) {
+	snap := &Snapshot{
+		Version: m.Version,
+		Values:  make(map[string][]byte, len(m.Names)),
+	}
+	for _, name := range m.Names {
+		v, err := c.kv.Get(ctx, c.valueKey(m.Generation, name))
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+		}
+		snap.Values[name] = v
+	}
+	return snap, nil
+}
+
+// manifest returns the current manifest and its encoded form. If there
+// is no manifest, it returns a nil slice, a zero manifest and an error
+// with a cause of ErrNotPublished.
+func (c *Config) manifest(ctx context.Context) ([]byte, manifest, error) {
+	data, err := c.kv.Get(ctx, c.manifestKey())
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, manifest{}, errgo.WithCausef(nil, ErrNotPublished, "")
+	}
+	if err != nil {
+		return nil, manifest{}, errgo.Mask(err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, manifest{}, errgo.Notef(err, "cannot decode manifest")
+	}
+	return data, m, nil
+}
+
+// remove removes the values with the given names written by the given
+// generation. Failures are logged rather than returned because they
+// leave only unreferenced values behind.
+func (c *Config) remove(ctx context.Context, gen string, names []string) {
+	for _, name := range names {
+		err := c.kv.Delete(ctx, c.valueKey(gen, name))
+		if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+			c.logger.Debugf("cannot remove configuration value %q: %v", name, err)
+		}
+	}
+}
+
+func (c *Config) manifestKey() string {
+	return c.prefix + "manifest"
+}
+
+func (c *Config) valueKey(gen, name string) string {
+	return c.prefix + "v/" + gen + "/" + name
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
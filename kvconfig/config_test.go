@@ -0,0 +1,150 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package kvconfig_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/kvconfig"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestPublishAndLoad(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore().(simplekv.KeyLister)
+	cfg := kvconfig.New(kv, "cfg/")
+
+	_, err := cfg.Load(ctx)
+	c.Assert(errgo.Cause(err), qt.Equals, kvconfig.ErrNotPublished)
+	c.Assert(err, qt.ErrorMatches, `configuration not published`)
+
+	v, err := cfg.Publish(ctx, map[string][]byte{
+		"host": []byte("a.example.com"),
+		"port": []byte("80"),
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.Equals, int64(1))
+
+	snap, err := cfg.Load(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, &kvconfig.Snapshot{
+		Version: 1,
+		Values: map[string][]byte{
+			"host": []byte("a.example.com"),
+			"port": []byte("80"),
+		},
+	})
+
+	v, err = cfg.Publish(ctx, map[string][]byte{
+		"host": []byte("b.example.com"),
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.Equals, int64(2))
+
+	snap, err = cfg.Load(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, &kvconfig.Snapshot{
+		Version: 2,
+		Values: map[string][]byte{
+			"host": []byte("b.example.com"),
+		},
+	})
+
+	// The values from the first publication have been removed.
+	keys, err := kv.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 2)
+}
+
+func TestLoadRetriesAfterConcurrentPublish(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := &interceptStore{Store: memsimplekv.NewStore()}
+	cfg := kvconfig.New(kv, "cfg/")
+	_, err := cfg.Publish(ctx, map[string][]byte{
+		"a": []byte("a1"),
+		"b": []byte("b1"),
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	// Publish a new configuration after Load has read the first
+	// value but before it reads the second one.
+	published := false
+	kv.beforeGet = func(key string) {
+		if published || !strings.HasSuffix(key, "/b") {
+			return
+		}
+		published = true
+		_, err := cfg.Publish(ctx, map[string][]byte{
+			"a": []byte("a2"),
+			"b": []byte("b2"),
+		})
+		c.Check(err, qt.Equals, nil)
+	}
+	snap, err := cfg.Load(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(published, qt.Equals, true)
+	c.Assert(snap, qt.DeepEquals, &kvconfig.Snapshot{
+		Version: 2,
+		Values: map[string][]byte{
+			"a": []byte("a2"),
+			"b": []byte("b2"),
+		},
+	})
+}
+
+func TestConcurrentPublish(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore().(simplekv.KeyLister)
+	cfg := kvconfig.New(kv, "cfg/")
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cfg.Publish(ctx, map[string][]byte{
+				"a": []byte(fmt.Sprint(i)),
+				"b": []byte(fmt.Sprint(i)),
+			})
+			c.Check(err, qt.Equals, nil)
+		}()
+	}
+	wg.Wait()
+
+	snap, err := cfg.Load(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap.Version, qt.Equals, int64(n))
+	c.Assert(snap.Values["a"], qt.DeepEquals, snap.Values["b"])
+
+	// Only the manifest and the latest values remain.
+	keys, err := kv.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 3)
+}
+
+// interceptStore calls beforeGet, if set, before each call to Get.
+type interceptStore struct {
+	simplekv.Store
+	beforeGet func(key string)
+}
+
+func (s *interceptStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if s.beforeGet != nil {
+		s.beforeGet(key)
+	}
+	return s.Store.Get(ctx, key)
+}
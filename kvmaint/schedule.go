@@ -0,0 +1,166 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package kvmaint
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// schedule holds a parsed cron expression. Each field holds a bit
+// for each value that matches.
+type schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domStar and dowStar record whether the day-of-month and
+	// day-of-week fields were "*". As in cron, if both are
+	// restricted, a day matches if either matches.
+	domStar, dowStar bool
+}
+
+// field describes one field of a cron expression.
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = [5]field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseSchedule parses a cron expression of five space-separated
+// fields: minute, hour, day of month, month and day of week. Each
+// field is "*" or a comma-separated list of values or ranges ("a-b"),
+// optionally followed by a step ("*/n" or "a-b/n"). Both 0 and 7 mean
+// Sunday.
+func parseSchedule(spec string) (*schedule, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, errgo.Newf("invalid schedule %q: got %d fields, want %d", spec, len(parts), len(fields))
+	}
+	var bits [5]uint64
+	for i, part := range parts {
+		b, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid schedule %q", spec)
+		}
+		bits[i] = b
+	}
+	s := &schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: parts[2] == "*",
+		dowStar: parts[4] == "*",
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseField parses one field of a cron expression.
+func parseField(s string, f field) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, errgo.Newf("invalid step in %s field %q", f.name, part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			var err error
+			if i := strings.Index(rng, "-"); i >= 0 {
+				lo, err = parseValue(rng[:i], f)
+				if err == nil {
+					hi, err = parseValue(rng[i+1:], f)
+				}
+			} else {
+				lo, err = parseValue(rng, f)
+				hi = lo
+				if step > 1 {
+					hi = f.max
+				}
+			}
+			if err != nil {
+				return 0, errgo.Mask(err)
+			}
+			if lo > hi {
+				return 0, errgo.Newf("invalid range in %s field %q", f.name, part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// parseValue parses a single value of the given field.
+func parseValue(s string, f field) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errgo.Newf("invalid %s %q", f.name, s)
+	}
+	return v, nil
+}
+
+// dayMatches reports whether the schedule matches the day of t.
+func (s *schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// maxSearchYears holds how far ahead next searches before deciding
+// that a schedule never matches (for example "0 0 31 2 *").
+const maxSearchYears = 5
+
+// next returns the first time after t, to the minute, that matches
+// the schedule, or the zero time if there is none.
+func (s *schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxSearchYears, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package kvmaint provides maintenance windows, which restrict when
+// heavy background work on a store, such as syncing a follower, may
+// run. A single Window can be shared by all the background jobs of a
+// deployment, so that they all run off-peak and can all be halted at
+// once during an incident.
+package kvmaint
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrClosed is the error cause used by Window.Run when the window is
+// closed or paused.
+var ErrClosed = errgo.New("maintenance window closed")
+
+// Option represents an option that can be passed to NewWindow.
+type Option func(*Window)
+
+// WithMaxRuntime returns an option that limits each job run in the
+// window to the given duration, even if the window is still open. By
+// default jobs may run until the window closes.
+func WithMaxRuntime(d time.Duration) Option {
+	return func(w *Window) {
+		w.maxRuntime = d
+	}
+}
+
+// WithClock returns an option that makes the window use the given
+// clock to determine whether it is open. By default the system clock
+// is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(w *Window) {
+		w.clock = clock
+	}
+}
+
+// Window describes the times at which maintenance work may run. A
+// nil *Window is always open and cannot be paused.
+type Window struct {
+	sched      *schedule
+	duration   time.Duration
+	maxRuntime time.Duration
+	clock      simplekv.Clock
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	// paused holds whether the window has been paused.
+	paused bool
+
+	// running holds the cancel functions of the jobs that are
+	// running in the window.
+	running map[*context.CancelFunc]bool
+}
+
+// NewWindow returns a window that opens at each time matching the
+// given cron expression and stays open for the given duration. The
+// expression has five fields, as in crontab(5): minute, hour, day of
+// month, month and day of week; names and the "@" shorthands are not
+// supported. Times are matched in the location of the window's clock,
+// which is local time for the system clock.
+//
+// For example, a window opening at 02:00 on weekdays for three hours
+// is given by:
+//
+//	kvmaint.NewWindow("0 2 * * 1-5", 3*time.Hour)
+func NewWindow(spec string, duration time.Duration, opts ...Option) (*Window, error) {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if duration <= 0 {
+		return nil, errgo.Newf("invalid window duration %v", duration)
+	}
+	w := &Window{
+		sched:    sched,
+		duration: duration,
+		clock:    systemClock{},
+		running:  make(map[*context.CancelFunc]bool),
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	return w, nil
+}
+
+// OpenUntil returns the time at which the window that is open at the
+// given time closes, or the zero time if the window is not open at
+// that time. Pausing does not affect the result.
+func (w *Window) OpenUntil(t time.Time) time.Time {
+	if w == nil {
+		return time.Time{}
+	}
+	// The window is open if it opened within the last duration. Of
+	// the windows that did, the latest closes last.
+	var end time.Time
+	for start := w.sched.next(t.Add(-w.duration - time.Minute)); !start.IsZero() && !start.After(t); start = w.sched.next(start) {
+		end = start.Add(w.duration)
+	}
+	if !end.After(t) {
+		return time.Time{}
+	}
+	return end
+}
+
+// Next returns the time at which the window next opens after t, or
+// the zero time if it never does.
+func (w *Window) Next(t time.Time) time.Time {
+	if w == nil {
+		return time.Time{}
+	}
+	return w.sched.next(t)
+}
+
+// Pause cancels the contexts of all the jobs running in the window
+// and prevents more from starting until Resume is called.
+func (w *Window) Pause() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = true
+	for cancel := range w.running {
+		(*cancel)()
+	}
+}
+
+// Resume allows jobs to run in the window again after Pause.
+func (w *Window) Resume() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paused = false
+}
+
+// Paused reports whether the window has been paused.
+func (w *Window) Paused() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// Run calls f if the window is open and not paused, and returns its
+// error. Otherwise it returns an error with a cause of ErrClosed
+// without calling f.
+//
+// The context passed to f is cancelled when the window closes, when
+// the maximum runtime is reached or when the window is paused, so f
+// should stop promptly when its context is done. Work that is cut
+// short is expected to be resumed by a later run.
+func (w *Window) Run(ctx context.Context, f func(ctx context.Context) error) error {
+	if w == nil {
+		return errgo.Mask(f(ctx), errgo.Any)
+	}
+	now := w.clock.Now()
+	end := w.OpenUntil(now)
+	if end.IsZero() {
+		return errgo.WithCausef(nil, ErrClosed, "")
+	}
+	if w.maxRuntime > 0 && now.Add(w.maxRuntime).Before(end) {
+		end = now.Add(w.maxRuntime)
+	}
+	ctx, cancel := context.WithTimeout(ctx, end.Sub(now))
+	defer cancel()
+	w.mu.Lock()
+	if w.paused {
+		w.mu.Unlock()
+		return errgo.WithCausef(nil, ErrClosed, "maintenance window paused")
+	}
+	w.running[&cancel] = true
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.running, &cancel)
+		w.mu.Unlock()
+	}()
+	return errgo.Mask(f(ctx), errgo.Any)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
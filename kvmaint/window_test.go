@@ -0,0 +1,215 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package kvmaint_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv/kvmaint"
+)
+
+// 2018-01-01 was a Monday.
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var windowTests = []struct {
+	about           string
+	spec            string
+	duration        time.Duration
+	at              time.Time
+	expectOpenUntil time.Time
+	expectNext      time.Time
+}{{
+	about:      "daily window, before it opens",
+	spec:       "0 2 * * *",
+	duration:   3 * time.Hour,
+	at:         epoch.Add(time.Hour),
+	expectNext: epoch.Add(2 * time.Hour),
+}, {
+	about:           "daily window, while it is open",
+	spec:            "0 2 * * *",
+	duration:        3 * time.Hour,
+	at:              epoch.Add(2 * time.Hour),
+	expectOpenUntil: epoch.Add(5 * time.Hour),
+	expectNext:      epoch.Add(26 * time.Hour),
+}, {
+	about:      "daily window, when it closes",
+	spec:       "0 2 * * *",
+	duration:   3 * time.Hour,
+	at:         epoch.Add(5 * time.Hour),
+	expectNext: epoch.Add(26 * time.Hour),
+}, {
+	about:           "weekdays only",
+	spec:            "30 22 * * 1-5",
+	duration:        time.Hour,
+	at:              epoch.AddDate(0, 0, 4).Add(23 * time.Hour),
+	expectOpenUntil: epoch.AddDate(0, 0, 4).Add(23*time.Hour + 30*time.Minute),
+	expectNext:      epoch.AddDate(0, 0, 7).Add(22*time.Hour + 30*time.Minute),
+}, {
+	about:      "Sunday as 7",
+	spec:       "0 0 * * 7",
+	duration:   time.Hour,
+	at:         epoch,
+	expectNext: epoch.AddDate(0, 0, 6),
+}, {
+	about:      "steps and lists",
+	spec:       "*/20 1,3 * * *",
+	duration:   10 * time.Minute,
+	at:         epoch.Add(time.Hour + 35*time.Minute),
+	expectNext: epoch.Add(time.Hour + 40*time.Minute),
+}, {
+	about:           "overlapping windows",
+	spec:            "0 * * * *",
+	duration:        90 * time.Minute,
+	at:              epoch.Add(80 * time.Minute),
+	expectOpenUntil: epoch.Add(150 * time.Minute),
+	expectNext:      epoch.Add(2 * time.Hour),
+}, {
+	about:      "day of month or day of week",
+	spec:       "0 0 15 * 0",
+	duration:   time.Hour,
+	at:         epoch.Add(time.Hour),
+	expectNext: epoch.AddDate(0, 0, 6),
+}, {
+	about:    "never",
+	spec:     "0 0 31 2 *",
+	duration: time.Hour,
+	at:       epoch,
+}}
+
+func TestWindow(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range windowTests {
+		c.Run(test.about, func(c *qt.C) {
+			w, err := kvmaint.NewWindow(test.spec, test.duration)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(w.OpenUntil(test.at), qt.DeepEquals, test.expectOpenUntil)
+			c.Assert(w.Next(test.at), qt.DeepEquals, test.expectNext)
+		})
+	}
+}
+
+var badWindowTests = []struct {
+	spec        string
+	duration    time.Duration
+	expectError string
+}{{
+	spec:        "0 2 * *",
+	duration:    time.Hour,
+	expectError: `invalid schedule "0 2 \* \*": got 4 fields, want 5`,
+}, {
+	spec:        "60 2 * * *",
+	duration:    time.Hour,
+	expectError: `invalid schedule "60 2 \* \* \*": invalid minute "60"`,
+}, {
+	spec:        "0 5-2 * * *",
+	duration:    time.Hour,
+	expectError: `invalid schedule "0 5-2 \* \* \*": invalid range in hour field "5-2"`,
+}, {
+	spec:        "0 */0 * * *",
+	duration:    time.Hour,
+	expectError: `invalid schedule "0 \*/0 \* \* \*": invalid step in hour field "\*/0"`,
+}, {
+	spec:        "0 0 * * mon",
+	duration:    time.Hour,
+	expectError: `invalid schedule "0 0 \* \* mon": invalid day of week "mon"`,
+}, {
+	spec:        "0 0 * * *",
+	expectError: `invalid window duration 0s`,
+}}
+
+func TestBadWindow(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range badWindowTests {
+		_, err := kvmaint.NewWindow(test.spec, test.duration)
+		c.Check(err, qt.ErrorMatches, test.expectError)
+	}
+}
+
+func TestRun(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: epoch}
+	w, err := kvmaint.NewWindow("0 2 * * *", time.Hour,
+		kvmaint.WithClock(clock),
+		kvmaint.WithMaxRuntime(10*time.Minute),
+	)
+	c.Assert(err, qt.Equals, nil)
+
+	called := false
+	f := func(ctx context.Context) error {
+		called = true
+		deadline, ok := ctx.Deadline()
+		c.Assert(ok, qt.Equals, true)
+		c.Assert(time.Until(deadline) <= 10*time.Minute, qt.Equals, true)
+		return errgo.New("job failed")
+	}
+
+	// Outside the window, f is not called.
+	err = w.Run(ctx, f)
+	c.Assert(errgo.Cause(err), qt.Equals, kvmaint.ErrClosed)
+	c.Assert(called, qt.Equals, false)
+
+	clock.now = epoch.Add(2 * time.Hour)
+	err = w.Run(ctx, f)
+	c.Assert(err, qt.ErrorMatches, "job failed")
+	c.Assert(called, qt.Equals, true)
+
+	// A paused window runs nothing until it is resumed.
+	w.Pause()
+	c.Assert(w.Paused(), qt.Equals, true)
+	called = false
+	err = w.Run(ctx, f)
+	c.Assert(err, qt.ErrorMatches, "maintenance window paused")
+	c.Assert(errgo.Cause(err), qt.Equals, kvmaint.ErrClosed)
+	c.Assert(called, qt.Equals, false)
+	w.Resume()
+	err = w.Run(ctx, f)
+	c.Assert(err, qt.ErrorMatches, "job failed")
+	c.Assert(called, qt.Equals, true)
+}
+
+func TestPauseCancelsRunningJobs(t *testing.T) {
+	c := qt.New(t)
+	w, err := kvmaint.NewWindow("* * * * *", time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	started := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- w.Run(context.Background(), func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+	<-started
+	w.Pause()
+	c.Assert(errgo.Cause(<-done), qt.Equals, context.Canceled)
+}
+
+func TestNilWindow(t *testing.T) {
+	c := qt.New(t)
+	var w *kvmaint.Window
+	w.Pause()
+	c.Assert(w.Paused(), qt.Equals, false)
+	called := false
+	err := w.Run(context.Background(), func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(called, qt.Equals, true)
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
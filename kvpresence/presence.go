@@ -0,0 +1,243 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package kvpresence provides a simple presence registry on top of a
+// simplekv.Store. Each member periodically refreshes a heartbeat key
+// with an expiry time; members whose heartbeat has not been refreshed
+// within the registry's TTL are no longer considered alive.
+package kvpresence
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Option represents an option that can be passed to New.
+type Option func(*Registry)
+
+// WithClock returns an option that makes the registry use the given
+// clock to determine the current time. By default the system clock is
+// used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(r *Registry) {
+		r.clock = clock
+	}
+}
+
+// WithLogger returns an option that makes registrations report
+// heartbeat failures to the given logger. By default failures are not
+// reported.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(r *Registry) {
+		r.logger = logger
+	}
+}
+
+// Registry records which members of a group are alive.
+type Registry struct {
+	kv     simplekv.Store
+	prefix string
+	ttl    time.Duration
+	clock  simplekv.Clock
+	logger simplekv.Logger
+}
+
+// Member holds information about a live member.
+type Member struct {
+	// ID holds the id the member registered with.
+	ID string
+
+	// Data holds the data the member registered with.
+	Data []byte
+
+	// Expire holds the time at which the member will no longer be
+	// considered alive unless its heartbeat is refreshed.
+	Expire time.Time
+}
+
+// heartbeat holds the value stored in a heartbeat key. The expiry time
+// is held in the value as well as being set on the key, because stores
+// do not guarantee to remove entries as soon as they expire.
+type heartbeat struct {
+	Expire time.Time `json:"expire"`
+	Data   []byte    `json:"data,omitempty"`
+}
+
+// New returns a registry that stores heartbeats in kv under keys
+// starting with the given prefix. A member is considered alive for
+// ttl after its last heartbeat.
+func New(kv simplekv.Store, prefix string, ttl time.Duration, opts ...Option) *Registry {
+	r := &Registry{
+		kv:     kv,
+		prefix: prefix,
+		ttl:    ttl,
+		clock:  systemClock{},
+		logger: nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Heartbeat marks the member with the given id as alive for the
+// registry's TTL, associating the given data with it.
+func (r *Registry) Heartbeat(ctx context.Context, id string, data []byte) error {
+	expire := simplekv.NormalizeExpire(r.clock.Now().Add(r.ttl))
+	value, err := json.Marshal(heartbeat{
+		Expire: expire,
+		Data:   data,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := r.kv.Set(ctx, r.prefix+id, value, expire); err != nil {
+		return errgo.Notef(err, "cannot record heartbeat for %q", id)
+	}
+	return nil
+}
+
+// Leave removes the member with the given id from the registry. It is
+// not an error if the member is not registered.
+func (r *Registry) Leave(ctx context.Context, id string) error {
+	err := r.kv.Delete(ctx, r.prefix+id)
+	if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		return errgo.Notef(err, "cannot remove %q", id)
+	}
+	return nil
+}
+
+// Alive returns all the members that are currently alive, sorted by
+// id.
+//
+// The underlying store must implement simplekv.Iterable or
+// simplekv.KeyLister.
+func (r *Registry) Alive(ctx context.Context) ([]Member, error) {
+	now := r.clock.Now()
+	var members []Member
+	add := func(key string, value []byte) {
+		var hb heartbeat
+		if err := json.Unmarshal(value, &hb); err != nil {
+			// Not a heartbeat; ignore it.
+			return
+		}
+		if !hb.Expire.After(now) {
+			return
+		}
+		members = append(members, Member{
+			ID:     strings.TrimPrefix(key, r.prefix),
+			Data:   hb.Data,
+			Expire: hb.Expire,
+		})
+	}
+	switch kv := r.kv.(type) {
+	case simplekv.Iterable:
+		iter, err := kv.Iterate(ctx, r.prefix)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer iter.Close()
+		for iter.Next() {
+			add(iter.Key(), iter.Value())
+		}
+		if err := iter.Close(); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	case simplekv.KeyLister:
+		keys, err := kv.KeysWithPrefix(ctx, r.prefix)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for _, key := range keys {
+			value, err := kv.Get(ctx, key)
+			if errgo.Cause(err) == simplekv.ErrNotFound {
+				// The heartbeat has expired or the member
+				// has left since the keys were listed.
+				continue
+			}
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			add(key, value)
+		}
+	default:
+		return nil, errgo.Newf("store does not support listing keys")
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members, nil
+}
+
+// A Registration keeps a member alive by sending heartbeats in the
+// background.
+type Registration struct {
+	r        *Registry
+	id       string
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Register sends a heartbeat for the member with the given id and
+// then starts sending further heartbeats at the given interval, which
+// should be comfortably shorter than the registry's TTL. The
+// registration must be stopped with Close when it is no longer needed.
+func (r *Registry) Register(ctx context.Context, id string, data []byte, interval time.Duration) (*Registration, error) {
+	if err := r.Heartbeat(ctx, id, data); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	reg := &Registration{
+		r:    r,
+		id:   id,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go reg.run(data, interval)
+	return reg, nil
+}
+
+func (reg *Registration) run(data []byte, interval time.Duration) {
+	defer close(reg.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-reg.stop:
+			return
+		}
+		ctx, close := reg.r.kv.Context(context.Background())
+		if err := reg.r.Heartbeat(ctx, reg.id, data); err != nil {
+			reg.r.logger.Debugf("%v", err)
+		}
+		close()
+	}
+}
+
+// Close stops sending heartbeats and removes the member from the
+// registry. It is safe to call Close more than once.
+func (reg *Registration) Close(ctx context.Context) error {
+	reg.stopOnce.Do(func() {
+		close(reg.stop)
+	})
+	<-reg.done
+	return errgo.Mask(reg.r.Leave(ctx, reg.id))
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
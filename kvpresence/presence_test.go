@@ -0,0 +1,128 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package kvpresence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/kvpresence"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestHeartbeatAndAlive(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	kv := memsimplekv.NewStore(memsimplekv.WithClock(clock))
+	r := kvpresence.New(kv, "presence/", time.Minute, kvpresence.WithClock(clock))
+
+	members, err := r.Alive(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(members, qt.HasLen, 0)
+
+	err = r.Heartbeat(ctx, "b", []byte("host-b"))
+	c.Assert(err, qt.Equals, nil)
+	clock.now = clock.now.Add(30 * time.Second)
+	err = r.Heartbeat(ctx, "a", []byte("host-a"))
+	c.Assert(err, qt.Equals, nil)
+
+	// Other keys in the store are ignored.
+	err = kv.Set(ctx, "other", []byte("x"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	members, err = r.Alive(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(members, qt.DeepEquals, []kvpresence.Member{{
+		ID:     "a",
+		Data:   []byte("host-a"),
+		Expire: time.Date(2018, 1, 1, 0, 1, 30, 0, time.UTC),
+	}, {
+		ID:     "b",
+		Data:   []byte("host-b"),
+		Expire: time.Date(2018, 1, 1, 0, 1, 0, 0, time.UTC),
+	}})
+
+	// After b's TTL has passed, only a is alive.
+	clock.now = clock.now.Add(30 * time.Second)
+	members, err = r.Alive(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(members, qt.HasLen, 1)
+	c.Assert(members[0].ID, qt.Equals, "a")
+
+	err = r.Leave(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	err = r.Leave(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	members, err = r.Alive(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(members, qt.HasLen, 0)
+}
+
+func TestAliveWithKeyLister(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	r := kvpresence.New(keyListerStore{memsimplekv.NewStore().(simplekv.KeyLister)}, "p/", time.Minute)
+
+	err := r.Heartbeat(ctx, "x", nil)
+	c.Assert(err, qt.Equals, nil)
+	members, err := r.Alive(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(members, qt.HasLen, 1)
+	c.Assert(members[0].ID, qt.Equals, "x")
+}
+
+func TestAliveUnsupportedStore(t *testing.T) {
+	c := qt.New(t)
+	r := kvpresence.New(plainStore{memsimplekv.NewStore()}, "p/", time.Minute)
+	_, err := r.Alive(context.Background())
+	c.Assert(err, qt.ErrorMatches, `store does not support listing keys`)
+}
+
+func TestRegister(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	r := kvpresence.New(memsimplekv.NewStore(), "p/", 50*time.Millisecond)
+
+	reg, err := r.Register(ctx, "x", []byte("data"), 10*time.Millisecond)
+	c.Assert(err, qt.Equals, nil)
+
+	// The registration outlives several TTLs.
+	time.Sleep(150 * time.Millisecond)
+	members, err := r.Alive(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(members, qt.HasLen, 1)
+	c.Assert(string(members[0].Data), qt.Equals, "data")
+
+	err = reg.Close(ctx)
+	c.Assert(err, qt.Equals, nil)
+	err = reg.Close(ctx)
+	c.Assert(err, qt.Equals, nil)
+	members, err = r.Alive(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(members, qt.HasLen, 0)
+}
+
+// keyListerStore hides any methods other than those of
+// simplekv.KeyLister.
+type keyListerStore struct {
+	simplekv.KeyLister
+}
+
+// plainStore hides any methods other than those of simplekv.Store.
+type plainStore struct {
+	simplekv.Store
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package kvverify
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrBadSignature is the error cause used when a manifest's signature
+// does not match its contents.
+var ErrBadSignature = errgo.New("bad manifest signature")
+
+// Manifest records the hash of the value of every entry under a prefix
+// of a store at a point in time, signed so that later changes to the
+// store, or to the manifest itself, can be detected. It can be
+// marshaled as JSON and kept separately from the store.
+type Manifest struct {
+	// Prefix holds the prefix of the keys in the manifest.
+	Prefix string `json:"prefix"`
+
+	// Time holds the time at which the manifest was made.
+	Time time.Time `json:"time"`
+
+	// Hashes holds the hex-encoded SHA-256 hash of the value of each
+	// entry, keyed by the entry's key.
+	Hashes map[string]string `json:"hashes"`
+
+	// Signature holds the Ed25519 signature of the other fields.
+	Signature []byte `json:"signature"`
+}
+
+// NewManifest returns a manifest of the entries in kv with keys
+// starting with the given prefix, signed with the given key. Entries
+// changed while the manifest is being made may be recorded with
+// either their old or their new value.
+func NewManifest(ctx context.Context, kv simplekv.KeyLister, prefix string, key ed25519.PrivateKey) (*Manifest, error) {
+	m := &Manifest{
+		Prefix: prefix,
+		Time:   time.Now().UTC().Round(0),
+		Hashes: make(map[string]string),
+	}
+	keys, err := kv.KeysWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot list keys", errgo.Any)
+	}
+	for _, k := range keys {
+		hash, _, found, err := readEntry(ctx, kv, k)
+		if err != nil {
+			return nil, errgo.NoteMask(err, fmt.Sprintf("cannot read %q", k), errgo.Any)
+		}
+		if found {
+			m.Hashes[k] = hex.EncodeToString(hash[:])
+		}
+	}
+	m.Signature = ed25519.Sign(key, m.signedData())
+	return m, nil
+}
+
+// signedData returns the data covered by the manifest's signature.
+func (m *Manifest) signedData() []byte {
+	data, err := json.Marshal(Manifest{
+		Prefix: m.Prefix,
+		Time:   m.Time,
+		Hashes: m.Hashes,
+	})
+	if err != nil {
+		panic(errgo.Notef(err, "cannot marshal manifest"))
+	}
+	return data
+}
+
+// Verify returns an error with a cause of ErrBadSignature if m was
+// not signed by the private key corresponding to the given public key
+// or has been changed since it was signed.
+func (m *Manifest) Verify(key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, m.signedData(), m.Signature) {
+		return errgo.WithCausef(nil, ErrBadSignature, "")
+	}
+	return nil
+}
+
+// Check verifies m with the given public key, as by Verify, and then
+// compares it with the current contents of kv. In the returned
+// report, store A is the manifest and store B is kv, so OnlyInA
+// holds the entries removed since the manifest was made, OnlyInB
+// holds the entries added, and Mismatches holds the entries whose
+// values have changed. Expiry times are not recorded in manifests and
+// are not compared.
+func (m *Manifest) Check(ctx context.Context, kv simplekv.KeyLister, key ed25519.PublicKey) (*Report, error) {
+	if err := m.Verify(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrBadSignature))
+	}
+	keys, err := kv.KeysWithPrefix(ctx, m.Prefix)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot list keys", errgo.Any)
+	}
+	r := &Report{
+		Keys: len(m.Hashes),
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		hashB, _, found, err := readEntry(ctx, kv, k)
+		if err != nil {
+			return nil, errgo.NoteMask(err, fmt.Sprintf("cannot read %q", k), errgo.Any)
+		}
+		if !found {
+			continue
+		}
+		seen[k] = true
+		h, ok := m.Hashes[k]
+		if !ok {
+			r.Keys++
+			r.OnlyInB = append(r.OnlyInB, k)
+			continue
+		}
+		r.Compared++
+		mm := Mismatch{
+			Key:   k,
+			HashB: hashB,
+		}
+		// A hash that cannot be decoded is left as zero, which no
+		// value matches.
+		if b, err := hex.DecodeString(h); err == nil && len(b) == sha256.Size {
+			copy(mm.HashA[:], b)
+		}
+		if mm.ValueDiffers() {
+			r.Mismatches = append(r.Mismatches, mm)
+		}
+	}
+	for k := range m.Hashes {
+		if !seen[k] {
+			r.OnlyInA = append(r.OnlyInA, k)
+		}
+	}
+	sort.Strings(r.OnlyInA)
+	sort.Strings(r.OnlyInB)
+	sort.Slice(r.Mismatches, func(i, j int) bool {
+		return r.Mismatches[i].Key < r.Mismatches[j].Key
+	})
+	return r, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package kvverify_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv/kvverify"
+)
+
+func TestManifest(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.Equals, nil)
+	kv := newStore(c, map[string]string{
+		"cfg/a": "1",
+		"cfg/b": "2",
+		"cfg/c": "3",
+		"other": "x",
+	})
+
+	m, err := kvverify.NewManifest(ctx, kv, "cfg/", priv)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(m.Prefix, qt.Equals, "cfg/")
+	c.Assert(m.Hashes, qt.HasLen, 3)
+	c.Assert(m.Hashes["cfg/a"], qt.Equals, "6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b")
+
+	// The manifest survives a round trip through JSON.
+	data, err := json.Marshal(m)
+	c.Assert(err, qt.Equals, nil)
+	var m1 kvverify.Manifest
+	err = json.Unmarshal(data, &m1)
+	c.Assert(err, qt.Equals, nil)
+	err = m1.Verify(pub)
+	c.Assert(err, qt.Equals, nil)
+
+	r, err := m1.Check(ctx, kv, pub)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Converged(), qt.Equals, true)
+	c.Assert(r.Compared, qt.Equals, 3)
+
+	// Changes outside the prefix are not reported.
+	err = kv.Set(ctx, "other", []byte("y"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "cfg/b", []byte("changed"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Delete(ctx, "cfg/c")
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "cfg/d", []byte("4"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	r, err = m1.Check(ctx, kv, pub)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Converged(), qt.Equals, false)
+	c.Assert(r.Keys, qt.Equals, 4)
+	c.Assert(r.Compared, qt.Equals, 2)
+	c.Assert(r.OnlyInA, qt.DeepEquals, []string{"cfg/c"})
+	c.Assert(r.OnlyInB, qt.DeepEquals, []string{"cfg/d"})
+	c.Assert(r.Mismatches, qt.HasLen, 1)
+	c.Assert(r.Mismatches[0].Key, qt.Equals, "cfg/b")
+}
+
+func TestManifestTampered(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.Equals, nil)
+	kv := newStore(c, map[string]string{"a": "1"})
+	m, err := kvverify.NewManifest(ctx, kv, "", priv)
+	c.Assert(err, qt.Equals, nil)
+
+	// A manifest changed to match a tampered store is detected.
+	err = kv.Set(ctx, "a", []byte("2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	m.Hashes["a"] = "d4735e3a265e16eee03f59718b9b5d03019c07d8b6c51f90da3a666eec13ab35"
+	err = m.Verify(pub)
+	c.Assert(errgo.Cause(err), qt.Equals, kvverify.ErrBadSignature)
+	_, err = m.Check(ctx, kv, pub)
+	c.Assert(errgo.Cause(err), qt.Equals, kvverify.ErrBadSignature)
+
+	// So is a manifest signed by another key.
+	pub1, _, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.Equals, nil)
+	m, err = kvverify.NewManifest(ctx, kv, "", priv)
+	c.Assert(err, qt.Equals, nil)
+	err = m.Verify(pub1)
+	c.Assert(errgo.Cause(err), qt.Equals, kvverify.ErrBadSignature)
+}
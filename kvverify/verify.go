@@ -0,0 +1,330 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package kvverify compares the contents of two stores, so that a
+// migration or a replicating wrapper can be checked to have actually
+// converged before it is relied upon.
+package kvverify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// DefaultConcurrency holds the number of keys compared concurrently
+// when WithConcurrency is not used.
+const DefaultConcurrency = 10
+
+// Option represents an option that can be passed to Compare.
+type Option func(*comparer)
+
+// WithSampleRate returns an option that compares the values and
+// expiry times of only the given proportion of keys, between 0 and 1.
+// The keys of both stores are always compared in full. Keys are
+// sampled by hash, so repeated comparisons sample the same keys. By
+// default every key is compared.
+func WithSampleRate(rate float64) Option {
+	return func(c *comparer) {
+		c.sampleRate = rate
+	}
+}
+
+// WithConcurrency returns an option that compares at most n keys
+// concurrently. By default DefaultConcurrency is used.
+func WithConcurrency(n int) Option {
+	return func(c *comparer) {
+		c.concurrency = n
+	}
+}
+
+// WithPrefix returns an option that restricts the comparison to keys
+// starting with the given prefix.
+func WithPrefix(prefix string) Option {
+	return func(c *comparer) {
+		c.prefix = prefix
+	}
+}
+
+// Report holds the differences found by Compare.
+type Report struct {
+	// Keys holds the number of distinct keys found in either store.
+	Keys int
+
+	// Compared holds the number of keys found in both stores whose
+	// entries were compared.
+	Compared int
+
+	// OnlyInA and OnlyInB hold, in sorted order, the keys that were
+	// found in only one of the stores.
+	OnlyInA []string
+	OnlyInB []string
+
+	// Mismatches holds, sorted by key, the compared entries that
+	// differ between the stores.
+	Mismatches []Mismatch
+}
+
+// Mismatch describes an entry that differs between two stores.
+type Mismatch struct {
+	// Key holds the key of the entry.
+	Key string
+
+	// HashA and HashB hold the SHA-256 hashes of the entry's value
+	// in each store.
+	HashA, HashB [sha256.Size]byte
+
+	// ExpireA and ExpireB hold the entry's expiry time in each
+	// store. They are only compared when both stores implement
+	// simplekv.ExpiryReader, and are otherwise left zero.
+	ExpireA, ExpireB time.Time
+}
+
+// ValueDiffers reports whether the entry's values differ.
+func (m Mismatch) ValueDiffers() bool {
+	return m.HashA != m.HashB
+}
+
+// ExpireDiffers reports whether the entry's expiry times differ.
+func (m Mismatch) ExpireDiffers() bool {
+	return !m.ExpireA.Equal(m.ExpireB)
+}
+
+// Converged reports whether no differences were found.
+func (r *Report) Converged() bool {
+	return len(r.OnlyInA) == 0 && len(r.OnlyInB) == 0 && len(r.Mismatches) == 0
+}
+
+// String returns the differences in r, one per line. Keys found only
+// in A are prefixed with "-", keys found only in B with "+", and
+// entries that differ with "~".
+func (r *Report) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d keys, %d compared, %d differences\n", r.Keys, r.Compared, len(r.OnlyInA)+len(r.OnlyInB)+len(r.Mismatches))
+	for _, key := range r.OnlyInA {
+		fmt.Fprintf(&buf, "- %q\n", key)
+	}
+	for _, key := range r.OnlyInB {
+		fmt.Fprintf(&buf, "+ %q\n", key)
+	}
+	for _, m := range r.Mismatches {
+		if m.ValueDiffers() {
+			fmt.Fprintf(&buf, "~ %q: value %x != %x\n", m.Key, m.HashA[:8], m.HashB[:8])
+		}
+		if m.ExpireDiffers() {
+			fmt.Fprintf(&buf, "~ %q: expiry %s != %s\n", m.Key, formatExpire(m.ExpireA), formatExpire(m.ExpireB))
+		}
+	}
+	return buf.String()
+}
+
+func formatExpire(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+type comparer struct {
+	a, b        simplekv.KeyLister
+	sampleRate  float64
+	concurrency int
+	prefix      string
+}
+
+// Compare compares the entries of stores a and b and returns a report
+// of the differences. Keys are compared in full; the values and, when
+// both stores implement simplekv.ExpiryReader, the expiry times of
+// the sampled keys found in both stores are compared as well. Entries
+// that are removed while the comparison is in progress are reported
+// as missing from the store they were removed from.
+//
+// Compare returns an error only if a store operation fails; the first
+// such error stops the comparison.
+func Compare(ctx context.Context, a, b simplekv.KeyLister, opts ...Option) (*Report, error) {
+	c := &comparer{
+		a:           a,
+		b:           b,
+		sampleRate:  1,
+		concurrency: DefaultConcurrency,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.concurrency < 1 {
+		c.concurrency = 1
+	}
+	return c.compare(ctx)
+}
+
+func (c *comparer) compare(ctx context.Context) (*Report, error) {
+	keysA, err := c.a.KeysWithPrefix(ctx, c.prefix)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot list keys in store A", errgo.Any)
+	}
+	keysB, err := c.b.KeysWithPrefix(ctx, c.prefix)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot list keys in store B", errgo.Any)
+	}
+	inB := make(map[string]bool, len(keysB))
+	for _, key := range keysB {
+		inB[key] = true
+	}
+	r := &Report{
+		Keys: len(keysB),
+	}
+	var both []string
+	for _, key := range keysA {
+		if !inB[key] {
+			r.Keys++
+			r.OnlyInA = append(r.OnlyInA, key)
+			continue
+		}
+		delete(inB, key)
+		if c.sampled(key) {
+			both = append(both, key)
+		}
+	}
+	for key := range inB {
+		r.OnlyInB = append(r.OnlyInB, key)
+	}
+	if err := c.compareEntries(ctx, r, both); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	sort.Strings(r.OnlyInA)
+	sort.Strings(r.OnlyInB)
+	sort.Slice(r.Mismatches, func(i, j int) bool {
+		return r.Mismatches[i].Key < r.Mismatches[j].Key
+	})
+	return r, nil
+}
+
+// sampled reports whether the entry with the given key should be
+// compared.
+func (c *comparer) sampled(key string) bool {
+	if c.sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return float64(h.Sum32()) < c.sampleRate*math.MaxUint32
+}
+
+// compareEntries compares the entries with the given keys in both
+// stores, recording the results in r.
+func (c *comparer) compareEntries(ctx context.Context, r *Report, keys []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keyc := make(chan string)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyc {
+				err := c.compareEntry(ctx, r, &mu, key)
+				if err == nil {
+					continue
+				}
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+loop:
+	for _, key := range keys {
+		select {
+		case keyc <- key:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(keyc)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return errgo.Mask(ctx.Err())
+}
+
+// compareEntry compares the entry with the given key in both stores,
+// recording the result in r with mu held.
+func (c *comparer) compareEntry(ctx context.Context, r *Report, mu *sync.Mutex, key string) error {
+	m := Mismatch{
+		Key: key,
+	}
+	hashA, expireA, foundA, err := readEntry(ctx, c.a, key)
+	if err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot read %q from store A", key), errgo.Any)
+	}
+	hashB, expireB, foundB, err := readEntry(ctx, c.b, key)
+	if err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot read %q from store B", key), errgo.Any)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case !foundA && !foundB:
+		r.Keys--
+		return nil
+	case !foundA:
+		r.OnlyInB = append(r.OnlyInB, key)
+		return nil
+	case !foundB:
+		r.OnlyInA = append(r.OnlyInA, key)
+		return nil
+	}
+	r.Compared++
+	m.HashA, m.HashB = hashA, hashB
+	_, okA := c.a.(simplekv.ExpiryReader)
+	_, okB := c.b.(simplekv.ExpiryReader)
+	if okA && okB {
+		m.ExpireA, m.ExpireB = expireA, expireB
+	}
+	if m.ValueDiffers() || m.ExpireDiffers() {
+		r.Mismatches = append(r.Mismatches, m)
+	}
+	return nil
+}
+
+// readEntry returns the hash of the value of the given key in kv and,
+// if kv implements simplekv.ExpiryReader, its expiry time. It reports
+// whether the entry was found.
+func readEntry(ctx context.Context, kv simplekv.Store, key string) (hash [sha256.Size]byte, expire time.Time, found bool, err error) {
+	v, err := kv.Get(ctx, key)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return hash, time.Time{}, false, nil
+	}
+	if err != nil {
+		return hash, time.Time{}, false, errgo.Mask(err, errgo.Any)
+	}
+	hash = sha256.Sum256(v)
+	if kv, ok := kv.(simplekv.ExpiryReader); ok {
+		expire, err = kv.GetExpiry(ctx, key)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return hash, time.Time{}, false, nil
+		}
+		if err != nil {
+			return hash, time.Time{}, false, errgo.Mask(err, errgo.Any)
+		}
+		expire = simplekv.NormalizeExpire(expire)
+	}
+	return hash, expire, true, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package kvverify_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/kvverify"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestCompareConverged(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	a := newStore(c, map[string]string{"x": "1", "y": "2", "z": ""})
+	b := newStore(c, map[string]string{"x": "1", "y": "2", "z": ""})
+
+	r, err := kvverify.Compare(ctx, a, b)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Converged(), qt.Equals, true)
+	c.Assert(r.Keys, qt.Equals, 3)
+	c.Assert(r.Compared, qt.Equals, 3)
+	c.Assert(r.String(), qt.Equals, "3 keys, 3 compared, 0 differences\n")
+}
+
+func TestCompareDifferences(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	a := newStore(c, map[string]string{"both": "v", "changed": "v1", "a-only": "v", "expiry": "v"})
+	b := newStore(c, map[string]string{"both": "v", "changed": "v2", "b-only": "v", "expiry": "v"})
+	err := b.Set(ctx, "expiry", []byte("v"), epoch.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	r, err := kvverify.Compare(ctx, a, b, kvverify.WithConcurrency(2))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Converged(), qt.Equals, false)
+	c.Assert(r.Keys, qt.Equals, 5)
+	c.Assert(r.Compared, qt.Equals, 3)
+	c.Assert(r.OnlyInA, qt.DeepEquals, []string{"a-only"})
+	c.Assert(r.OnlyInB, qt.DeepEquals, []string{"b-only"})
+	c.Assert(r.Mismatches, qt.HasLen, 2)
+	c.Assert(r.Mismatches[0].Key, qt.Equals, "changed")
+	c.Assert(r.Mismatches[0].ValueDiffers(), qt.Equals, true)
+	c.Assert(r.Mismatches[0].ExpireDiffers(), qt.Equals, false)
+	c.Assert(r.Mismatches[1].Key, qt.Equals, "expiry")
+	c.Assert(r.Mismatches[1].ValueDiffers(), qt.Equals, false)
+	c.Assert(r.Mismatches[1].ExpireA.IsZero(), qt.Equals, true)
+	c.Assert(r.Mismatches[1].ExpireB, qt.DeepEquals, epoch.Add(time.Hour))
+	c.Assert(r.String(), qt.Matches, `5 keys, 3 compared, 4 differences
+- "a-only"
+\+ "b-only"
+~ "changed": value [0-9a-f]{16} != [0-9a-f]{16}
+~ "expiry": expiry never != 2018-01-01T01:00:00Z
+`)
+}
+
+func TestCompareWithPrefix(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	a := newStore(c, map[string]string{"p/x": "1", "q/x": "1"})
+	b := newStore(c, map[string]string{"p/x": "1", "q/x": "2", "q/y": "1"})
+
+	r, err := kvverify.Compare(ctx, a, b, kvverify.WithPrefix("p/"))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Converged(), qt.Equals, true)
+	c.Assert(r.Keys, qt.Equals, 1)
+}
+
+func TestCompareSampled(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	valsA := make(map[string]string)
+	valsB := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key", i)
+		valsA[key] = "a"
+		valsB[key] = "b"
+	}
+	a := newStore(c, valsA)
+	b := newStore(c, valsB)
+
+	r, err := kvverify.Compare(ctx, a, b, kvverify.WithSampleRate(0.1))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Keys, qt.Equals, 1000)
+	if r.Compared < 50 || r.Compared > 150 {
+		c.Fatalf("unexpected number of keys compared: %d", r.Compared)
+	}
+	c.Assert(r.Mismatches, qt.HasLen, r.Compared)
+
+	// The same keys are sampled each time.
+	r1, err := kvverify.Compare(ctx, a, b, kvverify.WithSampleRate(0.1))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r1, qt.DeepEquals, r)
+
+	// Keys missing from one store are always reported.
+	err = b.Delete(ctx, "key1")
+	c.Assert(err, qt.Equals, nil)
+	r, err = kvverify.Compare(ctx, a, b, kvverify.WithSampleRate(0))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Compared, qt.Equals, 0)
+	c.Assert(r.OnlyInA, qt.DeepEquals, []string{"key1"})
+}
+
+func TestCompareError(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	a := newStore(c, map[string]string{"x": "1"})
+	b := newStore(c, map[string]string{"x": "1"})
+	err := b.(simplekv.Closer).Close()
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = kvverify.Compare(ctx, a, b)
+	c.Assert(err, qt.ErrorMatches, `cannot list keys in store B: .*`)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrStoreClosed)
+}
+
+func newStore(c *qt.C, vals map[string]string) simplekv.KeyLister {
+	kv := memsimplekv.NewStore(memsimplekv.WithClock(clock{})).(simplekv.KeyLister)
+	for key, val := range vals {
+		err := kv.Set(context.Background(), key, []byte(val), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	return kv
+}
+
+type clock struct{}
+
+func (clock) Now() time.Time {
+	return epoch
+}
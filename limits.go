@@ -0,0 +1,62 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrValueTooLarge is the error cause used when a value is larger
+// than a store can hold.
+var ErrValueTooLarge = errgo.New("value too large")
+
+// KeyLimiter is implemented by stores that accept only keys shorter
+// than MaxKeyLen, for example because they add a prefix to each key
+// before passing it to another store.
+type KeyLimiter interface {
+	Store
+
+	// MaxKeyLen returns the maximum length of a key in bytes.
+	MaxKeyLen() int
+}
+
+// KeyLimit returns the maximum length of a key that can be used with
+// the given store.
+func KeyLimit(kv Store) int {
+	if kv, ok := kv.(KeyLimiter); ok {
+		return kv.MaxKeyLen()
+	}
+	return MaxKeyLen
+}
+
+// ValueLimiter is implemented by stores that limit the size of the
+// values they can hold. Such stores return an error with a cause of
+// ErrValueTooLarge when asked to store a larger value, before
+// attempting to write it, so that callers can store it some other way
+// (for example by splitting it into several entries).
+type ValueLimiter interface {
+	Store
+
+	// MaxValueLen returns the maximum length of a value in bytes.
+	MaxValueLen() int
+}
+
+// MaxValueLen returns the maximum length of a value that can be held
+// by the given store, or 0 if the store does not advertise a limit.
+func MaxValueLen(kv Store) int {
+	if kv, ok := kv.(ValueLimiter); ok {
+		return kv.MaxValueLen()
+	}
+	return 0
+}
+
+// CheckValue returns an error with a cause of ErrValueTooLarge if the
+// given value is longer than maxLen. Store implementations that
+// implement ValueLimiter call it before writing a value.
+func CheckValue(value []byte, maxLen int) error {
+	if len(value) > maxLen {
+		return errgo.WithCausef(nil, ErrValueTooLarge, "value of %d bytes exceeds maximum length of %d", len(value), maxLen)
+	}
+	return nil
+}
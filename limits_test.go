@@ -0,0 +1,54 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestMaxValueLen(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(simplekv.MaxValueLen(memsimplekv.NewStore()), qt.Equals, 0)
+	c.Assert(simplekv.MaxValueLen(limitedStore{Store: memsimplekv.NewStore()}), qt.Equals, 10)
+}
+
+func TestCheckValue(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(simplekv.CheckValue(make([]byte, 10), 10), qt.Equals, nil)
+	err := simplekv.CheckValue(make([]byte, 11), 10)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+	c.Assert(err, qt.ErrorMatches, `value of 11 bytes exceeds maximum length of 10`)
+}
+
+func TestKeyLimit(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(simplekv.KeyLimit(memsimplekv.NewStore()), qt.Equals, simplekv.MaxKeyLen)
+	c.Assert(simplekv.KeyLimit(limitedStore{Store: memsimplekv.NewStore()}), qt.Equals, 20)
+}
+
+func TestCheckKeyLen(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(simplekv.CheckKeyLen("0123456789", 10), qt.Equals, nil)
+	err := simplekv.CheckKeyLen("0123456789a", 10)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrKeyTooLarge)
+	c.Assert(err, qt.ErrorMatches, `key of 11 bytes exceeds maximum length of 10`)
+}
+
+type limitedStore struct {
+	simplekv.Store
+}
+
+func (limitedStore) MaxValueLen() int {
+	return 10
+}
+
+func (limitedStore) MaxKeyLen() int {
+	return 20
+}
@@ -4,25 +4,94 @@
 package memsimplekv
 
 import (
+	"bytes"
 	"context"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	errgo "gopkg.in/errgo.v1"
-
 	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
 )
 
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithClock returns an option that makes the store use the given
+// clock to decide whether entries have expired. By default the
+// system clock is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages to the given logger.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// WithSweepInterval returns an option that sets how often expired
+// entries are removed from memory. Sweeping happens when a value is
+// written, so an idle store will not sweep at all. If the interval is
+// zero or negative, expired entries are never removed, although they
+// are still not visible. The default interval is one minute.
+func WithSweepInterval(d time.Duration) Option {
+	return func(s *kvStore) {
+		s.sweepInterval = d
+	}
+}
+
 // NewStore returns a new Store instance.
-func NewStore() simplekv.Store {
-	return &kvStore{
-		data: make(map[string][]byte),
+func NewStore(opts ...Option) simplekv.Store {
+	s := &kvStore{
+		data:          make(map[string]entry),
+		clock:         systemClock{},
+		logger:        nopLogger{},
+		sweepInterval: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.lastSweep = s.clock.Now()
+	return s
 }
 
 type kvStore struct {
-	mu   sync.Mutex
-	data map[string][]byte
+	clock         simplekv.Clock
+	logger        simplekv.Logger
+	sweepInterval time.Duration
+
+	mu        sync.Mutex
+	data      map[string]entry
+	lastSweep time.Time
+
+	// lastRev holds the revision assigned to the most recently
+	// written entry.
+	lastRev int64
+
+	// closed holds whether Close has been called.
+	closed bool
+}
+
+type entry struct {
+	value  []byte
+	expire time.Time
+	rev    int64
+
+	// metadata holds the metadata set by SetMetadata, which is
+	// discarded when the value is written.
+	metadata map[string]string
+}
+
+// expired reports whether the entry has expired at the given time.
+func (e entry) expired(now time.Time) bool {
+	return !e.expire.IsZero() && !now.Before(e.expire)
 }
 
 // Context implements simplekv.Store.Context by returning the given
@@ -33,50 +102,597 @@ func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func())
 
 // Get implements simplekv.Store.Get.
 func (s *kvStore) Get(_ context.Context, key string) ([]byte, error) {
-	s.mu.Lock()
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
 	defer s.mu.Unlock()
-	v, ok := s.data[key]
+	e, ok := s.get(key)
 	if !ok {
 		return nil, simplekv.KeyNotFoundError(key)
 	}
-	return v, nil
+	return e.value, nil
 }
 
-// Set implements simplekv.Store.Set.
-func (s *kvStore) Set(_ context.Context, key string, value []byte, _ time.Time) error {
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(_ context.Context, key string) (bool, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	_, ok := s.get(key)
+	return ok, nil
+}
+
+// lock acquires s.mu. If the store has been closed, it returns an
+// error with a cause of simplekv.ErrStoreClosed instead, without
+// holding the lock.
+func (s *kvStore) lock() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errgo.WithCausef(nil, simplekv.ErrStoreClosed, "")
+	}
+	return nil
+}
+
+// Close implements simplekv.Closer.Close by discarding all entries.
+// Closing a store more than once has no further effect.
+func (s *kvStore) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.closed = true
+	s.data = nil
+	return nil
+}
+
+// get returns the unexpired entry for the given key.
+// It must be called with s.mu held.
+func (s *kvStore) get(key string) (entry, bool) {
+	e, ok := s.data[key]
+	if !ok || e.expired(s.clock.Now()) {
+		return entry{}, false
+	}
+	return e, true
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(_ context.Context, key string, value []byte, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.set(key, value, expire)
+	return nil
+}
+
+// set sets the entry for the given key, sweeping expired entries
+// if it is time to do so, and returns the entry's new revision.
+// It must be called with s.mu held.
+func (s *kvStore) set(key string, value []byte, expire time.Time) int64 {
 	if value == nil {
 		value = []byte{}
 	}
-	s.data[key] = value
+	s.lastRev++
+	s.data[key] = entry{
+		value:  value,
+		expire: simplekv.NormalizeExpire(expire),
+		rev:    s.lastRev,
+	}
+	s.maybeSweep()
+	return s.lastRev
+}
+
+// maybeSweep removes expired entries if the sweep interval has
+// elapsed since the last sweep. It must be called with s.mu held.
+func (s *kvStore) maybeSweep() {
+	if s.sweepInterval <= 0 {
+		return
+	}
+	now := s.clock.Now()
+	if now.Sub(s.lastSweep) < s.sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	n := 0
+	for k, e := range s.data {
+		if e.expired(now) {
+			delete(s.data, k)
+			n++
+		}
+	}
+	if n > 0 {
+		s.logger.Debugf("removed %d expired entries", n)
+	}
+}
+
+// SetTTL implements simplekv.TTLSetter.SetTTL by computing the
+// expiry time with the store's clock.
+func (s *kvStore) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return errgo.Mask(s.Set(ctx, key, value, simplekv.ExpireAfter(s.clock.Now(), ttl)), errgo.Is(simplekv.ErrKeyTooLarge))
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti. The entries
+// are written atomically.
+func (s *kvStore) SetMulti(_ context.Context, entries []simplekv.Entry) error {
+	for _, e := range entries {
+		if err := simplekv.CheckKey(e.Key); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+		}
+	}
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		s.set(e.Key, e.Value, e.Expire)
+	}
 	return nil
 }
 
 // Update implements simplekv.Store.Update.
 func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
-	s.mu.Lock()
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return err
+	}
 	defer s.mu.Unlock()
-	newVal, err := getVal(s.data[key])
+	old, _ := s.get(key)
+	newVal, err := getVal(old.value)
 	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
-	if newVal == nil {
-		newVal = []byte{}
+	s.set(key, newVal, expire)
+	return nil
+}
+
+// UpdateTTL implements simplekv.TTLSetter.UpdateTTL by computing the
+// expiry time with the store's clock.
+func (s *kvStore) UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	return errgo.Mask(s.Update(ctx, key, simplekv.ExpireAfter(s.clock.Now(), ttl), getVal), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals.
+func (s *kvStore) SetIfEquals(_ context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return err
 	}
-	s.data[key] = newVal
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if ok != (oldVal != nil) || !bytes.Equal(e.value, oldVal) {
+		return simplekv.KeyConflictError(key)
+	}
+	s.set(key, newVal, expire)
 	return nil
 }
 
-// Keys implements simplekv.Store.Keys.
-func (s *kvStore) Keys(_ context.Context) ([]string, error) {
-	s.mu.Lock()
+// GetWithRevision implements simplekv.Revisioner.GetWithRevision.
+func (s *kvStore) GetWithRevision(_ context.Context, key string) ([]byte, string, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return nil, "", err
+	}
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		return nil, "", simplekv.KeyNotFoundError(key)
+	}
+	return e.value, formatRev(e.rev), nil
+}
+
+// SetWithRevision implements simplekv.Revisioner.SetWithRevision.
+func (s *kvStore) SetWithRevision(_ context.Context, key string, value []byte, expire time.Time) (string, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+	return formatRev(s.set(key, value, expire)), nil
+}
+
+// UpdateWithRevision implements simplekv.Revisioner.UpdateWithRevision.
+func (s *kvStore) UpdateWithRevision(_ context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) (string, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+	old, _ := s.get(key)
+	newVal, err := getVal(old.value)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	return formatRev(s.set(key, newVal, expire)), nil
+}
+
+// SetAt implements simplekv.Revisioner.SetAt.
+func (s *kvStore) SetAt(_ context.Context, key string, value []byte, expire time.Time, rev string) (string, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return "", err
+	}
+	defer s.mu.Unlock()
+	oldRev := ""
+	if e, ok := s.get(key); ok {
+		oldRev = formatRev(e.rev)
+	}
+	if oldRev != rev {
+		return "", simplekv.KeyConflictError(key)
+	}
+	return formatRev(s.set(key, value, expire)), nil
+}
+
+// formatRev returns the revision string for the given entry revision.
+func formatRev(rev int64) string {
+	return strconv.FormatInt(rev, 10)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(_ context.Context, key string, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		return simplekv.KeyNotFoundError(key)
+	}
+	s.set(key, e.value, expire)
+	// The value is unchanged, so the metadata is kept.
+	e1 := s.data[key]
+	e1.metadata = e.metadata
+	s.data[key] = e1
+	return nil
+}
+
+// GetExpiry implements simplekv.ExpiryReader.GetExpiry.
+func (s *kvStore) GetExpiry(_ context.Context, key string) (time.Time, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return time.Time{}, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return time.Time{}, err
+	}
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		return time.Time{}, simplekv.KeyNotFoundError(key)
+	}
+	return e.expire, nil
+}
+
+// GetMetadata implements simplekv.MetadataStore.GetMetadata.
+func (s *kvStore) GetMetadata(_ context.Context, key string) (map[string]string, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return copyMetadata(e.metadata), nil
+}
+
+// SetMetadata implements simplekv.MetadataStore.SetMetadata. Setting
+// the metadata does not change the revision of the entry.
+func (s *kvStore) SetMetadata(_ context.Context, key string, md map[string]string) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckMetadata(md); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		return simplekv.KeyNotFoundError(key)
+	}
+	e.metadata = copyMetadata(md)
+	s.data[key] = e
+	return nil
+}
+
+// copyMetadata returns a copy of md, or nil if md is empty.
+func copyMetadata(md map[string]string) map[string]string {
+	if len(md) == 0 {
+		return nil
+	}
+	md1 := make(map[string]string, len(md))
+	for k, v := range md {
+		md1[k] = v
+	}
+	return md1
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(_ context.Context, key string) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if _, ok := s.get(key); !ok {
+		return simplekv.KeyNotFoundError(key)
+	}
+	delete(s.data, key)
+	return nil
+}
+
+// Txn implements simplekv.Transactor.Txn. The store is locked while f
+// runs, so the transaction is isolated from all other operations and
+// f must not call methods on the store itself.
+func (s *kvStore) Txn(_ context.Context, f func(tx simplekv.Tx) error) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	tx := &txn{
+		s:      s,
+		writes: make(map[string]*entry),
+	}
+	if err := f(tx); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for key, e := range tx.writes {
+		if e == nil {
+			delete(s.data, key)
+		} else {
+			s.set(key, e.value, e.expire)
+		}
+	}
+	return nil
+}
+
+// txn implements simplekv.Tx. Its methods are called with s.mu held.
+type txn struct {
+	s *kvStore
+
+	// writes holds the entries written in the transaction. A nil
+	// entry records a deletion.
+	writes map[string]*entry
+}
+
+// Get implements simplekv.Tx.Get.
+func (tx *txn) Get(key string) ([]byte, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	e, ok := tx.get(key)
+	if !ok {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return e.value, nil
+}
+
+// Set implements simplekv.Tx.Set.
+func (tx *txn) Set(key string, value []byte, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	tx.writes[key] = &entry{
+		value:  value,
+		expire: simplekv.NormalizeExpire(expire),
+	}
+	return nil
+}
+
+// Delete implements simplekv.Tx.Delete.
+func (tx *txn) Delete(key string) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if _, ok := tx.get(key); !ok {
+		return simplekv.KeyNotFoundError(key)
+	}
+	tx.writes[key] = nil
+	return nil
+}
+
+// get returns the entry for the given key as seen by the transaction.
+func (tx *txn) get(key string) (entry, bool) {
+	if e, ok := tx.writes[key]; ok {
+		if e == nil || e.expired(tx.s.clock.Now()) {
+			return entry{}, false
+		}
+		return *e, true
+	}
+	return tx.s.get(key)
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead. The
+// store is locked while f runs, so f must not call methods on the
+// store itself.
+func (s *kvStore) SnapshotRead(_ context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	return errgo.Mask(f(snapshotTx{s}), errgo.Any)
+}
+
+// snapshotTx implements simplekv.SnapshotTx. Its methods are called
+// with s.mu held.
+type snapshotTx struct {
+	s *kvStore
+}
+
+// Get implements simplekv.SnapshotTx.Get.
+func (tx snapshotTx) Get(key string) ([]byte, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	e, ok := tx.s.get(key)
+	if !ok {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return e.value, nil
+}
+
+// KeysWithPrefix implements simplekv.SnapshotTx.KeysWithPrefix.
+func (tx snapshotTx) KeysWithPrefix(prefix string) ([]string, error) {
+	return tx.s.keysWithPrefix(prefix), nil
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	return s.KeysWithPrefix(ctx, "")
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *kvStore) KeysWithPrefix(_ context.Context, prefix string) ([]string, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
 	defer s.mu.Unlock()
-	keys := make([]string, len(s.data))
-	i := 0
-	for k, _ := range s.data {
-		keys[i] = k
-		i++
+	return s.keysWithPrefix(prefix), nil
+}
+
+// keysWithPrefix returns the unexpired keys that start with the given
+// prefix. It must be called with s.mu held.
+func (s *kvStore) keysWithPrefix(prefix string) []string {
+	now := s.clock.Now()
+	keys := make([]string, 0, len(s.data))
+	for k, e := range s.data {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			keys = append(keys, k)
+		}
 	}
-	return keys, nil
+	return keys
+}
+
+// Count implements simplekv.Counter.Count.
+func (s *kvStore) Count(ctx context.Context) (int, error) {
+	return s.CountWithPrefix(ctx, "")
 }
+
+// CountWithPrefix implements simplekv.Counter.CountWithPrefix.
+func (s *kvStore) CountWithPrefix(_ context.Context, prefix string) (int, error) {
+	if err := s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	n := 0
+	for k, e := range s.data {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Iterate implements simplekv.Iterable.Iterate. The entries are
+// captured when Iterate is called.
+func (s *kvStore) Iterate(_ context.Context, prefix string) (simplekv.Iterator, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	var iter iterator
+	for k, e := range s.data {
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			iter.keys = append(iter.keys, k)
+			iter.values = append(iter.values, e.value)
+		}
+	}
+	sort.Sort(&iter)
+	iter.pos = -1
+	return &iter, nil
+}
+
+// iterator implements simplekv.Iterator over a fixed set of entries.
+type iterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+}
+
+// Next implements simplekv.Iterator.Next.
+func (iter *iterator) Next() bool {
+	if iter.pos < len(iter.keys) {
+		iter.pos++
+	}
+	return iter.pos < len(iter.keys)
+}
+
+// Key implements simplekv.Iterator.Key.
+func (iter *iterator) Key() string {
+	return iter.keys[iter.pos]
+}
+
+// Value implements simplekv.Iterator.Value.
+func (iter *iterator) Value() []byte {
+	return iter.values[iter.pos]
+}
+
+// Err implements simplekv.Iterator.Err.
+func (iter *iterator) Err() error {
+	return nil
+}
+
+// Close implements simplekv.Iterator.Close.
+func (iter *iterator) Close() error {
+	iter.pos = len(iter.keys)
+	return nil
+}
+
+// Len, Less and Swap implement sort.Interface.
+func (iter *iterator) Len() int {
+	return len(iter.keys)
+}
+
+func (iter *iterator) Less(i, j int) bool {
+	return iter.keys[i] < iter.keys[j]
+}
+
+func (iter *iterator) Swap(i, j int) {
+	iter.keys[i], iter.keys[j] = iter.keys[j], iter.keys[i]
+	iter.values[i], iter.values[j] = iter.values[j], iter.values[i]
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
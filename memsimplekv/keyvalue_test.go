@@ -4,11 +4,18 @@
 package memsimplekv_test
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
 
 	"github.com/juju/simplekv"
-	"github.com/juju/simplekv/internal/simplekvtest"
 	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
 )
 
 func TestMemStore(t *testing.T) {
@@ -16,3 +23,107 @@ func TestMemStore(t *testing.T) {
 		return memsimplekv.NewStore(), nil
 	})
 }
+
+func BenchmarkMemStoreUpdate(b *testing.B) {
+	simplekvtest.BenchmarkUpdate(b, func() (simplekv.Store, error) {
+		return memsimplekv.NewStore(), nil
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	logger := &recordingLogger{}
+	kv := memsimplekv.NewStore(
+		memsimplekv.WithClock(clock),
+		memsimplekv.WithLogger(logger),
+		memsimplekv.WithSweepInterval(time.Hour),
+	)
+
+	err := kv.Set(ctx, "test-key", []byte("test-value"), clock.now.Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "test-key-2", []byte("test-value-2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	v, err := kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "test-value")
+
+	expire, err := kv.(simplekv.ExpiryReader).GetExpiry(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expire, qt.DeepEquals, clock.now.Add(time.Minute))
+	expire, err = kv.(simplekv.ExpiryReader).GetExpiry(ctx, "test-key-2")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expire.IsZero(), qt.Equals, true)
+
+	clock.now = clock.now.Add(time.Minute)
+	_, err = kv.Get(ctx, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	_, err = kv.(simplekv.ExpiryReader).GetExpiry(ctx, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	keys, err := kv.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.DeepEquals, []string{"test-key-2"})
+
+	err = kv.Update(ctx, "test-key", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(old, qt.IsNil)
+		return []byte("new-value"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(logger.msgs, qt.HasLen, 0)
+
+	// Once the sweep interval has passed, the expired
+	// entry is removed on the next write.
+	err = kv.Set(ctx, "test-key-3", []byte("x"), clock.now)
+	c.Assert(err, qt.Equals, nil)
+	clock.now = clock.now.Add(time.Hour)
+	err = kv.Set(ctx, "test-key-4", []byte("x"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(logger.msgs, qt.DeepEquals, []string{"removed 1 expired entries"})
+}
+
+func TestTTL(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	kv := memsimplekv.NewStore(memsimplekv.WithClock(clock))
+
+	// The expiry time is computed with the store's clock.
+	err := simplekv.SetTTL(ctx, kv, "a", []byte("a"), time.Minute)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.UpdateTTL(ctx, kv, "b", 2*time.Minute, func(old []byte) ([]byte, error) {
+		return []byte("b"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetTTL(ctx, kv, "c", []byte("c"), 0)
+	c.Assert(err, qt.Equals, nil)
+
+	clock.now = clock.now.Add(time.Minute)
+	keys, err := kv.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	sort.Strings(keys)
+	c.Assert(keys, qt.DeepEquals, []string{"b", "c"})
+
+	clock.now = clock.now.Add(time.Minute)
+	keys, err = kv.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.DeepEquals, []string{"c"})
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Debugf(f string, a ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(f, a...))
+}
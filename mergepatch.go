@@ -0,0 +1,79 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// UpdateJSON atomically applies the given JSON merge patch, as
+// defined by RFC 7386, to the JSON document stored at the given key.
+// A key with no value is treated as holding null, so patching it with
+// an object creates a new document.
+//
+// An error is returned, and the value is left unchanged, if the patch
+// or the existing value is not valid JSON.
+func UpdateJSON(ctx context.Context, kv Store, key string, patch []byte, expire time.Time) error {
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return errgo.Notef(err, "invalid merge patch")
+	}
+	err = kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		var target interface{}
+		if old != nil {
+			v, err := decodeJSON(old)
+			if err != nil {
+				return nil, errgo.Notef(err, "value of key %s is not valid JSON", key)
+			}
+			target = v
+		}
+		data, err := json.Marshal(mergePatch(target, p))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return data, nil
+	})
+	return errgo.Mask(err, errgo.Is(ErrKeyTooLarge), errgo.Is(ErrValueTooLarge), IsContention)
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers in their
+// original form so that they are not rounded.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errgo.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// mergePatch returns the result of applying patch to target, as
+// described in section 2 of RFC 7386.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for name, v := range p {
+		if v == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], v)
+		}
+	}
+	return t
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+// mergePatchTests holds the examples from appendix A of RFC 7386.
+var mergePatchTests = []struct {
+	original string
+	patch    string
+	expect   string
+}{
+	{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+	{`{"a":"b"}`, `{"a":null}`, `{}`},
+	{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+	{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+	{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+	{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+	{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+	{`{"a":"b"}`, `["c"]`, `["c"]`},
+	{`{"a":"foo"}`, `null`, `null`},
+	{`{"a":"foo"}`, `"bar"`, `"bar"`},
+	{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+	{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+	{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	// Large numbers are not rounded.
+	{`{"a":12345678901234567890}`, `{"b":1}`, `{"a":12345678901234567890,"b":1}`},
+}
+
+func TestUpdateJSON(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	for _, test := range mergePatchTests {
+		err := kv.Set(ctx, "doc", []byte(test.original), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+		err = simplekv.UpdateJSON(ctx, kv, "doc", []byte(test.patch), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+		v, err := kv.Get(ctx, "doc")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, test.expect, qt.Commentf("original %s; patch %s", test.original, test.patch))
+	}
+}
+
+func TestUpdateJSONNewKey(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+	err := simplekv.UpdateJSON(ctx, kv, "doc", []byte(`{"a":{"b":1,"c":null}}`), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := kv.Get(ctx, "doc")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, `{"a":{"b":1}}`)
+}
+
+func TestUpdateJSONErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+
+	err := simplekv.UpdateJSON(ctx, kv, "doc", []byte(`{`), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `invalid merge patch: unexpected EOF`)
+	err = simplekv.UpdateJSON(ctx, kv, "doc", []byte(`{} {}`), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `invalid merge patch: unexpected data after JSON value`)
+
+	err = kv.Set(ctx, "doc", []byte("not json"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.UpdateJSON(ctx, kv, "doc", []byte(`{"a":1}`), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `value of key doc is not valid JSON: invalid character 'o' in literal null \(expecting 'u'\)`)
+	v, err := kv.Get(ctx, "doc")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "not json")
+}
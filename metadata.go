@@ -0,0 +1,87 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// MaxMetadataLen holds the maximum total length in bytes of the keys
+// and values in the metadata of an entry.
+const MaxMetadataLen = 4096
+
+// ErrMetadataNotSupported is the error cause used by SetMetadata when
+// the store cannot hold metadata.
+var ErrMetadataNotSupported = errgo.New("metadata not supported")
+
+// MetadataStore is implemented by stores that can hold a small map of
+// strings alongside each entry, so that callers can tag entries (for
+// example with an owner or a content type) without encoding the tags
+// in the value.
+//
+// Metadata describes the current value of an entry: writing a new
+// value to the entry, by any means, removes its metadata, and the
+// metadata is removed with the entry when it is deleted or expires.
+type MetadataStore interface {
+	Store
+
+	// GetMetadata returns the metadata of the entry with the given
+	// key. An entry without metadata has nil metadata. If the entry
+	// does not exist, an error with a cause of ErrNotFound is
+	// returned.
+	GetMetadata(ctx context.Context, key string) (map[string]string, error)
+
+	// SetMetadata replaces the metadata of the existing entry with
+	// the given key, leaving its value and expiry time unchanged. A
+	// nil or empty map removes the metadata. If the entry does not
+	// exist, an error with a cause of ErrNotFound is returned. If
+	// the metadata is longer than MaxMetadataLen, an error with a
+	// cause of ErrValueTooLarge is returned.
+	SetMetadata(ctx context.Context, key string, md map[string]string) error
+}
+
+// GetMetadata returns the metadata of the given key, as described by
+// MetadataStore.GetMetadata. If kv does not implement MetadataStore,
+// no entry has metadata, so nil is returned for any key that exists.
+func GetMetadata(ctx context.Context, kv Store, key string) (map[string]string, error) {
+	if kv, ok := kv.(MetadataStore); ok {
+		md, err := kv.GetMetadata(ctx, key)
+		return md, errgo.Mask(err, errgo.Any)
+	}
+	ok, err := kv.Exists(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if !ok {
+		return nil, KeyNotFoundError(key)
+	}
+	return nil, nil
+}
+
+// SetMetadata replaces the metadata of the given key, as described by
+// MetadataStore.SetMetadata. If kv does not implement MetadataStore,
+// an error with a cause of ErrMetadataNotSupported is returned.
+func SetMetadata(ctx context.Context, kv Store, key string, md map[string]string) error {
+	if kv, ok := kv.(MetadataStore); ok {
+		return errgo.Mask(kv.SetMetadata(ctx, key, md), errgo.Any)
+	}
+	return errgo.WithCausef(nil, ErrMetadataNotSupported, "cannot set metadata of %q", key)
+}
+
+// CheckMetadata returns an error with a cause of ErrValueTooLarge if
+// the total length of the keys and values in md is greater than
+// MaxMetadataLen. Store implementations call it before writing
+// metadata.
+func CheckMetadata(md map[string]string) error {
+	n := 0
+	for k, v := range md {
+		n += len(k) + len(v)
+	}
+	if n > MaxMetadataLen {
+		return errgo.WithCausef(nil, ErrValueTooLarge, "metadata of %d bytes exceeds maximum length of %d", n, MaxMetadataLen)
+	}
+	return nil
+}
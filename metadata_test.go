@@ -0,0 +1,48 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestMetadataFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := plainStore{memsimplekv.NewStore()}
+
+	_, err := simplekv.GetMetadata(ctx, kv, "a")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	err = kv.Set(ctx, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	md, err := simplekv.GetMetadata(ctx, kv, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.IsNil)
+
+	err = simplekv.SetMetadata(ctx, kv, "a", map[string]string{"owner": "bob"})
+	c.Assert(err, qt.ErrorMatches, `cannot set metadata of "a"`)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrMetadataNotSupported)
+}
+
+func TestCheckMetadata(t *testing.T) {
+	c := qt.New(t)
+	err := simplekv.CheckMetadata(map[string]string{
+		"k": strings.Repeat("v", simplekv.MaxMetadataLen-1),
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.CheckMetadata(map[string]string{
+		"k": strings.Repeat("v", simplekv.MaxMetadataLen),
+	})
+	c.Assert(err, qt.ErrorMatches, `metadata of 4097 bytes exceeds maximum length of 4096`)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+}
@@ -0,0 +1,16 @@
+module github.com/juju/simplekv/mgosimplekv
+
+go 1.12
+
+require (
+	github.com/frankban/quicktest v1.14.0
+	github.com/juju/mgo/v2 v2.0.0-20210302023703-70d5d206e208
+	github.com/juju/mgotest v1.0.2
+	github.com/juju/simplekv v0.0.0-20261015053811-8a53b2fa50dd
+	gopkg.in/errgo.v1 v1.0.1
+	gopkg.in/retry.v1 v1.0.3
+)
+
+// The replace directive builds against the local checkout; it is
+// ignored when this module is required from elsewhere.
+replace github.com/juju/simplekv => ../
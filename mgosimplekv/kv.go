@@ -6,35 +6,216 @@ package mgosimplekv
 import (
 	"bytes"
 	"context"
+	"regexp"
 	"time"
 
 	mgo "github.com/juju/mgo/v2"
 	"github.com/juju/mgo/v2/bson"
-	errgo "gopkg.in/errgo.v1"
 	retry "gopkg.in/retry.v1"
 
 	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
 )
 
 type sessionKey struct{}
 
+func init() {
+	simplekv.RegisterContextKey(sessionKey{})
+}
+
 // kvStore implements simplekv.Store.
 type kvStore struct {
-	coll *mgo.Collection
+	coll   *mgo.Collection
+	logger simplekv.Logger
+
+	// validateOnly holds whether the schema should be validated
+	// rather than created.
+	validateOnly bool
+
+	// updateRetry holds the parameters used when Update retries
+	// after a concurrent modification.
+	updateRetry UpdateRetry
+
+	// updateObserver, if not nil, is called at the end of each
+	// Update with the number of attempts made.
+	updateObserver func(key string, attempts int)
+
+	// checkPermissions holds whether the user's privileges should be
+	// checked when the store is created.
+	checkPermissions bool
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages to the given logger.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// WithoutSchemaCreation returns an option that stops NewStore from
+// creating indexes and the schema document. Instead, NewStore checks
+// that they already exist and are up to date, and returns an error
+// describing any differences. This is useful when the database user
+// does not have permission to create indexes.
+func WithoutSchemaCreation() Option {
+	return func(s *kvStore) {
+		s.validateOnly = true
+	}
+}
+
+// WithPermissionCheck returns an option that makes NewStore check
+// that the authenticated user has all the privileges that the store
+// needs on its collection before using it, and return an error listing
+// any that are missing. The check passes trivially if authentication
+// is not enabled on the server.
+func WithPermissionCheck() Option {
+	return func(s *kvStore) {
+		s.checkPermissions = true
+	}
+}
+
+// UpdateRetry holds the parameters controlling how Update retries
+// when the entry is modified concurrently. Attempts are delayed
+// exponentially with jitter. Zero fields take their default values.
+type UpdateRetry struct {
+	// MaxAttempts holds the maximum number of attempts made before
+	// Update gives up with a *simplekv.ContentionError cause. If it
+	// is zero, Update keeps trying until its context is done.
+	MaxAttempts int
+
+	// Initial holds the delay before the first retry. The default
+	// is one microsecond.
+	Initial time.Duration
+
+	// MaxDelay holds the maximum delay between attempts. It is also
+	// used as the retry hint when Update gives up. The default is
+	// 500 milliseconds.
+	MaxDelay time.Duration
+
+	// Factor holds the factor that the delay is multiplied by after
+	// each attempt. The default is 2.
+	Factor float64
+}
+
+// strategy returns the retry strategy described by r.
+func (r UpdateRetry) strategy() retry.Strategy {
+	strategy := defaultUpdateStrategy
+	if r.Initial > 0 {
+		strategy.Initial = r.Initial
+	}
+	if r.MaxDelay > 0 {
+		strategy.MaxDelay = r.MaxDelay
+	}
+	if r.Factor > 0 {
+		strategy.Factor = r.Factor
+	}
+	if r.MaxAttempts > 0 {
+		return retry.LimitCount(r.MaxAttempts, strategy)
+	}
+	return strategy
+}
+
+// maxDelay returns the maximum delay between attempts described by r.
+func (r UpdateRetry) maxDelay() time.Duration {
+	if r.MaxDelay > 0 {
+		return r.MaxDelay
+	}
+	return defaultUpdateStrategy.MaxDelay
+}
+
+// WithUpdateRetry returns an option that controls how Update retries
+// after concurrent modifications. By default, Update retries until its
+// context is done.
+func WithUpdateRetry(r UpdateRetry) Option {
+	return func(s *kvStore) {
+		s.updateRetry = r
+	}
+}
+
+// WithUpdateObserver returns an option that causes f to be called at
+// the end of each call to Update with the key and the number of
+// attempts made to update it, whether or not the update succeeded.
+// This can be used to monitor contention on the store.
+func WithUpdateObserver(f func(key string, attempts int)) Option {
+	return func(s *kvStore) {
+		s.updateObserver = f
+	}
 }
 
 // NewStore returns a new Store implementation that uses
 // the given mongo collection for storage.
-func NewStore(coll *mgo.Collection) (simplekv.Store, error) {
-	if err := coll.EnsureIndex(mgo.Index{
-		Key:         []string{"expire"},
-		ExpireAfter: time.Second,
-	}); err != nil {
+func NewStore(coll *mgo.Collection, opts ...Option) (simplekv.Store, error) {
+	s, err := NewStoreContext(context.Background(), coll, opts...)
+	return s, errgo.Mask(err)
+}
+
+// NewStoreContext is like NewStore except that creating or validating
+// the indexes and schema document is abandoned if the given context is
+// done first, in which case the returned error has a cause of
+// ctx.Err(). The initialisation uses a copy of the collection's
+// session whose timeouts are limited by any deadline of the context;
+// the context is checked between initialisation steps, so a step
+// that is in progress when the context is cancelled is allowed to
+// finish.
+func NewStoreContext(ctx context.Context, coll *mgo.Collection, opts ...Option) (simplekv.Store, error) {
+	s := &kvStore{
+		coll:   coll,
+		logger: nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errgo.WithCausef(err, err, "cannot initialise collection")
+	}
+	session := coll.Database.Session.Copy()
+	defer session.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
+	}
+	// Initialise using a copy of the store that uses the new session,
+	// so that the timeouts do not apply to the store itself.
+	initStore := *s
+	initStore.coll = coll.With(session)
+	if err := initStore.init(ctx); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// The error was most likely caused by the
+			// session timing out at the context's deadline.
+			return nil, errgo.WithCausef(err, ctxErr, "cannot initialise collection")
+		}
 		return nil, errgo.Mask(err)
 	}
-	return &kvStore{
-		coll: coll,
-	}, nil
+	return s, nil
+}
+
+// init creates or validates the indexes and schema document of the
+// store's collection. It returns ctx.Err() without doing any more if
+// the context is done between steps.
+func (s *kvStore) init(ctx context.Context) error {
+	if s.checkPermissions {
+		if err := s.checkPrivileges(); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := ctx.Err(); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	if s.validateOnly {
+		return errgo.Mask(s.validateSchema())
+	}
+	if err := s.coll.EnsureIndex(expireIndex); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.checkSchema())
 }
 
 // Context implements simplekv.Context by copying the kvStore's underlying
@@ -68,18 +249,94 @@ func (s *kvStore) c(ctx context.Context) *mgo.Collection {
 
 type kvDoc struct {
 	Key    string    `bson:"_id"`
-	Value  []byte    `bson:"value'`
+	Value  []byte    `bson:"value"`
 	Expire time.Time `bson:",omitempty"`
+
+	// Metadata holds the metadata set by SetMetadata. It is held as
+	// a list rather than a document because MongoDB restricts the
+	// characters allowed in field names.
+	Metadata []metadataItem `bson:"metadata,omitempty"`
+
+	// Version is incremented every time the document is written,
+	// so that Update can detect concurrent modifications without
+	// matching on the whole value.
+	Version int64 `bson:"version"`
+}
+
+// metadataItem holds one key and value of an entry's metadata.
+type metadataItem struct {
+	Key   string `bson:"k"`
+	Value string `bson:"v"`
+}
+
+// expired reports whether the document has expired at the given time.
+func (doc *kvDoc) expired(now time.Time) bool {
+	return !doc.Expire.IsZero() && !now.Before(doc.Expire)
+}
+
+// notExpired returns a query element that matches documents that have
+// not expired at the given time. The TTL index only removes expired
+// documents periodically, so queries must exclude them explicitly.
+func notExpired(now time.Time) bson.DocElem {
+	return bson.DocElem{
+		Name: "$or",
+		Value: []bson.D{{{
+			Name:  "expire",
+			Value: bson.D{{Name: "$exists", Value: false}},
+		}}, {{
+			Name:  "expire",
+			Value: bson.D{{Name: "$gt", Value: now}},
+		}}},
+	}
+}
+
+// update returns the update operators that set a document's value and
+// expiry time and increment its version. A zero expiry time removes the
+// expire field: storing the zero time would cause the TTL index to
+// remove the document.
+func update(value []byte, expire time.Time) bson.D {
+	set := bson.D{{
+		Name:  "value",
+		Value: value,
+	}}
+	// Metadata describes the value, so it is removed whenever the
+	// value is written.
+	unset := bson.D{{Name: "metadata", Value: 1}}
+	if expire.IsZero() {
+		unset = append(unset, bson.DocElem{Name: "expire", Value: 1})
+	} else {
+		set = append(set, bson.DocElem{
+			Name:  "expire",
+			Value: simplekv.NormalizeExpire(expire),
+		})
+	}
+	return bson.D{{
+		Name:  "$set",
+		Value: set,
+	}, {
+		Name:  "$unset",
+		Value: unset,
+	}, {
+		Name:  "$inc",
+		Value: bson.D{{Name: "version", Value: 1}},
+	}}
 }
 
 // Get implements simplekv.Store.Get by retrieving the document with
 // the given key from the store's collection.
 func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
 	coll := s.c(ctx)
 	defer coll.Database.Session.Close()
 
 	var doc kvDoc
-	if err := coll.FindId(key).One(&doc); err != nil {
+	err := coll.Find(bson.D{{
+		Name:  "_id",
+		Value: key,
+	}, notExpired(time.Now())}).One(&doc)
+	if err != nil {
 		if errgo.Cause(err) == mgo.ErrNotFound {
 			return nil, simplekv.KeyNotFoundError(key)
 		}
@@ -88,23 +345,82 @@ func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
 	return doc.Value, nil
 }
 
+// Exists implements simplekv.Store.Exists by counting the documents
+// with the given key, which does not fetch the value.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	n, err := coll.Find(bson.D{{
+		Name:  "_id",
+		Value: key,
+	}, notExpired(time.Now())}).Count()
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return n > 0, nil
+}
+
 // Set implements simplekv.Store.Set by upserting the document with
 // the given key, value and expire time into the store's collection.
 func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckValue(value, maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
 	coll := s.c(ctx)
 	defer coll.Database.Session.Close()
 
-	_, err := coll.UpsertId(key, bson.D{{
-		"$set", bson.D{{
-			"value", value,
-		}, {
-			"expire", expire,
-		}},
-	}})
+	_, err := coll.UpsertId(key, update(value, expire))
+	return errgo.Mask(err)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by upserting all
+// the entries in a single ordered bulk operation. The entries are not
+// written atomically: if an error is returned, some of them may have
+// been written.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	for _, e := range entries {
+		if err := simplekv.CheckKey(e.Key); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+		}
+		if err := simplekv.CheckValue(e.Value, maxValueLen); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	bulk := coll.Bulk()
+	for _, e := range entries {
+		bulk.Upsert(bson.D{{
+			Name:  "_id",
+			Value: e.Key,
+		}}, update(e.Value, e.Expire))
+	}
+	_, err := bulk.Run()
 	return errgo.Mask(err)
 }
 
-var updateStrategy = retry.Exponential{
+// maxValueLen holds the maximum length of a value. MongoDB limits
+// documents to 16MiB; the remainder allows for the key and the other
+// fields of the document.
+const maxValueLen = 16<<20 - 4<<10
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen.
+func (s *kvStore) MaxValueLen() int {
+	return maxValueLen
+}
+
+var defaultUpdateStrategy = retry.Exponential{
 	Initial:  time.Microsecond,
 	Factor:   2,
 	MaxDelay: 500 * time.Millisecond,
@@ -113,13 +429,21 @@ var updateStrategy = retry.Exponential{
 
 // Update implements simplekv.Store.Update.
 func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
 	coll := s.c(ctx)
 	defer coll.Database.Session.Close()
 
-	r := retry.StartWithCancel(updateStrategy, nil, ctx.Done())
+	r := retry.StartWithCancel(s.updateRetry.strategy(), nil, ctx.Done())
+	if s.updateObserver != nil {
+		defer func() {
+			s.updateObserver(key, r.Count())
+		}()
+	}
 	for r.Next() {
 		var doc kvDoc
-		if err := coll.Find(bson.D{{"_id", key}}).One(&doc); err != nil {
+		if err := coll.Find(bson.D{{Name: "_id", Value: key}}).One(&doc); err != nil {
 			if errgo.Cause(err) != mgo.ErrNotFound {
 				return errgo.Mask(err)
 			}
@@ -127,10 +451,14 @@ func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getV
 			if err != nil {
 				return errgo.Mask(err, errgo.Any)
 			}
+			if err := simplekv.CheckValue(newVal, maxValueLen); err != nil {
+				return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+			}
 			err = coll.Insert(kvDoc{
-				Key:    key,
-				Value:  newVal,
-				Expire: expire,
+				Key:     key,
+				Value:   newVal,
+				Expire:  simplekv.NormalizeExpire(expire),
+				Version: 1,
 			})
 			if err == nil {
 				return nil
@@ -140,26 +468,39 @@ func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getV
 			}
 			// A new document has been inserted after we did the FindId and before Insert,
 			// so try again.
+			s.logger.Debugf("retrying update of key %q after concurrent insert", key)
 			continue
 		}
-		newVal, err := getVal(doc.Value)
+		old := doc.Value
+		if doc.expired(time.Now()) {
+			// The document has expired but has not yet been
+			// removed, so treat it as if it did not exist.
+			old = nil
+		}
+		newVal, err := getVal(old)
 		if err != nil {
 			return errgo.Mask(err, errgo.Any)
 		}
-		if bytes.Equal(newVal, doc.Value) {
+		if err := simplekv.CheckValue(newVal, maxValueLen); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+		if old != nil && bytes.Equal(newVal, old) && doc.Expire.Equal(simplekv.NormalizeExpire(expire)) {
+			// Neither the value nor the expiry time has changed.
 			return nil
 		}
+		var version interface{} = doc.Version
+		if doc.Version == 0 {
+			// The document was written before versions were
+			// recorded; a null query matches the missing field.
+			version = nil
+		}
 		err = coll.Update(bson.D{{
-			"_id", key,
+			Name:  "_id",
+			Value: key,
 		}, {
-			"value", doc.Value,
-		}}, bson.D{{
-			"$set", bson.D{{
-				"value", newVal,
-			}, {
-				"expire", expire,
-			}},
-		}})
+			Name:  "version",
+			Value: version,
+		}}, update(newVal, expire))
 		if err == nil {
 			return nil
 		}
@@ -168,28 +509,322 @@ func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getV
 		}
 		// The document has been removed or updated since we retrieved it,
 		// so try again.
+		s.logger.Debugf("retrying update of key %q after concurrent modification", key)
 	}
 	if r.Stopped() {
 		return errgo.Notef(ctx.Err(), "cannot update key")
 	}
-	return errgo.Newf("too many retry attempts trying to update key")
+	err := errgo.WithCausef(nil, &simplekv.ContentionError{
+		RetryAfter: s.updateRetry.maxDelay(),
+		Attempts:   r.Count(),
+	}, "too many retry attempts trying to update key")
+	err.(*errgo.Err).SetLocation(0)
+	return err
 }
 
-// Keys implements simplekv.Store.Keys.
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// upserting the document when oldVal is nil and otherwise updating
+// it only if it holds oldVal.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckValue(newVal, maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	now := time.Now()
+	if oldVal == nil {
+		// Replace an expired document if there is one. If there is
+		// a live document, the upsert will try to insert a
+		// document with the same _id and fail.
+		_, err := coll.Upsert(bson.D{{
+			Name:  "_id",
+			Value: key,
+		}, {
+			Name:  "expire",
+			Value: bson.D{{Name: "$lte", Value: now}},
+		}}, update(newVal, expire))
+		if mgo.IsDup(err) {
+			return simplekv.KeyConflictError(key)
+		}
+		return errgo.Mask(err)
+	}
+	err := coll.Update(bson.D{{
+		Name:  "_id",
+		Value: key,
+	}, {
+		Name:  "value",
+		Value: oldVal,
+	}, notExpired(now)}, update(newVal, expire))
+	if err == mgo.ErrNotFound {
+		return simplekv.KeyConflictError(key)
+	}
+	return errgo.Mask(err)
+}
+
+// Touch implements simplekv.Store.Touch by updating only the expire
+// field of the document with the given key.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	var set bson.DocElem
+	if expire.IsZero() {
+		set = bson.DocElem{
+			Name:  "$unset",
+			Value: bson.D{{Name: "expire", Value: 1}},
+		}
+	} else {
+		set = bson.DocElem{
+			Name:  "$set",
+			Value: bson.D{{Name: "expire", Value: simplekv.NormalizeExpire(expire)}},
+		}
+	}
+	err := coll.Update(bson.D{{
+		Name:  "_id",
+		Value: key,
+	}, notExpired(time.Now())}, bson.D{set, {
+		Name:  "$inc",
+		Value: bson.D{{Name: "version", Value: 1}},
+	}})
+	if err == mgo.ErrNotFound {
+		return simplekv.KeyNotFoundError(key)
+	}
+	return errgo.Mask(err)
+}
+
+// GetMetadata implements simplekv.MetadataStore.GetMetadata by
+// retrieving the metadata field of the document with the given key.
+func (s *kvStore) GetMetadata(ctx context.Context, key string) (map[string]string, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	var doc kvDoc
+	err := coll.Find(bson.D{{
+		Name:  "_id",
+		Value: key,
+	}, notExpired(time.Now())}).Select(bson.D{{
+		Name:  "metadata",
+		Value: 1,
+	}}).One(&doc)
+	if err != nil {
+		if errgo.Cause(err) == mgo.ErrNotFound {
+			return nil, simplekv.KeyNotFoundError(key)
+		}
+		return nil, errgo.Mask(err)
+	}
+	if len(doc.Metadata) == 0 {
+		return nil, nil
+	}
+	md := make(map[string]string, len(doc.Metadata))
+	for _, item := range doc.Metadata {
+		md[item.Key] = item.Value
+	}
+	return md, nil
+}
+
+// SetMetadata implements simplekv.MetadataStore.SetMetadata by
+// updating the metadata field of the document with the given key. The
+// document's version is not changed.
+func (s *kvStore) SetMetadata(ctx context.Context, key string, md map[string]string) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckMetadata(md); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	var op bson.D
+	if len(md) == 0 {
+		op = bson.D{{
+			Name:  "$unset",
+			Value: bson.D{{Name: "metadata", Value: 1}},
+		}}
+	} else {
+		items := make([]metadataItem, 0, len(md))
+		for k, v := range md {
+			items = append(items, metadataItem{
+				Key:   k,
+				Value: v,
+			})
+		}
+		op = bson.D{{
+			Name:  "$set",
+			Value: bson.D{{Name: "metadata", Value: items}},
+		}}
+	}
+	err := coll.Update(bson.D{{
+		Name:  "_id",
+		Value: key,
+	}, notExpired(time.Now())}, op)
+	if err == mgo.ErrNotFound {
+		return simplekv.KeyNotFoundError(key)
+	}
+	return errgo.Mask(err)
+}
+
+// Delete implements simplekv.Store.Delete by removing the document
+// with the given key from the store's collection.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	err := coll.Remove(bson.D{{
+		Name:  "_id",
+		Value: key,
+	}, notExpired(time.Now())})
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return simplekv.KeyNotFoundError(key)
+		}
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Keys implements simplekv.KeyLister.Keys.
 func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	return s.keys(ctx, prefixQuery("", time.Now()))
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	return s.keys(ctx, prefixQuery(prefix, time.Now()))
+}
+
+// prefixQuery returns a query that matches all entries with keys
+// starting with the given prefix that have not expired at the given
+// time. A non-empty prefix is matched with an anchored regular
+// expression, which can be satisfied from the _id index. Only string
+// keys are matched, so the schema document is never included.
+func prefixQuery(prefix string, now time.Time) bson.D {
+	var id interface{} = bson.D{{Name: "$type", Value: "string"}}
+	if prefix != "" {
+		id = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}
+	}
+	return bson.D{{
+		Name:  "_id",
+		Value: id,
+	}, notExpired(now)}
+}
+
+// keys returns the keys of all documents matching the given query.
+func (s *kvStore) keys(ctx context.Context, query bson.D) ([]string, error) {
 	coll := s.c(ctx)
 	defer coll.Database.Session.Close()
 
 	var keys []string
-	if err := coll.Find(bson.M{}).Distinct("_id", &keys); err != nil {
+	if err := coll.Find(query).Distinct("_id", &keys); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return keys, nil
 }
 
+// Count implements simplekv.Counter.Count.
+func (s *kvStore) Count(ctx context.Context) (int, error) {
+	return s.count(ctx, prefixQuery("", time.Now()))
+}
+
+// CountWithPrefix implements simplekv.Counter.CountWithPrefix.
+func (s *kvStore) CountWithPrefix(ctx context.Context, prefix string) (int, error) {
+	return s.count(ctx, prefixQuery(prefix, time.Now()))
+}
+
+// count returns the number of documents matching the given query.
+func (s *kvStore) count(ctx context.Context, query bson.D) (int, error) {
+	coll := s.c(ctx)
+	defer coll.Database.Session.Close()
+
+	n, err := coll.Find(query).Count()
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return n, nil
+}
+
+// Iterate implements simplekv.Iterable.Iterate using a MongoDB
+// cursor ordered by _id.
+func (s *kvStore) Iterate(ctx context.Context, prefix string) (simplekv.Iterator, error) {
+	coll := s.c(ctx)
+	return &iterator{
+		session: coll.Database.Session,
+		iter:    coll.Find(prefixQuery(prefix, time.Now())).Sort("_id").Iter(),
+	}, nil
+}
+
+// iterator implements simplekv.Iterator using an *mgo.Iter.
+type iterator struct {
+	session *mgo.Session
+	iter    *mgo.Iter
+	doc     kvDoc
+	err     error
+}
+
+// Next implements simplekv.Iterator.Next.
+func (iter *iterator) Next() bool {
+	if iter.iter == nil {
+		return false
+	}
+	iter.doc = kvDoc{}
+	if iter.iter.Next(&iter.doc) {
+		return true
+	}
+	iter.Close()
+	return false
+}
+
+// Key implements simplekv.Iterator.Key.
+func (iter *iterator) Key() string {
+	return iter.doc.Key
+}
+
+// Value implements simplekv.Iterator.Value.
+func (iter *iterator) Value() []byte {
+	if iter.doc.Value == nil {
+		return []byte{}
+	}
+	return iter.doc.Value
+}
+
+// Err implements simplekv.Iterator.Err.
+func (iter *iterator) Err() error {
+	return iter.err
+}
+
+// Close implements simplekv.Iterator.Close.
+func (iter *iterator) Close() error {
+	if iter.iter == nil {
+		return iter.err
+	}
+	if err := iter.iter.Close(); err != nil {
+		iter.err = errgo.Mask(err)
+	}
+	iter.iter = nil
+	iter.session.Close()
+	return iter.err
+}
+
 // ContextWithSession returns the given context associated with the given
 // session. When the context is passed to one of the Store methods,
 // the session will be used for database access.
 func ContextWithSession(ctx context.Context, session *mgo.Session) context.Context {
 	return context.WithValue(ctx, sessionKey{}, session)
 }
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
@@ -4,18 +4,34 @@
 package mgosimplekv_test
 
 import (
+	"context"
 	"fmt"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/mgo/v2/bson"
 	"github.com/juju/mgotest"
 	"github.com/juju/simplekv"
-	"github.com/juju/simplekv/internal/simplekvtest"
 	"github.com/juju/simplekv/mgosimplekv"
+	"github.com/juju/simplekv/simplekvtest"
 	errgo "gopkg.in/errgo.v1"
 )
 
 func TestMgoStore(t *testing.T) {
+	db := newDatabase(t)
+	defer db.Close()
+	simplekvtest.TestStore(t, newStoreFunc(db))
+}
+
+func BenchmarkMgoStoreUpdate(b *testing.B) {
+	db := newDatabase(b)
+	defer db.Close()
+	simplekvtest.BenchmarkUpdate(b, newStoreFunc(db))
+}
+
+func newDatabase(t testing.TB) *mgotest.Database {
 	db, err := mgotest.New()
 	if err != nil {
 		if errgo.Cause(err) == mgotest.ErrDisabled {
@@ -23,15 +39,219 @@ func TestMgoStore(t *testing.T) {
 		}
 		t.Fatal(err)
 	}
+	return db
+}
 
-	defer db.Close()
+// newStoreFunc returns a function that creates a new store
+// in a new collection in db each time it is called.
+func newStoreFunc(db *mgotest.Database) func() (simplekv.Store, error) {
 	var id int32
-	simplekvtest.TestStore(t, func() (_ simplekv.Store, err error) {
+	return func() (_ simplekv.Store, err error) {
 		coll := fmt.Sprintf("test%d", atomic.AddInt32(&id, 1))
 		store, err := mgosimplekv.NewStore(db.C(coll))
 		if err != nil {
 			return nil, errgo.Mask(err)
 		}
 		return store, nil
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	c := qt.New(t)
+	db := newDatabase(c)
+	defer db.Close()
+	coll := db.C("test-schema")
+
+	// An unversioned collection with existing data is migrated.
+	err := coll.Insert(bson.M{"_id": "existing", "value": []byte("x")})
+	c.Assert(err, qt.Equals, nil)
+	store, err := mgosimplekv.NewStore(coll)
+	c.Assert(err, qt.Equals, nil)
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	err = coll.FindId(bson.M{"simplekv": "schema"}).One(&doc)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(doc.Version, qt.Equals, 2)
+
+	// Existing entries have been given a version.
+	err = coll.FindId("existing").One(&doc)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(doc.Version, qt.Equals, 1)
+
+	// The schema document is not visible as a key.
+	keys, err := store.(simplekv.KeyLister).Keys(context.Background())
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.DeepEquals, []string{"existing"})
+
+	// A collection with a newer schema is rejected.
+	err = coll.UpdateId(bson.M{"simplekv": "schema"}, bson.M{"$set": bson.M{"version": 99}})
+	c.Assert(err, qt.Equals, nil)
+	_, err = mgosimplekv.NewStore(coll)
+	c.Assert(err, qt.ErrorMatches, `collection has schema version 99; this version of mgosimplekv supports up to version 2`)
+}
+
+func TestUpdateUnversionedEntry(t *testing.T) {
+	c := qt.New(t)
+	db := newDatabase(c)
+	defer db.Close()
+	coll := db.C("test-unversioned")
+	ctx := context.Background()
+
+	store, err := mgosimplekv.NewStore(coll)
+	c.Assert(err, qt.Equals, nil)
+
+	// An entry written without a version, as by an older version
+	// of this package, can still be updated.
+	err = coll.Insert(bson.M{"_id": "key", "value": []byte("old")})
+	c.Assert(err, qt.Equals, nil)
+	err = store.Update(ctx, "key", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, "old")
+		return []byte("new"), nil
 	})
+	c.Assert(err, qt.Equals, nil)
+	var doc struct {
+		Value   []byte `bson:"value"`
+		Version int    `bson:"version"`
+	}
+	err = coll.FindId("key").One(&doc)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(doc.Value), qt.Equals, "new")
+	c.Assert(doc.Version, qt.Equals, 1)
+
+	err = store.Set(ctx, "key", []byte("newer"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = coll.FindId("key").One(&doc)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(doc.Version, qt.Equals, 2)
+}
+
+func TestWithoutSchemaCreation(t *testing.T) {
+	c := qt.New(t)
+	db := newDatabase(c)
+	defer db.Close()
+	coll := db.C("test-validate")
+
+	_, err := mgosimplekv.NewStore(coll, mgosimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `collection .*test-validate does not match the expected schema: missing index on \[expire\]; missing schema document`)
+
+	_, err = mgosimplekv.NewStore(coll)
+	c.Assert(err, qt.Equals, nil)
+	_, err = mgosimplekv.NewStore(coll, mgosimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	c := qt.New(t)
+	db := newDatabase(c)
+	defer db.Close()
+	coll := db.C("test-rebuild")
+
+	_, err := mgosimplekv.NewStore(coll)
+	c.Assert(err, qt.Equals, nil)
+	err = mgosimplekv.RebuildIndexes(coll)
+	c.Assert(err, qt.Equals, nil)
+	_, err = mgosimplekv.NewStore(coll, mgosimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.Equals, nil)
+
+	// A missing index is created.
+	err = coll.DropIndex("expire")
+	c.Assert(err, qt.Equals, nil)
+	err = mgosimplekv.RebuildIndexes(coll)
+	c.Assert(err, qt.Equals, nil)
+	_, err = mgosimplekv.NewStore(coll, mgosimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestStats(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db := newDatabase(c)
+	defer db.Close()
+	coll := db.C("test-stats")
+	kv, err := mgosimplekv.NewStore(coll)
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "a", []byte("a"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "b", []byte("b"), time.Now().Add(-time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	stats, err := mgosimplekv.Stats(coll)
+	c.Assert(err, qt.Equals, nil)
+	// The expiry index may already have removed the expired entry.
+	c.Assert(stats.Entries-stats.ExpiredEntries, qt.Equals, 1)
+	c.Assert(stats.Bytes > 0, qt.Equals, true)
+}
+
+func TestUpdateRetry(t *testing.T) {
+	c := qt.New(t)
+	db := newDatabase(c)
+	defer db.Close()
+	var observed []int
+	store, err := mgosimplekv.NewStore(db.C("test-retry"),
+		mgosimplekv.WithUpdateRetry(mgosimplekv.UpdateRetry{
+			MaxAttempts: 3,
+			MaxDelay:    time.Millisecond,
+		}),
+		mgosimplekv.WithUpdateObserver(func(key string, attempts int) {
+			c.Check(key, qt.Equals, "key")
+			observed = append(observed, attempts)
+		}),
+	)
+	c.Assert(err, qt.Equals, nil)
+	ctx := context.Background()
+
+	// Modify the entry during every attempt so that the update
+	// can never succeed.
+	n := 0
+	err = store.Update(ctx, "key", time.Time{}, func(old []byte) ([]byte, error) {
+		n++
+		if err := store.Set(ctx, "key", []byte(fmt.Sprint("other", n)), time.Time{}); err != nil {
+			return nil, err
+		}
+		return []byte("value"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `too many retry attempts trying to update key`)
+	c.Assert(simplekv.IsContention(errgo.Cause(err)), qt.Equals, true)
+	c.Assert(errgo.Cause(err).(*simplekv.ContentionError).Attempts, qt.Equals, 3)
+	retryAfter, ok := simplekv.RetryAfter(err)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(retryAfter, qt.Equals, time.Millisecond)
+	c.Assert(n, qt.Equals, 3)
+
+	err = store.Update(ctx, "key", time.Time{}, func(old []byte) ([]byte, error) {
+		return []byte("value"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(observed, qt.DeepEquals, []int{3, 1})
+}
+
+func TestNewStoreContext(t *testing.T) {
+	c := qt.New(t)
+	db := newDatabase(c)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := mgosimplekv.NewStoreContext(ctx, db.C("test-cancelled"))
+	c.Assert(err, qt.ErrorMatches, `cannot initialise collection: context canceled`)
+	c.Assert(errgo.Cause(err), qt.Equals, context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	store, err := mgosimplekv.NewStoreContext(ctx, db.C("test-timeout"))
+	c.Assert(err, qt.Equals, nil)
+	err = store.Set(context.Background(), "key", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestWithPermissionCheck(t *testing.T) {
+	c := qt.New(t)
+	db := newDatabase(c)
+	defer db.Close()
+
+	// The test server either has authentication disabled or
+	// connects as a user with full privileges, so the check passes.
+	_, err := mgosimplekv.NewStore(db.C("test-permissions"), mgosimplekv.WithPermissionCheck())
+	c.Assert(err, qt.Equals, nil)
 }
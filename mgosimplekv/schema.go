@@ -0,0 +1,335 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package mgosimplekv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	mgo "github.com/juju/mgo/v2"
+	"github.com/juju/mgo/v2/bson"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// schemaVersion holds the version of the document layout used by this
+// package. When the layout changes, schemaVersion should be incremented
+// and a migration added to the migrations slice.
+const schemaVersion = 2
+
+// migrations holds the migrations between schema versions; the
+// function at index i migrates a collection from version i to
+// version i+1. Version 0 is used for collections created before the
+// schema was versioned.
+var migrations = [schemaVersion]func(*kvStore) error{
+	// Version 1 has the same layout as unversioned collections.
+	0: func(*kvStore) error { return nil },
+	// Version 2 adds a version field to each entry.
+	1: func(s *kvStore) error {
+		_, err := s.coll.UpdateAll(bson.D{{
+			Name:  "_id",
+			Value: bson.D{{Name: "$type", Value: "string"}},
+		}, {
+			Name:  "version",
+			Value: bson.D{{Name: "$exists", Value: false}},
+		}}, bson.D{{
+			Name:  "$set",
+			Value: bson.D{{Name: "version", Value: 1}},
+		}})
+		return errgo.Mask(err)
+	},
+}
+
+// expireIndex holds the index used to garbage-collect expired entries.
+var expireIndex = mgo.Index{
+	Key:         []string{"expire"},
+	ExpireAfter: time.Second,
+}
+
+// schemaID holds the _id of the document that records the schema of
+// the collection. It is not a string, so it can never clash with a
+// key.
+var schemaID = schemaKey{Name: "schema"}
+
+type schemaKey struct {
+	Name string `bson:"simplekv"`
+}
+
+// schemaDoc records the schema of a collection.
+type schemaDoc struct {
+	ID      schemaKey `bson:"_id"`
+	Version int       `bson:"version"`
+
+	// Indexes describes the indexes created on the collection.
+	Indexes []string `bson:"indexes"`
+}
+
+// indexes returns a description of the indexes that this package
+// creates on a collection.
+func indexes() []string {
+	return []string{
+		fmt.Sprintf("%v expireAfter=%v", expireIndex.Key, expireIndex.ExpireAfter),
+	}
+}
+
+// checkSchema checks the schema document in the store's collection,
+// running any migrations needed to bring it to the current version.
+// If the collection has no schema document, one is created.
+func (s *kvStore) checkSchema() error {
+	var doc schemaDoc
+	err := s.coll.FindId(schemaID).One(&doc)
+	switch {
+	case err == mgo.ErrNotFound:
+		err := s.coll.Insert(schemaDoc{
+			ID:      schemaID,
+			Version: 0,
+		})
+		if err != nil && !mgo.IsDup(err) {
+			return errgo.Notef(err, "cannot create schema document")
+		}
+		// Read it back in case another store got there first.
+		if err := s.coll.FindId(schemaID).One(&doc); err != nil {
+			return errgo.Notef(err, "cannot read schema document")
+		}
+	case err != nil:
+		return errgo.Notef(err, "cannot read schema document")
+	}
+	if doc.Version > schemaVersion {
+		return errgo.Newf("collection has schema version %d; this version of mgosimplekv supports up to version %d", doc.Version, schemaVersion)
+	}
+	for v := doc.Version; v < schemaVersion; v++ {
+		s.logger.Debugf("migrating collection %s from schema version %d to %d", s.coll.FullName, v, v+1)
+		if err := migrations[v](s); err != nil {
+			return errgo.Notef(err, "cannot migrate collection from schema version %d", v)
+		}
+		err := s.coll.Update(bson.D{{
+			Name:  "_id",
+			Value: schemaID,
+		}, {
+			Name:  "version",
+			Value: v,
+		}}, bson.D{{
+			Name: "$set",
+			Value: bson.D{{
+				Name:  "version",
+				Value: v + 1,
+			}},
+		}})
+		if err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot update schema version")
+		}
+		// If the document was not found, another store has
+		// already completed this migration.
+	}
+	want := indexes()
+	if !equalStrings(doc.Indexes, want) {
+		err := s.coll.UpdateId(schemaID, bson.D{{
+			Name: "$set",
+			Value: bson.D{{
+				Name:  "indexes",
+				Value: want,
+			}},
+		}})
+		if err != nil {
+			return errgo.Notef(err, "cannot record index configuration")
+		}
+	}
+	return nil
+}
+
+// validateSchema checks that the collection has the indexes created by
+// NewStore and a schema document for the current version, without
+// changing anything. If it does not, it returns an error listing all
+// the differences.
+func (s *kvStore) validateSchema() error {
+	var problems []string
+	indexes, err := s.coll.Indexes()
+	if err != nil {
+		return errgo.Notef(err, "cannot read indexes")
+	}
+	found := false
+	for _, index := range indexes {
+		if equalStrings(index.Key, expireIndex.Key) {
+			found = true
+			if index.ExpireAfter != expireIndex.ExpireAfter {
+				problems = append(problems, fmt.Sprintf("index on %v has expireAfter %v, want %v", index.Key, index.ExpireAfter, expireIndex.ExpireAfter))
+			}
+		}
+	}
+	if !found {
+		problems = append(problems, fmt.Sprintf("missing index on %v", expireIndex.Key))
+	}
+	var doc schemaDoc
+	switch err := s.coll.FindId(schemaID).One(&doc); {
+	case err == mgo.ErrNotFound:
+		problems = append(problems, "missing schema document")
+	case err != nil:
+		return errgo.Notef(err, "cannot read schema document")
+	case doc.Version != schemaVersion:
+		problems = append(problems, fmt.Sprintf("schema version is %d, want %d", doc.Version, schemaVersion))
+	}
+	if len(problems) > 0 {
+		return errgo.Newf("collection %s does not match the expected schema: %s", s.coll.FullName, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// RebuildIndexes drops and recreates the indexes that NewStore creates
+// on the given collection. Expired entries are not removed while the
+// expiry index is missing.
+func RebuildIndexes(coll *mgo.Collection) error {
+	indexes, err := coll.Indexes()
+	if err != nil {
+		return errgo.Notef(err, "cannot read indexes")
+	}
+	for _, index := range indexes {
+		if equalStrings(index.Key, expireIndex.Key) {
+			if err := coll.DropIndexName(index.Name); err != nil {
+				return errgo.Notef(err, "cannot drop index %s", index.Name)
+			}
+		}
+	}
+	if err := coll.EnsureIndex(expireIndex); err != nil {
+		return errgo.Notef(err, "cannot create index on %v", expireIndex.Key)
+	}
+	return nil
+}
+
+// CollectionStats holds statistics about a collection used by a
+// store.
+type CollectionStats struct {
+	// Entries holds the number of entries in the collection,
+	// including expired ones.
+	Entries int
+
+	// ExpiredEntries holds the number of entries that have expired
+	// but have not yet been removed by the expiry index.
+	ExpiredEntries int
+
+	// Bytes holds the storage used by the collection and its
+	// indexes.
+	Bytes int64
+}
+
+// Stats returns statistics about the given collection, which must be
+// used by a store created with NewStore.
+func Stats(coll *mgo.Collection) (*CollectionStats, error) {
+	var stats CollectionStats
+	var err error
+	stats.Entries, err = coll.Find(bson.D{{
+		Name:  "_id",
+		Value: bson.D{{Name: "$type", Value: "string"}},
+	}}).Count()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot count entries")
+	}
+	stats.ExpiredEntries, err = coll.Find(bson.D{{
+		Name:  "expire",
+		Value: bson.D{{Name: "$lte", Value: time.Now()}},
+	}}).Count()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot count expired entries")
+	}
+	var result struct {
+		StorageSize    int64 `bson:"storageSize"`
+		TotalIndexSize int64 `bson:"totalIndexSize"`
+	}
+	if err := coll.Database.Run(bson.D{{
+		Name:  "collStats",
+		Value: coll.Name,
+	}}, &result); err != nil {
+		return nil, errgo.Notef(err, "cannot read collection statistics")
+	}
+	stats.Bytes = result.StorageSize + result.TotalIndexSize
+	return &stats, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// privilegesResult holds the part of the result of the
+// connectionStatus command that describes the user's privileges.
+type privilegesResult struct {
+	AuthInfo struct {
+		AuthenticatedUsers []struct {
+			User string `bson:"user"`
+			DB   string `bson:"db"`
+		} `bson:"authenticatedUsers"`
+		AuthenticatedUserPrivileges []struct {
+			Resource struct {
+				DB          *string `bson:"db"`
+				Collection  *string `bson:"collection"`
+				AnyResource bool    `bson:"anyResource"`
+			} `bson:"resource"`
+			Actions []string `bson:"actions"`
+		} `bson:"authenticatedUserPrivileges"`
+	} `bson:"authInfo"`
+}
+
+// requiredActions returns the actions that the store needs to be
+// able to perform on its collection.
+func (s *kvStore) requiredActions() []string {
+	actions := []string{"find", "insert", "update", "remove"}
+	if s.validateOnly {
+		return append(actions, "listIndexes")
+	}
+	return append(actions, "createIndex")
+}
+
+// checkPrivileges checks that the authenticated user is allowed to
+// perform all the actions returned by requiredActions on the store's
+// collection, and returns an error listing any that are not allowed.
+func (s *kvStore) checkPrivileges() error {
+	var result privilegesResult
+	if err := s.coll.Database.Run(bson.D{{
+		Name:  "connectionStatus",
+		Value: 1,
+	}, {
+		Name:  "showPrivileges",
+		Value: true,
+	}}, &result); err != nil {
+		return errgo.Notef(err, "cannot check privileges")
+	}
+	if len(result.AuthInfo.AuthenticatedUsers) == 0 {
+		// Authentication is not enabled, or the connection is
+		// not authenticated; either way there are no privileges
+		// to check.
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, p := range result.AuthInfo.AuthenticatedUserPrivileges {
+		r := p.Resource
+		if !r.AnyResource {
+			if r.DB == nil || (*r.DB != "" && *r.DB != s.coll.Database.Name) {
+				continue
+			}
+			if r.Collection == nil || (*r.Collection != "" && *r.Collection != s.coll.Name) {
+				continue
+			}
+		}
+		for _, a := range p.Actions {
+			allowed[a] = true
+		}
+	}
+	var missing []string
+	for _, a := range s.requiredActions() {
+		if !allowed[a] {
+			missing = append(missing, a)
+		}
+	}
+	if len(missing) > 0 {
+		return errgo.Newf("database user lacks required privileges: %s on collection %s", strings.Join(missing, ", "), s.coll.FullName)
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package mocksimplekv provides a simplekv.Store whose behaviour is
+// programmed by tests. It is useful for testing code that uses a
+// Store without depending on the behaviour of a real backend, and for
+// injecting errors.
+//
+// Expectations are registered with the Expect* methods and matched
+// by method and key. Expectations for the same method and key are
+// matched in the order in which they were registered. A call that
+// matches no expectation fails with an error with a cause of
+// ErrUnexpectedCall. Verify reports unexpected calls and
+// expectations that were not met.
+package mocksimplekv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrUnexpectedCall is the error cause used when a method is called
+// that does not match any expectation.
+var ErrUnexpectedCall = errgo.New("unexpected call")
+
+// Store implements simplekv.Store by matching calls against
+// expectations. It is safe to call its methods concurrently.
+type Store struct {
+	mu           sync.Mutex
+	expectations []*Expectation
+	problems     []string
+}
+
+// New returns a new Store with no expectations.
+func New() *Store {
+	return &Store{}
+}
+
+// Expectation represents an expected call to a method of Store.
+type Expectation struct {
+	method string
+	key    string
+
+	// value holds the expected value for Set, the value returned
+	// from Get, or the old value passed to the update function
+	// for Update.
+	value []byte
+
+	// newValue holds the value that the update function is
+	// expected to return for Update.
+	newValue []byte
+
+	// exists holds the result returned from Exists.
+	exists bool
+
+	expire      time.Time
+	checkExpire bool
+
+	err   error
+	times int
+	calls int
+}
+
+// ExpectGet registers an expectation that Get will be called with
+// the given key. By default, Get returns an error with a cause of
+// simplekv.ErrNotFound; use Return or ReturnError to change this.
+func (s *Store) ExpectGet(key string) *Expectation {
+	return s.expect(&Expectation{
+		method: "Get",
+		key:    key,
+		err:    simplekv.KeyNotFoundError(key),
+	})
+}
+
+// ExpectExists registers an expectation that Exists will be called
+// with the given key, and will return the given result.
+func (s *Store) ExpectExists(key string, exists bool) *Expectation {
+	return s.expect(&Expectation{
+		method: "Exists",
+		key:    key,
+		exists: exists,
+	})
+}
+
+// ExpectSet registers an expectation that Set will be called with
+// the given key and value. By default any expiry time is allowed;
+// use WithExpire to check it.
+func (s *Store) ExpectSet(key string, value []byte) *Expectation {
+	return s.expect(&Expectation{
+		method: "Set",
+		key:    key,
+		value:  value,
+	})
+}
+
+// ExpectUpdate registers an expectation that Update will be called
+// with the given key. When it is, the update function is called with
+// old, and must return newValue. By default any expiry time is
+// allowed; use WithExpire to check it.
+func (s *Store) ExpectUpdate(key string, old, newValue []byte) *Expectation {
+	return s.expect(&Expectation{
+		method:   "Update",
+		key:      key,
+		value:    old,
+		newValue: newValue,
+	})
+}
+
+// ExpectTouch registers an expectation that Touch will be called
+// with the given key. By default any expiry time is allowed; use
+// WithExpire to check it.
+func (s *Store) ExpectTouch(key string) *Expectation {
+	return s.expect(&Expectation{
+		method: "Touch",
+		key:    key,
+	})
+}
+
+// ExpectDelete registers an expectation that Delete will be called
+// with the given key.
+func (s *Store) ExpectDelete(key string) *Expectation {
+	return s.expect(&Expectation{
+		method: "Delete",
+		key:    key,
+	})
+}
+
+func (s *Store) expect(e *Expectation) *Expectation {
+	e.times = 1
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expectations = append(s.expectations, e)
+	return e
+}
+
+// Return sets the value returned by an expected Get call, which will
+// then succeed. It returns e.
+func (e *Expectation) Return(value []byte) *Expectation {
+	e.value = value
+	e.err = nil
+	return e
+}
+
+// ReturnError sets the error returned by the expected call. For
+// Update, the update function is not called. It returns e.
+func (e *Expectation) ReturnError(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// WithExpire makes the expectation check that the call's expiry time
+// is equal to the given time. It returns e.
+func (e *Expectation) WithExpire(expire time.Time) *Expectation {
+	e.expire = expire
+	e.checkExpire = true
+	return e
+}
+
+// Times sets the number of times the expected call should be made.
+// If n is negative, the call may be made any number of times. It
+// returns e.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+func (e *Expectation) String() string {
+	return fmt.Sprintf("%s(%q)", e.method, e.key)
+}
+
+// Verify returns an error describing any unexpected calls and any
+// expectations that have not been met, or nil if there are none.
+func (s *Store) Verify() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	problems := append([]string(nil), s.problems...)
+	for _, e := range s.expectations {
+		if e.times >= 0 && e.calls < e.times {
+			problems = append(problems, fmt.Sprintf("%v called %d times; want %d", e, e.calls, e.times))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errgo.New(strings.Join(problems, "; "))
+}
+
+// call finds the expectation matching the given method and key and
+// records a call to it. If there is none, it records the problem and
+// returns an error.
+func (s *Store) call(method, key string) (*Expectation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.expectations {
+		if e.method == method && e.key == key && (e.times < 0 || e.calls < e.times) {
+			e.calls++
+			return e, nil
+		}
+	}
+	return nil, s.unexpected("unexpected call to %s(%q)", method, key)
+}
+
+// unexpected records a problem and returns an error with a cause of
+// ErrUnexpectedCall describing it.
+func (s *Store) unexpected(f string, a ...interface{}) error {
+	msg := fmt.Sprintf(f, a...)
+	s.problems = append(s.problems, msg)
+	return errgo.WithCausef(nil, ErrUnexpectedCall, "%s", msg)
+}
+
+func (s *Store) checkExpire(e *Expectation, expire time.Time) error {
+	if !e.checkExpire || e.expire.Equal(expire) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unexpected("%v called with expiry time %v; want %v", e, expire, e.expire)
+}
+
+// Context implements simplekv.Store.Context by returning the given
+// context unchanged and a nop close function.
+func (s *Store) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *Store) Get(_ context.Context, key string) ([]byte, error) {
+	e, err := s.call("Get", key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.value, nil
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *Store) Exists(_ context.Context, key string) (bool, error) {
+	e, err := s.call("Exists", key)
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	if e.err != nil {
+		return false, e.err
+	}
+	return e.exists, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *Store) Set(_ context.Context, key string, value []byte, expire time.Time) error {
+	e, err := s.call("Set", key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	if !bytes.Equal(value, e.value) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.unexpected("%v called with value %q; want %q", e, value, e.value)
+	}
+	if err := s.checkExpire(e, expire); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	return e.err
+}
+
+// Update implements simplekv.Store.Update.
+func (s *Store) Update(_ context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	e, err := s.call("Update", key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	if err := s.checkExpire(e, expire); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	if e.err != nil {
+		return e.err
+	}
+	newValue, err := getVal(e.value)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if !bytes.Equal(newValue, e.newValue) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.unexpected("%v produced value %q; want %q", e, newValue, e.newValue)
+	}
+	return nil
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *Store) Touch(_ context.Context, key string, expire time.Time) error {
+	e, err := s.call("Touch", key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	if err := s.checkExpire(e, expire); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	return e.err
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *Store) Delete(_ context.Context, key string) error {
+	e, err := s.call("Delete", key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrUnexpectedCall))
+	}
+	return e.err
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package mocksimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/mocksimplekv"
+)
+
+var _ simplekv.Store = (*mocksimplekv.Store)(nil)
+
+func TestExpectationsMet(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	expire := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	testErr := errgo.New("test error")
+
+	m := mocksimplekv.New()
+	m.ExpectGet("a").Return([]byte("a-value"))
+	m.ExpectGet("b")
+	m.ExpectExists("a", true)
+	m.ExpectExists("b", false)
+	m.ExpectSet("a", []byte("new")).WithExpire(expire)
+	m.ExpectSet("b", []byte("new")).ReturnError(testErr)
+	m.ExpectUpdate("a", []byte("1"), []byte("2"))
+	m.ExpectTouch("a").WithExpire(expire)
+	m.ExpectDelete("a").Times(2)
+
+	v, err := m.Get(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a-value")
+
+	_, err = m.Get(ctx, "b")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	ok, err := m.Exists(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+	ok, err = m.Exists(ctx, "b")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+
+	err = m.Set(ctx, "a", []byte("new"), expire)
+	c.Assert(err, qt.Equals, nil)
+
+	err = m.Set(ctx, "b", []byte("new"), time.Time{})
+	c.Assert(err, qt.Equals, testErr)
+
+	err = m.Update(ctx, "a", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, "1")
+		return []byte("2"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	c.Assert(m.Touch(ctx, "a", expire), qt.Equals, nil)
+	c.Assert(m.Delete(ctx, "a"), qt.Equals, nil)
+	c.Assert(m.Delete(ctx, "a"), qt.Equals, nil)
+
+	c.Assert(m.Verify(), qt.Equals, nil)
+}
+
+func TestExpectationsMatchedInOrder(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	m := mocksimplekv.New()
+	m.ExpectGet("a").Return([]byte("1"))
+	m.ExpectGet("a").Return([]byte("2"))
+	m.ExpectGet("b").Return([]byte("3")).Times(-1)
+
+	for _, want := range []string{"3", "1", "3", "2", "3"} {
+		key := "a"
+		if want == "3" {
+			key = "b"
+		}
+		v, err := m.Get(ctx, key)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, want)
+	}
+	c.Assert(m.Verify(), qt.Equals, nil)
+}
+
+func TestUnexpectedCalls(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	m := mocksimplekv.New()
+	m.ExpectSet("a", []byte("x"))
+	m.ExpectSet("b", []byte("x")).WithExpire(time.Time{})
+	m.ExpectUpdate("c", nil, []byte("x"))
+	m.ExpectDelete("d")
+
+	_, err := m.Get(ctx, "a")
+	c.Assert(errgo.Cause(err), qt.Equals, mocksimplekv.ErrUnexpectedCall)
+	c.Assert(err, qt.ErrorMatches, `unexpected call to Get\("a"\)`)
+
+	err = m.Set(ctx, "a", []byte("y"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, mocksimplekv.ErrUnexpectedCall)
+	c.Assert(err, qt.ErrorMatches, `Set\("a"\) called with value "y"; want "x"`)
+
+	err = m.Set(ctx, "b", []byte("x"), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(errgo.Cause(err), qt.Equals, mocksimplekv.ErrUnexpectedCall)
+
+	err = m.Update(ctx, "c", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(old, qt.IsNil)
+		return []byte("y"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `Update\("c"\) produced value "y"; want "x"`)
+
+	err = m.Verify()
+	c.Assert(err, qt.ErrorMatches, `unexpected call to Get\("a"\); Set\("a"\) called with value "y"; want "x"; Set\("b"\) called with expiry time .*; want .*; Update\("c"\) produced value "y"; want "x"; Delete\("d"\) called 0 times; want 1`)
+}
+
+func TestUpdateFunctionError(t *testing.T) {
+	c := qt.New(t)
+	testErr := errgo.New("test error")
+	m := mocksimplekv.New()
+	m.ExpectUpdate("a", nil, nil)
+	err := m.Update(context.Background(), "a", time.Time{}, func(old []byte) ([]byte, error) {
+		return nil, testErr
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, testErr)
+}
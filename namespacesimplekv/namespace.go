@@ -0,0 +1,379 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package namespacesimplekv provides a simplekv.Store that stores its
+// entries in another store with all keys prefixed by a namespace, so
+// that several components can safely share a single table or
+// collection.
+package namespacesimplekv
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/internal/wrapkv"
+)
+
+// NewStore returns a store that holds its entries in kv, prefixing
+// each key with the given namespace. Namespaces should be chosen so
+// that no namespace sharing kv is a prefix of another; ending each
+// namespace with a separator such as "/" is an easy way to ensure
+// this.
+//
+// Because the namespace is part of the key in kv, the maximum key
+// length of the returned store is reduced by the length of the
+// namespace, as reported by simplekv.KeyLimit.
+//
+// The returned store implements simplekv.KeyLister, simplekv.Counter
+// and simplekv.Iterable if kv does. Like other wrapping stores, it
+// does not implement simplekv.Closer: kv, which may be shared with
+// other namespaces, is closed by its creator.
+func NewStore(kv simplekv.Store, namespace string) simplekv.Store {
+	s := &kvStore{
+		kv:        kv,
+		namespace: namespace,
+		maxKeyLen: simplekv.KeyLimit(kv) - len(namespace),
+	}
+	return wrapkv.NewStore(s, kv)
+}
+
+type kvStore struct {
+	kv        simplekv.Store
+	namespace string
+	maxKeyLen int
+}
+
+// checkKey checks that the given key can be used with the store and
+// returns the corresponding key in the underlying store.
+func (s *kvStore) checkKey(key string) (string, error) {
+	if err := simplekv.CheckKeyLen(key, s.maxKeyLen); err != nil {
+		return "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return s.namespace + key, nil
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	v, err := s.kv.Get(ctx, nsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	ok, err := s.kv.Exists(ctx, nsKey)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(s.kv.Set(ctx, nsKey, value, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(s.kv.Update(ctx, nsKey, expire, getVal), errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	err = s.kv.Touch(ctx, nsKey, expire)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return simplekv.KeyNotFoundError(key)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	err = s.kv.Delete(ctx, nsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return simplekv.KeyNotFoundError(key)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// SetTTL implements simplekv.TTLSetter.SetTTL by calling
+// simplekv.SetTTL on the underlying store.
+func (s *kvStore) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(simplekv.SetTTL(ctx, s.kv, nsKey, value, ttl), errgo.Any)
+}
+
+// UpdateTTL implements simplekv.TTLSetter.UpdateTTL by calling
+// simplekv.UpdateTTL on the underlying store.
+func (s *kvStore) UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(simplekv.UpdateTTL(ctx, s.kv, nsKey, ttl, getVal), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the underlying store.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	err = simplekv.SetIfEquals(ctx, s.kv, nsKey, oldVal, newVal, expire)
+	if errgo.Cause(err) == simplekv.ErrConflict {
+		return simplekv.KeyConflictError(key)
+	}
+	return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+}
+
+// GetWithRevision implements simplekv.Revisioner.GetWithRevision by
+// calling simplekv.GetWithRevision on the underlying store.
+func (s *kvStore) GetWithRevision(ctx context.Context, key string) ([]byte, string, error) {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	v, rev, err := simplekv.GetWithRevision(ctx, s.kv, nsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, "", simplekv.KeyNotFoundError(key)
+	}
+	return v, rev, errgo.Mask(err, errgo.Any)
+}
+
+// SetWithRevision implements simplekv.Revisioner.SetWithRevision by
+// calling simplekv.SetWithRevision on the underlying store.
+func (s *kvStore) SetWithRevision(ctx context.Context, key string, value []byte, expire time.Time) (string, error) {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	rev, err := simplekv.SetWithRevision(ctx, s.kv, nsKey, value, expire)
+	return rev, errgo.Mask(err, errgo.Any)
+}
+
+// UpdateWithRevision implements simplekv.Revisioner.UpdateWithRevision
+// by calling simplekv.UpdateWithRevision on the underlying store.
+func (s *kvStore) UpdateWithRevision(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) (string, error) {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	rev, err := simplekv.UpdateWithRevision(ctx, s.kv, nsKey, expire, getVal)
+	return rev, errgo.Mask(err, errgo.Any)
+}
+
+// SetAt implements simplekv.Revisioner.SetAt by calling
+// simplekv.SetAt on the underlying store.
+func (s *kvStore) SetAt(ctx context.Context, key string, value []byte, expire time.Time, rev string) (string, error) {
+	nsKey, err := s.checkKey(key)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	newRev, err := simplekv.SetAt(ctx, s.kv, nsKey, value, expire, rev)
+	if errgo.Cause(err) == simplekv.ErrConflict {
+		return "", simplekv.KeyConflictError(key)
+	}
+	return newRev, errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge), simplekv.IsContention)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by calling
+// simplekv.SetMulti on the underlying store.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	nsEntries := make([]simplekv.Entry, len(entries))
+	for i, e := range entries {
+		nsKey, err := s.checkKey(e.Key)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+		}
+		e.Key = nsKey
+		nsEntries[i] = e
+	}
+	return errgo.Mask(simplekv.SetMulti(ctx, s.kv, nsEntries), errgo.Any)
+}
+
+// Txn implements simplekv.Transactor.Txn by calling simplekv.Txn on
+// the underlying store, so the transaction is atomic if the underlying
+// store supports transactions.
+func (s *kvStore) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	err := simplekv.Txn(ctx, s.kv, func(tx simplekv.Tx) error {
+		return errgo.Mask(f(&txn{
+			s:  s,
+			tx: tx,
+		}), errgo.Any)
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// txn implements simplekv.Tx by prefixing keys before passing them to
+// a transaction on the underlying store.
+type txn struct {
+	s  *kvStore
+	tx simplekv.Tx
+}
+
+// Get implements simplekv.Tx.Get.
+func (tx *txn) Get(key string) ([]byte, error) {
+	nsKey, err := tx.s.checkKey(key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	v, err := tx.tx.Get(nsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Tx.Set.
+func (tx *txn) Set(key string, value []byte, expire time.Time) error {
+	nsKey, err := tx.s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(tx.tx.Set(nsKey, value, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Tx.Delete.
+func (tx *txn) Delete(key string) error {
+	nsKey, err := tx.s.checkKey(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	err = tx.tx.Delete(nsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return simplekv.KeyNotFoundError(key)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead by
+// calling simplekv.SnapshotRead on the underlying store.
+func (s *kvStore) SnapshotRead(ctx context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	err := simplekv.SnapshotRead(ctx, s.kv, func(tx simplekv.SnapshotTx) error {
+		return errgo.Mask(f(snapshotTx{
+			s:  s,
+			tx: tx,
+		}), errgo.Any)
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// snapshotTx implements simplekv.SnapshotTx by prefixing keys before
+// passing them to a snapshot of the underlying store.
+type snapshotTx struct {
+	s  *kvStore
+	tx simplekv.SnapshotTx
+}
+
+// Get implements simplekv.SnapshotTx.Get.
+func (tx snapshotTx) Get(key string) ([]byte, error) {
+	nsKey, err := tx.s.checkKey(key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	v, err := tx.tx.Get(nsKey)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// KeysWithPrefix implements simplekv.SnapshotTx.KeysWithPrefix.
+func (tx snapshotTx) KeysWithPrefix(prefix string) ([]string, error) {
+	keys, err := tx.tx.KeysWithPrefix(tx.s.namespace + prefix)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, tx.s.namespace)
+	}
+	return keys, nil
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen.
+func (s *kvStore) MaxKeyLen() int {
+	return s.maxKeyLen
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+// ListKeys implements wrapkv.Lister.ListKeys.
+func (s *kvStore) ListKeys(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.kv.(simplekv.KeyLister).KeysWithPrefix(ctx, s.namespace+prefix)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.namespace)
+	}
+	return keys, nil
+}
+
+// CountKeys implements wrapkv.Counter.CountKeys.
+func (s *kvStore) CountKeys(ctx context.Context, prefix string) (int, error) {
+	n, err := simplekv.CountWithPrefix(ctx, s.kv.(simplekv.KeyLister), s.namespace+prefix)
+	return n, errgo.Mask(err, errgo.Any)
+}
+
+// IterateEntries implements wrapkv.Iterable.IterateEntries.
+func (s *kvStore) IterateEntries(ctx context.Context, prefix string) (simplekv.Iterator, error) {
+	iter, err := s.kv.(simplekv.Iterable).Iterate(ctx, s.namespace+prefix)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return &iterator{
+		Iterator:  iter,
+		namespace: s.namespace,
+	}, nil
+}
+
+// iterator strips the namespace from the keys returned by an
+// iterator over the underlying store.
+type iterator struct {
+	simplekv.Iterator
+	namespace string
+}
+
+// Key implements simplekv.Iterator.Key.
+func (iter *iterator) Key() string {
+	return strings.TrimPrefix(iter.Iterator.Key(), iter.namespace)
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package namespacesimplekv_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/namespacesimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestNamespaceStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		kv := memsimplekv.NewStore()
+		// Put something in another namespace to check that
+		// it is not visible.
+		err := kv.Set(context.Background(), "other/test-key", []byte("other"), time.Time{})
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return namespacesimplekv.NewStore(kv, "ns/"), nil
+	})
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore().(simplekv.KeyLister)
+	a := namespacesimplekv.NewStore(kv, "a/").(simplekv.KeyLister)
+	b := namespacesimplekv.NewStore(kv, "b/").(simplekv.KeyLister)
+
+	err := a.Set(ctx, "k1", []byte("a1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = a.Set(ctx, "k2", []byte("a2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = b.Set(ctx, "k1", []byte("b1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	entries, err := simplekv.Snapshot(ctx, kv)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(entries, qt.DeepEquals, map[string][]byte{
+		"a/k1": []byte("a1"),
+		"a/k2": []byte("a2"),
+		"b/k1": []byte("b1"),
+	})
+
+	keys, err := a.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	sort.Strings(keys)
+	c.Assert(keys, qt.DeepEquals, []string{"k1", "k2"})
+
+	n, err := a.(simplekv.Counter).Count(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 2)
+
+	iter, err := b.(simplekv.Iterable).Iterate(ctx, "")
+	c.Assert(err, qt.Equals, nil)
+	defer iter.Close()
+	c.Assert(iter.Next(), qt.Equals, true)
+	c.Assert(iter.Key(), qt.Equals, "k1")
+	c.Assert(string(iter.Value()), qt.Equals, "b1")
+	c.Assert(iter.Next(), qt.Equals, false)
+	c.Assert(iter.Close(), qt.Equals, nil)
+
+	err = b.Delete(ctx, "k2")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, `key k2 not found`)
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	c := qt.New(t)
+	mem := memsimplekv.NewStore()
+
+	kv := namespacesimplekv.NewStore(mem, "ns/")
+	_, ok := kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, true)
+	_, ok = kv.(simplekv.Iterable)
+	c.Assert(ok, qt.Equals, true)
+
+	kv = namespacesimplekv.NewStore(keyListerStore{mem.(simplekv.KeyLister)}, "ns/")
+	_, ok = kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, true)
+	_, ok = kv.(simplekv.Iterable)
+	c.Assert(ok, qt.Equals, false)
+
+	kv = namespacesimplekv.NewStore(iterableStore{mem.(simplekv.Iterable)}, "ns/")
+	_, ok = kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, false)
+	_, ok = kv.(simplekv.Iterable)
+	c.Assert(ok, qt.Equals, true)
+
+	kv = namespacesimplekv.NewStore(plainStore{mem}, "ns/")
+	_, ok = kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, false)
+	_, ok = kv.(simplekv.Iterable)
+	c.Assert(ok, qt.Equals, false)
+}
+
+func TestMaxKeyLen(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := namespacesimplekv.NewStore(memsimplekv.NewStore(), "ns/")
+	c.Assert(simplekv.KeyLimit(kv), qt.Equals, simplekv.MaxKeyLen-3)
+
+	// Nested namespaces reduce the limit further.
+	kv = namespacesimplekv.NewStore(kv, "inner/")
+	c.Assert(simplekv.KeyLimit(kv), qt.Equals, simplekv.MaxKeyLen-9)
+	err := kv.Set(ctx, strings.Repeat("k", simplekv.MaxKeyLen-9), []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, strings.Repeat("k", simplekv.MaxKeyLen-8), []byte("value"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrKeyTooLarge)
+}
+
+// keyListerStore hides any methods other than those of
+// simplekv.KeyLister.
+type keyListerStore struct {
+	simplekv.KeyLister
+}
+
+// iterableStore hides any methods other than those of
+// simplekv.Iterable.
+type iterableStore struct {
+	simplekv.Iterable
+}
+
+// plainStore hides any methods other than those of simplekv.Store.
+type plainStore struct {
+	simplekv.Store
+}
@@ -0,0 +1,368 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package provenancesimplekv provides a simplekv.Store that records
+// who changed each entry, and why, alongside the entries themselves.
+//
+// Callers attach a Provenance to the context of each mutation with
+// ContextWithProvenance. After each successful change, the store
+// appends a Record to an audit area of the underlying store, under a
+// separate prefix, so that the change history of a key can be
+// retrieved with History. Values are not recorded, so this is not a
+// substitute for versioning; it is intended for sensitive keys whose
+// changes must be accounted for.
+package provenancesimplekv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrNoProvenance is the error cause used when a store created with
+// WithRequireProvenance is asked to change an audited key without a
+// Provenance in the context.
+var ErrNoProvenance = errgo.New("no provenance in context")
+
+// Provenance describes the origin of a change.
+type Provenance struct {
+	// Who identifies the user or service making the change.
+	Who string `json:"who,omitempty"`
+
+	// What identifies the tool or operation making the change.
+	What string `json:"what,omitempty"`
+
+	// Why holds the reason for the change.
+	Why string `json:"why,omitempty"`
+}
+
+type provenanceKey struct{}
+
+// ContextWithProvenance returns a context that attaches the given
+// provenance to changes made with it.
+func ContextWithProvenance(ctx context.Context, p Provenance) context.Context {
+	return context.WithValue(ctx, provenanceKey{}, p)
+}
+
+// ProvenanceFromContext returns the provenance attached to the given
+// context by ContextWithProvenance and reports whether there was one.
+func ProvenanceFromContext(ctx context.Context) (Provenance, bool) {
+	p, ok := ctx.Value(provenanceKey{}).(Provenance)
+	return p, ok
+}
+
+// Op identifies the kind of change recorded in a Record.
+type Op string
+
+// The operations that can be recorded in Record.Op.
+const (
+	OpSet    Op = "set"
+	OpUpdate Op = "update"
+	OpTouch  Op = "touch"
+	OpDelete Op = "delete"
+)
+
+// Record describes a change made through the store.
+type Record struct {
+	Provenance
+
+	// Op holds the operation that made the change.
+	Op Op `json:"op"`
+
+	// Key holds the key that was changed.
+	Key string `json:"key"`
+
+	// Time holds the time at which the change was recorded.
+	Time time.Time `json:"time"`
+
+	// Expire holds the expiry time set by the change. It is zero
+	// for OpDelete and for entries that do not expire.
+	Expire time.Time `json:"expire"`
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithClock returns an option that makes the store use the given clock
+// to timestamp records. By default the system clock is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// WithAuditedKeys returns an option that restricts auditing to the
+// keys for which audited returns true. Changes to other keys are made
+// without being recorded. By default every key is audited.
+func WithAuditedKeys(audited func(key string) bool) Option {
+	return func(s *kvStore) {
+		s.audited = audited
+	}
+}
+
+// WithRequireProvenance returns an option that makes changes to
+// audited keys fail with an error with a cause of ErrNoProvenance
+// unless their context holds a Provenance. By default such changes
+// are recorded with an empty Provenance.
+func WithRequireProvenance() Option {
+	return func(s *kvStore) {
+		s.requireProvenance = true
+	}
+}
+
+// Store is implemented by the stores returned by NewStore.
+type Store interface {
+	simplekv.KeyLister
+
+	// History returns the records of the changes made to the given
+	// key, oldest first. A key that has never been changed through
+	// the store has no records.
+	History(ctx context.Context, key string) ([]Record, error)
+}
+
+// recordIDLen holds the length of the sequence number at the end of
+// each record key.
+const recordIDLen = 20
+
+// NewStore returns a store that holds its entries in kv and appends a
+// record of each change to an audited key under keys in kv starting
+// with auditPrefix. The audit prefix is reserved: keys starting with
+// it cannot be used through the returned store and are not listed by
+// it.
+//
+// A record is written only after the change has been made, so a
+// failure to write it is returned as an error even though the change
+// took effect. Records are never overwritten or removed by the store.
+func NewStore(kv simplekv.KeyLister, auditPrefix string, opts ...Option) Store {
+	s := &kvStore{
+		kv:          kv,
+		auditPrefix: auditPrefix,
+		clock:       systemClock{},
+		audited: func(string) bool {
+			return true
+		},
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	// Allow for the length of the key, which is at most three
+	// digits, and the separators and sequence number that follow it.
+	s.maxKeyLen = simplekv.KeyLimit(kv) - len(auditPrefix) - len("512:/r/") - recordIDLen
+	return s
+}
+
+type kvStore struct {
+	kv                simplekv.KeyLister
+	auditPrefix       string
+	maxKeyLen         int
+	clock             simplekv.Clock
+	audited           func(key string) bool
+	requireProvenance bool
+}
+
+// checkKey checks that the given key can be used with the store.
+func (s *kvStore) checkKey(key string) error {
+	if err := simplekv.CheckKeyLen(key, s.maxKeyLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if strings.HasPrefix(key, s.auditPrefix) {
+		return errgo.WithCausef(nil, simplekv.ErrInvalidKey, "key %q is in the audit area", key)
+	}
+	return nil
+}
+
+// checkProvenance checks that a change to the given key may be made
+// with the given context.
+func (s *kvStore) checkProvenance(ctx context.Context, key string) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge), errgo.Is(simplekv.ErrInvalidKey))
+	}
+	if !s.requireProvenance || !s.audited(key) {
+		return nil
+	}
+	if _, ok := ProvenanceFromContext(ctx); !ok {
+		return errgo.WithCausef(nil, ErrNoProvenance, "cannot change %q", key)
+	}
+	return nil
+}
+
+// recordPrefix returns the prefix of the keys of the records of the
+// given key. The key's length is included so that the records of one
+// key are not listed with those of another key that it is a prefix
+// of.
+func (s *kvStore) recordPrefix(key string) string {
+	return s.auditPrefix + strconv.Itoa(len(key)) + ":" + key + "/"
+}
+
+// record appends a record of a change to the given key.
+func (s *kvStore) record(ctx context.Context, op Op, key string, expire time.Time) error {
+	if !s.audited(key) {
+		return nil
+	}
+	p, _ := ProvenanceFromContext(ctx)
+	data, err := json.Marshal(Record{
+		Provenance: p,
+		Op:         op,
+		Key:        key,
+		Time:       s.clock.Now().UTC().Round(0),
+		Expire:     simplekv.NormalizeExpire(expire),
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	prefix := s.recordPrefix(key)
+	seq, err := simplekv.Increment(ctx, s.kv, prefix+"seq", 1, time.Time{})
+	if err != nil {
+		return errgo.Notef(err, "cannot record %s of %q", op, key)
+	}
+	recordKey := fmt.Sprintf("%sr/%0*d", prefix, recordIDLen, seq)
+	if err := simplekv.SetKeyOnce(ctx, s.kv, recordKey, data, time.Time{}); err != nil {
+		return errgo.Notef(err, "cannot record %s of %q", op, key)
+	}
+	return nil
+}
+
+// History implements Store.History.
+func (s *kvStore) History(ctx context.Context, key string) ([]Record, error) {
+	if err := s.checkKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge), errgo.Is(simplekv.ErrInvalidKey))
+	}
+	keys, err := s.kv.KeysWithPrefix(ctx, s.recordPrefix(key)+"r/")
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot list records of %q", key)
+	}
+	// Sequence numbers have a fixed width, so the keys sort in the
+	// order the records were written.
+	sort.Strings(keys)
+	records := make([]Record, 0, len(keys))
+	for _, k := range keys {
+		data, err := s.kv.Get(ctx, k)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get record of %q", key)
+		}
+		var r Record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, errgo.Notef(err, "invalid record %q", k)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := s.checkKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge), errgo.Is(simplekv.ErrInvalidKey))
+	}
+	v, err := s.kv.Get(ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := s.checkKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge), errgo.Is(simplekv.ErrInvalidKey))
+	}
+	ok, err := s.kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := s.checkProvenance(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := s.kv.Set(ctx, key, value, expire); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.record(ctx, OpSet, key, expire))
+}
+
+// Update implements simplekv.Store.Update. No record is written if
+// getVal returns an error.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := s.checkProvenance(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := s.kv.Update(ctx, key, expire, getVal); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.record(ctx, OpUpdate, key, expire))
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := s.checkProvenance(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := s.kv.Touch(ctx, key, expire); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.record(ctx, OpTouch, key, expire))
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := s.checkProvenance(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := s.kv.Delete(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.record(ctx, OpDelete, key, time.Time{}))
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	return s.KeysWithPrefix(ctx, "")
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix. Keys in
+// the audit area are not included.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.kv.KeysWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	n := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, s.auditPrefix) {
+			keys[n] = key
+			n++
+		}
+	}
+	return keys[:n], nil
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen. The limit
+// allows room for the audit prefix and record sequence numbers.
+func (s *kvStore) MaxKeyLen() int {
+	return s.maxKeyLen
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package provenancesimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/provenancesimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestProvenanceStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return provenancesimplekv.NewStore(memsimplekv.NewStore().(simplekv.KeyLister), "audit/"), nil
+	})
+}
+
+func TestHistory(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore(memsimplekv.WithClock(clock{})).(simplekv.KeyLister)
+	kv := provenancesimplekv.NewStore(mem, "audit/", provenancesimplekv.WithClock(clock{}))
+
+	alice := provenancesimplekv.ContextWithProvenance(ctx, provenancesimplekv.Provenance{
+		Who:  "alice",
+		What: "admin-cli",
+		Why:  "rotate credentials",
+	})
+	err := kv.Set(alice, "cred", []byte("v1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Update(ctx, "cred", epoch.Add(time.Hour), func(old []byte) ([]byte, error) {
+		return []byte("v2"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	// Failed changes are not recorded.
+	err = kv.Update(alice, "cred", time.Time{}, func(old []byte) ([]byte, error) {
+		return nil, errgo.New("failed")
+	})
+	c.Assert(err, qt.ErrorMatches, "failed")
+	err = kv.Delete(alice, "nothing")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// Records for a key are not mixed with those of keys that it is
+	// a prefix of.
+	err = kv.Set(alice, "cred2", []byte("x"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Delete(alice, "cred")
+	c.Assert(err, qt.Equals, nil)
+
+	records, err := kv.History(ctx, "cred")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.DeepEquals, []provenancesimplekv.Record{{
+		Provenance: provenancesimplekv.Provenance{
+			Who:  "alice",
+			What: "admin-cli",
+			Why:  "rotate credentials",
+		},
+		Op:   provenancesimplekv.OpSet,
+		Key:  "cred",
+		Time: epoch,
+	}, {
+		Op:     provenancesimplekv.OpUpdate,
+		Key:    "cred",
+		Time:   epoch,
+		Expire: epoch.Add(time.Hour),
+	}, {
+		Provenance: provenancesimplekv.Provenance{
+			Who:  "alice",
+			What: "admin-cli",
+			Why:  "rotate credentials",
+		},
+		Op:   provenancesimplekv.OpDelete,
+		Key:  "cred",
+		Time: epoch,
+	}})
+
+	records, err = kv.History(ctx, "nothing")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.HasLen, 0)
+
+	// The audit area is hidden and cannot be written through the
+	// store.
+	keys, err := kv.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.DeepEquals, []string{"cred2"})
+	err = kv.Set(ctx, "audit/x", []byte("x"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey)
+	auditKeys, err := mem.KeysWithPrefix(ctx, "audit/")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(auditKeys, qt.Not(qt.HasLen), 0)
+}
+
+func TestAuditedKeys(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := provenancesimplekv.NewStore(memsimplekv.NewStore().(simplekv.KeyLister), "audit/",
+		provenancesimplekv.WithAuditedKeys(func(key string) bool {
+			return key == "secret"
+		}),
+		provenancesimplekv.WithRequireProvenance(),
+	)
+
+	// Changes to keys that are not audited need no provenance.
+	err := kv.Set(ctx, "plain", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	records, err := kv.History(ctx, "plain")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.HasLen, 0)
+
+	err = kv.Set(ctx, "secret", []byte("v"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, provenancesimplekv.ErrNoProvenance)
+	ok, err := kv.Exists(ctx, "secret")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+
+	bob := provenancesimplekv.ContextWithProvenance(ctx, provenancesimplekv.Provenance{Who: "bob"})
+	err = kv.Set(bob, "secret", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	records, err = kv.History(ctx, "secret")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.HasLen, 1)
+	c.Assert(records[0].Who, qt.Equals, "bob")
+}
+
+type clock struct{}
+
+func (clock) Now() time.Time {
+	return epoch
+}
@@ -0,0 +1,341 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package regionsimplekv provides a simplekv.Store that places each key
+// in one of several region-specific stores, so that data can be kept
+// in the region it belongs to for data residency requirements.
+package regionsimplekv
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrNoRegion is the error cause used when a key cannot be placed in
+// any region.
+var ErrNoRegion = errgo.New("no region for key")
+
+// Placement returns the name of the region that holds the given key.
+// It should return an error with a cause of ErrNoRegion if the key
+// does not belong in any region.
+type Placement func(key string) (string, error)
+
+// PrefixPlacement returns a Placement that places each key in the
+// region mapped to by the longest prefix of the key in prefixes. Keys
+// that do not start with any of the prefixes are placed in
+// defaultRegion, or are not placed at all if defaultRegion is empty.
+func PrefixPlacement(prefixes map[string]string, defaultRegion string) Placement {
+	// Sort the prefixes longest first, so that the first match is
+	// the longest.
+	sorted := make([]string, 0, len(prefixes))
+	for p := range prefixes {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	return func(key string) (string, error) {
+		for _, p := range sorted {
+			if strings.HasPrefix(key, p) {
+				return prefixes[p], nil
+			}
+		}
+		if defaultRegion == "" {
+			return "", errgo.WithCausef(nil, ErrNoRegion, "no region for key %q", key)
+		}
+		return defaultRegion, nil
+	}
+}
+
+// RegionKey holds a key and the name of the region that holds it.
+type RegionKey struct {
+	Region string
+	Key    string
+}
+
+// Store is implemented by the stores returned by NewStore.
+type Store interface {
+	simplekv.Store
+
+	// Region returns the name of the region that holds the given
+	// key.
+	Region(key string) (string, error)
+
+	// RegionKeys returns all the keys in all the regions, along
+	// with the region that holds each one. It returns an error if
+	// any region's store does not implement simplekv.KeyLister.
+	RegionKeys(ctx context.Context) ([]RegionKey, error)
+
+	// RegionKeysWithPrefix is like RegionKeys except that it only
+	// returns keys that start with the given prefix.
+	RegionKeysWithPrefix(ctx context.Context, prefix string) ([]RegionKey, error)
+}
+
+// NewStore returns a store that holds each key in the store for the
+// region chosen by place. Operations on a key whose region is unknown
+// fail with an error with a cause of ErrNoRegion.
+//
+// SetMulti is atomic only when the underlying store is and all the
+// entries are in the same region; otherwise the entries for each
+// region are written in turn. The returned store does not implement
+// simplekv.Transactor, so transactions use the best effort fallback
+// of simplekv.Txn.
+//
+// Keys are listed from every region, ordered by region name. A key
+// found in a region other than the one it is placed in is left out,
+// so that regions that share an underlying store do not report its
+// keys twice. The returned store implements simplekv.KeyLister if all
+// the regions' stores do.
+func NewStore(regions map[string]simplekv.Store, place Placement) Store {
+	s := &kvStore{
+		regions: regions,
+		place:   place,
+	}
+	for name := range regions {
+		s.names = append(s.names, name)
+	}
+	sort.Strings(s.names)
+	for _, kv := range regions {
+		if _, ok := kv.(simplekv.KeyLister); !ok {
+			return s
+		}
+	}
+	return &keyListerStore{s}
+}
+
+type kvStore struct {
+	regions map[string]simplekv.Store
+	place   Placement
+
+	// names holds the names of the regions in sorted order.
+	names []string
+}
+
+// Region implements Store.Region.
+func (s *kvStore) Region(key string) (string, error) {
+	region, err := s.place(key)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	if _, ok := s.regions[region]; !ok {
+		return "", errgo.WithCausef(nil, ErrNoRegion, "key %q placed in unknown region %q", key, region)
+	}
+	return region, nil
+}
+
+// store returns the store for the region that holds the given key.
+func (s *kvStore) store(key string) (simplekv.Store, error) {
+	region, err := s.Region(key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	return s.regions[region], nil
+}
+
+// Context implements simplekv.Store.Context by returning a context
+// suitable for all the regions' stores.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	closers := make([]func(), len(s.names))
+	for i, name := range s.names {
+		ctx, closers[i] = s.regions[name].Context(ctx)
+	}
+	return ctx, func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	kv, err := s.store(key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	v, err := kv.Get(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return v, nil
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	kv, err := s.store(key)
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	ok, err := kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	kv, err := s.store(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	return errgo.Mask(kv.Set(ctx, key, value, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	kv, err := s.store(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	return errgo.Mask(kv.Update(ctx, key, expire, getVal), errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	kv, err := s.store(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	return errgo.Mask(kv.Touch(ctx, key, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	kv, err := s.store(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	return errgo.Mask(kv.Delete(ctx, key), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the key's region.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	kv, err := s.store(key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNoRegion))
+	}
+	return errgo.Mask(simplekv.SetIfEquals(ctx, kv, key, oldVal, newVal, expire), errgo.Any)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by calling
+// simplekv.SetMulti on each region with the entries placed in it. No
+// entries are written unless all of them can be placed.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	byRegion := make(map[string][]simplekv.Entry)
+	for _, e := range entries {
+		region, err := s.Region(e.Key)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(ErrNoRegion))
+		}
+		byRegion[region] = append(byRegion[region], e)
+	}
+	for _, name := range s.names {
+		if len(byRegion[name]) == 0 {
+			continue
+		}
+		if err := simplekv.SetMulti(ctx, s.regions[name], byRegion[name]); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return nil
+}
+
+// RegionKeys implements Store.RegionKeys.
+func (s *kvStore) RegionKeys(ctx context.Context) ([]RegionKey, error) {
+	keys, err := s.regionKeys(func(kv simplekv.KeyLister) ([]string, error) {
+		return kv.Keys(ctx)
+	})
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// RegionKeysWithPrefix implements Store.RegionKeysWithPrefix.
+func (s *kvStore) RegionKeysWithPrefix(ctx context.Context, prefix string) ([]RegionKey, error) {
+	keys, err := s.regionKeys(func(kv simplekv.KeyLister) ([]string, error) {
+		return kv.KeysWithPrefix(ctx, prefix)
+	})
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// regionKeys calls list on each region's store and returns the keys
+// that are placed in that region.
+func (s *kvStore) regionKeys(list func(kv simplekv.KeyLister) ([]string, error)) ([]RegionKey, error) {
+	var keys []RegionKey
+	for _, name := range s.names {
+		kv, ok := s.regions[name].(simplekv.KeyLister)
+		if !ok {
+			return nil, errgo.Newf("region %q does not support listing keys", name)
+		}
+		rkeys, err := list(kv)
+		if err != nil {
+			return nil, errgo.NoteMask(err, "cannot list keys in region "+name, errgo.Any)
+		}
+		for _, key := range rkeys {
+			if region, err := s.Region(key); err == nil && region == name {
+				keys = append(keys, RegionKey{
+					Region: name,
+					Key:    key,
+				})
+			}
+		}
+	}
+	return keys, nil
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen by returning the
+// smallest of the limits of the regions' stores.
+func (s *kvStore) MaxKeyLen() int {
+	n := -1
+	for _, kv := range s.regions {
+		if m := simplekv.KeyLimit(kv); n < 0 || m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the smallest of the limits of the regions' stores.
+func (s *kvStore) MaxValueLen() int {
+	n := -1
+	for _, kv := range s.regions {
+		if m := simplekv.MaxValueLen(kv); n < 0 || m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+// keyListerStore is used when all the regions' stores implement
+// simplekv.KeyLister.
+type keyListerStore struct {
+	*kvStore
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *keyListerStore) Keys(ctx context.Context) ([]string, error) {
+	keys, err := s.RegionKeys(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return keyNames(keys), nil
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *keyListerStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.RegionKeysWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return keyNames(keys), nil
+}
+
+func keyNames(keys []RegionKey) []string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Key
+	}
+	return names
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package regionsimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/regionsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestRegionStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return regionsimplekv.NewStore(map[string]simplekv.Store{
+			"eu": memsimplekv.NewStore(),
+			"us": memsimplekv.NewStore(),
+		}, regionsimplekv.PrefixPlacement(map[string]string{
+			"a": "eu",
+		}, "us")), nil
+	})
+}
+
+func TestPrefixPlacement(t *testing.T) {
+	c := qt.New(t)
+	place := regionsimplekv.PrefixPlacement(map[string]string{
+		"eu/":    "eu",
+		"eu/uk/": "uk",
+		"us/":    "us",
+	}, "")
+	for key, want := range map[string]string{
+		"eu/x":    "eu",
+		"eu/uk/x": "uk",
+		"eu/ukx":  "eu",
+		"us/x":    "us",
+	} {
+		region, err := place(key)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(region, qt.Equals, want, qt.Commentf("key %q", key))
+	}
+	_, err := place("other")
+	c.Assert(err, qt.ErrorMatches, `no region for key "other"`)
+	c.Assert(errgo.Cause(err), qt.Equals, regionsimplekv.ErrNoRegion)
+
+	region, err := regionsimplekv.PrefixPlacement(nil, "us")("other")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(region, qt.Equals, "us")
+}
+
+func TestPlacement(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	eu := memsimplekv.NewStore()
+	us := memsimplekv.NewStore()
+	kv := regionsimplekv.NewStore(map[string]simplekv.Store{
+		"eu": eu,
+		"us": us,
+	}, regionsimplekv.PrefixPlacement(map[string]string{
+		"eu/":   "eu",
+		"us/":   "us",
+		"mars/": "mars",
+	}, ""))
+
+	err := simplekv.SetMulti(ctx, kv, []simplekv.Entry{
+		{Key: "eu/a", Value: []byte("1")},
+		{Key: "us/a", Value: []byte("2")},
+		{Key: "eu/b", Value: []byte("3")},
+	})
+	c.Assert(err, qt.Equals, nil)
+	keys, err := eu.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.ContentEquals, []string{"eu/a", "eu/b"})
+	keys, err = us.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.DeepEquals, []string{"us/a"})
+
+	// A key in the wrong region is not reported.
+	err = us.Set(ctx, "eu/c", []byte("4"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	rkeys, err := kv.RegionKeys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rkeys, qt.ContentEquals, []regionsimplekv.RegionKey{
+		{Region: "eu", Key: "eu/a"},
+		{Region: "eu", Key: "eu/b"},
+		{Region: "us", Key: "us/a"},
+	})
+	rkeys, err = kv.RegionKeysWithPrefix(ctx, "us/")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rkeys, qt.DeepEquals, []regionsimplekv.RegionKey{
+		{Region: "us", Key: "us/a"},
+	})
+
+	// Keys that cannot be placed are rejected.
+	err = kv.Set(ctx, "other", []byte("x"), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `no region for key "other"`)
+	c.Assert(errgo.Cause(err), qt.Equals, regionsimplekv.ErrNoRegion)
+	_, err = kv.Get(ctx, "mars/a")
+	c.Assert(err, qt.ErrorMatches, `key "mars/a" placed in unknown region "mars"`)
+	c.Assert(errgo.Cause(err), qt.Equals, regionsimplekv.ErrNoRegion)
+
+	// Nothing is written by SetMulti if any entry cannot be placed.
+	err = simplekv.SetMulti(ctx, kv, []simplekv.Entry{
+		{Key: "eu/d", Value: []byte("1")},
+		{Key: "other", Value: []byte("2")},
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, regionsimplekv.ErrNoRegion)
+	_, err = eu.Get(ctx, "eu/d")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func TestRegionKeysWithoutKeyLister(t *testing.T) {
+	c := qt.New(t)
+	kv := regionsimplekv.NewStore(map[string]simplekv.Store{
+		"eu": memsimplekv.NewStore(),
+		"us": struct{ simplekv.Store }{memsimplekv.NewStore()},
+	}, regionsimplekv.PrefixPlacement(nil, "eu"))
+	_, ok := kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, false)
+	_, err := kv.RegionKeys(context.Background())
+	c.Assert(err, qt.ErrorMatches, `region "us" does not support listing keys`)
+}
@@ -0,0 +1,523 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package resilientsimplekv provides a simplekv.Store that keeps a
+// local copy of the values it reads and writes, and serves them when
+// the underlying store is unavailable instead of failing. It is
+// intended for read paths where availability matters more than
+// freshness, such as configuration that rarely changes.
+//
+// A value served from the local copy may be out of date: it may have
+// been changed or deleted through another store since it was cached.
+// Callers that need to know can pass a context returned by
+// ContextWithStaleInfo to Get and Exists.
+package resilientsimplekv
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/internal/wrapkv"
+)
+
+// DefaultMaxEntries holds the maximum number of values held in the
+// local copy when WithMaxEntries is not used.
+const DefaultMaxEntries = 10000
+
+// StaleInfo holds information about the value returned by a call to
+// Get or Exists made with a context returned by ContextWithStaleInfo.
+type StaleInfo struct {
+	// Stale holds whether the value was served from the local copy
+	// because the underlying store was unavailable.
+	Stale bool
+
+	// CachedAt holds the time at which the stale value was read
+	// from or written to the underlying store.
+	CachedAt time.Time
+
+	// Err holds the error returned by the underlying store.
+	Err error
+}
+
+type staleInfoKey struct{}
+
+// ContextWithStaleInfo returns a context that makes Get and Exists
+// calls made with it record in info whether they served a stale value.
+func ContextWithStaleInfo(ctx context.Context, info *StaleInfo) context.Context {
+	return context.WithValue(ctx, staleInfoKey{}, info)
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithPrefix returns an option that allows values of keys with the
+// given prefix to be served from the local copy up to maxStaleness
+// after they were cached. If maxStaleness is zero, there is no limit.
+// If the option is used more than once, the longest matching prefix
+// applies, and keys that match none of the prefixes are never served
+// from the local copy. By default any key may be served from the local
+// copy, however old its value.
+func WithPrefix(prefix string, maxStaleness time.Duration) Option {
+	return func(s *kvStore) {
+		s.prefixes = append(s.prefixes, prefixPolicy{
+			prefix:       prefix,
+			maxStaleness: maxStaleness,
+		})
+	}
+}
+
+// WithMaxEntries returns an option that limits the number of values
+// held in the local copy. When the limit is reached, the least
+// recently used value is discarded. By default DefaultMaxEntries is
+// used.
+func WithMaxEntries(n int) Option {
+	return func(s *kvStore) {
+		s.maxEntries = n
+	}
+}
+
+// WithUnavailable returns an option that makes the store use the given
+// function to decide whether an error returned by the underlying store
+// means that it is unavailable. By default any error is taken to mean
+// that the store is unavailable unless its cause is
+// simplekv.ErrNotFound, simplekv.ErrKeyTooLarge,
+// simplekv.ErrValueTooLarge, simplekv.ErrInvalidKey or
+// simplekv.ErrStoreClosed.
+func WithUnavailable(f func(err error) bool) Option {
+	return func(s *kvStore) {
+		s.unavailable = f
+	}
+}
+
+// WithLogger returns an option that makes the store log the stale
+// values it serves to the given logger.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// WithClock returns an option that makes the store use the given clock
+// to determine the age of the values in the local copy. By default the
+// system clock is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// NewStore returns a store that uses kv for storage and falls back to
+// a local copy of recently used values when kv is unavailable. Values
+// are cached when they are read with Get or written with Set or
+// Update, and forgotten when they are found not to exist or are
+// deleted. A value whose expiry time was set through the store is not
+// served after it expires.
+//
+// Only Get and Exists fall back to the local copy; writes, listings,
+// transactions and snapshot reads always go to kv. If a write fails,
+// the cached value of its key is forgotten, because kv may or may not
+// have been changed. Keys written in a transaction are always
+// forgotten.
+//
+// The returned store implements simplekv.KeyLister and
+// simplekv.Counter if kv implements simplekv.KeyLister, and
+// simplekv.Iterable if kv does.
+func NewStore(kv simplekv.Store, opts ...Option) simplekv.Store {
+	s := &kvStore{
+		kv:          kv,
+		maxEntries:  DefaultMaxEntries,
+		unavailable: isUnavailable,
+		logger:      nopLogger{},
+		clock:       systemClock{},
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return wrapkv.NewStore(s, kv)
+}
+
+// isUnavailable is the default function used to decide whether an
+// error means that the underlying store is unavailable.
+func isUnavailable(err error) bool {
+	switch errgo.Cause(err) {
+	case simplekv.ErrNotFound,
+		simplekv.ErrKeyTooLarge,
+		simplekv.ErrValueTooLarge,
+		simplekv.ErrInvalidKey,
+		simplekv.ErrStoreClosed:
+		return false
+	}
+	return true
+}
+
+type prefixPolicy struct {
+	prefix       string
+	maxStaleness time.Duration
+}
+
+type kvStore struct {
+	kv          simplekv.Store
+	prefixes    []prefixPolicy
+	maxEntries  int
+	unavailable func(error) bool
+	logger      simplekv.Logger
+	clock       simplekv.Clock
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	// entries holds the element of lru holding the cached value of
+	// each key.
+	entries map[string]*list.Element
+
+	// lru holds the cached values, most recently used first.
+	lru *list.List
+}
+
+// entry holds a cached value.
+type entry struct {
+	key      string
+	value    []byte
+	cachedAt time.Time
+
+	// expire holds the expiry time of the value if it was written
+	// through the store, or the zero time if it is not known.
+	expire time.Time
+}
+
+// maxStaleness returns the maximum staleness of values of the given
+// key and reports whether they may be served from the local copy at
+// all.
+func (s *kvStore) maxStaleness(key string) (time.Duration, bool) {
+	if len(s.prefixes) == 0 {
+		return 0, true
+	}
+	var best *prefixPolicy
+	for i, p := range s.prefixes {
+		if strings.HasPrefix(key, p.prefix) && (best == nil || len(p.prefix) > len(best.prefix)) {
+			best = &s.prefixes[i]
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return best.maxStaleness, true
+}
+
+// cache records the given value of the given key in the local copy.
+func (s *kvStore) cache(key string, value []byte, expire time.Time) {
+	if _, ok := s.maxStaleness(key); !ok || s.maxEntries <= 0 {
+		return
+	}
+	e := &entry{
+		key:      key,
+		value:    value,
+		cachedAt: s.clock.Now(),
+		expire:   expire,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		elem.Value = e
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(e)
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*entry).key)
+	}
+}
+
+// forget removes the value of the given key from the local copy.
+func (s *kvStore) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		s.lru.Remove(elem)
+		delete(s.entries, key)
+	}
+}
+
+// stale returns the value of the given key from the local copy, if
+// the underlying store returned the given error when asked for it and
+// the value may be served, and records the fact in the context's
+// StaleInfo.
+func (s *kvStore) stale(ctx context.Context, key string, err error) ([]byte, bool) {
+	if ctx.Err() != nil || !s.unavailable(err) {
+		return nil, false
+	}
+	maxStaleness, ok := s.maxStaleness(key)
+	if !ok {
+		return nil, false
+	}
+	now := s.clock.Now()
+	s.mu.Lock()
+	elem, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	s.lru.MoveToFront(elem)
+	s.mu.Unlock()
+	if maxStaleness > 0 && now.Sub(e.cachedAt) > maxStaleness {
+		return nil, false
+	}
+	if !e.expire.IsZero() && !now.Before(e.expire) {
+		return nil, false
+	}
+	s.logger.Debugf("serving stale value of %q cached at %v: %v", key, e.cachedAt, err)
+	if info, _ := ctx.Value(staleInfoKey{}).(*StaleInfo); info != nil {
+		*info = StaleInfo{
+			Stale:    true,
+			CachedAt: e.cachedAt,
+			Err:      err,
+		}
+	}
+	return e.value, true
+}
+
+// fresh records in the context's StaleInfo that a fresh value has
+// been returned.
+func fresh(ctx context.Context) {
+	if info, _ := ctx.Value(staleInfoKey{}).(*StaleInfo); info != nil {
+		*info = StaleInfo{}
+	}
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.kv.Get(ctx, key)
+	if err == nil {
+		fresh(ctx)
+		s.cache(key, v, time.Time{})
+		return v, nil
+	}
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		fresh(ctx)
+		s.forget(key)
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if v, ok := s.stale(ctx, key, err); ok {
+		return v, nil
+	}
+	return nil, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	ok, err := s.kv.Exists(ctx, key)
+	if err == nil {
+		fresh(ctx)
+		if !ok {
+			s.forget(key)
+		}
+		return ok, nil
+	}
+	if _, ok := s.stale(ctx, key, err); ok {
+		return true, nil
+	}
+	return false, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := s.kv.Set(ctx, key, value, expire); err != nil {
+		s.forget(key)
+		return errgo.Mask(err, errgo.Any)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.cache(key, value, simplekv.NormalizeExpire(expire))
+	return nil
+}
+
+// Update implements simplekv.Store.Update. The value cached is the one
+// returned by the last call to getVal.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	var value []byte
+	err := s.kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		v, err := getVal(old)
+		value = v
+		return v, err
+	})
+	if err != nil {
+		s.forget(key)
+		return errgo.Mask(err, errgo.Any)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.cache(key, value, simplekv.NormalizeExpire(expire))
+	return nil
+}
+
+// Touch implements simplekv.Store.Touch. The expiry time of the
+// cached value is not known afterwards, so the value is forgotten.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	s.forget(key)
+	return errgo.Mask(s.kv.Touch(ctx, key, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	s.forget(key)
+	return errgo.Mask(s.kv.Delete(ctx, key), errgo.Any)
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen by returning the
+// limit of the underlying store.
+func (s *kvStore) MaxKeyLen() int {
+	return simplekv.KeyLimit(s.kv)
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+// SetTTL implements simplekv.TTLSetter.SetTTL by calling
+// simplekv.SetTTL on the underlying store. The expiry time of the
+// cached value is computed from the local clock.
+func (s *kvStore) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := simplekv.SetTTL(ctx, s.kv, key, value, ttl); err != nil {
+		s.forget(key)
+		return errgo.Mask(err, errgo.Any)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.cache(key, value, simplekv.ExpireAfter(s.clock.Now(), ttl))
+	return nil
+}
+
+// UpdateTTL implements simplekv.TTLSetter.UpdateTTL by calling
+// simplekv.UpdateTTL on the underlying store. The value cached is the
+// one returned by the last call to getVal.
+func (s *kvStore) UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	var value []byte
+	err := simplekv.UpdateTTL(ctx, s.kv, key, ttl, func(old []byte) ([]byte, error) {
+		v, err := getVal(old)
+		value = v
+		return v, err
+	})
+	if err != nil {
+		s.forget(key)
+		return errgo.Mask(err, errgo.Any)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.cache(key, value, simplekv.ExpireAfter(s.clock.Now(), ttl))
+	return nil
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the underlying store.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	if err := simplekv.SetIfEquals(ctx, s.kv, key, oldVal, newVal, expire); err != nil {
+		s.forget(key)
+		return errgo.Mask(err, errgo.Any)
+	}
+	if newVal == nil {
+		newVal = []byte{}
+	}
+	s.cache(key, newVal, simplekv.NormalizeExpire(expire))
+	return nil
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by calling
+// simplekv.SetMulti on the underlying store. If it fails, all the
+// keys are forgotten.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	if err := simplekv.SetMulti(ctx, s.kv, entries); err != nil {
+		for _, e := range entries {
+			s.forget(e.Key)
+		}
+		return errgo.Mask(err, errgo.Any)
+	}
+	for _, e := range entries {
+		value := e.Value
+		if value == nil {
+			value = []byte{}
+		}
+		s.cache(e.Key, value, simplekv.NormalizeExpire(e.Expire))
+	}
+	return nil
+}
+
+// Txn implements simplekv.Transactor.Txn by calling simplekv.Txn on
+// the underlying store. The keys written in the transaction are
+// forgotten when it completes, whether or not it succeeds.
+func (s *kvStore) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	written := make(map[string]bool)
+	defer func() {
+		for key := range written {
+			s.forget(key)
+		}
+	}()
+	err := simplekv.Txn(ctx, s.kv, func(tx simplekv.Tx) error {
+		return errgo.Mask(f(txn{
+			tx:      tx,
+			written: written,
+		}), errgo.Any)
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// txn implements simplekv.Tx by recording the keys written in a
+// transaction on the underlying store.
+type txn struct {
+	tx      simplekv.Tx
+	written map[string]bool
+}
+
+// Get implements simplekv.Tx.Get.
+func (tx txn) Get(key string) ([]byte, error) {
+	v, err := tx.tx.Get(key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Tx.Set.
+func (tx txn) Set(key string, value []byte, expire time.Time) error {
+	tx.written[key] = true
+	return errgo.Mask(tx.tx.Set(key, value, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Tx.Delete.
+func (tx txn) Delete(key string) error {
+	tx.written[key] = true
+	return errgo.Mask(tx.tx.Delete(key), errgo.Any)
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead by
+// calling simplekv.SnapshotRead on the underlying store.
+func (s *kvStore) SnapshotRead(ctx context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	return errgo.Mask(simplekv.SnapshotRead(ctx, s.kv, f), errgo.Any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
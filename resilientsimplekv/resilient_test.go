@@ -0,0 +1,205 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package resilientsimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/resilientsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestResilientStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return resilientsimplekv.NewStore(memsimplekv.NewStore()), nil
+	})
+}
+
+func TestStaleValuesServed(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: epoch}
+	backend := &flakyStore{Store: memsimplekv.NewStore(memsimplekv.WithClock(clock))}
+	kv := resilientsimplekv.NewStore(backend, resilientsimplekv.WithClock(clock))
+
+	err := kv.Set(ctx, "written", []byte("w"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = backend.Set(ctx, "read", []byte("r"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, err = kv.Get(ctx, "read")
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "expiring", []byte("e"), epoch.Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = backend.Set(ctx, "uncached", []byte("u"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	backend.down = true
+	clock.now = epoch.Add(time.Hour)
+	var info resilientsimplekv.StaleInfo
+	infoCtx := resilientsimplekv.ContextWithStaleInfo(ctx, &info)
+	for _, key := range []string{"written", "read"} {
+		v, err := kv.Get(infoCtx, key)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, key[:1])
+		c.Assert(info.Stale, qt.Equals, true)
+		c.Assert(info.CachedAt, qt.DeepEquals, epoch)
+		c.Assert(info.Err, qt.ErrorMatches, "connection refused")
+	}
+	ok, err := kv.Exists(ctx, "written")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+
+	// Expired and uncached values are not served.
+	_, err = kv.Get(ctx, "expiring")
+	c.Assert(err, qt.ErrorMatches, "connection refused")
+	_, err = kv.Get(ctx, "uncached")
+	c.Assert(err, qt.ErrorMatches, "connection refused")
+
+	// Once the store is back, fresh values are served again.
+	backend.down = false
+	err = backend.Set(ctx, "written", []byte("w2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := kv.Get(infoCtx, "written")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "w2")
+	c.Assert(info, qt.DeepEquals, resilientsimplekv.StaleInfo{})
+
+	// Deleted values are forgotten.
+	err = kv.Delete(ctx, "read")
+	c.Assert(err, qt.Equals, nil)
+	backend.down = true
+	_, err = kv.Get(ctx, "read")
+	c.Assert(err, qt.ErrorMatches, "connection refused")
+}
+
+func TestPrefixes(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: epoch}
+	backend := &flakyStore{Store: memsimplekv.NewStore()}
+	kv := resilientsimplekv.NewStore(backend,
+		resilientsimplekv.WithClock(clock),
+		resilientsimplekv.WithPrefix("config/", 0),
+		resilientsimplekv.WithPrefix("config/flags/", time.Minute),
+	)
+	for _, key := range []string{"config/a", "config/flags/b", "session/c"} {
+		err := kv.Set(ctx, key, []byte("v"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	backend.down = true
+	clock.now = epoch.Add(time.Hour)
+
+	_, err := kv.Get(ctx, "config/a")
+	c.Assert(err, qt.Equals, nil)
+	_, err = kv.Get(ctx, "config/flags/b")
+	c.Assert(err, qt.ErrorMatches, "connection refused")
+	_, err = kv.Get(ctx, "session/c")
+	c.Assert(err, qt.ErrorMatches, "connection refused")
+}
+
+func TestMaxEntries(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	backend := &flakyStore{Store: memsimplekv.NewStore()}
+	kv := resilientsimplekv.NewStore(backend, resilientsimplekv.WithMaxEntries(2))
+	for _, key := range []string{"a", "b", "c"} {
+		err := kv.Set(ctx, key, []byte(key), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+		if key == "b" {
+			// Using "a" makes "b" the least recently used.
+			_, err := kv.Get(ctx, "a")
+			c.Assert(err, qt.Equals, nil)
+		}
+	}
+	backend.down = true
+	for _, key := range []string{"a", "c"} {
+		_, err := kv.Get(ctx, key)
+		c.Assert(err, qt.Equals, nil, qt.Commentf("key %q", key))
+	}
+	_, err := kv.Get(ctx, "b")
+	c.Assert(err, qt.ErrorMatches, "connection refused")
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	backend := &flakyStore{Store: memsimplekv.NewStore()}
+	kv := resilientsimplekv.NewStore(backend)
+
+	err := kv.(simplekv.MultiSetter).SetMulti(ctx, []simplekv.Entry{
+		{Key: "a", Value: []byte("a")},
+		{Key: "b", Value: []byte("b")},
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.(simplekv.TTLSetter).SetTTL(ctx, "c", []byte("c"), time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	err = kv.(simplekv.CompareAndSwapper).SetIfEquals(ctx, "d", nil, []byte("d"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// Keys written in a transaction are forgotten.
+	err = kv.(simplekv.Transactor).Txn(ctx, func(tx simplekv.Tx) error {
+		if err := tx.Set("a", []byte("a2"), time.Time{}); err != nil {
+			return err
+		}
+		return tx.Delete("b")
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	backend.down = true
+	for _, key := range []string{"c", "d"} {
+		v, err := kv.Get(ctx, key)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, key)
+	}
+	for _, key := range []string{"a", "b"} {
+		_, err := kv.Get(ctx, key)
+		c.Assert(err, qt.ErrorMatches, "connection refused")
+	}
+
+	// A failed compare-and-swap forgets the key, as the value
+	// in the underlying store is not known.
+	backend.down = false
+	err = kv.(simplekv.CompareAndSwapper).SetIfEquals(ctx, "d", []byte("x"), []byte("d2"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+	backend.down = true
+	_, err = kv.Get(ctx, "d")
+	c.Assert(err, qt.ErrorMatches, "connection refused")
+}
+
+// flakyStore is a store whose reads fail while it is down.
+type flakyStore struct {
+	simplekv.Store
+	down bool
+}
+
+func (s *flakyStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if s.down {
+		return nil, errgo.New("connection refused")
+	}
+	return s.Store.Get(ctx, key)
+}
+
+func (s *flakyStore) Exists(ctx context.Context, key string) (bool, error) {
+	if s.down {
+		return false, errgo.New("connection refused")
+	}
+	return s.Store.Exists(ctx, key)
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Revisioner is implemented by stores that identify each write of a
+// key with a revision, an opaque string that can be used for
+// optimistic concurrency control, for example as an HTTP entity tag.
+// A revision changes whenever the value of the key is written, and may
+// also change when only its expiry time is changed. The empty revision
+// refers to a key that does not exist.
+type Revisioner interface {
+	Store
+
+	// GetWithRevision is like Store.Get except that it also
+	// returns the current revision of the key.
+	GetWithRevision(ctx context.Context, key string) ([]byte, string, error)
+
+	// SetWithRevision is like Store.Set except that it returns the
+	// new revision of the key.
+	SetWithRevision(ctx context.Context, key string, value []byte, expire time.Time) (string, error)
+
+	// UpdateWithRevision is like Store.Update except that it
+	// returns the new revision of the key.
+	UpdateWithRevision(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) (string, error)
+
+	// SetAt sets the value of the given key only if its current
+	// revision is rev, and returns the new revision. An empty rev
+	// matches only a key that does not exist. If the revision does
+	// not match, an error with a cause of ErrConflict is returned.
+	SetAt(ctx context.Context, key string, value []byte, expire time.Time, rev string) (string, error)
+}
+
+// GetWithRevision returns the value and revision of the given key, as
+// described by Revisioner.GetWithRevision. If kv implements
+// Revisioner, its GetWithRevision method is used; otherwise the
+// revision is derived from a hash of the value, so writing a value
+// that the key has held before restores its earlier revision.
+func GetWithRevision(ctx context.Context, kv Store, key string) ([]byte, string, error) {
+	if kv, ok := kv.(Revisioner); ok {
+		v, rev, err := kv.GetWithRevision(ctx, key)
+		return v, rev, errgo.Mask(err, errgo.Any)
+	}
+	v, err := kv.Get(ctx, key)
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Any)
+	}
+	return v, valueRevision(v), nil
+}
+
+// SetWithRevision sets the value of the given key and returns its new
+// revision, as described by Revisioner.SetWithRevision. If kv
+// implements Revisioner, its SetWithRevision method is used; otherwise
+// the revision is derived as described in GetWithRevision.
+func SetWithRevision(ctx context.Context, kv Store, key string, value []byte, expire time.Time) (string, error) {
+	if kv, ok := kv.(Revisioner); ok {
+		rev, err := kv.SetWithRevision(ctx, key, value, expire)
+		return rev, errgo.Mask(err, errgo.Any)
+	}
+	if err := kv.Set(ctx, key, value, expire); err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	return valueRevision(value), nil
+}
+
+// UpdateWithRevision updates the value of the given key and returns
+// its new revision, as described by Revisioner.UpdateWithRevision. If
+// kv implements Revisioner, its UpdateWithRevision method is used;
+// otherwise the revision is derived as described in GetWithRevision.
+func UpdateWithRevision(ctx context.Context, kv Store, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) (string, error) {
+	if kv, ok := kv.(Revisioner); ok {
+		rev, err := kv.UpdateWithRevision(ctx, key, expire, getVal)
+		return rev, errgo.Mask(err, errgo.Any)
+	}
+	var newVal []byte
+	err := kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		v, err := getVal(old)
+		newVal = v
+		return v, err
+	})
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	return valueRevision(newVal), nil
+}
+
+// SetAt sets the value of the given key if its current revision is
+// rev, as described by Revisioner.SetAt. If kv implements Revisioner,
+// its SetAt method is used; otherwise the revision is derived as
+// described in GetWithRevision and compared inside kv.Update.
+func SetAt(ctx context.Context, kv Store, key string, value []byte, expire time.Time, rev string) (string, error) {
+	if kv, ok := kv.(Revisioner); ok {
+		newRev, err := kv.SetAt(ctx, key, value, expire, rev)
+		return newRev, errgo.Mask(err, errgo.Is(ErrConflict), errgo.Is(ErrKeyTooLarge), errgo.Is(ErrValueTooLarge), IsContention)
+	}
+	err := kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		oldRev := ""
+		if old != nil {
+			oldRev = valueRevision(old)
+		}
+		if oldRev != rev {
+			return nil, KeyConflictError(key)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(ErrConflict), errgo.Is(ErrKeyTooLarge), errgo.Is(ErrValueTooLarge), IsContention)
+	}
+	return valueRevision(value), nil
+}
+
+// valueRevision returns the revision used for the given value by stores
+// that do not implement Revisioner.
+func valueRevision(v []byte) string {
+	sum := sha256.Sum256(v)
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestRevisionFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := plainStore{memsimplekv.NewStore()}
+
+	rev1, err := simplekv.SetAt(ctx, kv, "a", []byte("1"), time.Time{}, "")
+	c.Assert(err, qt.Equals, nil)
+	rev2, err := simplekv.SetWithRevision(ctx, kv, "a", []byte("2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rev2, qt.Not(qt.Equals), rev1)
+
+	_, err = simplekv.SetAt(ctx, kv, "a", []byte("3"), time.Time{}, rev1)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+
+	// Without native support, the revision is derived from the
+	// value, so writing an earlier value restores its revision.
+	rev, err := simplekv.UpdateWithRevision(ctx, kv, "a", time.Time{}, func(old []byte) ([]byte, error) {
+		return []byte("1"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rev, qt.Equals, rev1)
+	v, rev, err := simplekv.GetWithRevision(ctx, kv, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "1")
+	c.Assert(rev, qt.Equals, rev1)
+}
+
+func TestRevisionNative(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore()
+
+	rev1, err := simplekv.SetWithRevision(ctx, kv, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, err = simplekv.SetWithRevision(ctx, kv, "a", []byte("2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	rev3, err := simplekv.SetWithRevision(ctx, kv, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rev3, qt.Not(qt.Equals), rev1)
+
+	_, err = simplekv.SetAt(ctx, kv, "a", []byte("3"), time.Time{}, rev1)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+}
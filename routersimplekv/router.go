@@ -0,0 +1,395 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package routersimplekv provides a simplekv.Store that routes reads
+// between a fast but unreliable store and a slower, reliable one,
+// according to how each has been performing recently.
+//
+// The router keeps an exponentially weighted moving average of the
+// latency and error rate of reads from each store. Reads are sent to
+// the fast store until its error rate rises above a high threshold or
+// its latency rises above that of the reliable store; they are then
+// sent to the reliable store until the fast store's error rate falls
+// below a lower threshold and its latency is clearly below that of the
+// reliable store again. The gap between the thresholds stops reads
+// flapping between the stores. To keep the averages up to date, a
+// proportion of reads is always sent to the store that is not
+// currently preferred.
+package routersimplekv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+const (
+	// DefaultErrorRateHigh holds the default error rate above
+	// which reads stop being sent to the fast store.
+	DefaultErrorRateHigh = 0.2
+
+	// DefaultErrorRateLow holds the default error rate below which
+	// reads are sent to the fast store again.
+	DefaultErrorRateLow = 0.05
+
+	// DefaultProbeInterval holds the default interval, in reads,
+	// between reads sent to the store that is not preferred.
+	DefaultProbeInterval = 10
+)
+
+// weight holds the weight given to each new sample in the moving
+// averages.
+const weight = 0.2
+
+// latencyMargin holds the proportion of the reliable store's latency
+// that the fast store's latency must fall below before reads are sent
+// to it again.
+const latencyMargin = 0.8
+
+// Backend identifies one of the stores behind a router.
+type Backend int
+
+const (
+	// Fast identifies the fast store.
+	Fast Backend = iota
+
+	// Reliable identifies the reliable store.
+	Reliable
+)
+
+// String implements fmt.Stringer.
+func (b Backend) String() string {
+	switch b {
+	case Fast:
+		return "fast"
+	case Reliable:
+		return "reliable"
+	}
+	return "unknown"
+}
+
+// Observer is notified of the router's reads and decisions, for
+// example to export them as metrics. Its methods may be called
+// concurrently.
+type Observer interface {
+	// Read is called after each read from a backend with the time
+	// it took and the error it returned, if any. Reads that fail
+	// with a cause of simplekv.ErrNotFound count as successful.
+	Read(b Backend, d time.Duration, err error)
+
+	// Route is called when reads start being sent to a different
+	// backend.
+	Route(b Backend)
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithErrorRateThresholds returns an option that sets the error rate
+// of the fast store above which reads are sent to the reliable store,
+// and below which they are sent to the fast store again. The high
+// threshold should be greater than the low one. By default
+// DefaultErrorRateHigh and DefaultErrorRateLow are used.
+func WithErrorRateThresholds(high, low float64) Option {
+	return func(s *kvStore) {
+		s.errorRateHigh = high
+		s.errorRateLow = low
+	}
+}
+
+// WithProbeInterval returns an option that makes one in every n reads
+// go to the store that is not currently preferred. By default
+// DefaultProbeInterval is used.
+func WithProbeInterval(n int) Option {
+	return func(s *kvStore) {
+		s.probeInterval = n
+	}
+}
+
+// WithObserver returns an option that makes the router report its
+// reads and decisions to the given observer.
+func WithObserver(o Observer) Option {
+	return func(s *kvStore) {
+		s.observer = o
+	}
+}
+
+// WithClock returns an option that makes the router use the given
+// clock to measure latency. By default the system clock is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// NewStore returns a store that reads from fast or reliable as
+// described in the package documentation. When a read from fast fails,
+// it is retried on reliable, so that the fast store's failures are not
+// seen by callers.
+//
+// All writes go to reliable. The fast store must hold a copy of the
+// data in reliable that is kept up to date by other means, such as a
+// read replica, and reads from it may return stale values.
+//
+// If reliable implements simplekv.KeyLister, so does the returned
+// store; keys are always listed from reliable.
+func NewStore(fast, reliable simplekv.Store, opts ...Option) simplekv.Store {
+	s := &kvStore{
+		fast:          fast,
+		reliable:      reliable,
+		errorRateHigh: DefaultErrorRateHigh,
+		errorRateLow:  DefaultErrorRateLow,
+		probeInterval: DefaultProbeInterval,
+		observer:      nopObserver{},
+		clock:         systemClock{},
+		route:         Fast,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if _, ok := reliable.(simplekv.KeyLister); ok {
+		return &keyListerStore{s}
+	}
+	return s
+}
+
+type kvStore struct {
+	fast          simplekv.Store
+	reliable      simplekv.Store
+	errorRateHigh float64
+	errorRateLow  float64
+	probeInterval int
+	observer      Observer
+	clock         simplekv.Clock
+
+	// mu guards the fields below it.
+	mu sync.Mutex
+
+	// route holds the backend that reads are currently sent to.
+	route Backend
+
+	// reads holds the number of reads started, used to choose
+	// which reads are probes.
+	reads int
+
+	// stats holds the moving averages for each backend, indexed
+	// by Backend.
+	stats [2]stats
+}
+
+// stats holds the moving averages for a backend.
+type stats struct {
+	// sampled holds whether any reads from the backend have been
+	// measured.
+	sampled bool
+
+	// latency holds the average latency in seconds.
+	latency float64
+
+	// errorRate holds the average proportion of reads that failed.
+	errorRate float64
+}
+
+// add adds a sample to the averages.
+func (st *stats) add(d time.Duration, failed bool) {
+	e := 0.0
+	if failed {
+		e = 1
+	}
+	if !st.sampled {
+		st.sampled = true
+		st.latency = d.Seconds()
+		st.errorRate = e
+		return
+	}
+	st.latency += weight * (d.Seconds() - st.latency)
+	st.errorRate += weight * (e - st.errorRate)
+}
+
+// next returns the backend that the next read should be sent to.
+func (s *kvStore) next() Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	if s.probeInterval > 0 && s.reads%s.probeInterval == 0 {
+		return 1 - s.route
+	}
+	return s.route
+}
+
+// observe records the outcome of a read from the given backend and
+// updates the route if necessary.
+func (s *kvStore) observe(b Backend, d time.Duration, err error) {
+	s.observer.Read(b, d, err)
+	s.mu.Lock()
+	s.stats[b].add(d, err != nil)
+	fast, reliable := s.stats[Fast], s.stats[Reliable]
+	route := s.route
+	switch route {
+	case Fast:
+		if fast.errorRate > s.errorRateHigh || reliable.sampled && fast.latency > reliable.latency {
+			route = Reliable
+		}
+	case Reliable:
+		if fast.errorRate < s.errorRateLow && (!reliable.sampled || fast.latency < latencyMargin*reliable.latency) {
+			route = Fast
+		}
+	}
+	changed := route != s.route
+	s.route = route
+	s.mu.Unlock()
+	if changed {
+		s.observer.Route(route)
+	}
+}
+
+// read calls f with the store that the read should use, falling back
+// to the reliable store if the fast store fails.
+func (s *kvStore) read(f func(kv simplekv.Store) error) error {
+	if s.next() == Fast {
+		t0 := s.clock.Now()
+		err := f(s.fast)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			s.observe(Fast, s.clock.Now().Sub(t0), nil)
+			return errgo.Mask(err, errgo.Any)
+		}
+		s.observe(Fast, s.clock.Now().Sub(t0), err)
+		if err == nil {
+			return nil
+		}
+	}
+	t0 := s.clock.Now()
+	err := f(s.reliable)
+	if errgo.Cause(err) == simplekv.ErrNotFound {
+		s.observe(Reliable, s.clock.Now().Sub(t0), nil)
+	} else {
+		s.observe(Reliable, s.clock.Now().Sub(t0), err)
+	}
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Context implements simplekv.Store.Context by returning a context
+// suitable for both the fast and the reliable store.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	ctx, closeFast := s.fast.Context(ctx)
+	ctx, closeReliable := s.reliable.Context(ctx)
+	return ctx, func() {
+		closeReliable()
+		closeFast()
+	}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var v []byte
+	err := s.read(func(kv simplekv.Store) error {
+		var err error
+		v, err = kv.Get(ctx, key)
+		return errgo.Mask(err, errgo.Any)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return v, nil
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	var ok bool
+	err := s.read(func(kv simplekv.Store) error {
+		var err error
+		ok, err = kv.Exists(ctx, key)
+		return errgo.Mask(err, errgo.Any)
+	})
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Any)
+	}
+	return ok, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	return errgo.Mask(s.reliable.Set(ctx, key, value, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	return errgo.Mask(s.reliable.Update(ctx, key, expire, getVal), errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	return errgo.Mask(s.reliable.Touch(ctx, key, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	return errgo.Mask(s.reliable.Delete(ctx, key), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the reliable store.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	return errgo.Mask(simplekv.SetIfEquals(ctx, s.reliable, key, oldVal, newVal, expire), errgo.Any)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by calling
+// simplekv.SetMulti on the reliable store.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	return errgo.Mask(simplekv.SetMulti(ctx, s.reliable, entries), errgo.Any)
+}
+
+// Txn implements simplekv.Transactor.Txn by calling simplekv.Txn on
+// the reliable store.
+func (s *kvStore) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	return errgo.Mask(simplekv.Txn(ctx, s.reliable, f), errgo.Any)
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen by returning the
+// smaller of the limits of the two stores.
+func (s *kvStore) MaxKeyLen() int {
+	n := simplekv.KeyLimit(s.reliable)
+	if m := simplekv.KeyLimit(s.fast); m < n {
+		n = m
+	}
+	return n
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the reliable store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.reliable)
+}
+
+// keyListerStore is used when the reliable store implements
+// simplekv.KeyLister.
+type keyListerStore struct {
+	*kvStore
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *keyListerStore) Keys(ctx context.Context) ([]string, error) {
+	keys, err := s.reliable.(simplekv.KeyLister).Keys(ctx)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *keyListerStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.reliable.(simplekv.KeyLister).KeysWithPrefix(ctx, prefix)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) Read(Backend, time.Duration, error) {}
+
+func (nopObserver) Route(Backend) {}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package routersimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/routersimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestRouterStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		// Both backends are the same store, so that values
+		// written to the reliable store are seen in the fast one.
+		kv := memsimplekv.NewStore()
+		return routersimplekv.NewStore(kv, kv), nil
+	})
+}
+
+// testClock is a clock that only moves when advanced by a backend.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// backend is a store that takes a given time to read and can be made
+// to fail.
+type backend struct {
+	simplekv.Store
+	clock   *testClock
+	latency time.Duration
+	fail    bool
+	reads   int
+}
+
+func (b *backend) Get(ctx context.Context, key string) ([]byte, error) {
+	b.reads++
+	b.clock.now = b.clock.now.Add(b.latency)
+	if b.fail {
+		return nil, errgo.New("backend failed")
+	}
+	return b.Store.Get(ctx, key)
+}
+
+type recordingObserver struct {
+	routes []routersimplekv.Backend
+}
+
+func (o *recordingObserver) Read(routersimplekv.Backend, time.Duration, error) {}
+
+func (o *recordingObserver) Route(b routersimplekv.Backend) {
+	o.routes = append(o.routes, b)
+}
+
+func TestRouting(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mem := memsimplekv.NewStore()
+	err := mem.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	fast := &backend{Store: mem, clock: clock, latency: time.Millisecond}
+	reliable := &backend{Store: mem, clock: clock, latency: 10 * time.Millisecond}
+	var o recordingObserver
+	kv := routersimplekv.NewStore(fast, reliable,
+		routersimplekv.WithClock(clock),
+		routersimplekv.WithObserver(&o),
+		routersimplekv.WithProbeInterval(10),
+	)
+
+	get := func(n int) {
+		for i := 0; i < n; i++ {
+			v, err := kv.Get(ctx, "k")
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(string(v), qt.Equals, "v")
+		}
+	}
+
+	// Reads go to the fast store, except for probes.
+	get(100)
+	c.Assert(fast.reads, qt.Equals, 90)
+	c.Assert(reliable.reads, qt.Equals, 10)
+	c.Assert(o.routes, qt.HasLen, 0)
+
+	// When the fast store fails, reads fall back to the reliable
+	// store and are soon routed to it.
+	fast.fail = true
+	get(5)
+	c.Assert(o.routes, qt.DeepEquals, []routersimplekv.Backend{routersimplekv.Reliable})
+	fast.reads, reliable.reads = 0, 0
+	get(100)
+	c.Assert(fast.reads, qt.Equals, 10)
+	c.Assert(reliable.reads, qt.Equals, 100)
+
+	// Once the fast store recovers, the probes bring reads back
+	// to it, but not after a single success.
+	fast.fail = false
+	get(10)
+	c.Assert(o.routes, qt.HasLen, 1)
+	get(200)
+	c.Assert(o.routes, qt.DeepEquals, []routersimplekv.Backend{routersimplekv.Reliable, routersimplekv.Fast})
+
+	// When the fast store becomes slower than the reliable one,
+	// reads are routed to the reliable store.
+	fast.latency = 20 * time.Millisecond
+	get(20)
+	c.Assert(o.routes, qt.DeepEquals, []routersimplekv.Backend{routersimplekv.Reliable, routersimplekv.Fast, routersimplekv.Reliable})
+}
+
+func TestWritesGoToReliable(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	fast := memsimplekv.NewStore()
+	reliable := memsimplekv.NewStore()
+	kv := routersimplekv.NewStore(fast, reliable)
+
+	err := kv.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, err = fast.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	v, err := reliable.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "v")
+
+	// A key missing from the fast store is not looked up in the
+	// reliable store, because the fast store is assumed to be a
+	// copy of it.
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func TestBackendString(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(routersimplekv.Fast.String(), qt.Equals, "fast")
+	c.Assert(routersimplekv.Reliable.String(), qt.Equals, "reliable")
+	c.Assert(routersimplekv.Backend(5).String(), qt.Equals, "unknown")
+}
@@ -0,0 +1,694 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package s3simplekv provides a simplekv.Store that stores each entry
+// as an object in an S3 bucket, or in any object store with an
+// S3-compatible API. It is intended for very large values that are
+// infrequently updated, such as certificates and backups; every
+// operation makes at least one HTTP request, so it is not suited to
+// small, frequently changing values.
+//
+// The data of each object holds the value of its entry in an expiry
+// envelope, which records the expiry time of the entry before the
+// value. Expiry is enforced lazily: an expired object is treated as
+// absent but is not removed from the bucket unless the store is
+// created with the WithReaper option.
+//
+// Update and Touch use conditional requests (If-Match and
+// If-None-Match), so they are atomic only when the object store
+// supports conditional writes, as S3 does. Delete first checks that
+// the entry exists, so a concurrent write between the check and the
+// deletion may be lost.
+package s3simplekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/internal/envelope"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+const (
+	// maxObjectNameLen holds the maximum length in bytes of an S3
+	// object name.
+	maxObjectNameLen = 1024
+
+	// maxValueLen holds the maximum length of a value. Values are
+	// held in memory and written with a single request, so this is
+	// well below the S3 limit on the size of an object.
+	maxValueLen = 1 << 30
+)
+
+// maxAttempts holds the number of times a conditional write is
+// attempted when the object is modified concurrently.
+const maxAttempts = 10
+
+// retryAfter holds the delay suggested to callers when an operation
+// fails after maxAttempts attempts. It is also the maximum delay
+// between attempts.
+const retryAfter = 100 * time.Millisecond
+
+// backoff waits before the given retry of a conditional write. The
+// delay doubles with each attempt, starting at one millisecond, and is
+// jittered so that concurrent writers do not retry in lock step.
+func backoff(ctx context.Context, attempt int) error {
+	d := time.Millisecond << uint(attempt)
+	if d > retryAfter {
+		d = retryAfter
+	}
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(d))) + 1)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return errgo.Mask(ctx.Err(), errgo.Any)
+	}
+}
+
+// errPreconditionFailed is the error cause used when a conditional
+// request fails because the object has been modified concurrently.
+var errPreconditionFailed = errgo.New("precondition failed")
+
+// Credentials holds the credentials used to sign requests.
+type Credentials struct {
+	// AccessKeyID and SecretAccessKey hold the access key used to
+	// sign requests.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// SessionToken holds the session token of temporary
+	// credentials, if any.
+	SessionToken string
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithRegion returns an option that sets the region used to sign
+// requests. The default is "us-east-1".
+func WithRegion(region string) Option {
+	return func(s *kvStore) {
+		s.region = region
+	}
+}
+
+// WithPrefix returns an option that stores each entry in the object
+// named prefix+key, so that several stores can share a bucket.
+func WithPrefix(prefix string) Option {
+	return func(s *kvStore) {
+		s.prefix = prefix
+	}
+}
+
+// WithHTTPClient returns an option that makes the store send
+// requests with the given client instead of http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *kvStore) {
+		s.client = client
+	}
+}
+
+// WithClock returns an option that makes the store use the given
+// clock to sign requests and to decide whether entries have expired.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages, including failures to remove expired objects, to the
+// given logger.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// WithReaper returns an option that makes the store remove expired
+// objects from the bucket at the given interval until the store is
+// closed. The start of every object in the bucket with the store's
+// prefix is fetched each time, to find out whether it has expired.
+func WithReaper(interval time.Duration) Option {
+	return func(s *kvStore) {
+		s.reapInterval = interval
+	}
+}
+
+// NewStore returns a new Store that stores entries in the given
+// bucket. The endpoint holds the URL of the object store, for example
+// "https://s3.eu-west-2.amazonaws.com"; buckets are addressed by path
+// rather than by host name. The bucket must already exist.
+//
+// The returned store implements simplekv.KeyLister,
+// simplekv.KeyLimiter, simplekv.ValueLimiter and simplekv.Closer.
+// Listing keys makes a request for every object, to find out whether
+// it has expired. Closing the store stops the removal of expired
+// objects started by WithReaper.
+func NewStore(endpoint, bucket string, creds Credentials, opts ...Option) (simplekv.Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid endpoint")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, errgo.Newf("invalid endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, errgo.Newf("empty bucket name")
+	}
+	s := &kvStore{
+		endpoint: u,
+		bucket:   bucket,
+		creds:    creds,
+		region:   "us-east-1",
+		client:   http.DefaultClient,
+		clock:    systemClock{},
+		logger:   nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if len(s.prefix) >= maxObjectNameLen {
+		return nil, errgo.Newf("prefix of %d bytes is too long", len(s.prefix))
+	}
+	if s.reapInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancelReap = cancel
+		s.reaper = envelope.NewReaper(reapBackend{ctx, s}, s.reapInterval, s.clock, s.logger)
+	}
+	return s, nil
+}
+
+type kvStore struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	creds        Credentials
+	region       string
+	client       *http.Client
+	clock        simplekv.Clock
+	logger       simplekv.Logger
+	reapInterval time.Duration
+
+	// reaper and cancelReap are set when the store removes
+	// expired objects.
+	reaper     *envelope.Reaper
+	cancelReap func()
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// object holds an object fetched from the store.
+type object struct {
+	// data holds the envelope held in the object, which holds only
+	// its first envelope.PrefixLen bytes if the value was not
+	// fetched.
+	data   []byte
+	value  []byte
+	etag   string
+	expire time.Time
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := s.check(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	o, err := s.getObject(ctx, key, true)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !s.alive(o) {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	return o.value, nil
+}
+
+// Exists implements simplekv.Store.Exists without fetching the value.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := s.check(key); err != nil {
+		return false, errgo.Mask(err, errgo.Any)
+	}
+	o, err := s.getObject(ctx, key, false)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return s.alive(o), nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := s.check(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := simplekv.CheckValue(value, maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return errgo.Mask(s.putObject(ctx, key, value, expire, nil))
+}
+
+// Update implements simplekv.Store.Update by writing the new value
+// only if the object has not changed since the old value was read.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := s.check(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			if err := backoff(ctx, i); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		o, err := s.getObject(ctx, key, true)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var old []byte
+		if s.alive(o) {
+			old = o.value
+		}
+		value, err := getVal(old)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if err := simplekv.CheckValue(value, maxValueLen); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+		err = s.putObject(ctx, key, value, expire, preconditions(o))
+		if errgo.Cause(err) == errPreconditionFailed {
+			continue
+		}
+		return errgo.Mask(err)
+	}
+	return simplekv.NewContentionError(retryAfter, "cannot update key %s: too many concurrent modifications", key)
+}
+
+// Touch implements simplekv.Store.Touch by writing the object again
+// with the new expiry time, only if it has not changed since it was
+// read.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := s.check(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			if err := backoff(ctx, i); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		o, err := s.getObject(ctx, key, true)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !s.alive(o) {
+			return simplekv.KeyNotFoundError(key)
+		}
+		err = s.putObject(ctx, key, o.value, expire, preconditions(o))
+		if errgo.Cause(err) == errPreconditionFailed {
+			continue
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot touch key %s", key)
+		}
+		return nil
+	}
+	return simplekv.NewContentionError(retryAfter, "cannot touch key %s: too many concurrent modifications", key)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := s.check(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	o, err := s.getObject(ctx, key, false)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !s.alive(o) {
+		return simplekv.KeyNotFoundError(key)
+	}
+	if _, err := s.do(ctx, http.MethodDelete, s.objectPath(key), nil, nil, nil); err != nil {
+		return errgo.Notef(err, "cannot delete key %s", key)
+	}
+	return nil
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	keys, err := s.KeysWithPrefix(ctx, "")
+	return keys, errgo.Mask(err)
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	keys := []string{}
+	err := s.walk(ctx, prefix, func(o *object, key string) error {
+		if s.alive(o) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+// Close implements simplekv.Closer.Close by stopping the removal of
+// expired objects, if the store was created with WithReaper. Closing
+// a store more than once has no effect.
+func (s *kvStore) Close() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if !closed && s.reaper != nil {
+		s.cancelReap()
+		s.reaper.Stop()
+	}
+	return nil
+}
+
+// walk calls f with each object holding a key with the given prefix,
+// along with its key. The values of the objects are not fetched. An
+// object that is deleted while walk is in progress is passed to f as
+// nil. If f returns an error, walk stops and returns it.
+func (s *kvStore) walk(ctx context.Context, prefix string, f func(o *object, key string) error) error {
+	params := map[string]string{
+		"list-type": "2",
+		"prefix":    s.prefix + prefix,
+	}
+	for {
+		data, err := s.do(ctx, http.MethodGet, "/"+uriEncode(s.bucket, false), params, nil, nil)
+		if err != nil {
+			return errgo.Notef(err, "cannot list objects")
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return errgo.Notef(err, "cannot unmarshal object list")
+		}
+		for _, c := range result.Contents {
+			key := strings.TrimPrefix(c.Key, s.prefix)
+			o, err := s.getObject(ctx, key, false)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if err := f(o, key); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		params["continuation-token"] = result.NextContinuationToken
+	}
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen. Keys are
+// limited by the maximum length of an object name, less the length
+// of the prefix.
+func (s *kvStore) MaxKeyLen() int {
+	if n := maxObjectNameLen - len(s.prefix); n < simplekv.MaxKeyLen {
+		return n
+	}
+	return simplekv.MaxKeyLen
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen.
+func (s *kvStore) MaxValueLen() int {
+	return maxValueLen
+}
+
+// check returns an error with a cause of simplekv.ErrStoreClosed if
+// the store has been closed, and otherwise checks that the given key
+// can be used as (part of) an object name.
+func (s *kvStore) check(key string) error {
+	if err := s.checkClosed(); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	return simplekv.ValidateKey(key, simplekv.KeyRules{
+		MaxLen:     s.MaxKeyLen(),
+		AllowEmpty: s.prefix != "",
+		Allowed:    func(rune) bool { return true },
+	})
+}
+
+// checkClosed returns an error with a cause of simplekv.ErrStoreClosed
+// if the store has been closed.
+func (s *kvStore) checkClosed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errgo.WithCausef(nil, simplekv.ErrStoreClosed, "")
+	}
+	return nil
+}
+
+// alive reports whether o holds an entry that has not expired.
+func (s *kvStore) alive(o *object) bool {
+	return o != nil && (o.expire.IsZero() || o.expire.After(s.clock.Now()))
+}
+
+// getObject fetches the object holding the given key. If withValue
+// is false, only the start of the envelope is fetched, so the value is
+// not. It returns a nil object if there is no such object.
+func (s *kvStore) getObject(ctx context.Context, key string, withValue bool) (*object, error) {
+	var h http.Header
+	if !withValue {
+		h = http.Header{
+			"Range": {fmt.Sprintf("bytes=0-%d", envelope.PrefixLen-1)},
+		}
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, s.objectPath(key), nil, h, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp, data, err := s.roundTrip(req)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get key %s", key)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := responseError(resp, data); err != nil {
+		return nil, errgo.Notef(err, "cannot get key %s", key)
+	}
+	o := &object{
+		data: data,
+		etag: resp.Header.Get("ETag"),
+	}
+	if withValue {
+		o.value, o.expire, err = envelope.Decode(data)
+	} else {
+		o.expire, err = envelope.DecodeExpiry(data)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid data in key %s", key)
+	}
+	return o, nil
+}
+
+// putObject writes the given value to the object holding the given
+// key, with the given preconditions.
+func (s *kvStore) putObject(ctx context.Context, key string, value []byte, expire time.Time, h http.Header) error {
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("Content-Type", "application/octet-stream")
+	if _, err := s.do(ctx, http.MethodPut, s.objectPath(key), nil, h, envelope.Encode(value, expire)); err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot set key %s", key), errgo.Is(errPreconditionFailed))
+	}
+	return nil
+}
+
+// preconditions returns the headers that make a write succeed only
+// if the object is unchanged since o was fetched, or still absent if
+// o is nil.
+func preconditions(o *object) http.Header {
+	h := make(http.Header)
+	if o == nil {
+		h.Set("If-None-Match", "*")
+	} else {
+		h.Set("If-Match", o.etag)
+	}
+	return h
+}
+
+// objectPath returns the escaped URL path of the object holding the
+// given key.
+func (s *kvStore) objectPath(key string) string {
+	return "/" + uriEncode(s.bucket, false) + "/" + uriEncode(s.prefix+key, true)
+}
+
+// do sends a request and returns the response body. A response with a
+// status other than 2xx is returned as an error; a failed conditional
+// request has a cause of errPreconditionFailed.
+func (s *kvStore) do(ctx context.Context, method, path string, params map[string]string, h http.Header, body []byte) ([]byte, error) {
+	req, err := s.newRequest(ctx, method, path, params, h, body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp, data, err := s.roundTrip(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := responseError(resp, data); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(errPreconditionFailed))
+	}
+	return data, nil
+}
+
+// newRequest returns a new signed request for the given escaped path
+// and query parameters.
+func (s *kvStore) newRequest(ctx context.Context, method, path string, params map[string]string, h http.Header, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + path
+	p, err := url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	u.Path = p
+	u.RawQuery = canonicalQuery(params)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Use the URL directly rather than the one parsed from its
+	// string form, so that the escaping of the path is preserved.
+	req.URL = &u
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	sign(req, s.creds, s.region, hashHex(body), s.clock.Now())
+	return req, nil
+}
+
+// roundTrip sends the given request and returns the response along
+// with its body.
+func (s *kvStore) roundTrip(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot read response body")
+	}
+	return resp, data, nil
+}
+
+// s3Error holds an error returned by the object store.
+type s3Error struct {
+	XMLName    xml.Name `xml:"Error"`
+	StatusCode int      `xml:"-"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+}
+
+// Error implements the error interface.
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s (status %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// responseError returns the error described by the given response, or
+// nil if it describes success. A copy request can fail after a success
+// status has been sent, in which case the body holds the error.
+func responseError(resp *http.Response, data []byte) error {
+	e := &s3Error{
+		StatusCode: resp.StatusCode,
+	}
+	if resp.StatusCode/100 == 2 {
+		if !bytes.Contains(data, []byte("<Error>")) || xml.Unmarshal(data, e) != nil {
+			return nil
+		}
+	} else if len(data) > 0 {
+		// The body may not describe the error (for example,
+		// HEAD responses have no body), so ignore failures.
+		xml.Unmarshal(data, e)
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed || e.Code == "PreconditionFailed" || e.Code == "ConditionalRequestConflict" {
+		return errgo.WithCausef(e, errPreconditionFailed, "")
+	}
+	return e
+}
+
+// listBucketResult holds the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// reapBackend implements envelope.Backend so that an envelope.Reaper
+// can remove expired objects from the store.
+type reapBackend struct {
+	ctx context.Context
+	s   *kvStore
+}
+
+// Walk implements envelope.Backend.Walk.
+func (b reapBackend) Walk(f func(key string, data []byte) error) error {
+	return errgo.Mask(b.s.walk(b.ctx, "", func(o *object, key string) error {
+		if o == nil {
+			return nil
+		}
+		return f(key, o.data)
+	}), errgo.Any)
+}
+
+// DeleteIf implements envelope.Backend.DeleteIf by deleting the object
+// only if it has not changed since it was checked, so the deletion is
+// atomic only when the object store supports conditional deletes.
+func (b reapBackend) DeleteIf(key string, cond func(data []byte) bool) error {
+	o, err := b.s.getObject(b.ctx, key, false)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if o == nil || !cond(o.data) {
+		return nil
+	}
+	_, err = b.s.do(b.ctx, http.MethodDelete, b.s.objectPath(key), nil, http.Header{
+		"If-Match": {o.etag},
+	}, nil)
+	if err != nil && errgo.Cause(err) != errPreconditionFailed {
+		return errgo.Notef(err, "cannot delete key %s", key)
+	}
+	return nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,461 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package s3simplekv_test
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/internal/envelope"
+	"github.com/juju/simplekv/s3simplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+var testCreds = s3simplekv.Credentials{
+	AccessKeyID:     "test-key",
+	SecretAccessKey: "test-secret",
+}
+
+func TestS3Store(t *testing.T) {
+	srv := newFakeS3()
+	defer srv.Close()
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return s3simplekv.NewStore(srv.URL, srv.newBucket(), testCreds)
+	})
+}
+
+func TestS3StoreWithPrefix(t *testing.T) {
+	srv := newFakeS3()
+	defer srv.Close()
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return s3simplekv.NewStore(srv.URL, srv.newBucket(), testCreds, s3simplekv.WithPrefix("kv/"))
+	})
+}
+
+func TestObjects(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeS3()
+	defer srv.Close()
+	bucket := srv.newBucket()
+	kv, err := s3simplekv.NewStore(srv.URL, bucket, testCreds, s3simplekv.WithPrefix("certs/"))
+	c.Assert(err, qt.Equals, nil)
+
+	expire := time.Date(2100, 1, 2, 3, 4, 5, 6, time.UTC)
+	err = kv.Set(ctx, "a b/c", []byte("value"), expire)
+	c.Assert(err, qt.Equals, nil)
+	o := srv.object(bucket, "certs/a b/c")
+	c.Assert(o, qt.Not(qt.IsNil))
+	c.Assert(o.data, qt.DeepEquals, envelope.Encode([]byte("value"), expire))
+	c.Assert(o.meta, qt.HasLen, 0)
+
+	// Touching an entry writes the value again with the new expiry
+	// time.
+	err = kv.Touch(ctx, "a b/c", time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	o = srv.object(bucket, "certs/a b/c")
+	c.Assert(o.data, qt.DeepEquals, envelope.Encode([]byte("value"), time.Time{}))
+
+	// Checking whether an entry exists fetches only the start of
+	// the object.
+	srv.object(bucket, "certs/a b/c").data = append(envelope.Encode([]byte("value"), time.Time{}), 0xff)
+	ok, err := kv.Exists(ctx, "a b/c")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(srv.lastRange(), qt.Equals, fmt.Sprintf("bytes=0-%d", envelope.PrefixLen-1))
+}
+
+func TestInvalidObject(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeS3()
+	defer srv.Close()
+	bucket := srv.newBucket()
+	kv, err := s3simplekv.NewStore(srv.URL, bucket, testCreds)
+	c.Assert(err, qt.Equals, nil)
+
+	err = kv.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	srv.object(bucket, "k").data = []byte("not an envelope")
+	_, err = kv.Get(ctx, "k")
+	c.Assert(err, qt.ErrorMatches, `invalid data in key k: unknown envelope version 110`)
+}
+
+func TestReaper(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeS3()
+	defer srv.Close()
+	bucket := srv.newBucket()
+	clock := &testClock{now: time.Now()}
+	kv, err := s3simplekv.NewStore(srv.URL, bucket, testCreds,
+		s3simplekv.WithPrefix("kv/"),
+		s3simplekv.WithClock(clock),
+		s3simplekv.WithReaper(time.Millisecond),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer kv.(simplekv.Closer).Close()
+
+	err = kv.Set(ctx, "expired", []byte("v"), clock.now.Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "live", []byte("v"), clock.now.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "forever", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	for a := 0; srv.object(bucket, "kv/expired") != nil; a++ {
+		if a > 5000 {
+			c.Fatalf("expired object not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	err = kv.(simplekv.Closer).Close()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.object(bucket, "kv/live"), qt.Not(qt.IsNil))
+	c.Assert(srv.object(bucket, "kv/forever"), qt.Not(qt.IsNil))
+
+	// Once the store is closed, expired objects are left alone.
+	other, err := s3simplekv.NewStore(srv.URL, bucket, testCreds, s3simplekv.WithPrefix("kv/"))
+	c.Assert(err, qt.Equals, nil)
+	err = other.Set(ctx, "expired", []byte("v"), clock.now.Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(srv.object(bucket, "kv/expired"), qt.Not(qt.IsNil))
+}
+
+func TestExpiryEnforcedLazily(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeS3()
+	defer srv.Close()
+	bucket := srv.newBucket()
+	clock := &testClock{now: time.Now()}
+	kv, err := s3simplekv.NewStore(srv.URL, bucket, testCreds, s3simplekv.WithClock(clock))
+	c.Assert(err, qt.Equals, nil)
+
+	err = kv.Set(ctx, "k", []byte("v"), clock.now.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	clock.now = clock.now.Add(2 * time.Hour)
+
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	ok, err := kv.Exists(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+	keys, err := kv.(simplekv.KeyLister).Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 0)
+
+	// The object is still there.
+	c.Assert(srv.object(bucket, "k"), qt.Not(qt.IsNil))
+
+	// The expired object is replaced by an update.
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(old, qt.IsNil)
+		return []byte("new"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	v, err := kv.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "new")
+}
+
+func TestUpdateRetriesOnConcurrentWrite(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeS3()
+	defer srv.Close()
+	kv, err := s3simplekv.NewStore(srv.URL, srv.newBucket(), testCreds)
+	c.Assert(err, qt.Equals, nil)
+	other, err := s3simplekv.NewStore(srv.URL, srv.bucket(), testCreds)
+	c.Assert(err, qt.Equals, nil)
+
+	calls := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			c.Check(old, qt.IsNil)
+			err := other.Set(ctx, "k", []byte("other"), time.Time{})
+			c.Check(err, qt.Equals, nil)
+		} else {
+			c.Check(string(old), qt.Equals, "other")
+		}
+		return append(old, "!"...), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(calls, qt.Equals, 2)
+	v, err := kv.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "other!")
+
+	// An update that never succeeds eventually gives up.
+	n := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		n++
+		err := other.Set(ctx, "k", []byte(fmt.Sprint(n)), time.Time{})
+		c.Check(err, qt.Equals, nil)
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot update key k: too many concurrent modifications`)
+	_, ok := simplekv.RetryAfter(err)
+	c.Assert(ok, qt.Equals, true)
+}
+
+func TestErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeS3()
+	defer srv.Close()
+
+	kv, err := s3simplekv.NewStore(srv.URL, "no-such-bucket", testCreds)
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `cannot set key k: NoSuchBucket: The specified bucket does not exist \(status 404\)`)
+
+	kv, err = s3simplekv.NewStore(srv.URL, srv.newBucket(), s3simplekv.Credentials{
+		AccessKeyID:     "bad-key",
+		SecretAccessKey: "test-secret",
+	})
+	c.Assert(err, qt.Equals, nil)
+	_, err = kv.Get(ctx, "k")
+	c.Assert(err, qt.ErrorMatches, `cannot get key k: InvalidAccessKeyId: .* \(status 403\)`)
+
+	_, err = kv.Get(ctx, "\xff")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey)
+
+	_, err = s3simplekv.NewStore("s3.amazonaws.com", "bucket", testCreds)
+	c.Assert(err, qt.ErrorMatches, `invalid endpoint "s3.amazonaws.com"`)
+	_, err = s3simplekv.NewStore("https://s3.amazonaws.com", "", testCreds)
+	c.Assert(err, qt.ErrorMatches, `empty bucket name`)
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// fakeS3 implements the small subset of the S3 API used by
+// s3simplekv.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+	// rangeHeader holds the Range header of the most recent GET
+	// request for an object.
+	rangeHeader string
+}
+
+type fakeObject struct {
+	data []byte
+	etag string
+	meta map[string]string
+}
+
+func newFakeS3() *fakeS3 {
+	srv := &fakeS3{
+		buckets: make(map[string]map[string]*fakeObject),
+	}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	return srv
+}
+
+// newBucket creates a new bucket and returns its name.
+func (srv *fakeS3) newBucket() string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	name := "bucket" + strconv.Itoa(len(srv.buckets))
+	srv.buckets[name] = make(map[string]*fakeObject)
+	return name
+}
+
+// bucket returns the name of the most recently created bucket.
+func (srv *fakeS3) bucket() string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return "bucket" + strconv.Itoa(len(srv.buckets)-1)
+}
+
+func (srv *fakeS3) object(bucket, name string) *fakeObject {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.buckets[bucket][name]
+}
+
+func (srv *fakeS3) lastRange() string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.rangeHeader
+}
+
+func (srv *fakeS3) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+testCreds.AccessKeyID+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "The AWS access key ID you provided does not exist in our records.")
+		return
+	}
+	if h := sha256.Sum256(body); req.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(h[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+		return
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)
+	bucket, ok := srv.buckets[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if len(parts) == 1 {
+		srv.list(w, req, bucket)
+		return
+	}
+	name := parts[1]
+	o := bucket[name]
+	switch req.Method {
+	case "GET":
+		if o == nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		for k, v := range o.meta {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("ETag", o.etag)
+		srv.rangeHeader = req.Header.Get("Range")
+		if srv.rangeHeader == "" {
+			w.Write(o.data)
+			return
+		}
+		// Only ranges starting at zero are supported.
+		var end int
+		if _, err := fmt.Sscanf(srv.rangeHeader, "bytes=0-%d", &end); err != nil {
+			writeError(w, http.StatusNotImplemented, "NotImplemented", "unsupported range")
+			return
+		}
+		data := o.data
+		if end+1 < len(data) {
+			data = data[:end+1]
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data)
+	case "PUT":
+		if !checkPreconditions(w, req, o) {
+			return
+		}
+		meta := make(map[string]string)
+		for k := range req.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				meta[k] = req.Header.Get(k)
+			}
+		}
+		sum := md5.Sum(body)
+		bucket[name] = &fakeObject{
+			data: body,
+			etag: `"` + hex.EncodeToString(sum[:]) + `"`,
+			meta: meta,
+		}
+	case "DELETE":
+		if !checkPreconditions(w, req, o) {
+			return
+		}
+		delete(bucket, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// list implements a ListObjectsV2 request. The pages are small, so
+// that the tests exercise continuation.
+func (srv *fakeS3) list(w http.ResponseWriter, req *http.Request, bucket map[string]*fakeObject) {
+	const pageSize = 2
+	q := req.URL.Query()
+	if req.Method != "GET" || q.Get("list-type") != "2" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "unsupported bucket request")
+		return
+	}
+	var names []string
+	for name := range bucket {
+		if strings.HasPrefix(name, q.Get("prefix")) && name > q.Get("continuation-token") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var result struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []struct {
+			Key string
+		}
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	if len(names) > pageSize {
+		names = names[:pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = names[pageSize-1]
+	}
+	for _, name := range names {
+		result.Contents = append(result.Contents, struct{ Key string }{name})
+	}
+	writeXML(w, http.StatusOK, &result)
+}
+
+// checkPreconditions checks the conditional request headers against
+// the given object and reports whether the request may proceed.
+func checkPreconditions(w http.ResponseWriter, req *http.Request, o *fakeObject) bool {
+	ok := true
+	if m := req.Header.Get("If-Match"); m != "" {
+		ok = o != nil && o.etag == m
+	}
+	if m := req.Header.Get("If-None-Match"); m == "*" {
+		ok = ok && o == nil
+	}
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	}
+	return ok
+}
+
+type fakeError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, &fakeError{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write(data)
+}
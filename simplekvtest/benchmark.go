@@ -0,0 +1,59 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekvtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juju/simplekv"
+)
+
+// BenchmarkUpdate measures the throughput of Update when several
+// goroutines update the same key at once. It runs a sub-benchmark
+// for each level of contention, reporting the number of extra calls
+// to the update function per operation as "retries/op". The newStore
+// function is called to create a new store for each sub-benchmark.
+func BenchmarkUpdate(b *testing.B, newStore func() (_ simplekv.Store, err error)) {
+	for _, n := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("goroutines-%d", n), func(b *testing.B) {
+			benchmarkUpdate(b, newStore, n)
+		})
+	}
+}
+
+func benchmarkUpdate(b *testing.B, newStore func() (_ simplekv.Store, err error), numGoroutines int) {
+	kv, err := newStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx, close := kv.Context(context.Background())
+	defer close()
+	var calls, next int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(b.N) {
+				err := kv.Update(ctx, "bench-key", time.Time{}, func(old []byte) ([]byte, error) {
+					atomic.AddInt64(&calls, 1)
+					return []byte(fmt.Sprint(len(old))), nil
+				})
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(calls-int64(b.N))/float64(b.N), "retries/op")
+}
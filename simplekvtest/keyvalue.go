@@ -0,0 +1,1116 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package simplekvtest provides helpers for testing simplekv stores
+// and the code that uses them: a conformance suite for Store
+// implementations, and functions for seeding stores with fixtures
+// and comparing them against golden files.
+package simplekvtest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// TestStore runs a set of tests to check that a given
+// store implementation works correctly. The newStore
+// function will be called to create new store instances
+// for the tests - each one should be independent
+// of the others.
+func TestStore(t *testing.T, newStore func() (_ simplekv.Store, err error)) {
+	runTests(qt.New(t), &suite{
+		newStore: newStore,
+	})
+}
+
+type suite struct {
+	newStore func() (_ simplekv.Store, err error)
+
+	ctx          context.Context
+	closeContext func()
+
+	kv simplekv.Store
+}
+
+func (s *suite) SetUpTest(c *qt.C) {
+	var err error
+	s.kv, err = s.newStore()
+	c.Assert(err, qt.Equals, nil)
+	s.ctx, s.closeContext = s.kv.Context(context.Background())
+}
+
+func (s *suite) TearDownTest(c *qt.C) {
+	s.closeContext()
+}
+
+func (s *suite) TestSet(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Set(ctx, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	result, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(result), qt.Equals, "test-value")
+
+	// Try again with an existing record, which might trigger different behavior.
+	err = s.kv.Set(ctx, "test-key", []byte("test-value-2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	result, err = s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(result), qt.Equals, "test-value-2")
+}
+
+func (s *suite) TestBinaryValues(c *qt.C) {
+	ctx := s.ctx
+	// The value holds every byte value, including NUL and bytes
+	// that are not valid UTF-8.
+	value := make([]byte, 256)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	err := s.kv.Set(ctx, "test-key", value, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	result, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(result, qt.DeepEquals, value)
+
+	value2 := append([]byte{0xff, 0xfe, 0}, value...)
+	err = s.kv.Update(ctx, "test-key", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(old, qt.DeepEquals, value)
+		return value2, nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetIfEquals(ctx, s.kv, "test-key", value2, value, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	result, err = s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(result, qt.DeepEquals, value)
+}
+
+func (s *suite) TestGetNotFound(c *qt.C) {
+	ctx := s.ctx
+	_, err := s.kv.Get(ctx, "test-not-there-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, "key test-not-there-key not found")
+}
+
+func (s *suite) TestExists(c *qt.C) {
+	ctx := s.ctx
+	ok, err := s.kv.Exists(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+
+	err = s.kv.Set(ctx, "test-key", nil, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	ok, err = s.kv.Exists(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, true)
+
+	err = s.kv.Set(ctx, "test-key-expired", []byte("value"), time.Now().Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	ok, err = s.kv.Exists(ctx, "test-key-expired")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+
+	err = s.kv.Delete(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	ok, err = s.kv.Exists(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+
+	_, err = s.kv.Exists(ctx, strings.Repeat("k", simplekv.MaxKeyLen+1))
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrKeyTooLarge)
+}
+
+func (s *suite) TestSetKeyOnce(c *qt.C) {
+	ctx := s.ctx
+	err := simplekv.SetKeyOnce(ctx, s.kv, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	result, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(result), qt.Equals, "test-value")
+}
+
+func (s *suite) TestSetKeyOnceDuplicate(c *qt.C) {
+	ctx := s.ctx
+	err := simplekv.SetKeyOnce(ctx, s.kv, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekv.SetKeyOnce(ctx, s.kv, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrDuplicateKey)
+	c.Assert(err, qt.ErrorMatches, "key test-key already exists")
+}
+
+func (s *suite) TestUpdateSuccessWithPreexistingKey(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Set(ctx, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+		c.Check(string(oldVal), qt.Equals, "test-value")
+		return []byte("test-value-2"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	val, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(val), qt.Equals, "test-value-2")
+}
+
+func (s *suite) TestUpdateSuccessWithoutPreexistingKey(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+		c.Check(oldVal, qt.IsNil)
+		return []byte("test-value"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	val, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(val), qt.Equals, "test-value")
+}
+
+func (s *suite) TestUpdateConcurrent(c *qt.C) {
+	ctx := s.ctx
+	const N = 100
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			for j := 0; j < N; j++ {
+				err := s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+					time.Sleep(time.Millisecond)
+					if oldVal == nil {
+						return []byte{1}, nil
+					}
+					return []byte{oldVal[0] + 1}, nil
+				})
+				c.Check(err, qt.Equals, nil)
+			}
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	val, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(val, qt.HasLen, 1)
+	c.Assert(int(val[0]), qt.Equals, N*2)
+}
+
+func (s *suite) TestUpdateErrorWithExistingKey(c *qt.C) {
+	ctx := s.ctx
+	testErr := errgo.Newf("test error")
+
+	err := s.kv.Set(ctx, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+		c.Check(string(oldVal), qt.Equals, "test-value")
+		return nil, testErr
+	})
+	c.Check(errgo.Cause(err), qt.Equals, testErr)
+
+}
+
+func (s *suite) TestUpdateErrorWithNonExistentKey(c *qt.C) {
+	ctx := s.ctx
+	testErr := errgo.Newf("test error")
+
+	err := s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+		c.Check(oldVal, qt.IsNil)
+		return nil, testErr
+	})
+	c.Check(errgo.Cause(err), qt.Equals, testErr)
+
+}
+
+func (s *suite) TestSetNilUpdatesAsNonNil(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Set(ctx, "test-key", nil, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+		c.Assert(oldVal, qt.DeepEquals, []byte{})
+		return nil, nil
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func (s *suite) TestUpdateReturnNilThenUpdatesAsNonNil(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Set(ctx, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+		c.Check(string(oldVal), qt.Equals, "test-value")
+		return nil, nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.kv.Update(ctx, "test-key", time.Time{}, func(oldVal []byte) ([]byte, error) {
+		c.Check(oldVal, qt.Not(qt.IsNil))
+		c.Assert(oldVal, qt.DeepEquals, []byte{})
+		return nil, nil
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func (s *suite) TestUpdateSameValueNewExpiry(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Set(ctx, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// The new expiry time is stored even though the value is
+	// unchanged.
+	err = s.kv.Update(ctx, "test-key", time.Now().Add(-time.Minute), func(oldVal []byte) ([]byte, error) {
+		return oldVal, nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.kv.Get(ctx, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func (s *suite) TestTouch(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Touch(ctx, "test-key", time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = s.kv.Set(ctx, "test-key", []byte("value"), time.Now().Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Touch(ctx, "test-key", time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = s.kv.Set(ctx, "test-key", []byte("value"), time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Touch(ctx, "test-key", time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value")
+
+	err = s.kv.Touch(ctx, "test-key", time.Now().Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.kv.Get(ctx, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func (s *suite) TestDelete(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Set(ctx, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Set(ctx, "test-key-2", []byte("test-value-2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.kv.Delete(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = s.kv.Get(ctx, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// Other keys are unaffected.
+	result, err := s.kv.Get(ctx, "test-key-2")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(result), qt.Equals, "test-value-2")
+
+	// The key can be recreated after it has been deleted.
+	err = simplekv.SetKeyOnce(ctx, s.kv, "test-key", []byte("test-value-3"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	result, err = s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(result), qt.Equals, "test-value-3")
+}
+
+func (s *suite) TestDeleteNotFound(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Delete(ctx, "test-not-there-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(err, qt.ErrorMatches, "key test-not-there-key not found")
+
+	err = s.kv.Set(ctx, "test-key", []byte("test-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Delete(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Delete(ctx, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func (s *suite) TestKeys(c *qt.C) {
+	ctx := s.ctx
+
+	kv, ok := s.kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, true)
+
+	keys, err := kv.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 0)
+
+	N := 100
+	expected := make(map[string]bool)
+	for i := 0; i < N; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		value := fmt.Sprintf("value-%d", i)
+		err := s.kv.Set(ctx, key, []byte(value), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+		expected[key] = true
+	}
+
+	keys, err = kv.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, len(expected))
+	for _, key := range keys {
+		_, ok := expected[key]
+		c.Assert(ok, qt.Equals, true)
+	}
+}
+
+func (s *suite) TestLinearizable(c *qt.C) {
+	ctx := s.ctx
+	const (
+		numWorkers = 4
+		numOps     = 40
+	)
+	keys := []string{"test-key-0", "test-key-1"}
+	var rec recorder
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < numOps; j++ {
+				op := operation{
+					kind:  opKind(rnd.Intn(3)),
+					key:   keys[rnd.Intn(len(keys))],
+					value: fmt.Sprintf("value-%d-%d", i, j),
+				}
+				op.call = rec.now()
+				var err error
+				switch op.kind {
+				case opGet:
+					var v []byte
+					v, err = s.kv.Get(ctx, op.key)
+					if errgo.Cause(err) == simplekv.ErrNotFound {
+						err = nil
+					} else if err == nil {
+						op.found, op.observed = true, string(v)
+					}
+				case opSet:
+					err = s.kv.Set(ctx, op.key, []byte(op.value), time.Time{})
+				case opUpdate:
+					err = s.kv.Update(ctx, op.key, time.Time{}, func(old []byte) ([]byte, error) {
+						// The update function may be called several
+						// times; the last call is the one that counts.
+						op.found, op.observed = old != nil, string(old)
+						return []byte(op.value), nil
+					})
+				}
+				op.ret = rec.now()
+				if !c.Check(err, qt.Equals, nil, qt.Commentf("%v", op.kind)) {
+					return
+				}
+				rec.add(op)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(checkLinearizable(rec.ops), qt.Equals, nil)
+}
+
+func (s *suite) TestKeysWithPrefix(c *qt.C) {
+	ctx := s.ctx
+
+	kv, ok := s.kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, true)
+
+	for _, key := range []string{
+		"sessions/a",
+		"sessions/b",
+		"sessions",
+		"sessionsx",
+		"other/sessions/c",
+		"a%b",
+		"axb",
+		"a_b",
+		`a\b`,
+		"a.b",
+	} {
+		err := s.kv.Set(ctx, key, []byte("value"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	tests := []struct {
+		prefix string
+		expect []string
+	}{
+		{"sessions/", []string{"sessions/a", "sessions/b"}},
+		{"sessions", []string{"sessions", "sessions/a", "sessions/b", "sessionsx"}},
+		{"nothing", []string{}},
+		{"a%", []string{"a%b"}},
+		{"a_", []string{"a_b"}},
+		{`a\`, []string{`a\b`}},
+		{"a.", []string{"a.b"}},
+		{"", []string{
+			"a%b",
+			"a.b",
+			`a\b`,
+			"a_b",
+			"axb",
+			"other/sessions/c",
+			"sessions",
+			"sessions/a",
+			"sessions/b",
+			"sessionsx",
+		}},
+	}
+	for _, test := range tests {
+		keys, err := kv.KeysWithPrefix(ctx, test.prefix)
+		c.Assert(err, qt.Equals, nil)
+		sort.Strings(keys)
+		c.Assert(keys, qt.DeepEquals, test.expect, qt.Commentf("prefix %q", test.prefix))
+	}
+}
+
+func (s *suite) TestCount(c *qt.C) {
+	ctx := s.ctx
+	kv, ok := s.kv.(simplekv.KeyLister)
+	c.Assert(ok, qt.Equals, true)
+
+	n, err := simplekv.CountWithPrefix(ctx, kv, "")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 0)
+
+	for _, key := range []string{"a/1", "a/2", "a_3", "b/1"} {
+		err := s.kv.Set(ctx, key, []byte("value"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	err = s.kv.Set(ctx, "a/expired", []byte("value"), time.Now().Add(-time.Minute))
+	c.Assert(err, qt.Equals, nil)
+
+	for prefix, want := range map[string]int{
+		"":        4,
+		"a/":      2,
+		"a":       3,
+		"b/1":     1,
+		"nothing": 0,
+	} {
+		n, err := simplekv.CountWithPrefix(ctx, kv, prefix)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(n, qt.Equals, want, qt.Commentf("prefix %q", prefix))
+	}
+	if kv, ok := kv.(simplekv.Counter); ok {
+		n, err := kv.Count(ctx)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(n, qt.Equals, 4)
+	}
+}
+
+func (s *suite) TestIterate(c *qt.C) {
+	ctx := s.ctx
+
+	kv, ok := s.kv.(simplekv.Iterable)
+	if !ok {
+		c.Skip("store does not implement simplekv.Iterable")
+	}
+
+	expect := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("iter/%02d", i)
+		expect[key] = fmt.Sprintf("value-%d", i)
+		err := s.kv.Set(ctx, key, []byte(expect[key]), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	err := s.kv.Set(ctx, "iter", []byte("x"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Set(ctx, "other", nil, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	collect := func(prefix string) (keys []string, values map[string]string) {
+		iter, err := kv.Iterate(ctx, prefix)
+		c.Assert(err, qt.Equals, nil)
+		defer iter.Close()
+		values = make(map[string]string)
+		for iter.Next() {
+			keys = append(keys, iter.Key())
+			values[iter.Key()] = string(iter.Value())
+		}
+		c.Assert(iter.Err(), qt.Equals, nil)
+		c.Assert(iter.Close(), qt.Equals, nil)
+		c.Assert(iter.Next(), qt.Equals, false)
+		return keys, values
+	}
+	keys, values := collect("iter/")
+	c.Assert(values, qt.DeepEquals, expect)
+	c.Assert(sort.StringsAreSorted(keys), qt.Equals, true, qt.Commentf("%q", keys))
+
+	keys, values = collect("")
+	c.Assert(keys, qt.HasLen, 52)
+	c.Assert(sort.StringsAreSorted(keys), qt.Equals, true, qt.Commentf("%q", keys))
+	c.Assert(values["other"], qt.Equals, "")
+
+	keys, _ = collect("nothing")
+	c.Assert(keys, qt.HasLen, 0)
+
+	// Closing an iterator early is fine.
+	iter, err := kv.Iterate(ctx, "")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(iter.Next(), qt.Equals, true)
+	c.Assert(iter.Close(), qt.Equals, nil)
+	c.Assert(iter.Next(), qt.Equals, false)
+}
+
+func (s *suite) TestSetMulti(c *qt.C) {
+	ctx := s.ctx
+	if _, ok := s.kv.(simplekv.MultiSetter); !ok {
+		c.Skip("store does not implement simplekv.MultiSetter")
+	}
+	err := s.kv.Set(ctx, "test-key-1", []byte("old-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekv.SetMulti(ctx, s.kv, []simplekv.Entry{{
+		Key:   "test-key-1",
+		Value: []byte("value-1"),
+	}, {
+		Key:   "test-key-2",
+		Value: []byte("value-2"),
+	}, {
+		Key:   "test-key-3",
+		Value: nil,
+	}, {
+		Key:   "test-key-2",
+		Value: []byte("value-2-again"),
+	}})
+	c.Assert(err, qt.Equals, nil)
+
+	for key, want := range map[string]string{
+		"test-key-1": "value-1",
+		"test-key-2": "value-2-again",
+		"test-key-3": "",
+	} {
+		v, err := s.kv.Get(ctx, key)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, want, qt.Commentf("key %q", key))
+	}
+
+	err = simplekv.SetMulti(ctx, s.kv, nil)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func (s *suite) TestSetIfEquals(c *qt.C) {
+	ctx := s.ctx
+	err := simplekv.SetIfEquals(ctx, s.kv, "test-key", []byte("old"), []byte("new"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+	_, err = s.kv.Get(ctx, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = simplekv.SetIfEquals(ctx, s.kv, "test-key", nil, []byte("value-1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value-1")
+
+	err = simplekv.SetIfEquals(ctx, s.kv, "test-key", nil, []byte("value-2"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+
+	err = simplekv.SetIfEquals(ctx, s.kv, "test-key", []byte("value-0"), []byte("value-2"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+	v, err = s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value-1")
+
+	err = simplekv.SetIfEquals(ctx, s.kv, "test-key", []byte("value-1"), nil, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err = s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.DeepEquals, []byte{})
+
+	err = simplekv.SetIfEquals(ctx, s.kv, "test-key", []byte{}, []byte("value-3"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err = s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value-3")
+}
+
+func (s *suite) TestExpire(c *qt.C) {
+	ctx := s.ctx
+	// Use a time zone other than UTC or local time to check that
+	// stores do not depend on the location of expiry times.
+	loc := time.FixedZone("test", -5*60*60)
+	past := time.Now().Add(-time.Minute).In(loc)
+	future := time.Now().Add(time.Hour).In(loc)
+
+	err := s.kv.Set(ctx, "test-key-future", []byte("value"), future)
+	c.Assert(err, qt.Equals, nil)
+	v, err := s.kv.Get(ctx, "test-key-future")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value")
+
+	err = s.kv.Set(ctx, "test-key-past", []byte("value"), past)
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.kv.Get(ctx, "test-key-past")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	err = s.kv.Delete(ctx, "test-key-past")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	if kv, ok := s.kv.(simplekv.KeyLister); ok {
+		keys, err := kv.Keys(ctx)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(keys, qt.DeepEquals, []string{"test-key-future"})
+	}
+
+	// An expired entry behaves as if it does not exist.
+	err = s.kv.Update(ctx, "test-key-past", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(old, qt.IsNil)
+		return []byte("new-value"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	v, err = s.kv.Get(ctx, "test-key-past")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "new-value")
+
+	err = s.kv.Set(ctx, "test-key-past", []byte("value"), past)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetKeyOnce(ctx, s.kv, "test-key-past", []byte("once"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = s.kv.Set(ctx, "test-key-past", []byte("value"), past)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetIfEquals(ctx, s.kv, "test-key-past", nil, []byte("swapped"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err = s.kv.Get(ctx, "test-key-past")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "swapped")
+}
+
+func (s *suite) TestTxn(c *qt.C) {
+	ctx := s.ctx
+	err := s.kv.Set(ctx, "test-key-a", []byte("a"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Set(ctx, "test-key-b", []byte("b"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// A transaction that fails makes no changes.
+	testErr := errgo.New("test error")
+	err = simplekv.Txn(ctx, s.kv, func(tx simplekv.Tx) error {
+		if err := tx.Set("test-key-a", []byte("a1"), time.Time{}); err != nil {
+			return err
+		}
+		if err := tx.Delete("test-key-b"); err != nil {
+			return err
+		}
+		return testErr
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, testErr)
+	v, err := s.kv.Get(ctx, "test-key-a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "a")
+	v, err = s.kv.Get(ctx, "test-key-b")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "b")
+
+	// A transaction that succeeds makes all its changes, and sees
+	// its own writes.
+	err = simplekv.Txn(ctx, s.kv, func(tx simplekv.Tx) error {
+		a, err := tx.Get("test-key-a")
+		if err != nil {
+			return err
+		}
+		b, err := tx.Get("test-key-b")
+		if err != nil {
+			return err
+		}
+		if err := tx.Set("test-key-c", append(a, b...), time.Time{}); err != nil {
+			return err
+		}
+		if err := tx.Delete("test-key-a"); err != nil {
+			return err
+		}
+		if _, err := tx.Get("test-key-a"); errgo.Cause(err) != simplekv.ErrNotFound {
+			return errgo.Newf("unexpected error getting deleted key: %v", err)
+		}
+		if err := tx.Delete("test-key-a"); errgo.Cause(err) != simplekv.ErrNotFound {
+			return errgo.Newf("unexpected error deleting deleted key: %v", err)
+		}
+		c, err := tx.Get("test-key-c")
+		if err != nil {
+			return err
+		}
+		if string(c) != "ab" {
+			return errgo.Newf("unexpected value %q", c)
+		}
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	_, err = s.kv.Get(ctx, "test-key-a")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	v, err = s.kv.Get(ctx, "test-key-c")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "ab")
+
+	err = simplekv.Txn(ctx, s.kv, func(tx simplekv.Tx) error {
+		_, err := tx.Get("test-not-there-key")
+		return err
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func (s *suite) TestSnapshotRead(c *qt.C) {
+	ctx := s.ctx
+	for _, key := range []string{"snap/a", "snap/b", "other"} {
+		err := s.kv.Set(ctx, key, []byte(key+"-value"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+	}
+	var keys []string
+	values := make(map[string]string)
+	err := simplekv.SnapshotRead(ctx, s.kv, func(tx simplekv.SnapshotTx) error {
+		var err error
+		keys, err = tx.KeysWithPrefix("snap/")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			v, err := tx.Get(key)
+			if err != nil {
+				return err
+			}
+			values[key] = string(v)
+		}
+		return nil
+	})
+	if _, ok := s.kv.(simplekv.KeyLister); !ok {
+		c.Assert(err, qt.ErrorMatches, `store does not support listing keys`)
+		return
+	}
+	c.Assert(err, qt.Equals, nil)
+	sort.Strings(keys)
+	c.Assert(keys, qt.DeepEquals, []string{"snap/a", "snap/b"})
+	c.Assert(values, qt.DeepEquals, map[string]string{
+		"snap/a": "snap/a-value",
+		"snap/b": "snap/b-value",
+	})
+
+	err = simplekv.SnapshotRead(ctx, s.kv, func(tx simplekv.SnapshotTx) error {
+		_, err := tx.Get("test-not-there-key")
+		return err
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func (s *suite) TestSetTTL(c *qt.C) {
+	ctx := s.ctx
+	err := simplekv.SetTTL(ctx, s.kv, "test-key-live", []byte("live"), time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetTTL(ctx, s.kv, "test-key-forever", []byte("forever"), 0)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetTTL(ctx, s.kv, "test-key-dead", []byte("dead"), -time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.UpdateTTL(ctx, s.kv, "test-key-live", time.Hour, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, "live")
+		return []byte("updated"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.UpdateTTL(ctx, s.kv, "test-key-forever", -time.Hour, func(old []byte) ([]byte, error) {
+		return old, nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	v, err := s.kv.Get(ctx, "test-key-live")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "updated")
+	_, err = s.kv.Get(ctx, "test-key-forever")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	_, err = s.kv.Get(ctx, "test-key-dead")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+func (s *suite) TestRevision(c *qt.C) {
+	ctx := s.ctx
+	_, _, err := simplekv.GetWithRevision(ctx, s.kv, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	// A non-empty revision does not match a key that does not exist.
+	_, err = simplekv.SetAt(ctx, s.kv, "test-key", []byte("value"), time.Time{}, "bogus")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+
+	rev1, err := simplekv.SetAt(ctx, s.kv, "test-key", []byte("value1"), time.Time{}, "")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rev1, qt.Not(qt.Equals), "")
+
+	v, rev, err := simplekv.GetWithRevision(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value1")
+	c.Assert(rev, qt.Equals, rev1)
+
+	// The empty revision does not match a key that exists.
+	_, err = simplekv.SetAt(ctx, s.kv, "test-key", []byte("value"), time.Time{}, "")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+
+	rev2, err := simplekv.SetWithRevision(ctx, s.kv, "test-key", []byte("value2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rev2, qt.Not(qt.Equals), rev1)
+
+	// The old revision no longer matches.
+	_, err = simplekv.SetAt(ctx, s.kv, "test-key", []byte("value"), time.Time{}, rev1)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+	c.Assert(err, qt.ErrorMatches, `key test-key does not have the expected value`)
+
+	rev3, err := simplekv.UpdateWithRevision(ctx, s.kv, "test-key", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, "value2")
+		return []byte("value3"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rev3, qt.Not(qt.Equals), rev2)
+
+	rev4, err := simplekv.SetAt(ctx, s.kv, "test-key", []byte("value4"), time.Time{}, rev3)
+	c.Assert(err, qt.Equals, nil)
+	v, rev, err = simplekv.GetWithRevision(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value4")
+	c.Assert(rev, qt.Equals, rev4)
+}
+
+func (s *suite) TestClose(c *qt.C) {
+	ctx := s.ctx
+	if _, ok := s.kv.(simplekv.Closer); !ok {
+		c.Skip("store does not implement simplekv.Closer")
+	}
+	err := s.kv.Set(ctx, "test-key", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.Close(s.kv)
+	c.Assert(err, qt.Equals, nil)
+
+	checkClosed := func(err error) {
+		c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrStoreClosed)
+	}
+	_, err = s.kv.Get(ctx, "test-key")
+	checkClosed(err)
+	_, err = s.kv.Exists(ctx, "test-key")
+	checkClosed(err)
+	checkClosed(s.kv.Set(ctx, "test-key", []byte("value"), time.Time{}))
+	checkClosed(s.kv.Update(ctx, "test-key", time.Time{}, func(old []byte) ([]byte, error) {
+		return []byte("value"), nil
+	}))
+	checkClosed(s.kv.Touch(ctx, "test-key", time.Time{}))
+	checkClosed(s.kv.Delete(ctx, "test-key"))
+
+	// Closing the store again has no effect.
+	err = simplekv.Close(s.kv)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func (s *suite) TestMetadata(c *qt.C) {
+	ctx := s.ctx
+	if _, ok := s.kv.(simplekv.MetadataStore); !ok {
+		c.Skip("store does not implement simplekv.MetadataStore")
+	}
+	_, err := simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	err = simplekv.SetMetadata(ctx, s.kv, "test-key", map[string]string{"owner": "bob"})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	err = s.kv.Set(ctx, "test-key", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	md, err := simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.HasLen, 0)
+
+	err = simplekv.SetMetadata(ctx, s.kv, "test-key", map[string]string{
+		"owner":        "bob",
+		"content-type": "text/plain",
+	})
+	c.Assert(err, qt.Equals, nil)
+	md, err = simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.DeepEquals, map[string]string{
+		"owner":        "bob",
+		"content-type": "text/plain",
+	})
+	v, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value")
+
+	// Touching the entry keeps its metadata.
+	err = s.kv.Touch(ctx, "test-key", time.Now().Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	md, err = simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.HasLen, 2)
+
+	// Writing the value removes it.
+	err = s.kv.Set(ctx, "test-key", []byte("value2"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	md, err = simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.HasLen, 0)
+
+	err = simplekv.SetMetadata(ctx, s.kv, "test-key", map[string]string{"owner": "bob"})
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Update(ctx, "test-key", time.Time{}, func(old []byte) ([]byte, error) {
+		return []byte("value3"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	md, err = simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.HasLen, 0)
+
+	// An empty map removes the metadata too.
+	err = simplekv.SetMetadata(ctx, s.kv, "test-key", map[string]string{"owner": "bob"})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetMetadata(ctx, s.kv, "test-key", nil)
+	c.Assert(err, qt.Equals, nil)
+	md, err = simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.HasLen, 0)
+
+	err = simplekv.SetMetadata(ctx, s.kv, "test-key", map[string]string{
+		"big": strings.Repeat("x", simplekv.MaxMetadataLen),
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+
+	// Deleting the entry removes its metadata.
+	err = simplekv.SetMetadata(ctx, s.kv, "test-key", map[string]string{"owner": "bob"})
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Delete(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	err = s.kv.Set(ctx, "test-key", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	md, err = simplekv.GetMetadata(ctx, s.kv, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(md, qt.HasLen, 0)
+}
+
+func (s *suite) TestMaxKeyLen(c *qt.C) {
+	ctx := s.ctx
+	maxLen := simplekv.KeyLimit(s.kv)
+	key := strings.Repeat("k", maxLen)
+	err := s.kv.Set(ctx, key, []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := s.kv.Get(ctx, key)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "value")
+
+	key += "k"
+	checkTooLarge := func(err error) {
+		c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrKeyTooLarge)
+		c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`key of %d bytes exceeds maximum length of %d`, maxLen+1, maxLen))
+	}
+	_, err = s.kv.Get(ctx, key)
+	checkTooLarge(err)
+	checkTooLarge(s.kv.Set(ctx, key, []byte("value"), time.Time{}))
+	checkTooLarge(s.kv.Update(ctx, key, time.Time{}, func(old []byte) ([]byte, error) {
+		c.Errorf("update function unexpectedly called")
+		return []byte("value"), nil
+	}))
+	checkTooLarge(s.kv.Delete(ctx, key))
+	checkTooLarge(simplekv.SetKeyOnce(ctx, s.kv, key, []byte("value"), time.Time{}))
+	checkTooLarge(simplekv.SetIfEquals(ctx, s.kv, key, nil, []byte("value"), time.Time{}))
+	err = simplekv.SetMulti(ctx, s.kv, []simplekv.Entry{{
+		Key:   "test-key",
+		Value: []byte("value"),
+	}, {
+		Key:   key,
+		Value: []byte("value"),
+	}})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrKeyTooLarge)
+}
+
+// maxTestValueLen holds the largest value limit that TestMaxValueLen
+// will check; larger limits would make the test too slow.
+const maxTestValueLen = 32 << 20
+
+func (s *suite) TestMaxValueLen(c *qt.C) {
+	ctx := s.ctx
+	maxLen := simplekv.MaxValueLen(s.kv)
+	if maxLen == 0 {
+		c.Skip("store does not implement simplekv.ValueLimiter")
+	}
+	if maxLen > maxTestValueLen {
+		c.Skipf("value limit of %d bytes is too large to test", maxLen)
+	}
+	value := make([]byte, maxLen)
+	err := s.kv.Set(ctx, "test-key", value, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	v, err := s.kv.Get(ctx, "test-key")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(len(v), qt.Equals, maxLen)
+
+	value = append(value, 0)
+	checkTooLarge := func(err error) {
+		c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+	}
+	checkTooLarge(s.kv.Set(ctx, "test-key", value, time.Time{}))
+	checkTooLarge(s.kv.Update(ctx, "test-key", time.Time{}, func(old []byte) ([]byte, error) {
+		return value, nil
+	}))
+	checkTooLarge(s.kv.Update(ctx, "test-key-new", time.Time{}, func(old []byte) ([]byte, error) {
+		return value, nil
+	}))
+	checkTooLarge(simplekv.SetKeyOnce(ctx, s.kv, "test-key-new", value, time.Time{}))
+	checkTooLarge(simplekv.SetIfEquals(ctx, s.kv, "test-key-new", nil, value, time.Time{}))
+	checkTooLarge(simplekv.SetMulti(ctx, s.kv, []simplekv.Entry{{
+		Key:   "test-key-new",
+		Value: value,
+	}}))
+	_, err = s.kv.Get(ctx, "test-key-new")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
+
+// TODO factor the runTests function into a separate public repo somewhere.
+
+// runTests runs all methods on the given value that have the
+// prefix "Test". The signature of the test methods must be
+// func(*quicktest.C).
+//
+// If s is is a pointer, the value pointed to is copied
+// before any methods are invoked on it; a new copy
+// is made for each test.
+//
+// If there is a method named SetUpTest, it will be
+// invoked before each test method runs.
+//
+// If there is a method named TearDownTest, it will
+// be invoked after each test method runs.
+//
+// If present the signature of both SetUpTest and TearDownTest
+// must be func(*quicktest.C).
+func runTests(c *qt.C, s interface{}) {
+	sv := reflect.ValueOf(s)
+	st := sv.Type()
+	for i := 0; i < st.NumMethod(); i++ {
+		sv := sv
+		if st.Kind() == reflect.Ptr {
+			// Make a copy (this makes it possible to have
+			// parallel tests).
+			sv1 := reflect.New(st.Elem())
+			sv1.Elem().Set(sv.Elem())
+			sv = sv1
+		}
+		methodName := st.Method(i).Name
+		name := strings.TrimPrefix(methodName, "Test")
+		if len(name) == len(methodName) {
+			continue
+		}
+		c.Run(name, func(c *qt.C) {
+			args := []reflect.Value{reflect.ValueOf(c)}
+			if setUp := sv.MethodByName("SetUpTest"); setUp.IsValid() {
+				setUp.Call(args)
+			}
+			if tearDown := sv.MethodByName("TearDownTest"); tearDown.IsValid() {
+				defer tearDown.Call(args)
+			}
+			sv.Method(i).Call(args)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekvtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// This file implements a linearizability checker for histories of
+// operations on a key-value store, using the algorithm described in
+// "Testing for Linearizability" (Lowe, 2017), as used by Porcupine.
+// Histories are partitioned by key, as operations on different keys
+// do not interact.
+
+type opKind int
+
+const (
+	opGet opKind = iota
+	opSet
+	opUpdate
+)
+
+func (k opKind) String() string {
+	switch k {
+	case opGet:
+		return "get"
+	case opSet:
+		return "set"
+	case opUpdate:
+		return "update"
+	}
+	return fmt.Sprintf("opKind(%d)", int(k))
+}
+
+// operation records a single completed call to the store.
+type operation struct {
+	// call and ret hold the logical times at which the
+	// operation was invoked and returned.
+	call, ret int64
+
+	kind opKind
+	key  string
+
+	// value holds the value written by a set or update operation.
+	value string
+
+	// found and observed hold the value seen by a get operation
+	// or the old value passed to the update function.
+	found    bool
+	observed string
+}
+
+func (op operation) String() string {
+	obs := "<none>"
+	if op.found {
+		obs = fmt.Sprintf("%q", op.observed)
+	}
+	switch op.kind {
+	case opGet:
+		return fmt.Sprintf("[%d,%d] get %q -> %s", op.call, op.ret, op.key, obs)
+	case opSet:
+		return fmt.Sprintf("[%d,%d] set %q %q", op.call, op.ret, op.key, op.value)
+	}
+	return fmt.Sprintf("[%d,%d] update %q %s -> %q", op.call, op.ret, op.key, obs, op.value)
+}
+
+// registerState holds the model state for a single key.
+type registerState struct {
+	found bool
+	value string
+}
+
+// step applies op to the state, reporting whether the result of op
+// is consistent with the state.
+func (s registerState) step(op operation) (registerState, bool) {
+	switch op.kind {
+	case opGet:
+		return s, s == registerState{op.found, op.observed}
+	case opSet:
+		return registerState{true, op.value}, true
+	case opUpdate:
+		if s != (registerState{op.found, op.observed}) {
+			return s, false
+		}
+		return registerState{true, op.value}, true
+	}
+	panic("unknown operation")
+}
+
+// recorder records a history of concurrent operations.
+type recorder struct {
+	clock int64
+
+	mu  sync.Mutex
+	ops []operation
+}
+
+// now returns the current logical time.
+func (r *recorder) now() int64 {
+	return atomic.AddInt64(&r.clock, 1)
+}
+
+// add records a completed operation.
+func (r *recorder) add(op operation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, op)
+}
+
+// checkLinearizable checks that the given history is linearizable
+// with respect to a model in which each key holds a single value,
+// initially absent. If it is not, it returns an error describing the
+// operations on the offending key.
+func checkLinearizable(ops []operation) error {
+	byKey := make(map[string][]operation)
+	for _, op := range ops {
+		byKey[op.key] = append(byKey[op.key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !checkSingleKey(byKey[k]) {
+			hist := byKey[k]
+			sort.Slice(hist, func(i, j int) bool {
+				return hist[i].call < hist[j].call
+			})
+			var buf strings.Builder
+			for _, op := range hist {
+				fmt.Fprintf(&buf, "\n\t%v", op)
+			}
+			return fmt.Errorf("history for key %q is not linearizable:%s", k, buf.String())
+		}
+	}
+	return nil
+}
+
+// event represents the call or return of an operation in the
+// doubly-linked list of events used by checkSingleKey.
+type event struct {
+	id     int
+	isCall bool
+	time   int64
+	// match holds the return event for a call event.
+	match      *event
+	prev, next *event
+}
+
+// lift removes the call event e and its matching return event from
+// the list.
+func (e *event) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift reverses the effect of lift.
+func (e *event) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// checkSingleKey reports whether the given operations, all on the
+// same key, are linearizable.
+func checkSingleKey(ops []operation) bool {
+	events := make([]*event, 0, 2*len(ops))
+	for i, op := range ops {
+		ret := &event{id: i, time: op.ret}
+		events = append(events, &event{id: i, isCall: true, time: op.call, match: ret}, ret)
+	}
+	// Order events by time. Logical times are unique, so the order
+	// is total.
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].time < events[j].time
+	})
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+
+	type frame struct {
+		e     *event
+		state registerState
+	}
+	var (
+		state      registerState
+		stack      []frame
+		linearized = make([]uint64, (len(ops)+63)/64)
+		seen       = make(map[string]bool)
+	)
+	cacheKey := func(s registerState) string {
+		var buf strings.Builder
+		for _, w := range linearized {
+			fmt.Fprintf(&buf, "%x,", w)
+		}
+		fmt.Fprintf(&buf, "%t:%s", s.found, s.value)
+		return buf.String()
+	}
+	e := head.next
+	for head.next != nil {
+		if e.isCall {
+			newState, ok := state.step(ops[e.id])
+			if ok {
+				linearized[e.id/64] |= 1 << uint(e.id%64)
+				if k := cacheKey(newState); !seen[k] {
+					seen[k] = true
+					stack = append(stack, frame{e, state})
+					state = newState
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized[e.id/64] &^= 1 << uint(e.id%64)
+			}
+			e = e.next
+			continue
+		}
+		// We have reached the return of an operation that cannot be
+		// linearized at this point, so backtrack.
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized[top.e.id/64] &^= 1 << uint(top.e.id%64)
+		top.e.unlift()
+		e = top.e.next
+	}
+	return true
+}
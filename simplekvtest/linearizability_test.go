@@ -0,0 +1,71 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekvtest
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var checkLinearizableTests = []struct {
+	about       string
+	ops         []operation
+	expectError string
+}{{
+	about: "empty history",
+}, {
+	about: "sequential",
+	ops: []operation{
+		{call: 1, ret: 2, kind: opGet, key: "a"},
+		{call: 3, ret: 4, kind: opSet, key: "a", value: "x"},
+		{call: 5, ret: 6, kind: opGet, key: "a", found: true, observed: "x"},
+		{call: 7, ret: 8, kind: opUpdate, key: "a", found: true, observed: "x", value: "y"},
+		{call: 9, ret: 10, kind: opGet, key: "a", found: true, observed: "y"},
+	},
+}, {
+	about: "concurrent get may see either value",
+	ops: []operation{
+		{call: 1, ret: 2, kind: opSet, key: "a", value: "x"},
+		{call: 3, ret: 6, kind: opSet, key: "a", value: "y"},
+		{call: 4, ret: 5, kind: opGet, key: "a", found: true, observed: "x"},
+		{call: 7, ret: 8, kind: opGet, key: "a", found: true, observed: "y"},
+	},
+}, {
+	about: "stale read",
+	ops: []operation{
+		{call: 1, ret: 2, kind: opSet, key: "a", value: "x"},
+		{call: 3, ret: 4, kind: opSet, key: "a", value: "y"},
+		{call: 5, ret: 6, kind: opGet, key: "a", found: true, observed: "x"},
+	},
+	expectError: `(?s)history for key "a" is not linearizable:\n.*`,
+}, {
+	about: "lost update",
+	ops: []operation{
+		{call: 1, ret: 4, kind: opUpdate, key: "a", value: "x"},
+		{call: 2, ret: 3, kind: opUpdate, key: "a", value: "y"},
+	},
+	expectError: `(?s)history for key "a" is not linearizable:\n.*`,
+}, {
+	about: "keys are independent",
+	ops: []operation{
+		{call: 1, ret: 2, kind: opSet, key: "a", value: "x"},
+		{call: 3, ret: 4, kind: opGet, key: "b"},
+		{call: 5, ret: 6, kind: opGet, key: "a", found: true, observed: "x"},
+	},
+}}
+
+func TestCheckLinearizable(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range checkLinearizableTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := checkLinearizable(test.ops)
+			if test.expectError != "" {
+				c.Assert(err, qt.ErrorMatches, test.expectError)
+			} else {
+				c.Assert(err, qt.Equals, nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekvtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Seed sets all the given entries in the store, with no expiry time.
+func Seed(ctx context.Context, kv simplekv.Store, entries map[string][]byte) error {
+	for key, value := range entries {
+		if err := kv.Set(ctx, key, value, time.Time{}); err != nil {
+			return errgo.Notef(err, "cannot set %q", key)
+		}
+	}
+	return nil
+}
+
+// SeedFromFile is like Seed except that the entries are read from
+// the golden file at the given path. See UnmarshalGolden for a
+// description of the format.
+func SeedFromFile(ctx context.Context, kv simplekv.Store, path string) error {
+	entries, err := readGoldenFile(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(Seed(ctx, kv, entries))
+}
+
+// CheckGolden checks that the contents of the store exactly match
+// the contents of the golden file at the given path. If they do not,
+// the returned error describes the differences.
+func CheckGolden(ctx context.Context, kv simplekv.KeyLister, path string) error {
+	want, err := readGoldenFile(path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	got, err := simplekv.Snapshot(ctx, kv)
+	if err != nil {
+		return errgo.Notef(err, "cannot read store")
+	}
+	var diffs []string
+	for key, gotv := range got {
+		wantv, ok := want[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("unexpected key %q", key))
+		case !bytes.Equal(gotv, wantv):
+			diffs = append(diffs, fmt.Sprintf("key %q has value %q; want %q", key, gotv, wantv))
+		}
+	}
+	for key := range want {
+		if _, ok := got[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("missing key %q", key))
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	sort.Strings(diffs)
+	return errgo.Newf("store does not match %s:\n\t%s", path, strings.Join(diffs, "\n\t"))
+}
+
+// WriteGoldenFile writes the contents of the store to a golden file
+// at the given path, replacing any existing file. It can be used to
+// create or update the golden files used by CheckGolden.
+func WriteGoldenFile(ctx context.Context, kv simplekv.KeyLister, path string) error {
+	entries, err := simplekv.Snapshot(ctx, kv)
+	if err != nil {
+		return errgo.Notef(err, "cannot read store")
+	}
+	data, err := MarshalGolden(entries)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(ioutil.WriteFile(path, data, 0666))
+}
+
+// goldenBinary holds the golden file representation of a value that
+// is not valid UTF-8.
+type goldenBinary struct {
+	Base64 string `json:"base64"`
+}
+
+// MarshalGolden returns the golden file representation of the given
+// entries. See UnmarshalGolden for a description of the format.
+func MarshalGolden(entries map[string][]byte) ([]byte, error) {
+	m := make(map[string]interface{}, len(entries))
+	for key, value := range entries {
+		if utf8.Valid(value) {
+			m[key] = string(value)
+		} else {
+			m[key] = goldenBinary{base64.StdEncoding.EncodeToString(value)}
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return append(data, '\n'), nil
+}
+
+// UnmarshalGolden parses the golden file representation of a set of
+// entries. A golden file holds a JSON object with a member for each
+// key. The value of a member is either a JSON string holding a text
+// value, or an object with a "base64" member holding a binary value
+// encoded as standard base64. For example:
+//
+//	{
+//		"config/name": "example",
+//		"config/key": {"base64": "AAECAw=="}
+//	}
+func UnmarshalGolden(data []byte) (map[string][]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errgo.Notef(err, "cannot parse golden data")
+	}
+	entries := make(map[string][]byte, len(m))
+	for key, raw := range m {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			entries[key] = []byte(s)
+			continue
+		}
+		var b goldenBinary
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return nil, errgo.Newf("invalid value for key %q", key)
+		}
+		v, err := base64.StdEncoding.DecodeString(b.Base64)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid base64 value for key %q", key)
+		}
+		entries[key] = v
+	}
+	return entries, nil
+}
+
+func readGoldenFile(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entries, err := UnmarshalGolden(data)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read %s", path)
+	}
+	return entries, nil
+}
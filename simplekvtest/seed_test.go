@@ -0,0 +1,108 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekvtest_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+func TestSeedAndCheckGolden(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore().(simplekv.KeyLister)
+
+	err := simplekvtest.SeedFromFile(ctx, kv, "testdata/seed.json")
+	c.Assert(err, qt.Equals, nil)
+	err = simplekvtest.CheckGolden(ctx, kv, "testdata/seed.json")
+	c.Assert(err, qt.Equals, nil)
+
+	v, err := kv.Get(ctx, "binary")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.DeepEquals, []byte{0, 1, 0xff})
+
+	err = simplekvtest.Seed(ctx, kv, map[string][]byte{
+		"text":  []byte("changed"),
+		"extra": []byte("x"),
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Delete(ctx, "empty")
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekvtest.CheckGolden(ctx, kv, "testdata/seed.json")
+	c.Assert(err, qt.ErrorMatches, `store does not match testdata/seed.json:
+	key "text" has value "changed"; want "hello, world"
+	missing key "empty"
+	unexpected key "extra"`)
+}
+
+func TestWriteGoldenFile(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore().(simplekv.KeyLister)
+	entries := map[string][]byte{
+		"a": []byte("a-value"),
+		"b": {0xfe},
+	}
+	err := simplekvtest.Seed(ctx, kv, entries)
+	c.Assert(err, qt.Equals, nil)
+
+	path := filepath.Join(c.Mkdir(), "golden.json")
+	err = simplekvtest.WriteGoldenFile(ctx, kv, path)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekvtest.CheckGolden(ctx, kv, path)
+	c.Assert(err, qt.Equals, nil)
+
+	kv2 := memsimplekv.NewStore().(simplekv.KeyLister)
+	err = simplekvtest.SeedFromFile(ctx, kv2, path)
+	c.Assert(err, qt.Equals, nil)
+	snap, err := simplekv.Snapshot(ctx, kv2)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, entries)
+}
+
+func TestMarshalGolden(t *testing.T) {
+	c := qt.New(t)
+	data, err := simplekvtest.MarshalGolden(map[string][]byte{
+		"b": []byte("text"),
+		"a": {0xff},
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Equals, `{
+	"a": {
+		"base64": "/w=="
+	},
+	"b": "text"
+}
+`)
+}
+
+var unmarshalGoldenErrorTests = []struct {
+	data        string
+	expectError string
+}{{
+	data:        `[]`,
+	expectError: `cannot parse golden data: .*`,
+}, {
+	data:        `{"a": 1}`,
+	expectError: `invalid value for key "a"`,
+}, {
+	data:        `{"a": {"base64": "!"}}`,
+	expectError: `invalid base64 value for key "a": .*`,
+}}
+
+func TestUnmarshalGoldenError(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range unmarshalGoldenErrorTests {
+		_, err := simplekvtest.UnmarshalGolden([]byte(test.data))
+		c.Check(err, qt.ErrorMatches, test.expectError, qt.Commentf("%s", test.data))
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Snapshot returns a copy of all the entries in the given store,
+// keyed by key. It is mostly useful in tests, where the complete
+// state of a store can then be checked with a single comparison.
+//
+// The snapshot is not atomic: entries that are changed while the
+// snapshot is being taken may or may not be reflected in it. Keys
+// that are deleted after being listed are omitted.
+func Snapshot(ctx context.Context, kv KeyLister) (map[string][]byte, error) {
+	keys, err := kv.Keys(ctx)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entries := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		v, err := kv.Get(ctx, key)
+		if err != nil {
+			if errgo.Cause(err) == ErrNotFound {
+				continue
+			}
+			return nil, errgo.Mask(err)
+		}
+		entries[key] = append([]byte{}, v...)
+	}
+	return entries, nil
+}
+
+// SnapshotTx gives read access to the entries of a store from within
+// SnapshotRead.
+type SnapshotTx interface {
+	// Get retrieves the value associated with the given key. If
+	// there is no such key an error with a cause of ErrNotFound
+	// will be returned.
+	Get(key string) ([]byte, error)
+
+	// KeysWithPrefix returns a distinct list of stored keys that
+	// start with the given prefix.
+	KeysWithPrefix(prefix string) ([]string, error)
+}
+
+// SnapshotReader is implemented by stores that can read several
+// entries from a consistent point-in-time view of the store.
+type SnapshotReader interface {
+	Store
+
+	// SnapshotRead calls f with a SnapshotTx whose reads all
+	// observe the store as it was at a single point in time,
+	// unaffected by concurrent writes. The error returned by f is
+	// returned with its cause unchanged.
+	SnapshotRead(ctx context.Context, f func(tx SnapshotTx) error) error
+}
+
+// SnapshotRead calls f with a SnapshotTx that reads from the given
+// store, as described by SnapshotReader.SnapshotRead. If kv
+// implements SnapshotReader, its SnapshotRead method is used.
+//
+// Otherwise the reads go directly to kv, so they may observe
+// concurrent writes, and KeysWithPrefix returns an error unless kv
+// implements KeyLister.
+func SnapshotRead(ctx context.Context, kv Store, f func(tx SnapshotTx) error) error {
+	if kv, ok := kv.(SnapshotReader); ok {
+		return errgo.Mask(kv.SnapshotRead(ctx, f), errgo.Any)
+	}
+	return errgo.Mask(f(directSnapshotTx{
+		ctx: ctx,
+		kv:  kv,
+	}), errgo.Any)
+}
+
+// directSnapshotTx implements SnapshotTx by reading directly from a
+// store.
+type directSnapshotTx struct {
+	ctx context.Context
+	kv  Store
+}
+
+// Get implements SnapshotTx.Get.
+func (tx directSnapshotTx) Get(key string) ([]byte, error) {
+	v, err := tx.kv.Get(tx.ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// KeysWithPrefix implements SnapshotTx.KeysWithPrefix.
+func (tx directSnapshotTx) KeysWithPrefix(prefix string) ([]string, error) {
+	kv, ok := tx.kv.(KeyLister)
+	if !ok {
+		return nil, errgo.Newf("store does not support listing keys")
+	}
+	keys, err := kv.KeysWithPrefix(tx.ctx, prefix)
+	return keys, errgo.Mask(err, errgo.Any)
+}
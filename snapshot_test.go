@@ -0,0 +1,59 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := memsimplekv.NewStore().(simplekv.KeyLister)
+
+	snap, err := simplekv.Snapshot(ctx, kv)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{})
+
+	err = kv.Set(ctx, "a", []byte("a-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "b", nil, time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	snap, err = simplekv.Snapshot(ctx, kv)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{
+		"a": []byte("a-value"),
+		"b": {},
+	})
+
+	// Changes to the store are not reflected in the snapshot.
+	err = kv.Set(ctx, "a", []byte("changed"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(snap["a"]), qt.Equals, "a-value")
+}
+
+func TestSnapshotReadFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore()
+	err := mem.Set(ctx, "a", []byte("a-value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekv.SnapshotRead(ctx, plainStore{mem}, func(tx simplekv.SnapshotTx) error {
+		v, err := tx.Get("a")
+		c.Check(err, qt.Equals, nil)
+		c.Check(string(v), qt.Equals, "a-value")
+		_, err = tx.KeysWithPrefix("")
+		return err
+	})
+	c.Assert(err, qt.ErrorMatches, `store does not support listing keys`)
+}
@@ -0,0 +1,639 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package spannersimplekv provides a simplekv.Store that stores
+// entries in a Google Cloud Spanner table, using the Spanner REST API.
+//
+// The table must be created before the store is used, with the
+// statements returned by DDL. The table has a row deletion policy on
+// its expire column, so Spanner removes expired rows in the
+// background; rows with a null expiry time are never removed. Spanner
+// may take some time to remove expired rows, so expiry times are also
+// checked, with the Spanner clock, when rows are read.
+package spannersimplekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+const (
+	// defaultEndpoint holds the URL of the Spanner API.
+	defaultEndpoint = "https://spanner.googleapis.com"
+
+	// maxValueLen holds the maximum length of a value, which is the
+	// Spanner limit on the size of a cell.
+	maxValueLen = 10 << 20
+
+	// queryLimit holds the number of keys fetched by each query
+	// made when listing keys.
+	queryLimit = 1000
+)
+
+// maxAttempts holds the number of times a transaction is attempted
+// when it is aborted because of concurrent modifications.
+const maxAttempts = 10
+
+// retryAfter holds the delay suggested to callers when an operation
+// fails after maxAttempts attempts.
+const retryAfter = 100 * time.Millisecond
+
+var (
+	// errAborted is the error cause used when Spanner aborts a
+	// transaction because of concurrent modifications.
+	errAborted = errgo.New("transaction aborted")
+
+	// errSessionNotFound is the error cause used when the session
+	// used by the store has been deleted, for example because it
+	// has been idle for too long.
+	errSessionNotFound = errgo.New("session not found")
+)
+
+// DDL returns the statements that create a table with the given name
+// that is suitable for use by the store.
+func DDL(table string) []string {
+	return []string{
+		"CREATE TABLE " + table + " (" +
+			"key STRING(512) NOT NULL, " +
+			"value BYTES(MAX) NOT NULL, " +
+			"expire TIMESTAMP" +
+			") PRIMARY KEY (key), " +
+			"ROW DELETION POLICY (OLDER_THAN(expire, INTERVAL 0 DAY))",
+	}
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithEndpoint returns an option that sends requests to the given URL
+// instead of the Spanner API, for example to use the Spanner
+// emulator.
+func WithEndpoint(endpoint string) Option {
+	return func(s *kvStore) {
+		s.endpoint = endpoint
+	}
+}
+
+// NewStore returns a new Store that stores entries in the given table
+// of the given database, which must be a database name of the form
+// "projects/PROJECT/instances/INSTANCE/databases/DATABASE". Requests
+// are sent with the given client, which is responsible for authorizing
+// them (for example, a client returned by
+// golang.org/x/oauth2/google.DefaultClient).
+//
+// Update, Touch and Delete use Spanner read-write transactions, which
+// are retried when Spanner aborts them because of concurrent
+// modifications.
+//
+// The returned store implements simplekv.KeyLister,
+// simplekv.KeyLimiter, simplekv.ValueLimiter and simplekv.Closer.
+// Closing the store deletes its Spanner session.
+func NewStore(client *http.Client, database, table string, opts ...Option) (simplekv.Store, error) {
+	parts := strings.Split(database, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "instances" || parts[4] != "databases" {
+		return nil, errgo.Newf("invalid database name %q", database)
+	}
+	if !validTableName(table) {
+		return nil, errgo.Newf("invalid table name %q", table)
+	}
+	s := &kvStore{
+		client:   client,
+		endpoint: defaultEndpoint,
+		database: database,
+		table:    table,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.endpoint = strings.TrimSuffix(s.endpoint, "/")
+	return s, nil
+}
+
+type kvStore struct {
+	client   *http.Client
+	endpoint string
+	database string
+	table    string
+
+	// mu guards the fields below it.
+	mu      sync.Mutex
+	session string
+	closed  bool
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return ctx, func() {}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	row, err := s.readRow(ctx, "", "value", key)
+	if err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get key %s", key), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	if row == nil {
+		return nil, simplekv.KeyNotFoundError(key)
+	}
+	v, err := decodeBytes(row[0])
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get key %s", key)
+	}
+	return v, nil
+}
+
+// Exists implements simplekv.Store.Exists without fetching the value.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Any)
+	}
+	row, err := s.readRow(ctx, "", "key", key)
+	if err != nil {
+		return false, errgo.NoteMask(err, fmt.Sprintf("cannot get key %s", key), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	return row != nil, nil
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := simplekv.CheckValue(value, maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	err := s.call(ctx, "commit", map[string]interface{}{
+		"singleUseTransaction": map[string]interface{}{
+			"readWrite": struct{}{},
+		},
+		"mutations": []mutation{s.insertOrUpdate(key, value, expire)},
+	}, nil)
+	if err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot set key %s", key), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	return nil
+}
+
+// Update implements simplekv.Store.Update by reading the old value and
+// writing the new one in a read-write transaction.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err := s.runTransaction(ctx, key, "value", func(row []interface{}) ([]mutation, error) {
+		var old []byte
+		if row != nil {
+			var err error
+			old, err = decodeBytes(row[0])
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+		}
+		value, err := getVal(old)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if err := simplekv.CheckValue(value, maxValueLen); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+		return []mutation{s.insertOrUpdate(key, value, expire)}, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch by changing only the expire
+// column of the row.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err := s.runTransaction(ctx, key, "key", func(row []interface{}) ([]mutation, error) {
+		if row == nil {
+			return nil, simplekv.KeyNotFoundError(key)
+		}
+		return []mutation{{
+			Update: &write{
+				Table:   s.table,
+				Columns: []string{"key", "expire"},
+				Values:  [][]interface{}{{key, encodeTime(expire)}},
+			},
+		}}, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	err := s.runTransaction(ctx, key, "key", func(row []interface{}) ([]mutation, error) {
+		if row == nil {
+			return nil, simplekv.KeyNotFoundError(key)
+		}
+		return []mutation{{
+			Delete: &deletion{
+				Table: s.table,
+				KeySet: keySet{
+					Keys: [][]interface{}{{key}},
+				},
+			},
+		}}, nil
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	keys, err := s.KeysWithPrefix(ctx, "")
+	return keys, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	q := "SELECT key FROM " + s.table + " WHERE STARTS_WITH(key, @prefix) AND key > @after AND " + s.alive() + " ORDER BY key LIMIT " + fmt.Sprint(queryLimit)
+	after := ""
+	for {
+		var result resultSet
+		err := s.call(ctx, "executeSql", map[string]interface{}{
+			"sql": q,
+			"params": map[string]string{
+				"prefix": prefix,
+				"after":  after,
+			},
+			"paramTypes": map[string]paramType{
+				"prefix": {"STRING"},
+				"after":  {"STRING"},
+			},
+		}, &result)
+		if err != nil {
+			return nil, errgo.NoteMask(err, "cannot list keys", errgo.Is(simplekv.ErrStoreClosed))
+		}
+		for _, row := range result.Rows {
+			key, ok := row[0].(string)
+			if !ok {
+				return nil, errgo.Newf("unexpected key type %T", row[0])
+			}
+			keys = append(keys, key)
+			after = key
+		}
+		if len(result.Rows) < queryLimit {
+			return keys, nil
+		}
+	}
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen.
+func (s *kvStore) MaxKeyLen() int {
+	return simplekv.MaxKeyLen
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen.
+func (s *kvStore) MaxValueLen() int {
+	return maxValueLen
+}
+
+// Close implements simplekv.Closer.Close by deleting the store's
+// session.
+func (s *kvStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.session == "" {
+		return nil
+	}
+	session := s.session
+	s.session = ""
+	err := s.do(context.Background(), http.MethodDelete, s.endpoint+"/v1/"+session, nil, nil)
+	if err != nil && errgo.Cause(err) != errSessionNotFound {
+		return errgo.Notef(err, "cannot delete session")
+	}
+	return nil
+}
+
+// readRow reads the given column of the row holding the given key, if
+// it has not expired. If tx is non-empty, the row is read in that
+// transaction. It returns a nil row if there is no such row.
+func (s *kvStore) readRow(ctx context.Context, tx string, column string, key string) ([]interface{}, error) {
+	req := map[string]interface{}{
+		"sql":        "SELECT " + column + " FROM " + s.table + " WHERE key = @key AND " + s.alive(),
+		"params":     map[string]string{"key": key},
+		"paramTypes": map[string]paramType{"key": {"STRING"}},
+	}
+	if tx != "" {
+		req["transaction"] = map[string]string{"id": tx}
+	}
+	var result resultSet
+	if err := s.call(ctx, "executeSql", req, &result); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed), errgo.Is(errAborted))
+	}
+	if len(result.Rows) == 0 {
+		return nil, nil
+	}
+	return result.Rows[0], nil
+}
+
+// runTransaction runs f in a read-write transaction with the given
+// column of the row holding the given key, which is nil if there is
+// no such row, and commits the mutations it returns. The transaction
+// is retried if it is aborted. Errors returned by f are returned with
+// their cause unchanged.
+func (s *kvStore) runTransaction(ctx context.Context, key, column string, f func(row []interface{}) ([]mutation, error)) error {
+	for i := 0; i < maxAttempts; i++ {
+		var tx struct {
+			ID string `json:"id"`
+		}
+		err := s.call(ctx, "beginTransaction", map[string]interface{}{
+			"options": map[string]interface{}{
+				"readWrite": struct{}{},
+			},
+		}, &tx)
+		if err != nil {
+			return errgo.NoteMask(err, "cannot begin transaction", errgo.Is(simplekv.ErrStoreClosed))
+		}
+		row, err := s.readRow(ctx, tx.ID, column, key)
+		if errgo.Cause(err) == errAborted {
+			continue
+		}
+		if err != nil {
+			s.rollback(ctx, tx.ID)
+			return errgo.NoteMask(err, fmt.Sprintf("cannot get key %s", key), errgo.Is(simplekv.ErrStoreClosed))
+		}
+		mutations, err := f(row)
+		if err != nil {
+			s.rollback(ctx, tx.ID)
+			return errgo.Mask(err, errgo.Any)
+		}
+		err = s.call(ctx, "commit", map[string]interface{}{
+			"transactionId": tx.ID,
+			"mutations":     mutations,
+		}, nil)
+		if errgo.Cause(err) == errAborted {
+			continue
+		}
+		if err != nil {
+			return errgo.NoteMask(err, "cannot commit transaction", errgo.Is(simplekv.ErrStoreClosed))
+		}
+		return nil
+	}
+	return simplekv.NewContentionError(retryAfter, "cannot update key %s: too many concurrent modifications", key)
+}
+
+// rollback rolls back the given transaction. Failures are ignored,
+// because Spanner expires abandoned transactions.
+func (s *kvStore) rollback(ctx context.Context, tx string) {
+	s.call(ctx, "rollback", map[string]string{
+		"transactionId": tx,
+	}, nil)
+}
+
+// insertOrUpdate returns a mutation that replaces the row holding the
+// given key.
+func (s *kvStore) insertOrUpdate(key string, value []byte, expire time.Time) mutation {
+	if value == nil {
+		// A nil slice would be encoded as null.
+		value = []byte{}
+	}
+	return mutation{
+		InsertOrUpdate: &write{
+			Table:   s.table,
+			Columns: []string{"key", "value", "expire"},
+			Values:  [][]interface{}{{key, value, encodeTime(expire)}},
+		},
+	}
+}
+
+// alive returns an SQL condition that holds for rows that have not
+// expired.
+func (s *kvStore) alive() string {
+	return "(expire IS NULL OR expire > CURRENT_TIMESTAMP())"
+}
+
+// call calls the given method on the store's session, creating the
+// session if necessary. If the session has been deleted, a new one is
+// created and the call is made again.
+func (s *kvStore) call(ctx context.Context, method string, req, resp interface{}) error {
+	for i := 0; ; i++ {
+		session, err := s.getSession(ctx)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+		}
+		err = s.do(ctx, http.MethodPost, s.endpoint+"/v1/"+session+":"+method, req, resp)
+		if errgo.Cause(err) == errSessionNotFound && i == 0 {
+			s.resetSession(session)
+			continue
+		}
+		return errgo.Mask(err, errgo.Is(errAborted))
+	}
+}
+
+// getSession returns the name of the store's session, creating it if
+// necessary.
+func (s *kvStore) getSession(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return "", errgo.WithCausef(nil, simplekv.ErrStoreClosed, "")
+	}
+	if s.session != "" {
+		return s.session, nil
+	}
+	var resp struct {
+		Name string `json:"name"`
+	}
+	if err := s.do(ctx, http.MethodPost, s.endpoint+"/v1/"+s.database+"/sessions", struct{}{}, &resp); err != nil {
+		return "", errgo.Notef(err, "cannot create session")
+	}
+	s.session = resp.Name
+	return s.session, nil
+}
+
+// resetSession forgets the given session, so that the next call
+// creates a new one.
+func (s *kvStore) resetSession(session string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == session {
+		s.session = ""
+	}
+}
+
+// do sends a request to the given URL with the given JSON body, if
+// any, and unmarshals the response into resp, if it is non-nil.
+// Errors returned by Spanner with a status of ABORTED have a cause of
+// errAborted, and those reporting a missing session have a cause of
+// errSessionNotFound.
+func (s *kvStore) do(ctx context.Context, method, u string, body, resp interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpResp, err := s.client.Do(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer httpResp.Body.Close()
+	data, err = ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return errgo.Notef(err, "cannot read response body")
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return responseError(httpResp.StatusCode, data)
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return errgo.Notef(err, "cannot unmarshal response")
+	}
+	return nil
+}
+
+// apiError holds an error returned by the Spanner API.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+// Error implements the error interface.
+func (e *apiError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("unexpected status %d", e.Code)
+	}
+	return e.Status + ": " + e.Message
+}
+
+// responseError returns the error described by a response with the
+// given status code and body.
+func responseError(code int, data []byte) error {
+	var resp struct {
+		Error apiError `json:"error"`
+	}
+	// The body may not describe the error (for example, when the
+	// response comes from a proxy), so ignore failures.
+	json.Unmarshal(data, &resp)
+	e := &resp.Error
+	e.Code = code
+	switch {
+	case e.Status == "ABORTED":
+		return errgo.WithCausef(e, errAborted, "")
+	case e.Status == "NOT_FOUND" && strings.HasPrefix(e.Message, "Session not found"):
+		return errgo.WithCausef(e, errSessionNotFound, "")
+	}
+	return e
+}
+
+// resultSet holds the result of an executeSql request. Values are
+// represented in JSON as described by the Spanner REST API: for
+// example, BYTES values are base64-encoded strings.
+type resultSet struct {
+	Rows [][]interface{} `json:"rows"`
+}
+
+type paramType struct {
+	Code string `json:"code"`
+}
+
+// mutation holds a mutation in a commit request.
+type mutation struct {
+	InsertOrUpdate *write    `json:"insertOrUpdate,omitempty"`
+	Update         *write    `json:"update,omitempty"`
+	Delete         *deletion `json:"delete,omitempty"`
+}
+
+type write struct {
+	Table   string          `json:"table"`
+	Columns []string        `json:"columns"`
+	Values  [][]interface{} `json:"values"`
+}
+
+type deletion struct {
+	Table  string `json:"table"`
+	KeySet keySet `json:"keySet"`
+}
+
+type keySet struct {
+	Keys [][]interface{} `json:"keys"`
+}
+
+// encodeTime returns the JSON representation of the given expiry
+// time, which is null for the zero time.
+func encodeTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// decodeBytes decodes a BYTES value from a result set.
+func decodeBytes(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errgo.Newf("unexpected value type %T", v)
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errgo.Notef(err, "invalid value")
+	}
+	return b, nil
+}
+
+// checkKey checks that the given key can be stored in a STRING
+// column, which holds only valid UTF-8.
+func checkKey(key string) error {
+	return simplekv.ValidateKey(key, simplekv.KeyRules{
+		AllowEmpty: true,
+		Allowed:    func(rune) bool { return true },
+	})
+}
+
+// validTableName reports whether the given name is a valid Spanner
+// table name. Only unquoted names are allowed, because the name is
+// used in SQL statements.
+func validTableName(name string) bool {
+	if name == "" || len(name) > 128 {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case c == '_' || '0' <= c && c <= '9':
+			if i == 0 && c != '_' {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,475 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package spannersimplekv_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/simplekvtest"
+	"github.com/juju/simplekv/spannersimplekv"
+)
+
+const testDatabase = "projects/p/instances/i/databases/d"
+
+func TestSpannerStore(t *testing.T) {
+	srv := newFakeSpanner()
+	defer srv.Close()
+	n := 0
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		n++
+		return spannersimplekv.NewStore(http.DefaultClient, testDatabase, "kv"+strconv.Itoa(n), spannersimplekv.WithEndpoint(srv.URL))
+	})
+}
+
+func TestDDL(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(spannersimplekv.DDL("kv"), qt.DeepEquals, []string{
+		"CREATE TABLE kv (key STRING(512) NOT NULL, value BYTES(MAX) NOT NULL, expire TIMESTAMP) PRIMARY KEY (key), " +
+			"ROW DELETION POLICY (OLDER_THAN(expire, INTERVAL 0 DAY))",
+	})
+}
+
+func TestRows(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeSpanner()
+	defer srv.Close()
+	kv, err := spannersimplekv.NewStore(http.DefaultClient, testDatabase, "kv", spannersimplekv.WithEndpoint(srv.URL))
+	c.Assert(err, qt.Equals, nil)
+
+	err = kv.Set(ctx, "k", []byte("value"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.row("kv", "k"), qt.DeepEquals, []interface{}{"k", base64.StdEncoding.EncodeToString([]byte("value")), nil})
+
+	// A non-zero expiry time is held in the expire column, which is
+	// used by the row deletion policy.
+	err = kv.Touch(ctx, "k", time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.row("kv", "k"), qt.DeepEquals, []interface{}{"k", base64.StdEncoding.EncodeToString([]byte("value")), "2100-01-02T03:04:05Z"})
+
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		return append(old, '!'), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.row("kv", "k"), qt.DeepEquals, []interface{}{"k", base64.StdEncoding.EncodeToString([]byte("value!")), nil})
+}
+
+func TestUpdateRetriesAbortedTransaction(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeSpanner()
+	defer srv.Close()
+	kv, err := spannersimplekv.NewStore(http.DefaultClient, testDatabase, "kv", spannersimplekv.WithEndpoint(srv.URL))
+	c.Assert(err, qt.Equals, nil)
+
+	calls := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			err := kv.Set(ctx, "k", []byte("other"), time.Time{})
+			c.Check(err, qt.Equals, nil)
+		}
+		return append(old, '!'), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(calls, qt.Equals, 2)
+	v, err := kv.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "other!")
+
+	// An update that is always aborted eventually gives up.
+	n := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		n++
+		err := kv.Set(ctx, "k", []byte(fmt.Sprint(n)), time.Time{})
+		c.Check(err, qt.Equals, nil)
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot update key k: too many concurrent modifications`)
+	_, ok := simplekv.RetryAfter(err)
+	c.Assert(ok, qt.Equals, true)
+}
+
+func TestSessions(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeSpanner()
+	defer srv.Close()
+	kv, err := spannersimplekv.NewStore(http.DefaultClient, testDatabase, "kv", spannersimplekv.WithEndpoint(srv.URL))
+	c.Assert(err, qt.Equals, nil)
+
+	// The session is created when it is first needed, and then
+	// reused.
+	c.Assert(srv.sessionCount(), qt.Equals, 0)
+	err = kv.Set(ctx, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	_, err = kv.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.sessionCount(), qt.Equals, 1)
+
+	// A session deleted by Spanner is replaced.
+	srv.deleteSessions()
+	_, err = kv.Get(ctx, "k")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.sessionCount(), qt.Equals, 1)
+
+	// Closing the store deletes the session.
+	err = simplekv.Close(kv)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(srv.sessionCount(), qt.Equals, 0)
+}
+
+func TestErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	srv := newFakeSpanner()
+	defer srv.Close()
+
+	kv, err := spannersimplekv.NewStore(http.DefaultClient, testDatabase, "missing", spannersimplekv.WithEndpoint(srv.URL))
+	c.Assert(err, qt.Equals, nil)
+	_, err = kv.Get(ctx, "k")
+	c.Assert(err, qt.ErrorMatches, `cannot get key k: INVALID_ARGUMENT: Table not found: missing`)
+
+	_, err = kv.Get(ctx, "\xff")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey)
+
+	_, err = spannersimplekv.NewStore(http.DefaultClient, "projects/p/databases/d", "kv")
+	c.Assert(err, qt.ErrorMatches, `invalid database name "projects/p/databases/d"`)
+	_, err = spannersimplekv.NewStore(http.DefaultClient, testDatabase, "kv; DROP TABLE kv")
+	c.Assert(err, qt.ErrorMatches, `invalid table name "kv; DROP TABLE kv"`)
+}
+
+// fakeSpanner implements the small subset of the Spanner REST API
+// used by spannersimplekv, recognising only the SQL statements that
+// it generates. Transactions are optimistic: a commit is aborted if
+// any row read in the transaction has changed.
+type fakeSpanner struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	tables       map[string]map[string]*fakeRow
+	sessions     map[string]bool
+	transactions map[string]map[string]int
+	nextID       int
+	version      int
+}
+
+type fakeRow struct {
+	value   string
+	expire  time.Time
+	version int
+}
+
+func newFakeSpanner() *fakeSpanner {
+	srv := &fakeSpanner{
+		tables:       make(map[string]map[string]*fakeRow),
+		sessions:     make(map[string]bool),
+		transactions: make(map[string]map[string]int),
+	}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	return srv
+}
+
+// row returns the given row in the form used by the REST API, or nil
+// if there is no such row.
+func (srv *fakeSpanner) row(table, key string) []interface{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	r := srv.tables[table][key]
+	if r == nil {
+		return nil
+	}
+	var expire interface{}
+	if !r.expire.IsZero() {
+		expire = r.expire.Format(time.RFC3339Nano)
+	}
+	return []interface{}{key, r.value, expire}
+}
+
+func (srv *fakeSpanner) sessionCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.sessions)
+}
+
+func (srv *fakeSpanner) deleteSessions() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.sessions = make(map[string]bool)
+}
+
+func (srv *fakeSpanner) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	if path == testDatabase+"/sessions" && req.Method == "POST" {
+		srv.nextID++
+		name := fmt.Sprintf("%s/sessions/s%d", testDatabase, srv.nextID)
+		srv.sessions[name] = true
+		writeJSON(w, map[string]string{"name": name})
+		return
+	}
+	session, method := path, ""
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		session, method = path[:i], path[i+1:]
+	}
+	if !srv.sessions[session] {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Session not found: "+session)
+		return
+	}
+	if req.Method == "DELETE" && method == "" {
+		delete(srv.sessions, session)
+		writeJSON(w, struct{}{})
+		return
+	}
+	var body json.RawMessage
+	if req.Method != "POST" || json.NewDecoder(req.Body).Decode(&body) != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid request")
+		return
+	}
+	switch method {
+	case "beginTransaction":
+		srv.nextID++
+		id := fmt.Sprintf("tx%d", srv.nextID)
+		srv.transactions[id] = make(map[string]int)
+		writeJSON(w, map[string]string{"id": id})
+	case "rollback":
+		var r struct {
+			TransactionID string `json:"transactionId"`
+		}
+		json.Unmarshal(body, &r)
+		delete(srv.transactions, r.TransactionID)
+		writeJSON(w, struct{}{})
+	case "executeSql":
+		srv.executeSQL(w, body)
+	case "commit":
+		srv.commit(w, body)
+	default:
+		writeError(w, http.StatusNotImplemented, "UNIMPLEMENTED", "unsupported request")
+	}
+}
+
+const aliveCondition = `\(expire IS NULL OR expire > CURRENT_TIMESTAMP\(\)\)`
+
+var (
+	selectRowPattern  = regexp.MustCompile(`^SELECT (key|value) FROM (\w+) WHERE key = @key AND ` + aliveCondition + `$`)
+	selectKeysPattern = regexp.MustCompile(`^SELECT key FROM (\w+) WHERE STARTS_WITH\(key, @prefix\) AND key > @after AND ` + aliveCondition + ` ORDER BY key LIMIT (\d+)$`)
+)
+
+func (srv *fakeSpanner) executeSQL(w http.ResponseWriter, body json.RawMessage) {
+	var r struct {
+		SQL         string            `json:"sql"`
+		Params      map[string]string `json:"params"`
+		Transaction *struct {
+			ID string `json:"id"`
+		} `json:"transaction"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
+		return
+	}
+	now := time.Now()
+	alive := func(row *fakeRow) bool {
+		return row != nil && (row.expire.IsZero() || row.expire.After(now))
+	}
+	var rows [][]interface{}
+	if m := selectRowPattern.FindStringSubmatch(r.SQL); m != nil {
+		table, ok := srv.table(w, m[2])
+		if !ok {
+			return
+		}
+		key := r.Params["key"]
+		row := table[key]
+		if r.Transaction != nil {
+			reads, ok := srv.transactions[r.Transaction.ID]
+			if !ok {
+				writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid transaction")
+				return
+			}
+			reads[m[2]+"/"+key] = 0
+			if row != nil {
+				reads[m[2]+"/"+key] = row.version
+			}
+		}
+		if alive(row) {
+			if m[1] == "key" {
+				rows = append(rows, []interface{}{key})
+			} else {
+				rows = append(rows, []interface{}{row.value})
+			}
+		}
+	} else if m := selectKeysPattern.FindStringSubmatch(r.SQL); m != nil {
+		table, ok := srv.table(w, m[1])
+		if !ok {
+			return
+		}
+		var keys []string
+		for key, row := range table {
+			if strings.HasPrefix(key, r.Params["prefix"]) && key > r.Params["after"] && alive(row) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if limit, _ := strconv.Atoi(m[2]); len(keys) > limit {
+			keys = keys[:limit]
+		}
+		for _, key := range keys {
+			rows = append(rows, []interface{}{key})
+		}
+	} else {
+		writeError(w, http.StatusNotImplemented, "UNIMPLEMENTED", "unsupported statement: "+r.SQL)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"metadata": struct{}{},
+		"rows":     rows,
+	})
+}
+
+func (srv *fakeSpanner) commit(w http.ResponseWriter, body json.RawMessage) {
+	type write struct {
+		Table   string          `json:"table"`
+		Columns []string        `json:"columns"`
+		Values  [][]interface{} `json:"values"`
+	}
+	var r struct {
+		TransactionID        string          `json:"transactionId"`
+		SingleUseTransaction json.RawMessage `json:"singleUseTransaction"`
+		Mutations            []struct {
+			InsertOrUpdate *write `json:"insertOrUpdate"`
+			Update         *write `json:"update"`
+			Delete         *struct {
+				Table  string `json:"table"`
+				KeySet struct {
+					Keys [][]string `json:"keys"`
+				} `json:"keySet"`
+			} `json:"delete"`
+		} `json:"mutations"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
+		return
+	}
+	if r.TransactionID != "" {
+		reads, ok := srv.transactions[r.TransactionID]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid transaction")
+			return
+		}
+		delete(srv.transactions, r.TransactionID)
+		for name, version := range reads {
+			parts := strings.SplitN(name, "/", 2)
+			current := 0
+			if row := srv.tables[parts[0]][parts[1]]; row != nil {
+				current = row.version
+			}
+			if current != version {
+				writeError(w, http.StatusConflict, "ABORTED", "Transaction was aborted.")
+				return
+			}
+		}
+	} else if r.SingleUseTransaction == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "no transaction")
+		return
+	}
+	for _, m := range r.Mutations {
+		srv.version++
+		switch {
+		case m.Delete != nil:
+			table, ok := srv.table(w, m.Delete.Table)
+			if !ok {
+				return
+			}
+			for _, key := range m.Delete.KeySet.Keys {
+				delete(table, key[0])
+			}
+		case m.InsertOrUpdate != nil, m.Update != nil:
+			wr := m.InsertOrUpdate
+			if wr == nil {
+				wr = m.Update
+			}
+			table, ok := srv.table(w, wr.Table)
+			if !ok {
+				return
+			}
+			for _, values := range wr.Values {
+				key := values[0].(string)
+				row := table[key]
+				if row == nil {
+					if m.Update != nil {
+						writeError(w, http.StatusNotFound, "NOT_FOUND", "Row not found")
+						return
+					}
+					row = &fakeRow{}
+				}
+				row = &fakeRow{
+					value:   row.value,
+					expire:  row.expire,
+					version: srv.version,
+				}
+				for i, col := range wr.Columns {
+					switch col {
+					case "value":
+						row.value = values[i].(string)
+					case "expire":
+						row.expire = time.Time{}
+						if values[i] != nil {
+							row.expire, _ = time.Parse(time.RFC3339Nano, values[i].(string))
+						}
+					}
+				}
+				table[key] = row
+			}
+		}
+	}
+	writeJSON(w, map[string]string{
+		"commitTimestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// table returns the table with the given name. Any table whose name
+// starts with "kv" exists.
+func (srv *fakeSpanner) table(w http.ResponseWriter, name string) (map[string]*fakeRow, bool) {
+	if !strings.HasPrefix(name, "kv") {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Table not found: "+name)
+		return nil, false
+	}
+	if srv.tables[name] == nil {
+		srv.tables[name] = make(map[string]*fakeRow)
+	}
+	return srv.tables[name], true
+}
+
+func writeError(w http.ResponseWriter, code int, status, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  status,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// cockroachInitTmpls holds the statements that create the table on
+// CockroachDB. CockroachDB does not support triggers, so expired rows
+// are removed when their key is written again instead. Strings are
+// always compared byte by byte, so the indexes that provide "C"
+// collation ordering with Postgres are not needed.
+var cockroachInitTmpls = []string{`
+CREATE TABLE IF NOT EXISTS {{.TableName}} (
+	key TEXT NOT NULL,
+	value BYTEA NOT NULL,
+	expire TIMESTAMP WITH TIME ZONE,
+	UNIQUE (key)
+)`, `
+CREATE INDEX IF NOT EXISTS {{.TableName}}_expire ON {{.TableName}} (expire)`,
+}
+
+// cockroachIndexes holds the suffixes of the names of the indexes
+// expected on the table, in addition to the unique index on key.
+var cockroachIndexes = []string{
+	"_expire",
+}
+
+// cockroachTmpls holds the statements used with CockroachDB. They are
+// the same as those used with Postgres, except that the inline value
+// index is not used and keys are ordered without an explicit
+// collation.
+var cockroachTmpls = func() [numTmpl]string {
+	tmpls := postgresTmpls
+	tmpls[tmplGetKeyValue] = `
+		SELECT value FROM {{.TableName}}
+		WHERE key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())`
+	tmpls[tmplIterate] = `
+		SELECT key, value FROM {{.TableName}}
+		WHERE key LIKE {{.Pattern | .Arg}} ESCAPE '\' AND (expire IS NULL OR expire > now())
+		ORDER BY key`
+	return tmpls
+}()
+
+// newCockroachDriver creates a CockroachDB driver using the given DB.
+// If createSchema is true, the table and its index are created if
+// necessary; otherwise they are expected to exist already and are
+// validated. The time taken by each step is logged to the given
+// logger.
+func newCockroachDriver(ctx context.Context, db *sql.DB, tableName string, createSchema bool, logger simplekv.Logger) (*driver, error) {
+	start := time.Now()
+	if createSchema {
+		// CockroachDB does not allow an index to be created in the
+		// same transaction as its table, so the statements are not
+		// run in a transaction.
+		if err := execSchema(ctx, db, cockroachInitTmpls, tableName, logger); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+	} else {
+		if err := validatePostgresSchema(ctx, db, tableName, postgresSchema{
+			indexes: cockroachIndexes,
+		}); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		logger.Debugf("validated schema of table %s in %v", tableName, time.Since(start))
+	}
+	start = time.Now()
+	d := &driver{
+		argBuilderFunc: func() argBuilder {
+			return &postgresArgBuilder{}
+		},
+		isDuplicate:           postgresIsDuplicate,
+		isRetryable:           cockroachIsRetryable,
+		maxValueLen:           postgresMaxValueLen,
+		deleteExpiredOnInsert: true,
+	}
+	for i, t := range cockroachTmpls {
+		if err := d.parseTemplate(tmplID(i), t); err != nil {
+			return nil, errgo.Notef(err, "cannot parse template %v", t)
+		}
+	}
+	logger.Debugf("parsed %d statement templates in %v", len(cockroachTmpls), time.Since(start))
+	return d, nil
+}
+
+// cockroachIsRetryable reports whether err is a serialization failure.
+// CockroachDB runs all transactions at SERIALIZABLE isolation and
+// returns this error when a transaction conflicts with another one;
+// the transaction can then be retried from the start.
+func cockroachIsRetryable(err error) bool {
+	if pqerr, ok := err.(*pq.Error); ok && pqerr.Code == "40001" {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/lib/pq"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+func TestCockroachNewStore(t *testing.T) {
+	c := qt.New(t)
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	_, err := sqlsimplekv.NewStore("cockroach", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+	stmts := rec.statements()
+	c.Assert(stmts, qt.DeepEquals, []string{
+		"CREATE TABLE IF NOT EXISTS kv ( key TEXT NOT NULL, value BYTEA NOT NULL, expire TIMESTAMP WITH TIME ZONE, UNIQUE (key) )",
+		"CREATE INDEX IF NOT EXISTS kv_expire ON kv (expire)",
+	})
+
+	_, err = sqlsimplekv.NewStore("cockroach", db, "kv", sqlsimplekv.WithPermissionCheck())
+	c.Assert(err, qt.ErrorMatches, `permission check not supported with database driver "cockroach"`)
+}
+
+func TestCockroachStatements(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+	kv, err := sqlsimplekv.NewStore("cockroach", db, "kv", sqlsimplekv.WithInlineValueIndex(100))
+	c.Assert(err, qt.Equals, nil)
+
+	rec.reset()
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"SELECT value FROM kv WHERE key=$1 AND (expire IS NULL OR expire > now())",
+	})
+
+	rec.reset()
+	_, err = kv.(simplekv.Iterable).Iterate(ctx, "a")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		`SELECT key, value FROM kv WHERE key LIKE $1 ESCAPE '\' AND (expire IS NULL OR expire > now()) ORDER BY key`,
+	})
+}
+
+func TestCockroachUpdateRetry(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+	kv, err := sqlsimplekv.NewStore("cockroach", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+
+	failures := 1
+	rec.execErr = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") && failures > 0 {
+			failures--
+			return &pq.Error{Code: "40001", Message: "restart transaction"}
+		}
+		return nil
+	}
+	rec.reset()
+	calls := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(calls, qt.Equals, 2)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"BEGIN",
+		"SELECT value FROM kv WHERE key=$1 AND (expire IS NULL OR expire > now()) FOR UPDATE",
+		"DELETE FROM kv WHERE key=$1 AND expire <= now()",
+		"INSERT INTO kv (key, value, expire) VALUES ($1, $2, $3)",
+		"ROLLBACK",
+		"BEGIN",
+		"SELECT value FROM kv WHERE key=$1 AND (expire IS NULL OR expire > now()) FOR UPDATE",
+		"DELETE FROM kv WHERE key=$1 AND expire <= now()",
+		"INSERT INTO kv (key, value, expire) VALUES ($1, $2, $3)",
+		"COMMIT",
+	})
+
+	// An update that keeps failing gives up with a contention error.
+	failures = 100
+	calls = 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `too many retryable transaction failures`)
+	c.Assert(calls, qt.Equals, 10)
+	cerr, ok := errgo.Cause(err).(*simplekv.ContentionError)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(cerr.Attempts, qt.Equals, 10)
+
+	// Other errors are not retried.
+	rec.execErr = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") {
+			return &pq.Error{Code: "23502", Message: "null value"}
+		}
+		return nil
+	}
+	calls = 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `.*null value`)
+	c.Assert(calls, qt.Equals, 1)
+
+	// Retries stop once the context is done.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rec.execErr = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") {
+			cancel()
+			return &pq.Error{Code: "40001", Message: "restart transaction"}
+		}
+		return nil
+	}
+	calls = 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.ErrorMatches, `.*restart transaction`)
+	c.Assert(calls, qt.Equals, 1)
+}
+
+func TestCockroachWithoutSchemaCreation(t *testing.T) {
+	c := qt.New(t)
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	rec.rows = func(query string) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "information_schema.columns"):
+			return [][]driver.Value{
+				{"key", "text", int64(0)},
+				{"value", "bytea", int64(0)},
+				{"expire", "timestamp with time zone", int64(1)},
+			}
+		case strings.Contains(query, "pg_indexes"):
+			return [][]driver.Value{
+				{"kv_key_key", "CREATE UNIQUE INDEX kv_key_key ON defaultdb.public.kv USING btree (key ASC)"},
+				{"kv_expire", "CREATE INDEX kv_expire ON defaultdb.public.kv USING btree (expire ASC)"},
+			}
+		}
+		return nil
+	}
+	_, err := sqlsimplekv.NewStore("cockroach", db, "kv", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.Equals, nil)
+	for _, stmt := range rec.statements() {
+		c.Assert(stmt, qt.Not(qt.Contains), "information_schema.triggers")
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"fmt"
+	"reflect"
 	"strings"
 	"text/template"
+	"time"
 
-	errgo "gopkg.in/errgo.v1"
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
 )
 
 type tmplID int
@@ -19,8 +23,17 @@ const (
 	_ tmplID = iota - 1
 	tmplGetKeyValue
 	tmplGetKeyValueForUpdate
+	tmplKeyExists
 	tmplInsertKeyValue
+	tmplUpdateKeyValueIfEquals
+	tmplTouchKey
 	tmplListKeys
+	tmplListKeysWithPrefix
+	tmplCountKeys
+	tmplCountKeysWithPrefix
+	tmplIterate
+	tmplDeleteKey
+	tmplDeleteExpiredKey
 	numTmpl
 )
 
@@ -48,6 +61,51 @@ type driver struct {
 	tmpls          [numTmpl]*template.Template
 	argBuilderFunc func() argBuilder
 	isDuplicate    func(error) bool
+
+	// maxValueLen holds the maximum length of a value.
+	maxValueLen int
+
+	// txOptions holds the options used to begin read-write
+	// transactions.
+	txOptions *sql.TxOptions
+
+	// deleteExpiredOnInsert holds whether an expired row must be
+	// deleted explicitly before its key can be inserted again,
+	// because the database does not remove expired rows itself.
+	deleteExpiredOnInsert bool
+
+	// isRetryable, if not nil, reports whether an error returned by
+	// the database means that the transaction was aborted and
+	// should be retried from the start.
+	isRetryable func(error) bool
+
+	// likeEscaper, if not nil, is used instead of the default
+	// escaper when making LIKE patterns, for databases that treat
+	// other characters specially in patterns.
+	likeEscaper *strings.Replacer
+}
+
+// retryable reports whether err, or any error that it wraps, is
+// reported as retryable by d.isRetryable. The whole chain is checked
+// because errors from the database are often masked before they reach
+// the code that begins the transaction.
+func (d *driver) retryable(err error) bool {
+	if d.isRetryable == nil {
+		return false
+	}
+	for err != nil {
+		if d.isRetryable(err) {
+			return true
+		}
+		w, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return false
+		}
+		err = w.Underlying()
+	}
+	return false
 }
 
 // exec performs the Exec method on the given queryer by processing the
@@ -85,6 +143,29 @@ func (d *driver) queryRow(ctx context.Context, q queryer, tmplID tmplID, params
 	return q.QueryRowContext(ctx, query, params.args()...), nil
 }
 
+// execSchema runs each of the given schema statements outside a
+// transaction, logging the time taken by each one.
+func execSchema(ctx context.Context, db *sql.DB, tmpls []string, tableName string, logger simplekv.Logger) error {
+	for i, t := range tmpls {
+		tmpl, err := template.New("").Parse(t)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, keyValueParams{
+			TableName: tableName,
+		}); err != nil {
+			return errgo.Mask(err)
+		}
+		start := time.Now()
+		if _, err := db.ExecContext(ctx, buf.String()); err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot run schema statement %d", i), errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		logger.Debugf("schema statement %d took %v: %s", i, time.Since(start), firstLine(buf.String()))
+	}
+	return nil
+}
+
 func (d *driver) parseTemplate(tmplID tmplID, tmpl string) error {
 	var err error
 	d.tmpls[tmplID], err = template.New("").Funcs(template.FuncMap{
@@ -100,3 +181,25 @@ func (d *driver) executeTemplate(tmplID tmplID, params argBuilder) (string, erro
 	}
 	return buf.String(), nil
 }
+
+// errorNumber returns the value of the integer Number field of the
+// struct that err is or points to, as used by the error types of the
+// MySQL and SQL Server drivers, so that errors can be recognised
+// without depending on a particular driver implementation.
+func errorNumber(err error) (int64, bool) {
+	v := reflect.ValueOf(err)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	n := v.FieldByName("Number")
+	switch n.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(n.Uint()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return n.Int(), true
+	}
+	return 0, false
+}
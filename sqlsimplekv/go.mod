@@ -0,0 +1,15 @@
+module github.com/juju/simplekv/sqlsimplekv
+
+go 1.12
+
+require (
+	github.com/frankban/quicktest v1.14.0
+	github.com/juju/postgrestest v1.1.1
+	github.com/juju/simplekv v0.0.0-20261015053811-8a53b2fa50dd
+	github.com/lib/pq v1.10.3
+	gopkg.in/errgo.v1 v1.0.1
+)
+
+// The replace directive builds against the local checkout; it is
+// ignored when this module is required from elsewhere.
+replace github.com/juju/simplekv => ../
@@ -7,32 +7,158 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
-	errgo "gopkg.in/errgo.v1"
-
 	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
 )
 
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages to the given logger.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// WithoutSchemaCreation returns an option that stops NewStore from
+// creating the table and its associated indexes, trigger and
+// function. Instead, NewStore checks that they already exist with
+// the expected definitions and returns an error describing any
+// differences. This is useful when the database user does not have
+// permission to run DDL statements.
+func WithoutSchemaCreation() Option {
+	return func(s *kvStore) {
+		s.validateOnly = true
+	}
+}
+
+// WithPermissionCheck returns an option that makes NewStore check
+// that the database user has all the privileges that the store needs
+// before using the database, and return an error listing any that are
+// missing. Without it, missing privileges are only reported when an
+// operation that needs them fails.
+func WithPermissionCheck() Option {
+	return func(s *kvStore) {
+		s.checkPermissions = true
+	}
+}
+
+// WithInlineValueIndex returns an option that makes the store keep
+// values of up to maxLen bytes in a covering index on the key, so that
+// Get can read them with an index-only scan instead of fetching the
+// table row. This helps workloads dominated by lookups of small
+// values, such as tokens. Larger values are read from the table as
+// usual, after one extra index probe.
+//
+// The index requires Postgres 11 or later, and index-only scans are
+// only possible for rows on pages that have been vacuumed since they
+// were last changed. maxLen should be well below the btree row size
+// limit of about 2700 bytes.
+func WithInlineValueIndex(maxLen int) Option {
+	return func(s *kvStore) {
+		s.inlineValueLen = maxLen
+	}
+}
+
 // NewStore returns a new Store instance that uses the
 // given sql database for storage, generating SQL with the
-// given driver (currently only "postgres" is supported).
+// given driver ("postgres", "cockroach", "mysql" or "sqlserver").
 //
 // The data will be stored in a table with the given name
 // (other SQL artificacts may also be created using the name as a prefix).
-func NewStore(driverName string, db *sql.DB, tableName string) (simplekv.Store, error) {
-	if driverName != "postgres" {
+//
+// The "mysql" driver supports MySQL 5.7 and later and MariaDB 10.2 and
+// later, through github.com/go-sql-driver/mysql or any driver that
+// reports errors in the same form. The data source name must set
+// clientFoundRows=true, so that statements that leave a row unchanged
+// are counted as matching it, and must leave the time zone used for
+// time values as UTC. MySQL has no equivalent of the Postgres trigger
+// that removes expired rows, so expired rows are only removed when
+// their key is written again; a table with many short-lived keys should
+// be cleaned periodically with a statement such as
+//
+//	DELETE FROM tableName WHERE expire < UTC_TIMESTAMP(3)
+//
+// WithPermissionCheck is not supported with "mysql", and
+// WithInlineValueIndex has no effect, because InnoDB already stores
+// values with the primary key.
+//
+// The "cockroach" driver supports CockroachDB through github.com/lib/pq.
+// CockroachDB has no triggers, so expired rows are removed in the same
+// way as with "mysql". Transactions that fail with a serialization
+// error (SQLSTATE 40001) are retried; if they still fail after several
+// attempts, the error has a *simplekv.ContentionError cause.
+// WithPermissionCheck and WithInlineValueIndex are not supported with
+// "cockroach"; the latter has no effect.
+//
+// The "sqlserver" driver supports SQL Server 2016 and later through
+// github.com/denisenkom/go-mssqldb or any driver that reports errors
+// in the same form. Expired rows are removed in the same way as with
+// "mysql", and transactions chosen as deadlock victims are retried.
+// WithPermissionCheck is not supported with "sqlserver", and
+// WithInlineValueIndex has no effect.
+func NewStore(driverName string, db *sql.DB, tableName string, opts ...Option) (simplekv.Store, error) {
+	s, err := NewStoreContext(context.Background(), driverName, db, tableName, opts...)
+	return s, errgo.Mask(err)
+}
+
+// NewStoreContext is like NewStore except that the statements used to
+// create or validate the schema are run with the given context, so
+// that initialisation can be bounded with a timeout. If the context is
+// done before initialisation completes, the returned error has a cause
+// of ctx.Err(). The time taken by each schema statement is logged to
+// the logger given with WithLogger.
+func NewStoreContext(ctx context.Context, driverName string, db *sql.DB, tableName string, opts ...Option) (simplekv.Store, error) {
+	s := &kvStore{
+		tableName: tableName,
+		db:        db,
+		logger:    nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	start := time.Now()
+	var (
+		driver *driver
+		err    error
+	)
+	switch driverName {
+	case "postgres":
+		if s.checkPermissions {
+			if err := checkPostgresPermissions(ctx, db, tableName, !s.validateOnly); err != nil {
+				return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+			}
+		}
+		driver, err = newPostgresDriver(ctx, db, tableName, !s.validateOnly, s.inlineValueLen, s.logger)
+	case "cockroach":
+		if s.checkPermissions {
+			return nil, errgo.Newf("permission check not supported with database driver %q", driverName)
+		}
+		driver, err = newCockroachDriver(ctx, db, tableName, !s.validateOnly, s.logger)
+	case "mysql":
+		if s.checkPermissions {
+			return nil, errgo.Newf("permission check not supported with database driver %q", driverName)
+		}
+		driver, err = newMySQLDriver(ctx, db, tableName, !s.validateOnly, s.logger)
+	case "sqlserver":
+		if s.checkPermissions {
+			return nil, errgo.Newf("permission check not supported with database driver %q", driverName)
+		}
+		driver, err = newSQLServerDriver(ctx, db, tableName, !s.validateOnly, s.logger)
+	default:
 		return nil, errgo.Newf("unsupported database driver %q", driverName)
 	}
-	driver, err := newPostgresDriver(db, tableName)
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot initialise database")
+		return nil, errgo.NoteMask(err, "cannot initialise database", errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
 	}
-	return &kvStore{
-		tableName: tableName,
-		db:        db,
-		driver:    driver,
-	}, nil
+	s.driver = driver
+	s.logger.Debugf("initialised table %s in %v", tableName, time.Since(start))
+	return s, nil
 }
 
 // A kvStore implements simplekv.Store.
@@ -40,6 +166,19 @@ type kvStore struct {
 	db        *sql.DB
 	driver    *driver
 	tableName string
+	logger    simplekv.Logger
+
+	// validateOnly holds whether the schema should be validated
+	// rather than created.
+	validateOnly bool
+
+	// checkPermissions holds whether the user's privileges should be
+	// checked when the store is created.
+	checkPermissions bool
+
+	// inlineValueLen holds the maximum length of the values held in
+	// the inline value index, or zero if it is not used.
+	inlineValueLen int
 }
 
 // Context implements simplekv.Store.Context.
@@ -55,11 +194,29 @@ type keyValueParams struct {
 	Value     []byte
 	Expire    sql.NullTime
 	Update    bool
+
+	// OldValue holds the value expected by a conditional update.
+	OldValue []byte
+
+	// Pattern holds a LIKE pattern used to match keys.
+	Pattern string
+
+	// TTL holds the lifetime of the entry in microseconds,
+	// measured from the database server's current time. If it is
+	// non-zero, Expire is ignored.
+	TTL int64
+
+	// InlineValueLen holds the maximum length of the values held in
+	// the inline value index, or zero if it is not used.
+	InlineValueLen int
 }
 
 // Get implements simplekv.Store.Get by selecting the blob with the
 // given key from the table.
 func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
 	v, err := s.get(ctx, s.db, key, false)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
@@ -80,6 +237,8 @@ func (s *kvStore) get(ctx context.Context, q queryer, key string, forUpdate bool
 	tmpl := tmplGetKeyValue
 	if forUpdate {
 		tmpl = tmplGetKeyValueForUpdate
+	} else {
+		params.InlineValueLen = s.inlineValueLen
 	}
 	row, err := s.driver.queryRow(ctx, q, tmpl, params)
 	if err != nil {
@@ -94,24 +253,66 @@ func (s *kvStore) get(ctx context.Context, q queryer, key string, forUpdate bool
 	return value, nil
 }
 
+// Exists implements simplekv.Store.Exists by selecting a constant
+// from the row with the given key, which does not fetch the value.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	row, err := s.driver.queryRow(ctx, s.db, tmplKeyExists, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+		Key:        key,
+	})
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	var one int
+	if err := row.Scan(&one); err != nil {
+		if errgo.Cause(err) == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, errgo.Mask(err)
+	}
+	return true, nil
+}
+
 // Set implements simplekv.Store.Set by upserting the blob with the
 // given key, value and expire time into the table.
 func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
-	return s.set(ctx, s.db, key, value, expire, false)
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckValue(value, s.driver.maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return s.set(ctx, s.db, key, value, expire, 0, false)
 }
 
 // set is like Set except that it operates on a general queryer value.
+// If ttl is non-zero, the expiry time is computed by adding it to the
+// database server's current time and expire is ignored.
 // If insertOnly is true, the value will only be set if the key doesn't exist.
-func (s *kvStore) set(ctx context.Context, q queryer, key string, value []byte, expire time.Time, insertOnly bool) error {
+func (s *kvStore) set(ctx context.Context, q queryer, key string, value []byte, expire time.Time, ttl time.Duration, insertOnly bool) error {
+	if insertOnly && s.driver.deleteExpiredOnInsert {
+		if _, err := s.driver.exec(ctx, q, tmplDeleteExpiredKey, &keyValueParams{
+			argBuilder: s.driver.argBuilderFunc(),
+			TableName:  s.tableName,
+			Key:        key,
+		}); err != nil {
+			return errgo.Mask(err)
+		}
+	}
 	_, err := s.driver.exec(ctx, q, tmplInsertKeyValue, &keyValueParams{
 		argBuilder: s.driver.argBuilderFunc(),
 		TableName:  s.tableName,
 		Key:        key,
 		Value:      value,
 		Expire: sql.NullTime{
-			Time:  expire,
+			Time:  simplekv.NormalizeExpire(expire),
 			Valid: !expire.IsZero(),
 		},
+		TTL:    ttl.Microseconds(),
 		Update: !insertOnly,
 	})
 	if err != nil {
@@ -120,11 +321,65 @@ func (s *kvStore) set(ctx context.Context, q queryer, key string, value []byte,
 	return nil
 }
 
+// SetMulti implements simplekv.MultiSetter.SetMulti by upserting
+// all the entries in a single transaction, so the entries are written
+// atomically.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	for _, e := range entries {
+		if err := simplekv.CheckKey(e.Key); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+		}
+		if err := simplekv.CheckValue(e.Value, s.driver.maxValueLen); err != nil {
+			return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		for _, e := range entries {
+			if err := s.set(ctx, tx, e.Key, e.Value, e.Expire, 0, false); err != nil {
+				return errgo.Notef(err, "cannot set %q", e.Key)
+			}
+		}
+		return nil
+	})
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen.
+func (s *kvStore) MaxValueLen() int {
+	return s.driver.maxValueLen
+}
+
 // Update implements simplekv.Store.Update.
 func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	return errgo.Mask(s.update(ctx, key, expire, 0, getVal), errgo.Any)
+}
+
+// SetTTL implements simplekv.TTLSetter.SetTTL by computing the expiry
+// time from the database server's clock.
+func (s *kvStore) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckValue(value, s.driver.maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return s.set(ctx, s.db, key, value, time.Time{}, ttl, false)
+}
+
+// UpdateTTL implements simplekv.TTLSetter.UpdateTTL by computing the
+// expiry time from the database server's clock.
+func (s *kvStore) UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	return errgo.Mask(s.update(ctx, key, time.Time{}, ttl, getVal), errgo.Any)
+}
+
+// update implements Update and UpdateTTL. If ttl is non-zero, expire
+// is ignored, as described in set.
+func (s *kvStore) update(ctx context.Context, key string, expire time.Time, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
 	for {
 		insertOnly := false
-		err := s.withTx(func(tx *sql.Tx) error {
+		err := s.withTx(ctx, func(tx *sql.Tx) error {
 			v, err := s.get(ctx, tx, key, true)
 			if err != nil {
 				if errgo.Cause(err) != simplekv.ErrNotFound {
@@ -140,7 +395,10 @@ func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getV
 			if err != nil {
 				return errgo.Mask(err, errgo.Any)
 			}
-			err = s.set(ctx, tx, key, newVal, expire, insertOnly)
+			if err := simplekv.CheckValue(newVal, s.driver.maxValueLen); err != nil {
+				return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+			}
+			err = s.set(ctx, tx, key, newVal, expire, ttl, insertOnly)
 			if err == nil {
 				return nil
 			}
@@ -152,15 +410,244 @@ func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getV
 		// The document didn't previously exist (so we couldn't lock it) but when we
 		// tried the insert, it failed with a duplicate-key error and aborted the transaction,
 		// so we'll now try again with the document in place.
+		s.logger.Debugf("retrying update of key %q after concurrent insert", key)
 	}
 }
 
-// Keys implements simplekv.Store.Keys.
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals
+// with a single conditional INSERT or UPDATE statement.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckValue(newVal, s.driver.maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	if oldVal == nil {
+		err := s.set(ctx, s.db, key, newVal, expire, 0, true)
+		if err != nil && s.driver.isDuplicate(errgo.Cause(err)) {
+			return simplekv.KeyConflictError(key)
+		}
+		return errgo.Mask(err)
+	}
+	res, err := s.driver.exec(ctx, s.db, tmplUpdateKeyValueIfEquals, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+		Key:        key,
+		Value:      newVal,
+		Expire: sql.NullTime{
+			Time:  simplekv.NormalizeExpire(expire),
+			Valid: !expire.IsZero(),
+		},
+		OldValue: oldVal,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n == 0 {
+		return simplekv.KeyConflictError(key)
+	}
+	return nil
+}
+
+// Touch implements simplekv.Store.Touch by updating only the expire
+// column of the row with the given key.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	res, err := s.driver.exec(ctx, s.db, tmplTouchKey, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+		Key:        key,
+		Expire: sql.NullTime{
+			Time:  simplekv.NormalizeExpire(expire),
+			Valid: !expire.IsZero(),
+		},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n == 0 {
+		return simplekv.KeyNotFoundError(key)
+	}
+	return nil
+}
+
+// Delete implements simplekv.Store.Delete by deleting the row with
+// the given key from the table.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(s.delete(ctx, s.db, key), errgo.Is(simplekv.ErrNotFound))
+}
+
+// delete is like Delete except that it operates on a general queryer
+// value.
+func (s *kvStore) delete(ctx context.Context, q queryer, key string) error {
+	res, err := s.driver.exec(ctx, q, tmplDeleteKey, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+		Key:        key,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if n == 0 {
+		return simplekv.KeyNotFoundError(key)
+	}
+	return nil
+}
+
+// Txn implements simplekv.Transactor.Txn using a database
+// transaction. Rows read in the transaction are locked until it
+// commits or rolls back. Keys that do not exist cannot be locked, so
+// if another client creates such a key concurrently, whichever write
+// commits last wins.
+func (s *kvStore) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		return errgo.Mask(f(&txn{
+			ctx: ctx,
+			s:   s,
+			tx:  tx,
+		}), errgo.Any)
+	})
+}
+
+// txn implements simplekv.Tx.
+type txn struct {
+	ctx context.Context
+	s   *kvStore
+	tx  *sql.Tx
+}
+
+// Get implements simplekv.Tx.Get.
+func (tx *txn) Get(key string) ([]byte, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	v, err := tx.s.get(tx.ctx, tx.tx, key, true)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+	}
+	return v, nil
+}
+
+// Set implements simplekv.Tx.Set.
+func (tx *txn) Set(key string, value []byte, expire time.Time) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	if err := simplekv.CheckValue(value, tx.s.driver.maxValueLen); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return errgo.Mask(tx.s.set(tx.ctx, tx.tx, key, value, expire, 0, false))
+}
+
+// Delete implements simplekv.Tx.Delete.
+func (tx *txn) Delete(key string) error {
+	if err := simplekv.CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	return errgo.Mask(tx.s.delete(tx.ctx, tx.tx, key), errgo.Is(simplekv.ErrNotFound))
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead using
+// a read-only REPEATABLE READ transaction, so all reads in f see the
+// table as it was when the first of them was made.
+func (s *kvStore) SnapshotRead(ctx context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Nothing is written in the transaction, so it is always
+	// rolled back.
+	defer tx.Rollback()
+	return errgo.Mask(f(snapshotTx{
+		ctx: ctx,
+		s:   s,
+		tx:  tx,
+	}), errgo.Any)
+}
+
+// snapshotTx implements simplekv.SnapshotTx.
+type snapshotTx struct {
+	ctx context.Context
+	s   *kvStore
+	tx  *sql.Tx
+}
+
+// Get implements simplekv.SnapshotTx.Get.
+func (tx snapshotTx) Get(key string) ([]byte, error) {
+	if err := simplekv.CheckKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrKeyTooLarge))
+	}
+	v, err := tx.s.get(tx.ctx, tx.tx, key, false)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrNotFound))
+	}
+	return v, nil
+}
+
+// KeysWithPrefix implements simplekv.SnapshotTx.KeysWithPrefix.
+func (tx snapshotTx) KeysWithPrefix(prefix string) ([]string, error) {
+	keys, err := tx.s.keysWithPrefix(tx.ctx, tx.tx, prefix)
+	return keys, errgo.Mask(err)
+}
+
+// Keys implements simplekv.KeyLister.Keys.
 func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
-	rows, err := s.driver.query(ctx, s.db, tmplListKeys, &keyValueParams{
+	return s.keys(ctx, s.db, tmplListKeys, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+	})
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	return s.keysWithPrefix(ctx, s.db, prefix)
+}
+
+// keysWithPrefix is like KeysWithPrefix except that it operates on a
+// general queryer value.
+func (s *kvStore) keysWithPrefix(ctx context.Context, q queryer, prefix string) ([]string, error) {
+	return s.keys(ctx, q, tmplListKeysWithPrefix, &keyValueParams{
 		argBuilder: s.driver.argBuilderFunc(),
 		TableName:  s.tableName,
+		Pattern:    s.driver.likePrefixPattern(prefix),
 	})
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePrefixPattern returns a LIKE pattern, using \ as the escape
+// character, that matches all strings with the given prefix.
+func (d *driver) likePrefixPattern(prefix string) string {
+	if d.likeEscaper != nil {
+		return d.likeEscaper.Replace(prefix) + "%"
+	}
+	return likeEscaper.Replace(prefix) + "%"
+}
+
+// keys returns the keys returned by the query in the given template.
+func (s *kvStore) keys(ctx context.Context, q queryer, tmplID tmplID, params *keyValueParams) ([]string, error) {
+	rows, err := s.driver.query(ctx, q, tmplID, params)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -179,12 +666,146 @@ func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
 	return keys, nil
 }
 
+// Count implements simplekv.Counter.Count.
+func (s *kvStore) Count(ctx context.Context) (int, error) {
+	return s.count(ctx, tmplCountKeys, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+	})
+}
+
+// CountWithPrefix implements simplekv.Counter.CountWithPrefix.
+func (s *kvStore) CountWithPrefix(ctx context.Context, prefix string) (int, error) {
+	return s.count(ctx, tmplCountKeysWithPrefix, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+		Pattern:    s.driver.likePrefixPattern(prefix),
+	})
+}
+
+// count returns the count returned by the query in the given template.
+func (s *kvStore) count(ctx context.Context, tmplID tmplID, params *keyValueParams) (int, error) {
+	row, err := s.driver.queryRow(ctx, s.db, tmplID, params)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	var n int
+	if err := row.Scan(&n); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return n, nil
+}
+
+// Iterate implements simplekv.Iterable.Iterate using a database
+// cursor.
+func (s *kvStore) Iterate(ctx context.Context, prefix string) (simplekv.Iterator, error) {
+	rows, err := s.driver.query(ctx, s.db, tmplIterate, &keyValueParams{
+		argBuilder: s.driver.argBuilderFunc(),
+		TableName:  s.tableName,
+		Pattern:    s.driver.likePrefixPattern(prefix),
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &iterator{
+		rows: rows,
+	}, nil
+}
+
+// iterator implements simplekv.Iterator using *sql.Rows.
+type iterator struct {
+	rows  *sql.Rows
+	key   string
+	value []byte
+	err   error
+}
+
+// Next implements simplekv.Iterator.Next.
+func (iter *iterator) Next() bool {
+	if iter.rows == nil {
+		return false
+	}
+	if !iter.rows.Next() {
+		iter.Close()
+		return false
+	}
+	iter.value = nil
+	if err := iter.rows.Scan(&iter.key, &iter.value); err != nil {
+		iter.err = errgo.Mask(err)
+		iter.Close()
+		return false
+	}
+	return true
+}
+
+// Key implements simplekv.Iterator.Key.
+func (iter *iterator) Key() string {
+	return iter.key
+}
+
+// Value implements simplekv.Iterator.Value.
+func (iter *iterator) Value() []byte {
+	return iter.value
+}
+
+// Err implements simplekv.Iterator.Err.
+func (iter *iterator) Err() error {
+	return iter.err
+}
+
+// Close implements simplekv.Iterator.Close.
+func (iter *iterator) Close() error {
+	if iter.rows == nil {
+		return iter.err
+	}
+	if err := iter.rows.Err(); err != nil && iter.err == nil {
+		iter.err = errgo.Mask(err)
+	}
+	if err := iter.rows.Close(); err != nil && iter.err == nil {
+		iter.err = errgo.Mask(err)
+	}
+	iter.rows = nil
+	return iter.err
+}
+
+// maxTxAttempts holds the maximum number of times withTx runs a
+// transaction that fails with a retryable error.
+const maxTxAttempts = 10
+
+// txRetryAfter holds the delay suggested to callers when a transaction
+// fails maxTxAttempts times.
+const txRetryAfter = 100 * time.Millisecond
+
 // withTx runs f in a new transaction. any error returned by f will not
-// have it's cause masked.
-func (s *kvStore) withTx(f func(*sql.Tx) error) error {
-	tx, err := s.db.Begin()
+// have it's cause masked. If the transaction fails with an error that
+// the driver reports as retryable, f is run again in a new
+// transaction, up to maxTxAttempts times in all, after which an error
+// with a *simplekv.ContentionError cause is returned. It is not run
+// again once the context is done.
+func (s *kvStore) withTx(ctx context.Context, f func(*sql.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := s.runTx(ctx, f)
+		if !s.driver.retryable(err) || ctx.Err() != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if attempt >= maxTxAttempts {
+			err := errgo.WithCausef(nil, &simplekv.ContentionError{
+				RetryAfter: txRetryAfter,
+				Attempts:   attempt,
+			}, "too many retryable transaction failures")
+			err.(*errgo.Err).SetLocation(0)
+			return err
+		}
+		s.logger.Debugf("retrying transaction after retryable error: %v", err)
+	}
+}
+
+// runTx runs f in a transaction, committing it if f succeeds and
+// rolling it back otherwise.
+func (s *kvStore) runTx(ctx context.Context, f func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, s.driver.txOptions)
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(context.Canceled), errgo.Is(context.DeadlineExceeded))
 	}
 	if err := f(tx); err != nil {
 		if err1 := tx.Rollback(); err1 != nil {
@@ -194,3 +815,7 @@ func (s *kvStore) withTx(f func(*sql.Tx) error) error {
 	}
 	return errgo.Mask(tx.Commit())
 }
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
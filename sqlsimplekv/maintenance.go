@@ -0,0 +1,331 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Action represents a maintenance action that can be run on a table
+// by RunMaintenance.
+type Action int
+
+const (
+	// DeleteExpired deletes the rows holding expired keys. With
+	// MySQL and CockroachDB, expired rows are otherwise only removed
+	// when their key is written again.
+	DeleteExpired Action = iota
+
+	// Vacuum runs VACUUM (ANALYZE) on the table, so that the space
+	// used by deleted and updated rows can be reused. It is only
+	// supported with Postgres.
+	Vacuum
+
+	// Optimize runs OPTIMIZE TABLE on the table, which rebuilds it
+	// to release unused space. It is only supported with MySQL and
+	// locks the table while it runs.
+	Optimize
+
+	// RebuildIndexes rebuilds all the indexes on the table with
+	// REINDEX TABLE CONCURRENTLY, including the key index with the
+	// "C" collation and any inline value index, so that writes are
+	// not blocked while it runs. It is only supported with Postgres
+	// 12 or later.
+	RebuildIndexes
+)
+
+// String implements fmt.Stringer.
+func (a Action) String() string {
+	switch a {
+	case DeleteExpired:
+		return "delete-expired"
+	case Vacuum:
+		return "vacuum"
+	case Optimize:
+		return "optimize"
+	case RebuildIndexes:
+		return "rebuild-indexes"
+	}
+	return "unknown"
+}
+
+// TableStats holds statistics about a table used by a store. Fields
+// that the database does not report are zero.
+type TableStats struct {
+	// Rows holds the estimated number of rows in the table,
+	// including expired ones.
+	Rows int64
+
+	// ExpiredRows holds the number of rows holding expired keys.
+	ExpiredRows int64
+
+	// DeadRows holds the estimated number of row versions left by
+	// updates and deletes that have not yet been vacuumed. It is
+	// only reported by Postgres.
+	DeadRows int64
+
+	// Bytes holds the space used by the table and its indexes.
+	Bytes int64
+
+	// FreeBytes holds the space allocated to the table but not used
+	// by any row. It is only reported by MySQL.
+	FreeBytes int64
+
+	// LastVacuum holds when the table was last vacuumed, manually
+	// or automatically. It is only reported by Postgres.
+	LastVacuum time.Time
+}
+
+// Recommendation holds a maintenance action recommended by
+// AdviseMaintenance.
+type Recommendation struct {
+	Action Action
+	Reason string
+}
+
+// MaintenanceReport holds the result of AdviseMaintenance.
+type MaintenanceReport struct {
+	Stats           TableStats
+	Recommendations []Recommendation
+}
+
+// Actions returns the actions recommended by the report, in the order
+// they should be run.
+func (r *MaintenanceReport) Actions() []Action {
+	actions := make([]Action, len(r.Recommendations))
+	for i, rec := range r.Recommendations {
+		actions[i] = rec.Action
+	}
+	return actions
+}
+
+const (
+	// maintenanceMinRows holds the number of expired or dead rows
+	// below which no maintenance is recommended.
+	maintenanceMinRows = 1000
+
+	// maintenanceMaxRatio holds the fraction of the table that can
+	// be taken by expired or dead rows, or free space, before
+	// maintenance is recommended.
+	maintenanceMaxRatio = 0.2
+
+	// maintenanceMinFreeBytes holds the amount of free space below
+	// which OPTIMIZE TABLE is not recommended.
+	maintenanceMinFreeBytes = 64 << 20
+
+	// deleteExpiredBatchSize holds the maximum number of rows
+	// deleted by each statement run by DeleteExpired, so that
+	// locks are not held for long.
+	deleteExpiredBatchSize = 10000
+)
+
+// AdviseMaintenance reads statistics about the table with the given
+// name used by a store created with NewStore with the same driver name,
+// and recommends maintenance actions for it. Tables holding many keys
+// with short expiry times bloat quickly: with Postgres, expired rows are
+// deleted on every insert, leaving dead rows behind until the table is
+// vacuumed, and with MySQL and CockroachDB they are only removed when
+// their key is written again.
+//
+// The statistics reported by the database are estimates, and may be
+// out of date if the table has not been analyzed recently.
+func AdviseMaintenance(ctx context.Context, driverName string, db *sql.DB, tableName string) (*MaintenanceReport, error) {
+	var (
+		stats TableStats
+		err   error
+	)
+	switch driverName {
+	case "postgres":
+		err = postgresTableStats(ctx, db, tableName, &stats)
+	case "mysql":
+		err = mysqlTableStats(ctx, db, tableName, &stats)
+	case "cockroach":
+		// CockroachDB garbage collects old row versions itself,
+		// so there are no dead rows to report.
+		err = db.QueryRowContext(ctx, `SELECT count(*) FROM `+tableName).Scan(&stats.Rows)
+		if err != nil {
+			err = errgo.Notef(err, "cannot count rows")
+		}
+	default:
+		return nil, errgo.Newf("unsupported database driver %q", driverName)
+	}
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot read table statistics", errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM `+tableName+` WHERE `+expiredCondition(driverName)).Scan(&stats.ExpiredRows); err != nil {
+		return nil, errgo.NoteMask(err, "cannot count expired rows", errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	r := &MaintenanceReport{
+		Stats: stats,
+	}
+	if exceeds(stats.ExpiredRows, stats.Rows) {
+		r.Recommendations = append(r.Recommendations, Recommendation{
+			Action: DeleteExpired,
+			Reason: fmt.Sprintf("%d of %d rows hold expired keys", stats.ExpiredRows, stats.Rows),
+		})
+	}
+	switch driverName {
+	case "postgres":
+		switch {
+		case exceeds(stats.DeadRows, stats.Rows+stats.DeadRows):
+			r.Recommendations = append(r.Recommendations, Recommendation{
+				Action: Vacuum,
+				Reason: fmt.Sprintf("%d dead rows, %d live rows", stats.DeadRows, stats.Rows),
+			})
+		case len(r.Recommendations) > 0:
+			r.Recommendations = append(r.Recommendations, Recommendation{
+				Action: Vacuum,
+				Reason: "deleted rows are not reused until the table is vacuumed",
+			})
+		}
+	case "mysql":
+		if stats.FreeBytes >= maintenanceMinFreeBytes && float64(stats.FreeBytes) > maintenanceMaxRatio*float64(stats.Bytes+stats.FreeBytes) {
+			r.Recommendations = append(r.Recommendations, Recommendation{
+				Action: Optimize,
+				Reason: fmt.Sprintf("%d of %d allocated bytes are free", stats.FreeBytes, stats.Bytes+stats.FreeBytes),
+			})
+		}
+	}
+	return r, nil
+}
+
+// exceeds reports whether n rows out of total are enough to warrant
+// maintenance.
+func exceeds(n, total int64) bool {
+	return n >= maintenanceMinRows && float64(n) > maintenanceMaxRatio*float64(total)
+}
+
+// RunMaintenance runs the given maintenance actions, in order, on the
+// table with the given name used by a store created with NewStore with
+// the same driver name. The actions recommended by AdviseMaintenance
+// can be obtained with MaintenanceReport.Actions.
+//
+// The table remains usable while DeleteExpired, Vacuum and
+// RebuildIndexes run; Optimize blocks writes to it.
+func RunMaintenance(ctx context.Context, driverName string, db *sql.DB, tableName string, actions []Action) error {
+	switch driverName {
+	case "postgres", "mysql", "cockroach":
+	default:
+		return errgo.Newf("unsupported database driver %q", driverName)
+	}
+	for _, a := range actions {
+		var err error
+		switch {
+		case a == DeleteExpired:
+			err = deleteExpired(ctx, driverName, db, tableName)
+		case a == Vacuum && driverName == "postgres":
+			_, err = db.ExecContext(ctx, `VACUUM (ANALYZE) `+tableName)
+		case a == Optimize && driverName == "mysql":
+			err = mysqlOptimize(ctx, db, tableName)
+		case a == RebuildIndexes && driverName == "postgres":
+			_, err = db.ExecContext(ctx, `REINDEX TABLE CONCURRENTLY `+tableName)
+		default:
+			return errgo.Newf("maintenance action %v not supported with database driver %q", a, driverName)
+		}
+		if err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot run %v on table %s", a, tableName), errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+	}
+	return nil
+}
+
+// expiredCondition returns the condition that selects expired rows
+// with the given driver.
+func expiredCondition(driverName string) string {
+	if driverName == "mysql" {
+		return `expire <= UTC_TIMESTAMP(3)`
+	}
+	return `expire <= now()`
+}
+
+// deleteExpired deletes the expired rows from the table in batches.
+func deleteExpired(ctx context.Context, driverName string, db *sql.DB, tableName string) error {
+	var stmt string
+	if driverName == "mysql" {
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE %s LIMIT %d`, tableName, expiredCondition(driverName), deleteExpiredBatchSize)
+	} else {
+		stmt = fmt.Sprintf(`DELETE FROM %s WHERE key IN (SELECT key FROM %s WHERE %s LIMIT %d)`, tableName, tableName, expiredCondition(driverName), deleteExpiredBatchSize)
+	}
+	for {
+		res, err := db.ExecContext(ctx, stmt)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if n < deleteExpiredBatchSize {
+			return nil
+		}
+	}
+}
+
+// postgresTableStats reads the statistics of the given table from
+// pg_stat_user_tables.
+func postgresTableStats(ctx context.Context, db *sql.DB, tableName string, stats *TableStats) error {
+	var lastVacuum, lastAutovacuum sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT n_live_tup, n_dead_tup, last_vacuum, last_autovacuum,
+			pg_total_relation_size(relid)
+		FROM pg_stat_user_tables
+		WHERE schemaname = current_schema() AND relname = $1`,
+		strings.ToLower(tableName),
+	).Scan(&stats.Rows, &stats.DeadRows, &lastVacuum, &lastAutovacuum, &stats.Bytes)
+	if err == sql.ErrNoRows {
+		return errgo.Newf("table %s does not exist", tableName)
+	}
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	stats.LastVacuum = lastVacuum.Time
+	if lastAutovacuum.Time.After(stats.LastVacuum) {
+		stats.LastVacuum = lastAutovacuum.Time
+	}
+	return nil
+}
+
+// mysqlTableStats reads the statistics of the given table from
+// information_schema.tables.
+func mysqlTableStats(ctx context.Context, db *sql.DB, tableName string, stats *TableStats) error {
+	err := db.QueryRowContext(ctx, `
+		SELECT table_rows, data_length + index_length, data_free
+		FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = ?`,
+		tableName,
+	).Scan(&stats.Rows, &stats.Bytes, &stats.FreeBytes)
+	if err == sql.ErrNoRows {
+		return errgo.Newf("table %s does not exist", tableName)
+	}
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	return nil
+}
+
+// mysqlOptimize runs OPTIMIZE TABLE on the given table. The statement
+// reports failure as a result row rather than an error.
+func mysqlOptimize(ctx context.Context, db *sql.DB, tableName string) error {
+	rows, err := db.QueryContext(ctx, `OPTIMIZE TABLE `+tableName)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, op, msgType, msg string
+		if err := rows.Scan(&table, &op, &msgType, &msg); err != nil {
+			return errgo.Mask(err)
+		}
+		if strings.EqualFold(msgType, "error") {
+			return errgo.New(msg)
+		}
+	}
+	return errgo.Mask(rows.Err())
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+func TestMySQLAdviseMaintenance(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	rec.rows = func(query string) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "information_schema.tables"):
+			return [][]driver.Value{{int64(10000), int64(200 << 20), int64(100 << 20)}}
+		case strings.Contains(query, "WHERE expire <="):
+			return [][]driver.Value{{int64(5000)}}
+		}
+		return nil
+	}
+	r, err := sqlsimplekv.AdviseMaintenance(ctx, "mysql", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Stats, qt.DeepEquals, sqlsimplekv.TableStats{
+		Rows:        10000,
+		ExpiredRows: 5000,
+		Bytes:       200 << 20,
+		FreeBytes:   100 << 20,
+	})
+	c.Assert(r.Actions(), qt.DeepEquals, []sqlsimplekv.Action{sqlsimplekv.DeleteExpired, sqlsimplekv.Optimize})
+	c.Assert(r.Recommendations[0].Reason, qt.Equals, "5000 of 10000 rows hold expired keys")
+
+	// A small number of expired rows is not worth deleting.
+	rec.rows = func(query string) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "information_schema.tables"):
+			return [][]driver.Value{{int64(1000), int64(1 << 20), int64(0)}}
+		case strings.Contains(query, "WHERE expire <="):
+			return [][]driver.Value{{int64(500)}}
+		}
+		return nil
+	}
+	r, err = sqlsimplekv.AdviseMaintenance(ctx, "mysql", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Recommendations, qt.HasLen, 0)
+
+	rec.rows = nil
+	_, err = sqlsimplekv.AdviseMaintenance(ctx, "mysql", db, "missing")
+	c.Assert(err, qt.ErrorMatches, `cannot read table statistics: table missing does not exist`)
+
+	_, err = sqlsimplekv.AdviseMaintenance(ctx, "sqlite", db, "kv")
+	c.Assert(err, qt.ErrorMatches, `unsupported database driver "sqlite"`)
+}
+
+func TestMySQLRunMaintenance(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	err := sqlsimplekv.RunMaintenance(ctx, "mysql", db, "kv", []sqlsimplekv.Action{sqlsimplekv.DeleteExpired, sqlsimplekv.Optimize})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"DELETE FROM kv WHERE expire <= UTC_TIMESTAMP(3) LIMIT 10000",
+		"OPTIMIZE TABLE kv",
+	})
+
+	rec.reset()
+	rec.rows = func(query string) [][]driver.Value {
+		return [][]driver.Value{{"db.kv", "optimize", "error", "table is locked"}}
+	}
+	err = sqlsimplekv.RunMaintenance(ctx, "mysql", db, "kv", []sqlsimplekv.Action{sqlsimplekv.Optimize})
+	c.Assert(err, qt.ErrorMatches, `cannot run optimize on table kv: table is locked`)
+
+	err = sqlsimplekv.RunMaintenance(ctx, "mysql", db, "kv", []sqlsimplekv.Action{sqlsimplekv.Vacuum})
+	c.Assert(err, qt.ErrorMatches, `maintenance action vacuum not supported with database driver "mysql"`)
+}
+
+func TestPostgresRunMaintenance(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	err := sqlsimplekv.RunMaintenance(ctx, "postgres", db, "kv", []sqlsimplekv.Action{sqlsimplekv.Vacuum, sqlsimplekv.RebuildIndexes})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"VACUUM (ANALYZE) kv",
+		"REINDEX TABLE CONCURRENTLY kv",
+	})
+
+	err = sqlsimplekv.RunMaintenance(ctx, "cockroach", db, "kv", []sqlsimplekv.Action{sqlsimplekv.RebuildIndexes})
+	c.Assert(err, qt.ErrorMatches, `maintenance action rebuild-indexes not supported with database driver "cockroach"`)
+}
+
+func TestPostgresMaintenance(t *testing.T) {
+	c := qt.New(t)
+	pg := newDatabase(c)
+	defer pg.Close()
+	ctx := context.Background()
+
+	_, err := sqlsimplekv.NewStore("postgres", pg.DB, "maint")
+	c.Assert(err, qt.Equals, nil)
+	// Insert the rows in a single statement so that the expire
+	// trigger does not delete them.
+	_, err = pg.DB.Exec(`
+		INSERT INTO maint (key, value, expire)
+		SELECT 'k' || i, '', $1 FROM generate_series(1, 2000) AS i`,
+		time.Now().Add(-time.Hour),
+	)
+	c.Assert(err, qt.Equals, nil)
+
+	r, err := sqlsimplekv.AdviseMaintenance(ctx, "postgres", pg.DB, "maint")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Stats.ExpiredRows, qt.Equals, int64(2000))
+	c.Assert(r.Actions(), qt.Contains, sqlsimplekv.DeleteExpired)
+	c.Assert(r.Actions(), qt.Contains, sqlsimplekv.Vacuum)
+
+	err = sqlsimplekv.RunMaintenance(ctx, "postgres", pg.DB, "maint", r.Actions())
+	c.Assert(err, qt.Equals, nil)
+	r, err = sqlsimplekv.AdviseMaintenance(ctx, "postgres", pg.DB, "maint")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(r.Stats.ExpiredRows, qt.Equals, int64(0))
+	c.Assert(r.Recommendations, qt.HasLen, 0)
+}
+
+func TestActionString(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(sqlsimplekv.DeleteExpired.String(), qt.Equals, "delete-expired")
+	c.Assert(sqlsimplekv.Vacuum.String(), qt.Equals, "vacuum")
+	c.Assert(sqlsimplekv.Optimize.String(), qt.Equals, "optimize")
+	c.Assert(sqlsimplekv.RebuildIndexes.String(), qt.Equals, "rebuild-indexes")
+	c.Assert(sqlsimplekv.Action(5).String(), qt.Equals, "unknown")
+}
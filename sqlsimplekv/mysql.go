@@ -0,0 +1,255 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// mysqlKey holds the quoted name of the key column; KEY is a reserved
+// word in MySQL.
+const mysqlKey = "`key`"
+
+// mysqlLive holds the condition that selects rows that have not
+// expired. Expiry times are stored in UTC.
+const mysqlLive = `(expire IS NULL OR expire > UTC_TIMESTAMP(3))`
+
+// mysqlInitTmpls holds the statements that create the table. Keys are
+// stored as binary strings so that they are compared and ordered
+// byte by byte, like the "C" collation used with Postgres.
+var mysqlInitTmpls = []string{`
+CREATE TABLE IF NOT EXISTS {{.TableName}} (
+	` + mysqlKey + ` VARBINARY(512) NOT NULL,
+	value LONGBLOB NOT NULL,
+	expire DATETIME(3) NULL,
+	PRIMARY KEY (` + mysqlKey + `),
+	INDEX {{.TableName}}_expire (expire)
+) ENGINE=InnoDB`,
+}
+
+var mysqlTmpls = [numTmpl]string{
+	tmplGetKeyValue: `
+		SELECT value FROM {{.TableName}}
+		WHERE ` + mysqlKey + `={{.Key | .Arg}} AND ` + mysqlLive,
+	tmplGetKeyValueForUpdate: `
+		SELECT value FROM {{.TableName}}
+		WHERE ` + mysqlKey + `={{.Key | .Arg}} AND ` + mysqlLive + `
+		FOR UPDATE`,
+	tmplKeyExists: `
+		SELECT 1 FROM {{.TableName}}
+		WHERE ` + mysqlKey + `={{.Key | .Arg}} AND ` + mysqlLive,
+	tmplInsertKeyValue: `
+		INSERT INTO {{.TableName}} (` + mysqlKey + `, value, expire)
+		VALUES ({{.Key | .Arg}}, {{.Value | .Arg}}, {{template "expire" .}})
+		{{if .Update}}ON DUPLICATE KEY UPDATE
+		value=VALUES(value), expire=VALUES(expire){{end}}
+		{{define "expire"}}{{if .TTL}}UTC_TIMESTAMP(6) + INTERVAL {{.TTL | .Arg}} MICROSECOND{{else}}{{.Expire | .Arg}}{{end}}{{end}}`,
+	tmplUpdateKeyValueIfEquals: `
+		UPDATE {{.TableName}}
+		SET value={{.Value | .Arg}}, expire={{.Expire | .Arg}}
+		WHERE ` + mysqlKey + `={{.Key | .Arg}} AND value={{.OldValue | .Arg}} AND ` + mysqlLive,
+	tmplTouchKey: `
+		UPDATE {{.TableName}} SET expire={{.Expire | .Arg}}
+		WHERE ` + mysqlKey + `={{.Key | .Arg}} AND ` + mysqlLive,
+	tmplListKeys: `
+		SELECT ` + mysqlKey + ` FROM {{.TableName}} WHERE ` + mysqlLive,
+	// Backslash is the default LIKE escape character in MySQL.
+	tmplListKeysWithPrefix: `
+		SELECT ` + mysqlKey + ` FROM {{.TableName}}
+		WHERE ` + mysqlKey + ` LIKE {{.Pattern | .Arg}} AND ` + mysqlLive,
+	tmplCountKeys: `
+		SELECT COUNT(*) FROM {{.TableName}} WHERE ` + mysqlLive,
+	tmplCountKeysWithPrefix: `
+		SELECT COUNT(*) FROM {{.TableName}}
+		WHERE ` + mysqlKey + ` LIKE {{.Pattern | .Arg}} AND ` + mysqlLive,
+	tmplIterate: `
+		SELECT ` + mysqlKey + `, value FROM {{.TableName}}
+		WHERE ` + mysqlKey + ` LIKE {{.Pattern | .Arg}} AND ` + mysqlLive + `
+		ORDER BY ` + mysqlKey,
+	tmplDeleteKey: `
+		DELETE FROM {{.TableName}}
+		WHERE ` + mysqlKey + `={{.Key | .Arg}} AND ` + mysqlLive,
+	tmplDeleteExpiredKey: `
+		DELETE FROM {{.TableName}}
+		WHERE ` + mysqlKey + `={{.Key | .Arg}} AND expire <= UTC_TIMESTAMP(3)`,
+}
+
+// mysqlPacketOverhead holds the space allowed in a MySQL packet for
+// everything in an insert statement other than the value.
+const mysqlPacketOverhead = 4096
+
+// newMySQLDriver creates a MySQL driver using the given DB. If
+// createSchema is true, the table is created if necessary; otherwise
+// it is expected to exist already and is validated. The time taken by
+// each step is logged to the given logger.
+func newMySQLDriver(ctx context.Context, db *sql.DB, tableName string, createSchema bool, logger simplekv.Logger) (*driver, error) {
+	start := time.Now()
+	if createSchema {
+		// MySQL commits DDL statements implicitly, so they are
+		// not run in a transaction.
+		if err := execSchema(ctx, db, mysqlInitTmpls, tableName, logger); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+	} else {
+		if err := validateMySQLSchema(ctx, db, tableName); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		logger.Debugf("validated schema of table %s in %v", tableName, time.Since(start))
+	}
+	// A value must fit in a single packet, along with the rest of
+	// the statement that writes it.
+	var maxPacket int
+	if err := db.QueryRowContext(ctx, `SELECT @@max_allowed_packet`).Scan(&maxPacket); err != nil {
+		return nil, errgo.NoteMask(err, "cannot read max_allowed_packet", errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	start = time.Now()
+	d := &driver{
+		argBuilderFunc: func() argBuilder {
+			return &mysqlArgBuilder{}
+		},
+		isDuplicate: mysqlIsDuplicate,
+		maxValueLen: maxPacket - mysqlPacketOverhead,
+		// In the default REPEATABLE READ isolation level, locking
+		// a key that does not exist takes a gap lock, so two
+		// concurrent updates that create the same key deadlock.
+		// In READ COMMITTED the second insert fails with a
+		// duplicate key error instead, and the update is retried.
+		txOptions: &sql.TxOptions{
+			Isolation: sql.LevelReadCommitted,
+		},
+		deleteExpiredOnInsert: true,
+	}
+	for i, t := range mysqlTmpls {
+		if err := d.parseTemplate(tmplID(i), t); err != nil {
+			return nil, errgo.Notef(err, "cannot parse template %v", t)
+		}
+	}
+	logger.Debugf("parsed %d statement templates in %v", len(mysqlTmpls), time.Since(start))
+	return d, nil
+}
+
+// mysqlColumns holds the columns expected in the table, and their
+// types as reported by information_schema.
+var mysqlColumns = []struct {
+	name     string
+	dataType string
+	nullable bool
+}{
+	{"key", "varbinary", false},
+	{"value", "longblob", false},
+	{"expire", "datetime", true},
+}
+
+// validateMySQLSchema checks that the table created by mysqlInitTmpls
+// exists with the expected definition. If it does not, it returns an
+// error listing all the differences.
+func validateMySQLSchema(ctx context.Context, db *sql.DB, table string) error {
+	var problems []string
+
+	type column struct {
+		dataType string
+		nullable bool
+	}
+	columns := make(map[string]column)
+	rows, err := db.QueryContext(ctx, `
+		SELECT column_name, data_type, is_nullable = 'YES'
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ?`, table)
+	if err != nil {
+		return errgo.Notef(err, "cannot read table columns")
+	}
+	for rows.Next() {
+		var name string
+		var c column
+		if err := rows.Scan(&name, &c.dataType, &c.nullable); err != nil {
+			rows.Close()
+			return errgo.Notef(err, "cannot read table columns")
+		}
+		columns[strings.ToLower(name)] = c
+	}
+	if err := rows.Close(); err != nil {
+		return errgo.Notef(err, "cannot read table columns")
+	}
+	if len(columns) == 0 {
+		return errgo.Newf("table %s does not exist", table)
+	}
+	for _, want := range mysqlColumns {
+		got, ok := columns[want.name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("missing column %q", want.name))
+		case strings.ToLower(got.dataType) != want.dataType:
+			problems = append(problems, fmt.Sprintf("column %q has type %s, want %s", want.name, got.dataType, want.dataType))
+		case got.nullable != want.nullable:
+			problems = append(problems, fmt.Sprintf("column %q has wrong nullability", want.name))
+		}
+	}
+
+	indexes := make(map[string]string)
+	rows, err = db.QueryContext(ctx, `
+		SELECT index_name, GROUP_CONCAT(column_name ORDER BY seq_in_index)
+		FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = ?
+		GROUP BY index_name`, table)
+	if err != nil {
+		return errgo.Notef(err, "cannot read table indexes")
+	}
+	for rows.Next() {
+		var name, columns string
+		if err := rows.Scan(&name, &columns); err != nil {
+			rows.Close()
+			return errgo.Notef(err, "cannot read table indexes")
+		}
+		indexes[name] = strings.ToLower(columns)
+	}
+	if err := rows.Close(); err != nil {
+		return errgo.Notef(err, "cannot read table indexes")
+	}
+	if indexes["PRIMARY"] != "key" {
+		problems = append(problems, "missing primary key on key")
+	}
+	if indexes[table+"_expire"] != "expire" {
+		problems = append(problems, fmt.Sprintf("missing index %s_expire", table))
+	}
+	if len(problems) > 0 {
+		return errgo.Newf("table %s does not match the expected schema: %s", table, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// mysqlDuplicateEntry holds the MySQL error number for a duplicate key.
+const mysqlDuplicateEntry = 1062
+
+// mysqlIsDuplicate reports whether err is a MySQL duplicate key error.
+// Errors are recognised by the Number field of the *MySQLError type
+// used by github.com/go-sql-driver/mysql, so that this package does
+// not depend on a particular driver implementation.
+func mysqlIsDuplicate(err error) bool {
+	n, ok := errorNumber(err)
+	return ok && n == mysqlDuplicateEntry
+}
+
+// mysqlArgBuilder implements an argBuilder that produces "?"
+// placeholders.
+type mysqlArgBuilder struct {
+	args_ []interface{}
+}
+
+// Arg implements argbuilder.Arg.
+func (b *mysqlArgBuilder) Arg(a interface{}) string {
+	b.args_ = append(b.args_, a)
+	return "?"
+}
+
+// args implements argbuilder.args.
+func (b *mysqlArgBuilder) args() []interface{} {
+	return b.args_
+}
@@ -0,0 +1,26 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build mysql
+// +build mysql
+
+package sqlsimplekv_test
+
+import (
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/juju/simplekv/simplekvtest"
+)
+
+// TestMySQLStore runs the store tests against the MySQL database
+// named by $SIMPLEKV_MYSQL_DSN, which must set clientFoundRows=true,
+// for example:
+//
+//	SIMPLEKV_MYSQL_DSN='root:password@tcp(localhost:3306)/simplekv?clientFoundRows=true' \
+//		go test -tags mysql -run TestMySQLStore
+func TestMySQLStore(t *testing.T) {
+	db := openServerDB(t, "mysql", "SIMPLEKV_MYSQL_DSN")
+	simplekvtest.TestStore(t, newServerStoreFunc(t, "mysql", db))
+}
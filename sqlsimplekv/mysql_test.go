@@ -0,0 +1,307 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+// These tests check the statements sent for each operation using a
+// database/sql driver that records them, so that they run without a
+// MySQL server. TestMySQLStore in mysql_server_test.go runs the store
+// tests against a real server when one is available.
+
+func TestMySQLNewStore(t *testing.T) {
+	c := qt.New(t)
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	kv, err := sqlsimplekv.NewStore("mysql", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.HasLen, 1)
+	c.Assert(rec.statements()[0], qt.Matches, "(?s)CREATE TABLE IF NOT EXISTS kv \\(.*`key` VARBINARY\\(512\\) NOT NULL.*")
+	c.Assert(simplekv.MaxValueLen(kv), qt.Equals, 64<<20-4096)
+
+	_, err = sqlsimplekv.NewStore("mysql", db, "kv", sqlsimplekv.WithPermissionCheck())
+	c.Assert(err, qt.ErrorMatches, `permission check not supported with database driver "mysql"`)
+
+	_, err = sqlsimplekv.NewStore("sqlite", db, "kv")
+	c.Assert(err, qt.ErrorMatches, `unsupported database driver "sqlite"`)
+}
+
+func TestMySQLStatements(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+	kv, err := sqlsimplekv.NewStore("mysql", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+
+	rec.reset()
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"SELECT value FROM kv WHERE `key`=? AND (expire IS NULL OR expire > UTC_TIMESTAMP(3))",
+	})
+	c.Assert(rec.args(), qt.DeepEquals, [][]driver.Value{{"k"}})
+
+	rec.reset()
+	expire := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = kv.Set(ctx, "k", []byte("v"), expire)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"INSERT INTO kv (`key`, value, expire) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value=VALUES(value), expire=VALUES(expire)",
+	})
+	c.Assert(rec.args(), qt.DeepEquals, [][]driver.Value{{"k", []byte("v"), expire}})
+
+	// Creating a key removes any expired row with the same key
+	// first, and does not overwrite a live one.
+	rec.reset()
+	err = simplekv.SetKeyOnce(ctx, kv, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"BEGIN READ COMMITTED",
+		"SELECT value FROM kv WHERE `key`=? AND (expire IS NULL OR expire > UTC_TIMESTAMP(3)) FOR UPDATE",
+		"DELETE FROM kv WHERE `key`=? AND expire <= UTC_TIMESTAMP(3)",
+		"INSERT INTO kv (`key`, value, expire) VALUES (?, ?, ?)",
+		"COMMIT",
+	})
+
+	rec.reset()
+	_, err = kv.(simplekv.Iterable).Iterate(ctx, "a_")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"SELECT `key`, value FROM kv WHERE `key` LIKE ? AND (expire IS NULL OR expire > UTC_TIMESTAMP(3)) ORDER BY `key`",
+	})
+	c.Assert(rec.args(), qt.DeepEquals, [][]driver.Value{{`a\_%`}})
+}
+
+func TestMySQLDuplicateKey(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+	kv, err := sqlsimplekv.NewStore("mysql", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+
+	rec.execErr = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") {
+			return &MySQLError{Number: 1062, Message: "Duplicate entry 'k' for key 'PRIMARY'"}
+		}
+		return nil
+	}
+	err = kv.(simplekv.CompareAndSwapper).SetIfEquals(ctx, "k", nil, []byte("v"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+}
+
+func TestMySQLWithoutSchemaCreation(t *testing.T) {
+	c := qt.New(t)
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	_, err := sqlsimplekv.NewStore("mysql", db, "kv", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: table kv does not exist`)
+
+	rec.rows = func(query string) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "information_schema.columns"):
+			return [][]driver.Value{
+				{"key", "varchar", int64(0)},
+				{"value", "longblob", int64(0)},
+			}
+		case strings.Contains(query, "information_schema.statistics"):
+			return [][]driver.Value{
+				{"PRIMARY", "key"},
+			}
+		}
+		return nil
+	}
+	_, err = sqlsimplekv.NewStore("mysql", db, "kv", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: table kv does not match the expected schema: column "key" has type varchar, want varbinary; missing column "expire"; missing index kv_expire`)
+}
+
+// MySQLError has the same form as the error type used by
+// github.com/go-sql-driver/mysql.
+type MySQLError struct {
+	Number  uint16
+	Message string
+}
+
+func (e *MySQLError) Error() string {
+	return e.Message
+}
+
+// newRecordingDB returns a database that records the statements run
+// on it.
+func newRecordingDB() (*sql.DB, *recorder) {
+	rec := &recorder{}
+	return sql.OpenDB(rec), rec
+}
+
+// recorder implements driver.Connector, driver.Driver and driver.Conn
+// by recording each statement, normalizing its white space. Queries
+// return the rows returned by the rows function; execs return the
+// error returned by the execErr function or report one affected row.
+type recorder struct {
+	mu      sync.Mutex
+	stmts   []string
+	args_   [][]driver.Value
+	rows    func(query string) [][]driver.Value
+	execErr func(query string) error
+}
+
+func (r *recorder) record(query string, args []driver.NamedValue) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	query = strings.Join(strings.Fields(query), " ")
+	r.stmts = append(r.stmts, query)
+	vals := make([]driver.Value, len(args))
+	for i, a := range args {
+		vals[i] = a.Value
+	}
+	r.args_ = append(r.args_, vals)
+	return query
+}
+
+func (r *recorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stmts, r.args_ = nil, nil
+}
+
+func (r *recorder) statements() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stmts
+}
+
+// args returns the arguments of the recorded statements that had any.
+func (r *recorder) args() [][]driver.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var args [][]driver.Value
+	for _, a := range r.args_ {
+		if len(a) > 0 {
+			args = append(args, a)
+		}
+	}
+	return args
+}
+
+func (r *recorder) Connect(context.Context) (driver.Conn, error) {
+	return r, nil
+}
+
+func (r *recorder) Driver() driver.Driver {
+	return r
+}
+
+func (r *recorder) Open(string) (driver.Conn, error) {
+	return r, nil
+}
+
+func (r *recorder) Prepare(query string) (driver.Stmt, error) {
+	return nil, errgo.New("prepared statements not supported")
+}
+
+func (r *recorder) Close() error {
+	return nil
+}
+
+func (r *recorder) Begin() (driver.Tx, error) {
+	return r.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (r *recorder) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	stmt := "BEGIN"
+	switch sql.IsolationLevel(opts.Isolation) {
+	case sql.LevelReadCommitted:
+		stmt += " READ COMMITTED"
+	case sql.LevelRepeatableRead:
+		stmt += " REPEATABLE READ"
+	}
+	r.record(stmt, nil)
+	return r, nil
+}
+
+func (r *recorder) Commit() error {
+	r.record("COMMIT", nil)
+	return nil
+}
+
+func (r *recorder) Rollback() error {
+	r.record("ROLLBACK", nil)
+	return nil
+}
+
+func (r *recorder) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query = r.record(query, args)
+	if r.execErr != nil {
+		if err := r.execErr(query); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (r *recorder) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if query == "SELECT @@max_allowed_packet" {
+		return &rows{
+			columns: []string{"@@max_allowed_packet"},
+			rows:    [][]driver.Value{{int64(64 << 20)}},
+		}, nil
+	}
+	query = r.record(query, args)
+	var result [][]driver.Value
+	if r.rows != nil {
+		result = r.rows(query)
+	}
+	columns := []string{"c0"}
+	if len(result) > 0 {
+		columns = make([]string, len(result[0]))
+		for i := range columns {
+			columns[i] = "c" + string(rune('0'+i))
+		}
+	}
+	return &rows{
+		columns: columns,
+		rows:    result,
+	}, nil
+}
+
+// rows implements driver.Rows.
+type rows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -5,22 +5,28 @@ package sqlsimplekv
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/lib/pq"
-	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
 )
 
-const postgresInitTmpl = `
+// postgresInitTmpls holds the statements that create the table and
+// associated objects. They are run in order in a single transaction.
+var postgresInitTmpls = []string{`
 CREATE TABLE IF NOT EXISTS {{.TableName}} ( 
 	key TEXT NOT NULL,
 	value BYTEA NOT NULL,
 	expire TIMESTAMP WITH TIME ZONE,
 	UNIQUE (key)
-);
-
+)`, `
 CREATE OR REPLACE FUNCTION {{.TableName}}_expire_fn() RETURNS trigger
 LANGUAGE plpgsql
 AS $$
@@ -28,62 +34,397 @@ AS $$
 		DELETE FROM {{.TableName}} WHERE expire < NOW();
 		RETURN NEW;
 	END;
-$$;
-
-CREATE INDEX IF NOT EXISTS {{.TableName}}_expire ON {{.TableName}} (expire);
-DROP TRIGGER IF EXISTS {{.TableName}}_expire_tr ON {{.TableName}};
+$$`, `
+CREATE INDEX IF NOT EXISTS {{.TableName}}_expire ON {{.TableName}} (expire)`, `
+DROP TRIGGER IF EXISTS {{.TableName}}_expire_tr ON {{.TableName}}`, `
 CREATE TRIGGER {{.TableName}}_expire_tr
    BEFORE INSERT ON {{.TableName}}
-   EXECUTE PROCEDURE {{.TableName}}_expire_fn();
-`
+   EXECUTE PROCEDURE {{.TableName}}_expire_fn()`,
+}
+
+// postgresIndexTmpls holds the statements that create the indexes that
+// may take a long time to build on an existing table. They are run in
+// order after postgresInitTmpls, outside a transaction, so that the
+// indexes can be built concurrently without blocking writes to the
+// table. If a build fails, Postgres leaves an invalid index behind,
+// which must be dropped by hand before it can be built again.
+//
+// The key index uses the "C" collation, so that it can be used both
+// for the LIKE prefix matches and for ordering keys byte by byte.
+var postgresIndexTmpls = []string{`
+CREATE INDEX CONCURRENTLY IF NOT EXISTS {{.TableName}}_key_c ON {{.TableName}} (key COLLATE "C")`,
+}
+
+// postgresInlineIndexTmpl holds the statement that creates the
+// covering index used by WithInlineValueIndex. The maximum value length
+// is part of the index name, so that changing it creates a new index
+// rather than leaving one with a different predicate in place.
+var postgresInlineIndexTmpl = `
+CREATE INDEX CONCURRENTLY IF NOT EXISTS {{.TableName}}_key_inline_{{.InlineValueLen}} ON {{.TableName}} (key)
+	INCLUDE (value, expire) WHERE octet_length(value) <= {{.InlineValueLen}}`
 
 var postgresTmpls = [numTmpl]string{
+	// When the inline value index is in use, small values are
+	// looked up first with a query that matches the index predicate,
+	// so that it can be satisfied by an index-only scan; LIMIT 1
+	// stops the second query from running if the first finds a row.
+	// The length is written into the query rather than passed as an
+	// argument, because the planner only uses a partial index when
+	// the predicate is known when the query is planned.
 	tmplGetKeyValue: `
+		{{if .InlineValueLen}}
+		(SELECT value FROM {{.TableName}}
+		WHERE key={{.Key | .Arg}} AND octet_length(value) <= {{.InlineValueLen}} AND (expire IS NULL OR expire > now()))
+		UNION ALL
+		(SELECT value FROM {{.TableName}}
+		WHERE key={{.Key | .Arg}} AND octet_length(value) > {{.InlineValueLen}} AND (expire IS NULL OR expire > now()))
+		LIMIT 1
+		{{else}}
 		SELECT value FROM {{.TableName}}
-		WHERE key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())`,
+		WHERE key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())
+		{{end}}`,
 	tmplGetKeyValueForUpdate: `
 		SELECT value FROM {{.TableName}}
 		WHERE key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())
 		FOR UPDATE`,
+	tmplKeyExists: `
+		SELECT 1 FROM {{.TableName}}
+		WHERE key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())`,
 	tmplInsertKeyValue: `
 		INSERT INTO {{.TableName}} (key, value, expire)
-		VALUES ({{.Key | .Arg}}, {{.Value | .Arg}}, {{.Expire | .Arg}})
+		VALUES ({{.Key | .Arg}}, {{.Value | .Arg}}, {{template "expire" .}})
 		{{if .Update}}ON CONFLICT (key) DO UPDATE
-		SET value={{.Value | .Arg}}, expire={{.Expire | .Arg}}{{end}}`,
+		SET value={{.Value | .Arg}}, expire={{template "expire" .}}{{end}}
+		{{define "expire"}}{{if .TTL}}date_trunc('milliseconds', now() + {{.TTL | .Arg}}::double precision * interval '1 microsecond'){{else}}{{.Expire | .Arg}}{{end}}{{end}}`,
+	tmplUpdateKeyValueIfEquals: `
+		UPDATE {{.TableName}}
+		SET value={{.Value | .Arg}}, expire={{.Expire | .Arg}}
+		WHERE key={{.Key | .Arg}} AND value={{.OldValue | .Arg}} AND (expire IS NULL OR expire > now())`,
+	tmplTouchKey: `
+		UPDATE {{.TableName}} SET expire={{.Expire | .Arg}}
+		WHERE key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())`,
 	tmplListKeys: `
 		SELECT DISTINCT key FROM {{.TableName}} WHERE (expire IS NULL OR expire > now())
 	`,
+	tmplListKeysWithPrefix: `
+		SELECT DISTINCT key FROM {{.TableName}}
+		WHERE key COLLATE "C" LIKE {{.Pattern | .Arg}} ESCAPE '\' AND (expire IS NULL OR expire > now())`,
+	tmplCountKeys: `
+		SELECT COUNT(*) FROM {{.TableName}} WHERE (expire IS NULL OR expire > now())`,
+	tmplCountKeysWithPrefix: `
+		SELECT COUNT(*) FROM {{.TableName}}
+		WHERE key COLLATE "C" LIKE {{.Pattern | .Arg}} ESCAPE '\' AND (expire IS NULL OR expire > now())`,
+	tmplIterate: `
+		SELECT key, value FROM {{.TableName}}
+		WHERE key COLLATE "C" LIKE {{.Pattern | .Arg}} ESCAPE '\' AND (expire IS NULL OR expire > now())
+		ORDER BY key COLLATE "C"`,
+	tmplDeleteKey: `
+		DELETE FROM {{.TableName}}
+		WHERE key={{.Key | .Arg}} AND (expire IS NULL OR expire > now())`,
+	// This is only used with CockroachDB; with Postgres, the expire
+	// trigger removes expired rows before each insert.
+	tmplDeleteExpiredKey: `
+		DELETE FROM {{.TableName}}
+		WHERE key={{.Key | .Arg}} AND expire <= now()`,
 }
 
+// postgresMaxValueLen holds the maximum length of a value. Postgres
+// limits a field to 1GiB, but byte values are sent hex-encoded,
+// doubling their size in the protocol message, which has the same
+// limit.
+const postgresMaxValueLen = 500 << 20
+
 // newPostgresDriver creates a postgres driver using the given DB.
-func newPostgresDriver(db *sql.DB, tableName string) (*driver, error) {
-	tmpl, err := template.New("").Parse(postgresInitTmpl)
-	if err != nil {
-		return nil, errgo.Mask(err)
-	}
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, keyValueParams{
-		TableName: tableName,
-	}); err != nil {
-		return nil, errgo.Mask(err)
-	}
-	if _, err := db.Exec(buf.String()); err != nil {
-		return nil, errgo.Mask(err)
+// If createSchema is true, the table and associated objects are
+// created if necessary; otherwise they are expected to exist already
+// and are validated. The time taken by each step is logged to the
+// given logger.
+func newPostgresDriver(ctx context.Context, db *sql.DB, tableName string, createSchema bool, inlineValueLen int, logger simplekv.Logger) (*driver, error) {
+	start := time.Now()
+	if createSchema {
+		if err := createPostgresSchema(ctx, db, tableName, inlineValueLen, logger); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+	} else {
+		if err := validatePostgresSchema(ctx, db, tableName, postgresSchema{
+			indexes:        postgresIndexes,
+			trigger:        true,
+			inlineValueLen: inlineValueLen,
+		}); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		logger.Debugf("validated schema of table %s in %v", tableName, time.Since(start))
 	}
+	start = time.Now()
 	d := &driver{
 		argBuilderFunc: func() argBuilder {
 			return &postgresArgBuilder{}
 		},
 		isDuplicate: postgresIsDuplicate,
+		maxValueLen: postgresMaxValueLen,
 	}
 	for i, t := range postgresTmpls {
 		if err := d.parseTemplate(tmplID(i), t); err != nil {
 			return nil, errgo.Notef(err, "cannot parse template %v", t)
 		}
 	}
+	logger.Debugf("parsed %d statement templates in %v", len(postgresTmpls), time.Since(start))
 	return d, nil
 }
 
+// createPostgresSchema runs the statements in postgresInitTmpls in a
+// single transaction and then those in postgresIndexTmpls, logging the
+// time taken by each one. If inlineValueLen is non-zero, the inline
+// value index is created too.
+func createPostgresSchema(ctx context.Context, db *sql.DB, tableName string, inlineValueLen int, logger simplekv.Logger) error {
+	params := keyValueParams{
+		TableName:      tableName,
+		InlineValueLen: inlineValueLen,
+	}
+	n := 0
+	exec := func(execer interface {
+		ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	}, t string) error {
+		tmpl, err := template.New("").Parse(t)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, params); err != nil {
+			return errgo.Mask(err)
+		}
+		start := time.Now()
+		if _, err := execer.ExecContext(ctx, buf.String()); err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot run schema statement %d", n), errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		logger.Debugf("schema statement %d took %v: %s", n, time.Since(start), firstLine(buf.String()))
+		n++
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	defer tx.Rollback()
+	for _, t := range postgresInitTmpls {
+		if err := exec(tx, t); err != nil {
+			return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	tmpls := postgresIndexTmpls
+	if inlineValueLen > 0 {
+		tmpls = append(tmpls[:len(tmpls):len(tmpls)], postgresInlineIndexTmpl)
+	}
+	for _, t := range tmpls {
+		if err := exec(db, t); err != nil {
+			return errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+	}
+	return nil
+}
+
+// firstLine returns the first non-empty line of the given statement,
+// for use in log messages.
+func firstLine(stmt string) string {
+	stmt = strings.TrimSpace(stmt)
+	if i := strings.IndexByte(stmt, '\n'); i >= 0 {
+		stmt = stmt[:i]
+	}
+	return strings.TrimSpace(stmt)
+}
+
+// postgresColumns holds the columns expected in the table, and their
+// types as reported by information_schema.
+var postgresColumns = []struct {
+	name     string
+	dataType string
+	nullable bool
+}{
+	{"key", "text", false},
+	{"value", "bytea", false},
+	{"expire", "timestamp with time zone", true},
+}
+
+// postgresIndexes holds the suffixes of the names of the indexes
+// expected on the table, in addition to the unique index on key.
+var postgresIndexes = []string{
+	"_expire",
+	"_key_c",
+}
+
+// postgresSchema describes the objects that validatePostgresSchema
+// expects to find in addition to the table and its unique index on key.
+type postgresSchema struct {
+	// indexes holds the suffixes of the names of the other indexes
+	// on the table.
+	indexes []string
+
+	// trigger holds whether the expire trigger is expected.
+	trigger bool
+
+	// inlineValueLen holds the maximum value length of the inline
+	// value index, or zero if it is not expected.
+	inlineValueLen int
+}
+
+// validatePostgresSchema checks that the table and associated objects
+// described by schema exist with the expected definitions. If they do
+// not, it returns an error listing all the differences.
+func validatePostgresSchema(ctx context.Context, db *sql.DB, tableName string, schema postgresSchema) error {
+	// Unquoted identifiers are folded to lower case by Postgres.
+	table := strings.ToLower(tableName)
+	var problems []string
+
+	type column struct {
+		dataType string
+		nullable bool
+	}
+	columns := make(map[string]column)
+	rows, err := db.QueryContext(ctx, `
+		SELECT column_name, data_type, is_nullable = 'YES'
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1`, table)
+	if err != nil {
+		return errgo.Notef(err, "cannot read table columns")
+	}
+	for rows.Next() {
+		var name string
+		var c column
+		if err := rows.Scan(&name, &c.dataType, &c.nullable); err != nil {
+			rows.Close()
+			return errgo.Notef(err, "cannot read table columns")
+		}
+		columns[name] = c
+	}
+	if err := rows.Close(); err != nil {
+		return errgo.Notef(err, "cannot read table columns")
+	}
+	if len(columns) == 0 {
+		return errgo.Newf("table %s does not exist", table)
+	}
+	for _, want := range postgresColumns {
+		got, ok := columns[want.name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("missing column %q", want.name))
+		case got.dataType != want.dataType:
+			problems = append(problems, fmt.Sprintf("column %q has type %s, want %s", want.name, got.dataType, want.dataType))
+		case got.nullable != want.nullable:
+			problems = append(problems, fmt.Sprintf("column %q has wrong nullability", want.name))
+		}
+	}
+
+	indexes := make(map[string]string)
+	rows, err = db.QueryContext(ctx, `
+		SELECT indexname, indexdef FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename = $1`, table)
+	if err != nil {
+		return errgo.Notef(err, "cannot read table indexes")
+	}
+	for rows.Next() {
+		var name, def string
+		if err := rows.Scan(&name, &def); err != nil {
+			rows.Close()
+			return errgo.Notef(err, "cannot read table indexes")
+		}
+		indexes[name] = def
+	}
+	if err := rows.Close(); err != nil {
+		return errgo.Notef(err, "cannot read table indexes")
+	}
+	hasUnique := false
+	for _, def := range indexes {
+		// CockroachDB includes the sort order in the definition.
+		if strings.HasPrefix(def, "CREATE UNIQUE INDEX") && (strings.HasSuffix(def, "(key)") || strings.HasSuffix(def, "(key ASC)")) {
+			hasUnique = true
+		}
+	}
+	if !hasUnique {
+		problems = append(problems, "missing unique index on key")
+	}
+	for _, suffix := range schema.indexes {
+		if _, ok := indexes[table+suffix]; !ok {
+			problems = append(problems, fmt.Sprintf("missing index %s", table+suffix))
+		}
+	}
+	if schema.inlineValueLen > 0 {
+		name := fmt.Sprintf("%s_key_inline_%d", table, schema.inlineValueLen)
+		if _, ok := indexes[name]; !ok {
+			problems = append(problems, fmt.Sprintf("missing index %s", name))
+		}
+	}
+
+	if schema.trigger {
+		var n int
+		if err := db.QueryRowContext(ctx, `
+			SELECT count(*) FROM information_schema.triggers
+			WHERE event_object_schema = current_schema() AND event_object_table = $1 AND trigger_name = $2`,
+			table, table+"_expire_tr",
+		).Scan(&n); err != nil {
+			return errgo.Notef(err, "cannot read table triggers")
+		}
+		if n == 0 {
+			problems = append(problems, fmt.Sprintf("missing trigger %s_expire_tr", table))
+		}
+	}
+	if len(problems) > 0 {
+		return errgo.Newf("table %s does not match the expected schema: %s", table, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// postgresTablePrivileges holds the privileges needed on the table
+// by the statements in postgresTmpls.
+var postgresTablePrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE"}
+
+// checkPostgresPermissions checks that the current user has the
+// privileges needed to use the given table and, if createSchema is
+// true, to create the table and associated objects. If any are missing,
+// it returns an error listing all of them.
+func checkPostgresPermissions(ctx context.Context, db *sql.DB, tableName string, createSchema bool) error {
+	table := strings.ToLower(tableName)
+	var exists, owner bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT to_regclass($1) IS NOT NULL,
+			COALESCE(pg_has_role((SELECT relowner FROM pg_class WHERE oid = to_regclass($1)), 'USAGE'), false)`,
+		table,
+	).Scan(&exists, &owner); err != nil {
+		return errgo.NoteMask(err, "cannot check privileges", errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+	}
+	var missing []string
+	if exists {
+		for _, priv := range postgresTablePrivileges {
+			var ok bool
+			if err := db.QueryRowContext(ctx, `SELECT has_table_privilege($1, $2)`, table, priv).Scan(&ok); err != nil {
+				return errgo.NoteMask(err, "cannot check privileges", errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+			}
+			if !ok {
+				missing = append(missing, fmt.Sprintf("%s on table %s", priv, table))
+			}
+		}
+		if createSchema && !owner {
+			// Only the owner of a table can create indexes and
+			// triggers on it.
+			missing = append(missing, fmt.Sprintf("ownership of table %s", table))
+		}
+	} else if createSchema {
+		var ok bool
+		if err := db.QueryRowContext(ctx, `SELECT has_schema_privilege(current_schema(), 'CREATE')`).Scan(&ok); err != nil {
+			return errgo.NoteMask(err, "cannot check privileges", errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		if !ok {
+			missing = append(missing, "CREATE on the current schema")
+		}
+	}
+	if len(missing) > 0 {
+		return errgo.Newf("database user lacks required privileges: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
 func postgresIsDuplicate(err error) bool {
 	if pqerr, ok := err.(*pq.Error); ok && pqerr.Code.Name() == "unique_violation" {
 		return true
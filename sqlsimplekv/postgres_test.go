@@ -4,19 +4,34 @@
 package sqlsimplekv_test
 
 import (
+	"context"
 	"fmt"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	qt "github.com/frankban/quicktest"
 	"github.com/juju/postgrestest"
 	errgo "gopkg.in/errgo.v1"
 
 	"github.com/juju/simplekv"
-	"github.com/juju/simplekv/internal/simplekvtest"
+	"github.com/juju/simplekv/simplekvtest"
 	"github.com/juju/simplekv/sqlsimplekv"
 )
 
 func TestPostgresStore(t *testing.T) {
+	pg := newDatabase(t)
+	defer pg.Close()
+	simplekvtest.TestStore(t, newStoreFunc(pg))
+}
+
+func BenchmarkPostgresStoreUpdate(b *testing.B) {
+	pg := newDatabase(b)
+	defer pg.Close()
+	simplekvtest.BenchmarkUpdate(b, newStoreFunc(pg))
+}
+
+func newDatabase(t testing.TB) *postgrestest.DB {
 	pg, err := postgrestest.New()
 	if err != nil {
 		if errgo.Cause(err) == postgrestest.ErrDisabled {
@@ -24,10 +39,144 @@ func TestPostgresStore(t *testing.T) {
 		}
 		t.Fatal(err)
 	}
-	defer pg.Close()
+	return pg
+}
+
+// newStoreFunc returns a function that creates a new store
+// in a new table in pg each time it is called.
+func newStoreFunc(pg *postgrestest.DB, opts ...sqlsimplekv.Option) func() (simplekv.Store, error) {
 	var id int32
-	simplekvtest.TestStore(t, func() (_ simplekv.Store, err error) {
+	return func() (_ simplekv.Store, err error) {
 		table := fmt.Sprintf("test%d", atomic.AddInt32(&id, 1))
-		return sqlsimplekv.NewStore("postgres", pg.DB, table)
+		return sqlsimplekv.NewStore("postgres", pg.DB, table, opts...)
+	}
+}
+
+func TestPostgresStoreWithInlineValueIndex(t *testing.T) {
+	pg := newDatabase(t)
+	defer pg.Close()
+	simplekvtest.TestStore(t, newStoreFunc(pg, sqlsimplekv.WithInlineValueIndex(64)))
+}
+
+func TestInlineValueIndex(t *testing.T) {
+	c := qt.New(t)
+	pg := newDatabase(c)
+	defer pg.Close()
+	ctx := context.Background()
+
+	kv, err := sqlsimplekv.NewStore("postgres", pg.DB, "inline", sqlsimplekv.WithInlineValueIndex(8))
+	c.Assert(err, qt.Equals, nil)
+	var def string
+	err = pg.DB.QueryRow(`SELECT indexdef FROM pg_indexes WHERE indexname = 'inline_key_inline_8'`).Scan(&def)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(def, qt.Matches, `.*INCLUDE \(value, expire\) WHERE \(octet_length\(value\) <= 8\)`)
+
+	// Both small and large values can be read.
+	for _, v := range []string{"small", "a value longer than eight bytes"} {
+		err := kv.Set(ctx, v, []byte(v), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+		got, err := kv.Get(ctx, v)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(got), qt.Equals, v)
+	}
+	_, err = kv.Get(ctx, "missing")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+
+	_, err = sqlsimplekv.NewStore("postgres", pg.DB, "inline", sqlsimplekv.WithInlineValueIndex(8), sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.Equals, nil)
+	_, err = sqlsimplekv.NewStore("postgres", pg.DB, "inline", sqlsimplekv.WithInlineValueIndex(16), sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: table inline does not match the expected schema: missing index inline_key_inline_16`)
+}
+
+func TestWithoutSchemaCreation(t *testing.T) {
+	c := qt.New(t)
+	pg := newDatabase(c)
+	defer pg.Close()
+
+	_, err := sqlsimplekv.NewStore("postgres", pg.DB, "validate", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: table validate does not exist`)
+
+	_, err = pg.DB.Exec(`CREATE TABLE validate (key TEXT NOT NULL, value TEXT, UNIQUE (key))`)
+	c.Assert(err, qt.Equals, nil)
+	_, err = sqlsimplekv.NewStore("postgres", pg.DB, "validate", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: table validate does not match the expected schema: column "value" has type text, want bytea; missing column "expire"; missing index validate_expire; missing index validate_key_c; missing trigger validate_expire_tr`)
+
+	_, err = sqlsimplekv.NewStore("postgres", pg.DB, "validate2")
+	c.Assert(err, qt.Equals, nil)
+	_, err = sqlsimplekv.NewStore("postgres", pg.DB, "validate2", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestSnapshotReadIsolation(t *testing.T) {
+	c := qt.New(t)
+	pg := newDatabase(c)
+	defer pg.Close()
+	ctx := context.Background()
+	kv, err := sqlsimplekv.NewStore("postgres", pg.DB, "snapshot")
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekv.SnapshotRead(ctx, kv, func(tx simplekv.SnapshotTx) error {
+		v, err := tx.Get("a")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, "1")
+
+		// Writes made after the snapshot was taken are not
+		// visible within it.
+		err = kv.Set(ctx, "a", []byte("2"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+		err = kv.Set(ctx, "b", []byte("3"), time.Time{})
+		c.Assert(err, qt.Equals, nil)
+
+		v, err = tx.Get("a")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, "1")
+		keys, err := tx.KeysWithPrefix("")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(keys, qt.DeepEquals, []string{"a"})
+		return nil
 	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(f string, a ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(f, a...))
+}
+
+func TestNewStoreContext(t *testing.T) {
+	c := qt.New(t)
+	pg := newDatabase(c)
+	defer pg.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := sqlsimplekv.NewStoreContext(ctx, "postgres", pg.DB, "cancelled")
+	c.Assert(errgo.Cause(err), qt.Equals, context.Canceled)
+
+	var logger recordingLogger
+	_, err = sqlsimplekv.NewStoreContext(context.Background(), "postgres", pg.DB, "timed", sqlsimplekv.WithLogger(&logger))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(logger.messages, qt.Not(qt.HasLen), 0)
+	c.Assert(logger.messages[0], qt.Matches, `schema statement 0 took .*: CREATE TABLE IF NOT EXISTS timed \(`)
+	c.Assert(logger.messages[len(logger.messages)-1], qt.Matches, `initialised table timed in .*`)
+}
+
+func TestWithPermissionCheck(t *testing.T) {
+	c := qt.New(t)
+	pg := newDatabase(c)
+	defer pg.Close()
+
+	// The test user owns everything it creates, so the check passes
+	// both before and after the table has been created.
+	_, err := sqlsimplekv.NewStore("postgres", pg.DB, "perms", sqlsimplekv.WithPermissionCheck())
+	c.Assert(err, qt.Equals, nil)
+	_, err = sqlsimplekv.NewStore("postgres", pg.DB, "perms", sqlsimplekv.WithPermissionCheck())
+	c.Assert(err, qt.Equals, nil)
+	_, err = sqlsimplekv.NewStore("postgres", pg.DB, "perms", sqlsimplekv.WithPermissionCheck(), sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.Equals, nil)
 }
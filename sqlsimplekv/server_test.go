@@ -0,0 +1,61 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build mysql || sqlserver
+// +build mysql sqlserver
+
+package sqlsimplekv_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+// The drivers for MySQL and SQL Server are not dependencies of this
+// module, so the tests that run against real servers are only built
+// with the mysql and sqlserver build tags, after adding the drivers
+// with go get. Each test is skipped unless an environment variable
+// holds the data source name of a database that it can create tables
+// in.
+
+// openServerDB opens the database whose data source name is held in
+// the given environment variable, skipping the test if it is not set.
+// The database is closed when the test completes.
+func openServerDB(t *testing.T, driverName, envVar string) *sql.DB {
+	dsn := os.Getenv(envVar)
+	if dsn == "" {
+		t.Skip(envVar + " not set")
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// newServerStoreFunc returns a function that creates a new store with
+// the given driver in a new table in db each time it is called. The
+// tables are dropped when the test completes.
+func newServerStoreFunc(t *testing.T, driverName string, db *sql.DB) func() (simplekv.Store, error) {
+	prefix := fmt.Sprintf("test%d_", time.Now().UnixNano())
+	var id int32
+	return func() (simplekv.Store, error) {
+		table := fmt.Sprintf("%s%d", prefix, atomic.AddInt32(&id, 1))
+		t.Cleanup(func() {
+			if _, err := db.Exec("DROP TABLE " + table); err != nil {
+				t.Logf("cannot drop table %s: %v", table, err)
+			}
+		})
+		return sqlsimplekv.NewStore(driverName, db, table)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// sqlserverKey holds the quoted name of the key column; KEY is a
+// reserved word in SQL Server.
+const sqlserverKey = "[key]"
+
+// sqlserverLive holds the condition that selects rows that have not
+// expired.
+const sqlserverLive = `(expire IS NULL OR expire > SYSDATETIMEOFFSET())`
+
+// sqlserverInitTmpls holds the statements that create the table. Keys
+// use a binary collation so that they are compared and ordered by code
+// point, which matches the byte order of their UTF-8 encoding. Index
+// keys are limited to 900 bytes in a clustered index but 1700 bytes in
+// a nonclustered one, so the primary key is nonclustered to allow keys
+// of simplekv.MaxKeyLen characters.
+var sqlserverInitTmpls = []string{`
+IF OBJECT_ID(N'{{.TableName}}', N'U') IS NULL
+CREATE TABLE {{.TableName}} (
+	` + sqlserverKey + ` NVARCHAR(512) COLLATE Latin1_General_100_BIN2 NOT NULL,
+	value VARBINARY(MAX) NOT NULL,
+	expire DATETIMEOFFSET(3) NULL,
+	CONSTRAINT {{.TableName}}_pk PRIMARY KEY NONCLUSTERED (` + sqlserverKey + `)
+)`, `
+IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE object_id = OBJECT_ID(N'{{.TableName}}') AND name = N'{{.TableName}}_expire')
+CREATE INDEX {{.TableName}}_expire ON {{.TableName}} (expire)`,
+}
+
+// sqlserverTmpls holds the statements used with SQL Server. DATEADD
+// only accepts an int, so TTLs are added as seconds and milliseconds
+// rather than microseconds.
+var sqlserverTmpls = [numTmpl]string{
+	tmplGetKeyValue: `
+		SELECT value FROM {{.TableName}}
+		WHERE ` + sqlserverKey + `={{.Key | .Arg}} AND ` + sqlserverLive,
+	// HOLDLOCK makes the lock cover the key even when there is no
+	// row for it, so that concurrent updates that create the same
+	// key wait for each other rather than failing.
+	tmplGetKeyValueForUpdate: `
+		SELECT value FROM {{.TableName}} WITH (UPDLOCK, ROWLOCK, HOLDLOCK)
+		WHERE ` + sqlserverKey + `={{.Key | .Arg}} AND ` + sqlserverLive,
+	tmplKeyExists: `
+		SELECT 1 FROM {{.TableName}}
+		WHERE ` + sqlserverKey + `={{.Key | .Arg}} AND ` + sqlserverLive,
+	tmplInsertKeyValue: `
+		{{if .Update}}
+		MERGE {{.TableName}} WITH (HOLDLOCK) AS t
+		USING (SELECT {{.Key | .Arg}} AS ` + sqlserverKey + `) AS s
+		ON t.` + sqlserverKey + ` = s.` + sqlserverKey + `
+		WHEN MATCHED THEN UPDATE SET value={{.Value | .Arg}}, expire={{template "expire" .}}
+		WHEN NOT MATCHED THEN INSERT (` + sqlserverKey + `, value, expire)
+		VALUES (s.` + sqlserverKey + `, {{.Value | .Arg}}, {{template "expire" .}});
+		{{else}}
+		INSERT INTO {{.TableName}} (` + sqlserverKey + `, value, expire)
+		VALUES ({{.Key | .Arg}}, {{.Value | .Arg}}, {{template "expire" .}})
+		{{end}}
+		{{define "expire"}}{{if .TTL}}DATEADD(millisecond, {{.TTL | .Arg}} % 1000000 / 1000, DATEADD(second, {{.TTL | .Arg}} / 1000000, SYSDATETIMEOFFSET())){{else}}{{.Expire | .Arg}}{{end}}{{end}}`,
+	tmplUpdateKeyValueIfEquals: `
+		UPDATE {{.TableName}}
+		SET value={{.Value | .Arg}}, expire={{.Expire | .Arg}}
+		WHERE ` + sqlserverKey + `={{.Key | .Arg}} AND value={{.OldValue | .Arg}} AND ` + sqlserverLive,
+	tmplTouchKey: `
+		UPDATE {{.TableName}} SET expire={{.Expire | .Arg}}
+		WHERE ` + sqlserverKey + `={{.Key | .Arg}} AND ` + sqlserverLive,
+	tmplListKeys: `
+		SELECT ` + sqlserverKey + ` FROM {{.TableName}} WHERE ` + sqlserverLive,
+	tmplListKeysWithPrefix: `
+		SELECT ` + sqlserverKey + ` FROM {{.TableName}}
+		WHERE ` + sqlserverKey + ` LIKE {{.Pattern | .Arg}} ESCAPE '\' AND ` + sqlserverLive,
+	tmplCountKeys: `
+		SELECT COUNT(*) FROM {{.TableName}} WHERE ` + sqlserverLive,
+	tmplCountKeysWithPrefix: `
+		SELECT COUNT(*) FROM {{.TableName}}
+		WHERE ` + sqlserverKey + ` LIKE {{.Pattern | .Arg}} ESCAPE '\' AND ` + sqlserverLive,
+	tmplIterate: `
+		SELECT ` + sqlserverKey + `, value FROM {{.TableName}}
+		WHERE ` + sqlserverKey + ` LIKE {{.Pattern | .Arg}} ESCAPE '\' AND ` + sqlserverLive + `
+		ORDER BY ` + sqlserverKey,
+	tmplDeleteKey: `
+		DELETE FROM {{.TableName}}
+		WHERE ` + sqlserverKey + `={{.Key | .Arg}} AND ` + sqlserverLive,
+	tmplDeleteExpiredKey: `
+		DELETE FROM {{.TableName}}
+		WHERE ` + sqlserverKey + `={{.Key | .Arg}} AND expire <= SYSDATETIMEOFFSET()`,
+}
+
+// sqlserverLikeEscaper escapes the characters that are special in SQL
+// Server LIKE patterns, which include character ranges in brackets.
+var sqlserverLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `[`, `\[`)
+
+// sqlserverMaxValueLen holds the maximum length of a value. SQL Server
+// limits VARBINARY(MAX) values to 2GiB.
+const sqlserverMaxValueLen = 1 << 30
+
+// newSQLServerDriver creates a SQL Server driver using the given DB.
+// If createSchema is true, the table and its index are created if
+// necessary; otherwise they are expected to exist already and are
+// validated. The time taken by each step is logged to the given
+// logger.
+func newSQLServerDriver(ctx context.Context, db *sql.DB, tableName string, createSchema bool, logger simplekv.Logger) (*driver, error) {
+	start := time.Now()
+	if createSchema {
+		if err := execSchema(ctx, db, sqlserverInitTmpls, tableName, logger); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+	} else {
+		if err := validateSQLServerSchema(ctx, db, tableName); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(context.DeadlineExceeded), errgo.Is(context.Canceled))
+		}
+		logger.Debugf("validated schema of table %s in %v", tableName, time.Since(start))
+	}
+	start = time.Now()
+	d := &driver{
+		argBuilderFunc: func() argBuilder {
+			return &sqlserverArgBuilder{}
+		},
+		isDuplicate:           sqlserverIsDuplicate,
+		isRetryable:           sqlserverIsDeadlock,
+		maxValueLen:           sqlserverMaxValueLen,
+		deleteExpiredOnInsert: true,
+		likeEscaper:           sqlserverLikeEscaper,
+	}
+	for i, t := range sqlserverTmpls {
+		if err := d.parseTemplate(tmplID(i), t); err != nil {
+			return nil, errgo.Notef(err, "cannot parse template %v", t)
+		}
+	}
+	logger.Debugf("parsed %d statement templates in %v", len(sqlserverTmpls), time.Since(start))
+	return d, nil
+}
+
+// sqlserverColumns holds the columns expected in the table, and their
+// types as reported by information_schema.
+var sqlserverColumns = []struct {
+	name     string
+	dataType string
+	nullable bool
+}{
+	{"key", "nvarchar", false},
+	{"value", "varbinary", false},
+	{"expire", "datetimeoffset", true},
+}
+
+// validateSQLServerSchema checks that the table created by
+// sqlserverInitTmpls exists with the expected definition. If it does
+// not, it returns an error listing all the differences.
+func validateSQLServerSchema(ctx context.Context, db *sql.DB, table string) error {
+	var problems []string
+
+	type column struct {
+		dataType string
+		nullable bool
+	}
+	columns := make(map[string]column)
+	rows, err := db.QueryContext(ctx, `
+		SELECT column_name, data_type, CASE is_nullable WHEN 'YES' THEN 1 ELSE 0 END
+		FROM information_schema.columns
+		WHERE table_schema = SCHEMA_NAME() AND table_name = @p1`, table)
+	if err != nil {
+		return errgo.Notef(err, "cannot read table columns")
+	}
+	for rows.Next() {
+		var name string
+		var c column
+		if err := rows.Scan(&name, &c.dataType, &c.nullable); err != nil {
+			rows.Close()
+			return errgo.Notef(err, "cannot read table columns")
+		}
+		columns[strings.ToLower(name)] = c
+	}
+	if err := rows.Close(); err != nil {
+		return errgo.Notef(err, "cannot read table columns")
+	}
+	if len(columns) == 0 {
+		return errgo.Newf("table %s does not exist", table)
+	}
+	for _, want := range sqlserverColumns {
+		got, ok := columns[want.name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("missing column %q", want.name))
+		case strings.ToLower(got.dataType) != want.dataType:
+			problems = append(problems, fmt.Sprintf("column %q has type %s, want %s", want.name, got.dataType, want.dataType))
+		case got.nullable != want.nullable:
+			problems = append(problems, fmt.Sprintf("column %q has wrong nullability", want.name))
+		}
+	}
+
+	var hasPrimary, hasExpire bool
+	rows, err = db.QueryContext(ctx, `
+		SELECT name, is_primary_key FROM sys.indexes
+		WHERE object_id = OBJECT_ID(@p1) AND name IS NOT NULL`, table)
+	if err != nil {
+		return errgo.Notef(err, "cannot read table indexes")
+	}
+	for rows.Next() {
+		var name string
+		var primary bool
+		if err := rows.Scan(&name, &primary); err != nil {
+			rows.Close()
+			return errgo.Notef(err, "cannot read table indexes")
+		}
+		hasPrimary = hasPrimary || primary
+		hasExpire = hasExpire || strings.EqualFold(name, table+"_expire")
+	}
+	if err := rows.Close(); err != nil {
+		return errgo.Notef(err, "cannot read table indexes")
+	}
+	if !hasPrimary {
+		problems = append(problems, "missing primary key on key")
+	}
+	if !hasExpire {
+		problems = append(problems, fmt.Sprintf("missing index %s_expire", table))
+	}
+	if len(problems) > 0 {
+		return errgo.Newf("table %s does not match the expected schema: %s", table, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+const (
+	// sqlserverUniqueIndexViolation and sqlserverPrimaryKeyViolation
+	// hold the SQL Server error numbers for a duplicate key.
+	sqlserverUniqueIndexViolation = 2601
+	sqlserverPrimaryKeyViolation  = 2627
+
+	// sqlserverDeadlockVictim holds the SQL Server error number for
+	// a transaction chosen as the victim of a deadlock.
+	sqlserverDeadlockVictim = 1205
+)
+
+// sqlserverIsDuplicate reports whether err is a SQL Server duplicate
+// key error. Errors are recognised by the Number field of the
+// mssql.Error type used by github.com/denisenkom/go-mssqldb.
+func sqlserverIsDuplicate(err error) bool {
+	n, ok := errorNumber(err)
+	return ok && (n == sqlserverPrimaryKeyViolation || n == sqlserverUniqueIndexViolation)
+}
+
+// sqlserverIsDeadlock reports whether err reports that the transaction
+// was rolled back to resolve a deadlock, in which case it can be
+// retried.
+func sqlserverIsDeadlock(err error) bool {
+	n, ok := errorNumber(err)
+	return ok && n == sqlserverDeadlockVictim
+}
+
+// sqlserverArgBuilder implements an argBuilder that produces
+// placeholders in the "@pn" format.
+type sqlserverArgBuilder struct {
+	args_ []interface{}
+}
+
+// Arg implements argbuilder.Arg.
+func (b *sqlserverArgBuilder) Arg(a interface{}) string {
+	b.args_ = append(b.args_, a)
+	return fmt.Sprintf("@p%d", len(b.args_))
+}
+
+// args implements argbuilder.args.
+func (b *sqlserverArgBuilder) args() []interface{} {
+	return b.args_
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package sqlsimplekv_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/sqlsimplekv"
+)
+
+// These tests use the recording driver from mysql_test.go, so that
+// they run without a SQL Server. TestSQLServerStore in
+// sqlserver_server_test.go runs the store tests against a real server
+// when one is available.
+
+func TestSQLServerNewStore(t *testing.T) {
+	c := qt.New(t)
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	kv, err := sqlsimplekv.NewStore("sqlserver", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.HasLen, 2)
+	c.Assert(rec.statements()[0], qt.Matches, `(?s)IF OBJECT_ID\(N'kv', N'U'\) IS NULL CREATE TABLE kv \(.*\[key\] NVARCHAR\(512\) COLLATE Latin1_General_100_BIN2 NOT NULL.*`)
+	c.Assert(rec.statements()[1], qt.Matches, `(?s)IF NOT EXISTS .* CREATE INDEX kv_expire ON kv \(expire\)`)
+	c.Assert(simplekv.MaxValueLen(kv), qt.Equals, 1<<30)
+
+	_, err = sqlsimplekv.NewStore("sqlserver", db, "kv", sqlsimplekv.WithPermissionCheck())
+	c.Assert(err, qt.ErrorMatches, `permission check not supported with database driver "sqlserver"`)
+}
+
+func TestSQLServerStatements(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+	kv, err := sqlsimplekv.NewStore("sqlserver", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+
+	rec.reset()
+	_, err = kv.Get(ctx, "k")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"SELECT value FROM kv WHERE [key]=@p1 AND (expire IS NULL OR expire > SYSDATETIMEOFFSET())",
+	})
+	c.Assert(rec.args(), qt.DeepEquals, [][]driver.Value{{"k"}})
+
+	rec.reset()
+	expire := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = kv.Set(ctx, "k", []byte("v"), expire)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"MERGE kv WITH (HOLDLOCK) AS t USING (SELECT @p1 AS [key]) AS s ON t.[key] = s.[key] " +
+			"WHEN MATCHED THEN UPDATE SET value=@p2, expire=@p3 " +
+			"WHEN NOT MATCHED THEN INSERT ([key], value, expire) VALUES (s.[key], @p4, @p5);",
+	})
+	c.Assert(rec.args(), qt.DeepEquals, [][]driver.Value{{"k", []byte("v"), expire, []byte("v"), expire}})
+
+	rec.reset()
+	err = kv.(simplekv.TTLSetter).SetTTL(ctx, "k", []byte("v"), 90*time.Second)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements()[0], qt.Contains, "expire=DATEADD(millisecond, @p3 % 1000000 / 1000, DATEADD(second, @p4 / 1000000, SYSDATETIMEOFFSET()))")
+
+	rec.reset()
+	err = simplekv.SetKeyOnce(ctx, kv, "k", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		"BEGIN",
+		"SELECT value FROM kv WITH (UPDLOCK, ROWLOCK, HOLDLOCK) WHERE [key]=@p1 AND (expire IS NULL OR expire > SYSDATETIMEOFFSET())",
+		"DELETE FROM kv WHERE [key]=@p1 AND expire <= SYSDATETIMEOFFSET()",
+		"INSERT INTO kv ([key], value, expire) VALUES (@p1, @p2, @p3)",
+		"COMMIT",
+	})
+
+	// Brackets are escaped in patterns, because they are special in
+	// SQL Server LIKE patterns.
+	rec.reset()
+	_, err = kv.(simplekv.Iterable).Iterate(ctx, "a[_")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(rec.statements(), qt.DeepEquals, []string{
+		`SELECT [key], value FROM kv WHERE [key] LIKE @p1 ESCAPE '\' AND (expire IS NULL OR expire > SYSDATETIMEOFFSET()) ORDER BY [key]`,
+	})
+	c.Assert(rec.args(), qt.DeepEquals, [][]driver.Value{{`a\[\_%`}})
+}
+
+func TestSQLServerErrors(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	db, rec := newRecordingDB()
+	defer db.Close()
+	kv, err := sqlsimplekv.NewStore("sqlserver", db, "kv")
+	c.Assert(err, qt.Equals, nil)
+
+	rec.execErr = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") {
+			return &SQLServerError{Number: 2627, Message: "Violation of PRIMARY KEY constraint"}
+		}
+		return nil
+	}
+	err = kv.(simplekv.CompareAndSwapper).SetIfEquals(ctx, "k", nil, []byte("v"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrConflict)
+
+	// Deadlock victims are retried.
+	deadlocks := 1
+	rec.execErr = func(query string) error {
+		if strings.HasPrefix(query, "INSERT") && deadlocks > 0 {
+			deadlocks--
+			return &SQLServerError{Number: 1205, Message: "Transaction was deadlocked"}
+		}
+		return nil
+	}
+	calls := 0
+	err = kv.Update(ctx, "k", time.Time{}, func(old []byte) ([]byte, error) {
+		calls++
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(calls, qt.Equals, 2)
+}
+
+func TestSQLServerWithoutSchemaCreation(t *testing.T) {
+	c := qt.New(t)
+	db, rec := newRecordingDB()
+	defer db.Close()
+
+	_, err := sqlsimplekv.NewStore("sqlserver", db, "kv", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: table kv does not exist`)
+
+	rec.rows = func(query string) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "information_schema.columns"):
+			return [][]driver.Value{
+				{"key", "nvarchar", int64(0)},
+				{"value", "varbinary", int64(0)},
+				{"expire", "datetime2", int64(1)},
+			}
+		case strings.Contains(query, "sys.indexes"):
+			return [][]driver.Value{
+				{"kv_pk", true},
+			}
+		}
+		return nil
+	}
+	_, err = sqlsimplekv.NewStore("sqlserver", db, "kv", sqlsimplekv.WithoutSchemaCreation())
+	c.Assert(err, qt.ErrorMatches, `cannot initialise database: table kv does not match the expected schema: column "expire" has type datetime2, want datetimeoffset; missing index kv_expire`)
+}
+
+// SQLServerError has the same form as the mssql.Error type used by
+// github.com/denisenkom/go-mssqldb.
+type SQLServerError struct {
+	Number  int32
+	Message string
+}
+
+func (e *SQLServerError) Error() string {
+	return e.Message
+}
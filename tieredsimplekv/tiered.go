@@ -0,0 +1,315 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package tieredsimplekv provides a simplekv.Store that keeps small
+// values in one store and large values in another. This allows, for
+// example, small values to be kept in a fast store with an expensive
+// per-byte cost while large values are kept in a store suited to
+// large blobs.
+//
+// Every key has an entry in the small store. For a small value, the
+// entry holds the value itself. For a large value, the entry holds the
+// key of a blob in the large store. Blobs are never modified: a new
+// value is always written to a new blob, and the old blob is deleted
+// once the entry in the small store no longer refers to it. If the
+// process stops between writing a blob and updating the small store,
+// or a blob cannot be deleted, the blob is left in the large store;
+// it will be garbage collected when it expires, if it has an expiry
+// time.
+package tieredsimplekv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+const (
+	// tagInline marks an entry in the small store that holds the
+	// value itself.
+	tagInline = 'v'
+
+	// tagBlob marks an entry in the small store that holds the key
+	// of a blob in the large store.
+	tagBlob = 'b'
+)
+
+// maxAttempts holds the number of times an operation is attempted
+// when a blob is deleted concurrently.
+const maxAttempts = 10
+
+// retryAfter holds the delay suggested to callers when an operation
+// fails after maxAttempts attempts.
+const retryAfter = 100 * time.Millisecond
+
+// errBlobMissing is the error cause used when an entry refers to a
+// blob that has been deleted, which happens when the entry is
+// changed concurrently.
+var errBlobMissing = errgo.New("blob missing")
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithLogger returns an option that makes the store log diagnostic
+// messages to the given logger, including failures to delete blobs
+// that are no longer used.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// NewStore returns a new Store that keeps values of up to threshold
+// bytes in small and larger values in large. The large store is
+// accessed while small's Update method is in progress, so small and
+// large must be different stores.
+//
+// If small implements simplekv.KeyLister, so does the returned store.
+func NewStore(small, large simplekv.Store, threshold int, opts ...Option) simplekv.Store {
+	s := &kvStore{
+		small:     small,
+		large:     large,
+		threshold: threshold,
+		logger:    nopLogger{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if _, ok := small.(simplekv.KeyLister); ok {
+		return &keyListerStore{s}
+	}
+	return s
+}
+
+type kvStore struct {
+	small     simplekv.Store
+	large     simplekv.Store
+	threshold int
+	logger    simplekv.Logger
+}
+
+// Context implements simplekv.Store.Context by returning a context
+// suitable for both the small and the large store.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	ctx, closeSmall := s.small.Context(ctx)
+	ctx, closeLarge := s.large.Context(ctx)
+	return ctx, func() {
+		closeLarge()
+		closeSmall()
+	}
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	for i := 0; i < maxAttempts; i++ {
+		entry, err := s.small.Get(ctx, key)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		v, err := s.value(ctx, entry)
+		if errgo.Cause(err) == errBlobMissing {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		return v, nil
+	}
+	return nil, simplekv.NewContentionError(retryAfter, "cannot get key %s: too many concurrent modifications", key)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	ok, err := s.small.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	err := s.update(ctx, key, expire, func(_ []byte) ([]byte, error) {
+		return value, nil
+	}, false)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	return errgo.Mask(s.update(ctx, key, expire, getVal, true), errgo.Any)
+}
+
+// update updates the entry for the given key. If needOld is false,
+// getVal is always passed nil, which avoids fetching the old value.
+func (s *kvStore) update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error), needOld bool) error {
+	for i := 0; i < maxAttempts; i++ {
+		// unused holds the blobs written by attempts of the update
+		// function whose results were discarded.
+		var unused []string
+		var oldEntry []byte
+		newBlob := ""
+		err := s.small.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+			if newBlob != "" {
+				unused = append(unused, newBlob)
+				newBlob = ""
+			}
+			oldEntry = old
+			var oldVal []byte
+			if needOld {
+				v, err := s.value(ctx, old)
+				if err != nil {
+					return nil, errgo.Mask(err, errgo.Any)
+				}
+				oldVal = v
+			}
+			newVal, err := getVal(oldVal)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Any)
+			}
+			if len(newVal) <= s.threshold {
+				return append([]byte{tagInline}, newVal...), nil
+			}
+			newBlob, err = s.writeBlob(ctx, newVal, expire)
+			if err != nil {
+				return nil, errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+			}
+			return append([]byte{tagBlob}, newBlob...), nil
+		})
+		if err != nil && newBlob != "" {
+			unused = append(unused, newBlob)
+		}
+		for _, blob := range unused {
+			s.deleteBlob(ctx, blob)
+		}
+		if errgo.Cause(err) == errBlobMissing {
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if blob, ok := blobKey(oldEntry); ok && blob != newBlob {
+			s.deleteBlob(ctx, blob)
+		}
+		return nil
+	}
+	return simplekv.NewContentionError(retryAfter, "cannot update key %s: too many concurrent modifications", key)
+}
+
+// Touch implements simplekv.Store.Touch by changing the expiry time
+// of the entry in the small store and of any blob it refers to.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	for i := 0; i < maxAttempts; i++ {
+		entry, err := s.small.Get(ctx, key)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if blob, ok := blobKey(entry); ok {
+			// Touch the blob first, so that it never expires
+			// before the entry that refers to it.
+			err := s.large.Touch(ctx, blob, expire)
+			if errgo.Cause(err) == simplekv.ErrNotFound {
+				// The entry has been changed concurrently.
+				continue
+			}
+			if err != nil {
+				return errgo.Notef(err, "cannot touch blob")
+			}
+		}
+		return errgo.Mask(s.small.Touch(ctx, key, expire), errgo.Any)
+	}
+	return simplekv.NewContentionError(retryAfter, "cannot touch key %s: too many concurrent modifications", key)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	entry, err := s.small.Get(ctx, key)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := s.small.Delete(ctx, key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if blob, ok := blobKey(entry); ok {
+		s.deleteBlob(ctx, blob)
+	}
+	return nil
+}
+
+// value returns the value held by the given entry from the small
+// store, fetching it from the large store if necessary. A nil entry
+// has a nil value.
+func (s *kvStore) value(ctx context.Context, entry []byte) ([]byte, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	if blob, ok := blobKey(entry); ok {
+		v, err := s.large.Get(ctx, blob)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			return nil, errgo.WithCausef(nil, errBlobMissing, "blob %s not found", blob)
+		}
+		if err != nil {
+			return nil, errgo.NoteMask(err, "cannot get blob", errgo.Any)
+		}
+		return v, nil
+	}
+	if len(entry) == 0 || entry[0] != tagInline {
+		return nil, errgo.Newf("invalid entry")
+	}
+	return entry[1:], nil
+}
+
+// blobKey returns the key of the blob referred to by the given entry,
+// and reports whether the entry refers to a blob.
+func blobKey(entry []byte) (string, bool) {
+	if len(entry) == 0 || entry[0] != tagBlob {
+		return "", false
+	}
+	return string(entry[1:]), true
+}
+
+// writeBlob writes the given value to a new blob in the large store
+// and returns its key.
+func (s *kvStore) writeBlob(ctx context.Context, value []byte, expire time.Time) (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	blob := hex.EncodeToString(buf[:])
+	if err := s.large.Set(ctx, blob, value, expire); err != nil {
+		return "", errgo.NoteMask(err, "cannot write blob", errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return blob, nil
+}
+
+// deleteBlob deletes the given blob from the large store. Failures
+// are logged rather than returned, because they only leave an unused
+// blob behind.
+func (s *kvStore) deleteBlob(ctx context.Context, blob string) {
+	if err := s.large.Delete(ctx, blob); err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		s.logger.Debugf("cannot delete unused blob %s: %v", blob, err)
+	}
+}
+
+// keyListerStore is used when the small store implements
+// simplekv.KeyLister.
+type keyListerStore struct {
+	*kvStore
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *keyListerStore) Keys(ctx context.Context) ([]string, error) {
+	keys, err := s.small.(simplekv.KeyLister).Keys(ctx)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix.
+func (s *keyListerStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.small.(simplekv.KeyLister).KeysWithPrefix(ctx, prefix)
+	return keys, errgo.Mask(err, errgo.Any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
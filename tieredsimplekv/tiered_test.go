@@ -0,0 +1,168 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package tieredsimplekv_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+	"github.com/juju/simplekv/tieredsimplekv"
+)
+
+func TestTieredStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		// Use a small threshold so that the tests exercise both
+		// stores.
+		return tieredsimplekv.NewStore(memsimplekv.NewStore(), memsimplekv.NewStore(), 6), nil
+	})
+}
+
+func TestValuesRouted(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	small := memsimplekv.NewStore().(simplekv.KeyLister)
+	large := memsimplekv.NewStore().(simplekv.KeyLister)
+	kv := tieredsimplekv.NewStore(small, large, 10)
+
+	err := kv.Set(ctx, "small", []byte("tiny"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "large", []byte(strings.Repeat("x", 11)), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snapshot(c, small), qt.HasLen, 2)
+	blobs := snapshot(c, large)
+	c.Assert(blobs, qt.HasLen, 1)
+
+	// Replacing a large value deletes the old blob.
+	err = kv.Update(ctx, "large", time.Time{}, func(old []byte) ([]byte, error) {
+		c.Check(string(old), qt.Equals, strings.Repeat("x", 11))
+		return []byte(strings.Repeat("y", 11)), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	newBlobs := snapshot(c, large)
+	c.Assert(newBlobs, qt.HasLen, 1)
+	c.Assert(newBlobs, qt.Not(qt.DeepEquals), blobs)
+
+	v, err := kv.Get(ctx, "large")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, strings.Repeat("y", 11))
+
+	// Replacing a large value with a small one deletes the blob.
+	err = kv.Set(ctx, "large", []byte("small now"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snapshot(c, large), qt.HasLen, 0)
+	v, err = kv.Get(ctx, "large")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "small now")
+
+	// Deleting a large value deletes the blob.
+	err = kv.Set(ctx, "large", []byte(strings.Repeat("z", 11)), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snapshot(c, large), qt.HasLen, 1)
+	err = kv.Delete(ctx, "large")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snapshot(c, large), qt.HasLen, 0)
+	c.Assert(snapshot(c, small), qt.HasLen, 1)
+}
+
+func TestMissingBlobReportsContention(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	large := memsimplekv.NewStore().(simplekv.KeyLister)
+	kv := tieredsimplekv.NewStore(memsimplekv.NewStore(), large, 10)
+	err := kv.Set(ctx, "large", []byte(strings.Repeat("x", 11)), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	// Remove the blob behind the store's back, so that every
+	// attempt to read it looks like a concurrent modification.
+	for blob := range snapshot(c, large) {
+		err := large.Delete(ctx, blob)
+		c.Assert(err, qt.Equals, nil)
+	}
+	_, err = kv.Get(ctx, "large")
+	c.Assert(err, qt.ErrorMatches, `cannot get key large: too many concurrent modifications`)
+	d, ok := simplekv.RetryAfter(err)
+	c.Assert(ok, qt.Equals, true)
+	c.Assert(d > 0, qt.Equals, true)
+}
+
+func TestLargeStoreErrorCauses(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	large := &faultyStore{Store: memsimplekv.NewStore()}
+	kv := tieredsimplekv.NewStore(memsimplekv.NewStore(), large, 10)
+	err := kv.Set(ctx, "large", []byte(strings.Repeat("x", 11)), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	large.getErr = simplekv.NewContentionError(time.Second, "blob store busy")
+	_, err = kv.Get(ctx, "large")
+	c.Assert(err, qt.ErrorMatches, `cannot get blob: blob store busy`)
+	c.Assert(simplekv.IsContention(errgo.Cause(err)), qt.Equals, true)
+	err = kv.Update(ctx, "large", time.Time{}, func(old []byte) ([]byte, error) {
+		return old, nil
+	})
+	c.Assert(simplekv.IsContention(errgo.Cause(err)), qt.Equals, true)
+
+	large.setErr = errgo.WithCausef(nil, simplekv.ErrValueTooLarge, "value too large")
+	err = kv.Set(ctx, "other", []byte(strings.Repeat("y", 11)), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `cannot write blob: value too large`)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+}
+
+// faultyStore returns the given errors, when set, from Get and Set.
+type faultyStore struct {
+	simplekv.Store
+	getErr error
+	setErr error
+}
+
+func (s *faultyStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if s.getErr != nil {
+		return nil, s.getErr
+	}
+	return s.Store.Get(ctx, key)
+}
+
+func (s *faultyStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if s.setErr != nil {
+		return s.setErr
+	}
+	return s.Store.Set(ctx, key, value, expire)
+}
+
+func TestClose(t *testing.T) {
+	c := qt.New(t)
+	small := &closerStore{Store: memsimplekv.NewStore()}
+	large := &closerStore{Store: memsimplekv.NewStore()}
+	kv := tieredsimplekv.NewStore(small, large, 10)
+	err := simplekv.Close(kv)
+	c.Assert(err, qt.Equals, nil)
+
+	// The wrapped stores are left for their creator to close.
+	c.Assert(small.closed, qt.Equals, false)
+	c.Assert(large.closed, qt.Equals, false)
+}
+
+type closerStore struct {
+	simplekv.Store
+	closed bool
+}
+
+func (s *closerStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func snapshot(c *qt.C, kv simplekv.KeyLister) map[string][]byte {
+	snap, err := simplekv.Snapshot(context.Background(), kv)
+	c.Assert(err, qt.Equals, nil)
+	return snap
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package timeseries stores time-bucketed values in a simplekv.Store.
+// Each (series, time) pair is mapped to the key of the bucket that
+// contains the time, and keys within a series sort in time order, so
+// that a range of buckets can be read with a single prefix iteration.
+// Buckets can be given an expiry time so that old data is removed
+// automatically.
+package timeseries
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// keyTimeFormat holds the format of the time in a bucket key. It has a
+// fixed width, so keys sort in time order.
+const keyTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*Store)
+
+// WithPrefix returns an option that makes the store prefix all keys
+// with the given string, so that the underlying store can be shared
+// with other data.
+func WithPrefix(prefix string) Option {
+	return func(s *Store) {
+		s.prefix = prefix
+	}
+}
+
+// WithRetention returns an option that makes buckets expire the given
+// duration after the end of the time they cover. By default buckets
+// do not expire.
+func WithRetention(d time.Duration) Option {
+	return func(s *Store) {
+		s.retention = d
+	}
+}
+
+// Store stores time-bucketed values for any number of series.
+type Store struct {
+	kv          simplekv.Store
+	granularity time.Duration
+	prefix      string
+	retention   time.Duration
+}
+
+// Bucket holds the value of a single bucket.
+type Bucket struct {
+	// Start holds the start time of the bucket. The bucket covers
+	// times from Start up to, but not including, Start plus the
+	// store's granularity.
+	Start time.Time
+
+	// Value holds the value stored in the bucket.
+	Value []byte
+}
+
+// NewStore returns a new Store that stores values in kv, in buckets
+// that each cover the given duration. Series names should not contain
+// a slash character.
+func NewStore(kv simplekv.Store, granularity time.Duration, opts ...Option) *Store {
+	s := &Store{
+		kv:          kv,
+		granularity: granularity,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// BucketStart returns the start time of the bucket that contains the
+// given time.
+func (s *Store) BucketStart(t time.Time) time.Time {
+	return t.UTC().Truncate(s.granularity)
+}
+
+// Key returns the key in the underlying store of the bucket in the
+// given series that contains the given time.
+func (s *Store) Key(series string, t time.Time) string {
+	return s.seriesPrefix(series) + s.BucketStart(t).Format(keyTimeFormat)
+}
+
+// seriesPrefix returns the prefix of all keys in the given series.
+func (s *Store) seriesPrefix(series string) string {
+	return s.prefix + series + "/"
+}
+
+// expire returns the expiry time of the bucket that contains the
+// given time.
+func (s *Store) expire(t time.Time) time.Time {
+	if s.retention <= 0 {
+		return time.Time{}
+	}
+	return s.BucketStart(t).Add(s.granularity + s.retention)
+}
+
+// Set sets the value of the bucket in the given series that contains
+// the given time.
+func (s *Store) Set(ctx context.Context, series string, t time.Time, value []byte) error {
+	err := s.kv.Set(ctx, s.Key(series, t), value, s.expire(t))
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Update updates the value of the bucket in the given series that
+// contains the given time, as described by simplekv.Store.Update.
+// This can be used to aggregate several values into a bucket.
+func (s *Store) Update(ctx context.Context, series string, t time.Time, getVal func(old []byte) ([]byte, error)) error {
+	err := s.kv.Update(ctx, s.Key(series, t), s.expire(t), getVal)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Range returns the buckets in the given series that cover times from
+// start up to, but not including, end, in time order. Buckets that
+// have never been set are omitted.
+//
+// The underlying store must implement simplekv.Iterable or
+// simplekv.KeyLister.
+func (s *Store) Range(ctx context.Context, series string, start, end time.Time) ([]Bucket, error) {
+	prefix := s.seriesPrefix(series)
+	from := s.Key(series, start)
+	switch kv := s.kv.(type) {
+	case simplekv.Iterable:
+		iter, err := kv.Iterate(ctx, prefix)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		defer iter.Close()
+		var buckets []Bucket
+		for iter.Next() {
+			if iter.Key() < from {
+				continue
+			}
+			b, ok := s.bucket(prefix, iter.Key())
+			if !ok {
+				continue
+			}
+			if !b.Start.Before(end) {
+				break
+			}
+			b.Value = append([]byte(nil), iter.Value()...)
+			buckets = append(buckets, b)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return buckets, nil
+	case simplekv.KeyLister:
+		keys, err := kv.KeysWithPrefix(ctx, prefix)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		sort.Strings(keys)
+		var buckets []Bucket
+		for _, key := range keys {
+			if key < from {
+				continue
+			}
+			b, ok := s.bucket(prefix, key)
+			if !ok {
+				continue
+			}
+			if !b.Start.Before(end) {
+				break
+			}
+			b.Value, err = kv.Get(ctx, key)
+			if errgo.Cause(err) == simplekv.ErrNotFound {
+				// The bucket has expired or been deleted since
+				// the keys were listed.
+				continue
+			}
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			buckets = append(buckets, b)
+		}
+		return buckets, nil
+	}
+	return nil, errgo.Newf("store does not support listing keys")
+}
+
+// bucket returns a bucket with the start time parsed from the given
+// key, which has the given series prefix. It reports whether the key
+// is a valid bucket key.
+func (s *Store) bucket(prefix, key string) (Bucket, bool) {
+	t, err := time.Parse(keyTimeFormat, strings.TrimPrefix(key, prefix))
+	if err != nil {
+		return Bucket{}, false
+	}
+	return Bucket{Start: t}, true
+}
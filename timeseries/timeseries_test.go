@@ -0,0 +1,123 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package timeseries_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/timeseries"
+)
+
+var t0 = time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestKey(t *testing.T) {
+	c := qt.New(t)
+	s := timeseries.NewStore(memsimplekv.NewStore(), time.Hour, timeseries.WithPrefix("metrics/"))
+	loc := time.FixedZone("test", 2*60*60)
+	c.Assert(s.Key("cpu", t0.Add(59*time.Minute).In(loc)), qt.Equals, "metrics/cpu/2018-01-01T12:00:00.000000000Z")
+	c.Assert(s.BucketStart(t0.Add(61*time.Minute)), qt.DeepEquals, t0.Add(time.Hour))
+}
+
+func TestRange(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	for _, test := range []struct {
+		about string
+		kv    simplekv.Store
+	}{{
+		about: "iterable",
+		kv:    memsimplekv.NewStore(),
+	}, {
+		about: "key lister",
+		kv:    keyListerStore{memsimplekv.NewStore().(simplekv.KeyLister)},
+	}} {
+		c.Run(test.about, func(c *qt.C) {
+			s := timeseries.NewStore(test.kv, time.Hour)
+			for i := 0; i < 5; i++ {
+				err := s.Set(ctx, "cpu", t0.Add(time.Duration(i)*time.Hour), []byte(strconv.Itoa(i)))
+				c.Assert(err, qt.Equals, nil)
+			}
+			// Another series with a name that is a prefix of the first.
+			err := s.Set(ctx, "cp", t0, []byte("other"))
+			c.Assert(err, qt.Equals, nil)
+
+			buckets, err := s.Range(ctx, "cpu", t0.Add(time.Hour+time.Minute), t0.Add(3*time.Hour))
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(buckets, qt.DeepEquals, []timeseries.Bucket{{
+				Start: t0.Add(time.Hour),
+				Value: []byte("1"),
+			}, {
+				Start: t0.Add(2 * time.Hour),
+				Value: []byte("2"),
+			}})
+
+			buckets, err = s.Range(ctx, "cp", t0, t0.Add(24*time.Hour))
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(buckets, qt.DeepEquals, []timeseries.Bucket{{
+				Start: t0,
+				Value: []byte("other"),
+			}})
+		})
+	}
+}
+
+func TestUpdateAggregates(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	s := timeseries.NewStore(memsimplekv.NewStore(), time.Minute)
+	for i := 0; i < 3; i++ {
+		err := s.Update(ctx, "requests", t0.Add(time.Duration(i)*time.Second), func(old []byte) ([]byte, error) {
+			n, _ := strconv.Atoi(string(old))
+			return []byte(strconv.Itoa(n + 1)), nil
+		})
+		c.Assert(err, qt.Equals, nil)
+	}
+	buckets, err := s.Range(ctx, "requests", t0, t0.Add(time.Minute))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(buckets, qt.DeepEquals, []timeseries.Bucket{{
+		Start: t0,
+		Value: []byte("3"),
+	}})
+}
+
+func TestRetention(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &fakeClock{now: t0}
+	kv := memsimplekv.NewStore(memsimplekv.WithClock(clock))
+	s := timeseries.NewStore(kv, time.Hour, timeseries.WithRetention(24*time.Hour))
+
+	err := s.Set(ctx, "cpu", t0.Add(30*time.Minute), []byte("x"))
+	c.Assert(err, qt.Equals, nil)
+
+	clock.now = t0.Add(25*time.Hour - time.Second)
+	_, err = kv.Get(ctx, s.Key("cpu", t0))
+	c.Assert(err, qt.Equals, nil)
+
+	clock.now = t0.Add(25 * time.Hour)
+	buckets, err := s.Range(ctx, "cpu", t0, t0.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(buckets, qt.HasLen, 0)
+}
+
+// keyListerStore hides all methods other than those in
+// simplekv.KeyLister.
+type keyListerStore struct {
+	simplekv.KeyLister
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// TTLSetter is implemented by stores that can compute an expiry time
+// from a duration themselves, for example using the clock of a
+// database server, which avoids problems caused by clock skew between
+// clients.
+type TTLSetter interface {
+	Store
+
+	// SetTTL is like Store.Set except that the entry expires after
+	// the given duration. If ttl is zero, the entry does not
+	// expire.
+	SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// UpdateTTL is like Store.Update except that the entry expires
+	// after the given duration. If ttl is zero, the entry does not
+	// expire.
+	UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error
+}
+
+// SetTTL sets the value of the given key so that it expires after the
+// given duration, as described by TTLSetter.SetTTL. If kv implements
+// TTLSetter, its SetTTL method is used; otherwise the expiry time is
+// computed from the local clock.
+func SetTTL(ctx context.Context, kv Store, key string, value []byte, ttl time.Duration) error {
+	if kv, ok := kv.(TTLSetter); ok {
+		return errgo.Mask(kv.SetTTL(ctx, key, value, ttl), errgo.Any)
+	}
+	return errgo.Mask(kv.Set(ctx, key, value, ExpireAfter(time.Now(), ttl)), errgo.Any)
+}
+
+// UpdateTTL updates the value of the given key so that it expires
+// after the given duration, as described by TTLSetter.UpdateTTL. If kv
+// implements TTLSetter, its UpdateTTL method is used; otherwise the
+// expiry time is computed from the local clock.
+func UpdateTTL(ctx context.Context, kv Store, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	if kv, ok := kv.(TTLSetter); ok {
+		return errgo.Mask(kv.UpdateTTL(ctx, key, ttl, getVal), errgo.Any)
+	}
+	return errgo.Mask(kv.Update(ctx, key, ExpireAfter(time.Now(), ttl), getVal), errgo.Any)
+}
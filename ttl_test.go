@@ -0,0 +1,43 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestTTLFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := plainStore{memsimplekv.NewStore()}
+
+	err := simplekv.SetTTL(ctx, kv, "a", []byte("a"), time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetTTL(ctx, kv, "b", []byte("b"), 0)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetTTL(ctx, kv, "c", []byte("c"), -time.Second)
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.UpdateTTL(ctx, kv, "d", -time.Second, func(old []byte) ([]byte, error) {
+		return []byte("d"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	for _, key := range []string{"a", "b"} {
+		ok, err := kv.Exists(ctx, key)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(ok, qt.Equals, true, qt.Commentf("key %s", key))
+	}
+	for _, key := range []string{"c", "d"} {
+		_, err := kv.Get(ctx, key)
+		c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound, qt.Commentf("key %s", key))
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package ttlsimplekv provides a simplekv.Store that gives a default
+// expiry time to entries written without one, so that a retention
+// policy can be enforced in one place rather than at every call site.
+//
+// With WithSlidingExpiry, the store also extends the expiry time of
+// entries as they are read, which gives the sliding expiration
+// usually wanted for sessions.
+package ttlsimplekv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/internal/wrapkv"
+)
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithSlidingExpiry returns an option that makes the store extend the
+// expiry time of an entry to the store's TTL from now each time it is
+// read with Get, so that entries expire only once they have not been
+// read for the TTL. This applies to all entries, including those
+// written with an explicit expiry time.
+//
+// To avoid a write for every read, an entry is not extended again
+// until minInterval has passed since the store last extended it. The
+// times are held in memory by each store, so stores sharing the
+// same underlying store do not share them.
+func WithSlidingExpiry(minInterval time.Duration) Option {
+	return func(s *kvStore) {
+		s.sliding = true
+		s.minSlideInterval = minInterval
+	}
+}
+
+// WithClock returns an option that makes the store use the given clock
+// to compute expiry times that are not computed by the underlying
+// store. By default the system clock is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// WithLogger returns an option that makes the store report failures
+// to extend expiry times to the given logger. By default failures are
+// not reported.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// NewStore returns a store that uses kv for storage, but makes any
+// entry written with a zero expiry time (or a zero TTL) expire after
+// the given duration instead of never. Writes that specify an expiry
+// time are passed to kv unchanged.
+//
+// Where possible, the expiry time is computed by kv with
+// simplekv.SetTTL and simplekv.UpdateTTL; otherwise it is computed
+// from the local clock.
+//
+// The returned store implements simplekv.KeyLister and
+// simplekv.Counter if kv implements simplekv.KeyLister, and
+// simplekv.Iterable if kv does.
+func NewStore(kv simplekv.Store, ttl time.Duration, opts ...Option) simplekv.Store {
+	s := &kvStore{
+		kv:     kv,
+		ttl:    ttl,
+		clock:  systemClock{},
+		logger: nopLogger{},
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	s.lastSweep = s.clock.Now()
+	return wrapkv.NewStore(s, kv)
+}
+
+type kvStore struct {
+	kv     simplekv.Store
+	ttl    time.Duration
+	clock  simplekv.Clock
+	logger simplekv.Logger
+
+	// sliding holds whether entries are extended when read, and
+	// minSlideInterval holds the minimum time between extensions
+	// of the same entry.
+	sliding          bool
+	minSlideInterval time.Duration
+
+	// mu guards the fields below.
+	mu sync.Mutex
+
+	// slid holds the time at which each recently read entry was
+	// last extended.
+	slid map[string]time.Time
+
+	// lastSweep holds the time at which old times were last
+	// removed from slid.
+	lastSweep time.Time
+}
+
+// expire returns the expiry time to use in place of the given one.
+func (s *kvStore) expire(expire time.Time) time.Time {
+	if expire.IsZero() {
+		return simplekv.ExpireAfter(s.clock.Now(), s.ttl)
+	}
+	return expire
+}
+
+// slide extends the expiry time of the entry with the given key if it
+// has not been extended within the minimum interval.
+func (s *kvStore) slide(ctx context.Context, key string) {
+	now := s.clock.Now()
+	if !s.shouldSlide(key, now) {
+		return
+	}
+	err := s.kv.Touch(ctx, key, simplekv.ExpireAfter(now, s.ttl))
+	if err != nil && errgo.Cause(err) != simplekv.ErrNotFound {
+		s.logger.Debugf("cannot extend expiry time of %q: %v", key, err)
+	}
+}
+
+// shouldSlide reports whether the entry with the given key should be
+// extended at the given time, and if so records that it has been.
+func (s *kvStore) shouldSlide(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.minSlideInterval <= 0 {
+		return true
+	}
+	if now.Sub(s.lastSweep) >= s.minSlideInterval {
+		// Times older than the interval no longer prevent an
+		// extension, so remove them to bound the map's size.
+		for k, t := range s.slid {
+			if now.Sub(t) >= s.minSlideInterval {
+				delete(s.slid, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if t, ok := s.slid[key]; ok && now.Sub(t) < s.minSlideInterval {
+		return false
+	}
+	if s.slid == nil {
+		s.slid = make(map[string]time.Time)
+	}
+	s.slid[key] = now
+	return true
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get. If the store was created with
+// WithSlidingExpiry, it also extends the expiry time of the entry.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.kv.Get(ctx, key)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if s.sliding {
+		s.slide(ctx, key)
+	}
+	return v, nil
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	ok, err := s.kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if expire.IsZero() {
+		return errgo.Mask(simplekv.SetTTL(ctx, s.kv, key, value, s.ttl), errgo.Any)
+	}
+	return errgo.Mask(s.kv.Set(ctx, key, value, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if expire.IsZero() {
+		return errgo.Mask(simplekv.UpdateTTL(ctx, s.kv, key, s.ttl, getVal), errgo.Any)
+	}
+	return errgo.Mask(s.kv.Update(ctx, key, expire, getVal), errgo.Any)
+}
+
+// SetTTL implements simplekv.TTLSetter.SetTTL.
+func (s *kvStore) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	return errgo.Mask(simplekv.SetTTL(ctx, s.kv, key, value, ttl), errgo.Any)
+}
+
+// UpdateTTL implements simplekv.TTLSetter.UpdateTTL.
+func (s *kvStore) UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	return errgo.Mask(simplekv.UpdateTTL(ctx, s.kv, key, ttl, getVal), errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	return errgo.Mask(s.kv.Touch(ctx, key, s.expire(expire)), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	return errgo.Mask(s.kv.Delete(ctx, key), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the underlying store.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	return errgo.Mask(simplekv.SetIfEquals(ctx, s.kv, key, oldVal, newVal, s.expire(expire)), errgo.Any)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by calling
+// simplekv.SetMulti on the underlying store.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	entries1 := make([]simplekv.Entry, len(entries))
+	for i, e := range entries {
+		e.Expire = s.expire(e.Expire)
+		entries1[i] = e
+	}
+	return errgo.Mask(simplekv.SetMulti(ctx, s.kv, entries1), errgo.Any)
+}
+
+// Txn implements simplekv.Transactor.Txn by calling simplekv.Txn on
+// the underlying store.
+func (s *kvStore) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	err := simplekv.Txn(ctx, s.kv, func(tx simplekv.Tx) error {
+		return errgo.Mask(f(txn{
+			s:  s,
+			tx: tx,
+		}), errgo.Any)
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// txn implements simplekv.Tx by applying the default expiry time to
+// values set in a transaction on the underlying store.
+type txn struct {
+	s  *kvStore
+	tx simplekv.Tx
+}
+
+// Get implements simplekv.Tx.Get.
+func (tx txn) Get(key string) ([]byte, error) {
+	v, err := tx.tx.Get(key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Tx.Set.
+func (tx txn) Set(key string, value []byte, expire time.Time) error {
+	return errgo.Mask(tx.tx.Set(key, value, tx.s.expire(expire)), errgo.Any)
+}
+
+// Delete implements simplekv.Tx.Delete.
+func (tx txn) Delete(key string) error {
+	return errgo.Mask(tx.tx.Delete(key), errgo.Any)
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead by
+// calling simplekv.SnapshotRead on the underlying store.
+func (s *kvStore) SnapshotRead(ctx context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	return errgo.Mask(simplekv.SnapshotRead(ctx, s.kv, f), errgo.Any)
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen by returning the
+// limit of the underlying store.
+func (s *kvStore) MaxKeyLen() int {
+	return simplekv.KeyLimit(s.kv)
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
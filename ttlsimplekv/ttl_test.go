@@ -0,0 +1,121 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package ttlsimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+	"github.com/juju/simplekv/ttlsimplekv"
+)
+
+func TestTTLStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return ttlsimplekv.NewStore(memsimplekv.NewStore(), time.Hour), nil
+	})
+}
+
+func TestSlidingTTLStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return ttlsimplekv.NewStore(memsimplekv.NewStore(), time.Hour, ttlsimplekv.WithSlidingExpiry(time.Second)), nil
+	})
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestDefaultTTLApplied(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Now()}
+	mem := memsimplekv.NewStore(memsimplekv.WithClock(clock))
+	kv := ttlsimplekv.NewStore(mem, time.Minute)
+
+	err := kv.Set(ctx, "default", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Update(ctx, "update", time.Time{}, func(old []byte) ([]byte, error) {
+		return []byte("v"), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.SetMulti(ctx, kv, []simplekv.Entry{{Key: "multi", Value: []byte("v")}})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.Txn(ctx, kv, func(tx simplekv.Tx) error {
+		return tx.Set("txn", []byte("v"), time.Time{})
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "explicit", []byte("v"), clock.now.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	for _, key := range []string{"default", "update", "multi", "txn"} {
+		_, err := kv.Get(ctx, key)
+		c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound, qt.Commentf("key %q", key))
+	}
+	v, err := kv.Get(ctx, "explicit")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "v")
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Now()}
+	mem := memsimplekv.NewStore(memsimplekv.WithClock(clock))
+	kv := ttlsimplekv.NewStore(mem, time.Minute,
+		ttlsimplekv.WithSlidingExpiry(10*time.Second),
+		ttlsimplekv.WithClock(clock),
+	)
+	expiry := func(key string) time.Time {
+		t, err := mem.(simplekv.ExpiryReader).GetExpiry(ctx, key)
+		c.Assert(err, qt.Equals, nil)
+		return t
+	}
+
+	err := kv.Set(ctx, "session", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "explicit", []byte("v"), clock.now.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+
+	// Each read extends the entry, so it outlives its original TTL.
+	for i := 0; i < 4; i++ {
+		clock.now = clock.now.Add(30 * time.Second)
+		v, err := kv.Get(ctx, "session")
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(string(v), qt.Equals, "v")
+	}
+	c.Assert(expiry("session"), qt.DeepEquals, simplekv.NormalizeExpire(clock.now.Add(time.Minute)))
+
+	// Reads within the minimum interval do not extend it again.
+	last := expiry("session")
+	clock.now = clock.now.Add(5 * time.Second)
+	_, err = kv.Get(ctx, "session")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expiry("session"), qt.DeepEquals, last)
+	clock.now = clock.now.Add(5 * time.Second)
+	_, err = kv.Get(ctx, "session")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expiry("session"), qt.DeepEquals, simplekv.NormalizeExpire(clock.now.Add(time.Minute)))
+
+	// Entries with an explicit expiry time slide too.
+	_, err = kv.Get(ctx, "explicit")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(expiry("explicit"), qt.DeepEquals, simplekv.NormalizeExpire(clock.now.Add(time.Minute)))
+
+	// Once an entry has not been read for the TTL, it expires.
+	clock.now = clock.now.Add(time.Minute)
+	_, err = kv.Get(ctx, "session")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// Tx gives access to the entries of a store from within a transaction
+// started by Txn. Reads within a transaction see the writes already
+// made in it.
+type Tx interface {
+	// Get retrieves the value associated with the given key. If
+	// there is no such key an error with a cause of ErrNotFound
+	// will be returned.
+	Get(key string) ([]byte, error)
+
+	// Set sets the value of the given key, as described by
+	// Store.Set.
+	Set(key string, value []byte, expire time.Time) error
+
+	// Delete removes the given key. If there is no such key an
+	// error with a cause of ErrNotFound will be returned.
+	Delete(key string) error
+}
+
+// Transactor is implemented by stores that can read and write several
+// keys in a single atomic transaction.
+type Transactor interface {
+	Store
+
+	// Txn calls f with a Tx that can be used to read and write
+	// entries. If f returns nil, all its writes are committed
+	// together; otherwise none of them are made, and the error is
+	// returned with its cause unchanged.
+	//
+	// Like the getVal argument to Store.Update, f may be called
+	// several times, so should not have side-effects.
+	Txn(ctx context.Context, f func(tx Tx) error) error
+}
+
+// Txn runs f in a transaction on the given store, as described by
+// Transactor.Txn. If kv implements Transactor, its Txn method is used.
+//
+// Otherwise Txn makes a best effort: f reads directly from kv while its
+// writes are kept in memory, and the writes are applied one at a time
+// only if f returns nil. Nothing is written if f fails, but writes by
+// other clients may interleave with the transaction, and if applying
+// the writes fails part way through only some of them are made.
+func Txn(ctx context.Context, kv Store, f func(tx Tx) error) error {
+	if kv, ok := kv.(Transactor); ok {
+		return errgo.Mask(kv.Txn(ctx, f), errgo.Any)
+	}
+	tx := &bufferedTx{
+		ctx:     ctx,
+		kv:      kv,
+		entries: make(map[string]*Entry),
+	}
+	if err := f(tx); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	for _, key := range tx.keys {
+		e := tx.entries[key]
+		var err error
+		if e == nil {
+			err = kv.Delete(ctx, key)
+			if errgo.Cause(err) == ErrNotFound {
+				// Someone else has already deleted it.
+				err = nil
+			}
+		} else {
+			err = kv.Set(ctx, key, e.Value, e.Expire)
+		}
+		if err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot write %q", key), errgo.Any)
+		}
+	}
+	return nil
+}
+
+// bufferedTx implements Tx for stores that do not implement
+// Transactor by holding writes in memory.
+type bufferedTx struct {
+	ctx context.Context
+	kv  Store
+
+	// entries holds the entries written in the transaction, keyed
+	// by key. A nil entry records a deletion.
+	entries map[string]*Entry
+
+	// keys holds the keys in entries in the order in which they
+	// were first written.
+	keys []string
+}
+
+// Get implements Tx.Get.
+func (tx *bufferedTx) Get(key string) ([]byte, error) {
+	if e, ok := tx.entries[key]; ok {
+		if e == nil {
+			return nil, KeyNotFoundError(key)
+		}
+		return e.Value, nil
+	}
+	v, err := tx.kv.Get(tx.ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements Tx.Set.
+func (tx *bufferedTx) Set(key string, value []byte, expire time.Time) error {
+	if err := CheckKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrKeyTooLarge))
+	}
+	if maxLen := MaxValueLen(tx.kv); maxLen > 0 {
+		if err := CheckValue(value, maxLen); err != nil {
+			return errgo.Mask(err, errgo.Is(ErrValueTooLarge))
+		}
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	tx.write(key, &Entry{
+		Key:    key,
+		Value:  value,
+		Expire: expire,
+	})
+	return nil
+}
+
+// Delete implements Tx.Delete.
+func (tx *bufferedTx) Delete(key string) error {
+	if e, ok := tx.entries[key]; ok {
+		if e == nil {
+			return KeyNotFoundError(key)
+		}
+	} else {
+		ok, err := tx.kv.Exists(tx.ctx, key)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if !ok {
+			return KeyNotFoundError(key)
+		}
+	}
+	tx.write(key, nil)
+	return nil
+}
+
+func (tx *bufferedTx) write(key string, e *Entry) {
+	if _, ok := tx.entries[key]; !ok {
+		tx.keys = append(tx.keys, key)
+	}
+	tx.entries[key] = e
+}
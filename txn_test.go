@@ -0,0 +1,63 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+)
+
+func TestTxnFallback(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore()
+	kv := plainStore{mem}
+	err := kv.Set(ctx, "a", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+
+	err = simplekv.Txn(ctx, kv, func(tx simplekv.Tx) error {
+		if err := tx.Set("b", []byte("2"), time.Time{}); err != nil {
+			return err
+		}
+		if err := tx.Delete("a"); err != nil {
+			return err
+		}
+		// Writes are not made until the transaction ends.
+		_, err := mem.Get(ctx, "b")
+		c.Check(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+		v, err := tx.Get("b")
+		c.Check(err, qt.Equals, nil)
+		c.Check(string(v), qt.Equals, "2")
+		_, err = tx.Get("a")
+		c.Check(errgo.Cause(err), qt.Equals, simplekv.ErrNotFound)
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	snap, err := simplekv.Snapshot(ctx, mem.(simplekv.KeyLister))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(snap, qt.DeepEquals, map[string][]byte{
+		"b": []byte("2"),
+	})
+
+	err = simplekv.Txn(ctx, kv, func(tx simplekv.Tx) error {
+		return tx.Set("c", make([]byte, 11), time.Time{})
+	})
+	c.Assert(err, qt.Equals, nil)
+	err = simplekv.Txn(ctx, limitedStore{Store: kv}, func(tx simplekv.Tx) error {
+		return tx.Set("c", make([]byte, 11), time.Time{})
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+}
+
+// plainStore hides any methods other than those of simplekv.Store.
+type plainStore struct {
+	simplekv.Store
+}
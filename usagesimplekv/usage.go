@@ -0,0 +1,535 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package usagesimplekv provides a simplekv.Store that accounts for
+// the operations made on it by each tenant of a shared store, so that
+// usage can be charged back or shown back to the tenants.
+//
+// Each operation is attributed to a tenant, by default the one
+// attached to its context with ContextWithTenant. Usage is tallied in
+// memory and periodically added to usage records held in the
+// underlying store itself, one per tenant per accounting period, so
+// several processes sharing the store contribute to the same records.
+package usagesimplekv
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// DefaultFlushInterval holds the interval at which usage is written to
+// the store when WithFlushInterval is not used.
+const DefaultFlushInterval = time.Minute
+
+// DefaultPeriod holds the length of the accounting period when
+// WithPeriod is not used.
+const DefaultPeriod = time.Hour
+
+// periodFormat holds the format of the start time of a period in the
+// key of a usage record. It sorts in time order.
+const periodFormat = "20060102T150405Z"
+
+// Usage holds the usage of a store by a tenant.
+type Usage struct {
+	// Reads holds the number of Get and Exists calls.
+	Reads int64 `json:"reads"`
+
+	// Writes holds the number of Set, Update and Touch calls.
+	Writes int64 `json:"writes"`
+
+	// Deletes holds the number of Delete calls.
+	Deletes int64 `json:"deletes"`
+
+	// Lists holds the number of Keys and KeysWithPrefix calls.
+	Lists int64 `json:"lists"`
+
+	// BytesRead holds the total length of the values returned by Get.
+	BytesRead int64 `json:"bytes-read"`
+
+	// BytesWritten holds the total length of the values written by
+	// Set and Update.
+	BytesWritten int64 `json:"bytes-written"`
+}
+
+// add adds the usage in u1 to u.
+func (u *Usage) add(u1 Usage) {
+	u.Reads += u1.Reads
+	u.Writes += u1.Writes
+	u.Deletes += u1.Deletes
+	u.Lists += u1.Lists
+	u.BytesRead += u1.BytesRead
+	u.BytesWritten += u1.BytesWritten
+}
+
+// Record holds the usage of a store by a tenant during one accounting
+// period.
+type Record struct {
+	// Tenant holds the tenant the usage is attributed to.
+	Tenant string
+
+	// Start holds the start of the accounting period.
+	Start time.Time
+
+	Usage
+}
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a context that attributes the operations
+// made with it to the given tenant.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant attached to the given context
+// by ContextWithTenant, or the empty string if there is none.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantFromKeyPrefix returns a function, suitable for passing to
+// WithTenantFunc, that attributes each operation to the part of its
+// key before the first occurrence of sep. Listings are attributed to
+// the part of their prefix before sep, and operations on keys that do
+// not contain sep are attributed to the empty tenant.
+func TenantFromKeyPrefix(sep string) func(ctx context.Context, key string) string {
+	return func(_ context.Context, key string) string {
+		if i := strings.Index(key, sep); i >= 0 {
+			return key[:i]
+		}
+		return ""
+	}
+}
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithTenantFunc returns an option that makes the store attribute each
+// operation to the tenant returned by f, which is called with the
+// operation's context and key (or prefix, for listings). By default
+// TenantFromContext is used.
+func WithTenantFunc(f func(ctx context.Context, key string) string) Option {
+	return func(s *kvStore) {
+		s.tenant = f
+	}
+}
+
+// WithFlushInterval returns an option that makes the store write the
+// usage tallied in memory to the store at the given interval. If the
+// interval is zero, usage is written only by Flush and Close. By
+// default DefaultFlushInterval is used.
+func WithFlushInterval(d time.Duration) Option {
+	return func(s *kvStore) {
+		s.flushInterval = d
+	}
+}
+
+// WithPeriod returns an option that sets the length of the accounting
+// period covered by each usage record. Periods are aligned to the
+// zero time, so an hour-long period starts on the hour. By default
+// DefaultPeriod is used.
+func WithPeriod(d time.Duration) Option {
+	return func(s *kvStore) {
+		s.period = d
+	}
+}
+
+// WithLogger returns an option that makes the store report failures
+// to write usage records to the given logger. By default failures are
+// not reported.
+func WithLogger(logger simplekv.Logger) Option {
+	return func(s *kvStore) {
+		s.logger = logger
+	}
+}
+
+// WithClock returns an option that makes the store use the given clock
+// to determine the accounting period of each operation. By default the
+// system clock is used.
+func WithClock(clock simplekv.Clock) Option {
+	return func(s *kvStore) {
+		s.clock = clock
+	}
+}
+
+// Store is implemented by the stores returned by NewStore.
+type Store interface {
+	simplekv.KeyLister
+
+	// Flush adds the usage tallied in memory to the usage records in
+	// the store. Usage that cannot be written is kept, to be written
+	// by the next flush.
+	Flush(ctx context.Context) error
+
+	// Usage returns the usage records of the given tenant for the
+	// periods starting in [from, to), in time order. Usage that
+	// has not yet been flushed is not included.
+	Usage(ctx context.Context, tenant string, from, to time.Time) ([]Record, error)
+
+	// Close stops the periodic flushes and flushes the remaining
+	// usage. The underlying store is not closed.
+	Close() error
+}
+
+// NewStore returns a store that holds its entries in kv and accounts
+// for the operations made on it, holding usage records in kv under
+// keys starting with usagePrefix. The usage prefix is reserved: keys
+// starting with it cannot be used through the returned store and are
+// not listed by it. The records are not given an expiry time, so old
+// records should be removed by other means.
+//
+// Unless the flush interval is zero, usage is flushed periodically in
+// the background, and the returned store must be closed when it is no
+// longer needed. Usage tallied since the last flush is lost if the
+// process exits without closing the store.
+func NewStore(kv simplekv.KeyLister, usagePrefix string, opts ...Option) Store {
+	s := &kvStore{
+		kv:            kv,
+		usagePrefix:   usagePrefix,
+		tenant:        func(ctx context.Context, _ string) string { return TenantFromContext(ctx) },
+		flushInterval: DefaultFlushInterval,
+		period:        DefaultPeriod,
+		logger:        nopLogger{},
+		clock:         systemClock{},
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		tally:         make(map[tallyKey]*Usage),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.period <= 0 {
+		s.period = DefaultPeriod
+	}
+	if s.flushInterval > 0 {
+		go s.run()
+	} else {
+		close(s.done)
+	}
+	return s
+}
+
+type kvStore struct {
+	kv            simplekv.KeyLister
+	usagePrefix   string
+	tenant        func(ctx context.Context, key string) string
+	flushInterval time.Duration
+	period        time.Duration
+	logger        simplekv.Logger
+	clock         simplekv.Clock
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// flushMu is held while a flush is in progress.
+	flushMu sync.Mutex
+
+	// mu guards tally.
+	mu sync.Mutex
+
+	// tally holds the usage that has not yet been flushed.
+	tally map[tallyKey]*Usage
+}
+
+// tallyKey identifies the usage record that usage is added to.
+type tallyKey struct {
+	tenant string
+	start  time.Time
+}
+
+// run flushes the store at the flush interval until the store is
+// closed.
+func (s *kvStore) run() {
+	defer close(s.done)
+	t := time.NewTicker(s.flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+		if err := s.Flush(context.Background()); err != nil {
+			s.logger.Debugf("cannot flush usage: %v", err)
+		}
+	}
+}
+
+// account adds the given usage to the tally of the tenant of an
+// operation on the given key.
+func (s *kvStore) account(ctx context.Context, key string, u Usage) {
+	k := tallyKey{
+		tenant: s.tenant(ctx, key),
+		start:  s.clock.Now().UTC().Truncate(s.period),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.tally[k]; t != nil {
+		t.add(u)
+	} else {
+		s.tally[k] = &u
+	}
+}
+
+// tenantPrefix returns the prefix of the keys of the usage records of
+// the given tenant. The tenant's length is included so that the
+// records of one tenant are not listed with those of another tenant
+// whose name it is a prefix of.
+func (s *kvStore) tenantPrefix(tenant string) string {
+	return s.usagePrefix + strconv.Itoa(len(tenant)) + ":" + tenant + "/"
+}
+
+// Flush implements Store.Flush.
+func (s *kvStore) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	tally := s.tally
+	s.tally = make(map[tallyKey]*Usage)
+	s.mu.Unlock()
+
+	var firstErr error
+	for k, u := range tally {
+		err := s.kv.Update(ctx, s.tenantPrefix(k.tenant)+k.start.Format(periodFormat), time.Time{}, func(old []byte) ([]byte, error) {
+			var total Usage
+			if old != nil {
+				if err := json.Unmarshal(old, &total); err != nil {
+					return nil, errgo.Notef(err, "invalid usage record")
+				}
+			}
+			total.add(*u)
+			return json.Marshal(total)
+		})
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = errgo.Notef(err, "cannot record usage of tenant %q", k.tenant)
+		}
+		// Keep the usage so that it is written by the next flush.
+		s.mu.Lock()
+		if t := s.tally[k]; t != nil {
+			t.add(*u)
+		} else {
+			s.tally[k] = u
+		}
+		s.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Usage implements Store.Usage.
+func (s *kvStore) Usage(ctx context.Context, tenant string, from, to time.Time) ([]Record, error) {
+	prefix := s.tenantPrefix(tenant)
+	keys, err := s.kv.KeysWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot list usage records")
+	}
+	sort.Strings(keys)
+	records := []Record{}
+	for _, key := range keys {
+		start, err := time.Parse(periodFormat, strings.TrimPrefix(key, prefix))
+		if err != nil || start.Before(from) || !start.Before(to) {
+			continue
+		}
+		data, err := s.kv.Get(ctx, key)
+		if errgo.Cause(err) == simplekv.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get usage record")
+		}
+		r := Record{
+			Tenant: tenant,
+			Start:  start,
+		}
+		if err := json.Unmarshal(data, &r.Usage); err != nil {
+			return nil, errgo.Notef(err, "invalid usage record %q", key)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// checkKey checks that the given key can be used with the store. It
+// returns an error with a cause of simplekv.ErrStoreClosed if the
+// store has been closed, or simplekv.ErrInvalidKey if the key is in
+// the usage area.
+func (s *kvStore) checkKey(key string) error {
+	if err := s.checkClosed(); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	if strings.HasPrefix(key, s.usagePrefix) {
+		return errgo.WithCausef(nil, simplekv.ErrInvalidKey, "key %q is in the usage area", key)
+	}
+	return nil
+}
+
+// checkClosed returns an error with a cause of simplekv.ErrStoreClosed
+// if the store has been closed.
+func (s *kvStore) checkClosed() error {
+	select {
+	case <-s.stop:
+		return errgo.WithCausef(nil, simplekv.ErrStoreClosed, "")
+	default:
+		return nil
+	}
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := s.checkKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	v, err := s.kv.Get(ctx, key)
+	s.account(ctx, key, Usage{
+		Reads:     1,
+		BytesRead: int64(len(v)),
+	})
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := s.checkKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	ok, err := s.kv.Exists(ctx, key)
+	s.account(ctx, key, Usage{
+		Reads: 1,
+	})
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	err := s.kv.Set(ctx, key, value, expire)
+	s.account(ctx, key, Usage{
+		Writes:       1,
+		BytesWritten: int64(len(value)),
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Update implements simplekv.Store.Update. The bytes written are
+// those of the value returned by the last call to getVal.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	var n int
+	err := s.kv.Update(ctx, key, expire, func(old []byte) ([]byte, error) {
+		v, err := getVal(old)
+		n = len(v)
+		return v, err
+	})
+	s.account(ctx, key, Usage{
+		Writes:       1,
+		BytesWritten: int64(n),
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	err := s.kv.Touch(ctx, key, expire)
+	s.account(ctx, key, Usage{
+		Writes: 1,
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Is(simplekv.ErrInvalidKey), errgo.Is(simplekv.ErrStoreClosed))
+	}
+	err := s.kv.Delete(ctx, key)
+	s.account(ctx, key, Usage{
+		Deletes: 1,
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// Keys implements simplekv.KeyLister.Keys.
+func (s *kvStore) Keys(ctx context.Context) ([]string, error) {
+	return s.KeysWithPrefix(ctx, "")
+}
+
+// KeysWithPrefix implements simplekv.KeyLister.KeysWithPrefix. Keys in
+// the usage area are not included.
+func (s *kvStore) KeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(simplekv.ErrStoreClosed))
+	}
+	keys, err := s.kv.KeysWithPrefix(ctx, prefix)
+	s.account(ctx, prefix, Usage{
+		Lists: 1,
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	n := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, s.usagePrefix) {
+			keys[n] = key
+			n++
+		}
+	}
+	return keys[:n], nil
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen by returning the
+// limit of the underlying store.
+func (s *kvStore) MaxKeyLen() int {
+	return simplekv.KeyLimit(s.kv)
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen by
+// returning the limit of the underlying store.
+func (s *kvStore) MaxValueLen() int {
+	return simplekv.MaxValueLen(s.kv)
+}
+
+// Close implements Store.Close. Closing a store more than once has no
+// further effect.
+func (s *kvStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		err = s.Flush(context.Background())
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
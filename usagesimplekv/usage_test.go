@@ -0,0 +1,156 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package usagesimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+	"github.com/juju/simplekv/usagesimplekv"
+)
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestUsageStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		// Flush often, so that the tests exercise flushes running
+		// concurrently with other operations.
+		return usagesimplekv.NewStore(
+			memsimplekv.NewStore().(simplekv.KeyLister),
+			"usage/",
+			usagesimplekv.WithFlushInterval(time.Millisecond),
+		), nil
+	})
+}
+
+func TestUsage(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: epoch.Add(10 * time.Minute)}
+	mem := memsimplekv.NewStore().(simplekv.KeyLister)
+	kv := usagesimplekv.NewStore(mem, "usage/",
+		usagesimplekv.WithFlushInterval(0),
+		usagesimplekv.WithClock(clock),
+	)
+	defer kv.Close()
+
+	a := usagesimplekv.ContextWithTenant(ctx, "a")
+	b := usagesimplekv.ContextWithTenant(ctx, "ab")
+	err := kv.Set(a, "k1", []byte("hello"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Update(a, "k1", time.Time{}, func(old []byte) ([]byte, error) {
+		return append(old, " world"...), nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	v, err := kv.Get(a, "k1")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(v), qt.Equals, "hello world")
+	_, err = kv.Exists(b, "k1")
+	c.Assert(err, qt.Equals, nil)
+	_, err = kv.Keys(b)
+	c.Assert(err, qt.Equals, nil)
+
+	// Nothing is recorded until the usage is flushed.
+	records, err := kv.Usage(ctx, "a", epoch, epoch.Add(24*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.HasLen, 0)
+	err = kv.Flush(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	// Usage in a later period is recorded separately.
+	clock.now = clock.now.Add(time.Hour)
+	err = kv.Delete(a, "k1")
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Flush(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	records, err = kv.Usage(ctx, "a", epoch, epoch.Add(24*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.DeepEquals, []usagesimplekv.Record{{
+		Tenant: "a",
+		Start:  epoch,
+		Usage: usagesimplekv.Usage{
+			Reads:        1,
+			Writes:       2,
+			BytesRead:    11,
+			BytesWritten: 16,
+		},
+	}, {
+		Tenant: "a",
+		Start:  epoch.Add(time.Hour),
+		Usage: usagesimplekv.Usage{
+			Deletes: 1,
+		},
+	}})
+	records, err = kv.Usage(ctx, "a", epoch.Add(time.Hour), epoch.Add(24*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.HasLen, 1)
+
+	records, err = kv.Usage(ctx, "ab", epoch, epoch.Add(24*time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.DeepEquals, []usagesimplekv.Record{{
+		Tenant: "ab",
+		Start:  epoch,
+		Usage: usagesimplekv.Usage{
+			Reads: 1,
+			Lists: 1,
+		},
+	}})
+
+	// Usage records are hidden and cannot be written through the
+	// store.
+	keys, err := kv.Keys(ctx)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(keys, qt.HasLen, 0)
+	err = kv.Set(ctx, "usage/x", []byte("x"), time.Time{})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey)
+}
+
+func TestUsageAddedAcrossStores(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	clock := &testClock{now: epoch}
+	mem := memsimplekv.NewStore().(simplekv.KeyLister)
+	newStore := func() usagesimplekv.Store {
+		return usagesimplekv.NewStore(mem, "usage/",
+			usagesimplekv.WithFlushInterval(0),
+			usagesimplekv.WithClock(clock),
+			usagesimplekv.WithTenantFunc(usagesimplekv.TenantFromKeyPrefix("/")),
+		)
+	}
+	kv1, kv2 := newStore(), newStore()
+	err := kv1.Set(ctx, "t1/x", []byte("1"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv2.Set(ctx, "t1/y", []byte("22"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv2.Set(ctx, "t2/y", []byte("333"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv1.Flush(ctx)
+	c.Assert(err, qt.Equals, nil)
+	err = kv2.Flush(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	records, err := kv1.Usage(ctx, "t1", epoch, epoch.Add(time.Hour))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(records, qt.HasLen, 1)
+	c.Assert(records[0].Usage, qt.DeepEquals, usagesimplekv.Usage{
+		Writes:       2,
+		BytesWritten: 3,
+	})
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv
+
+import (
+	"unicode/utf8"
+
+	errgo "github.com/juju/simplekv/internal/errgo"
+)
+
+// ErrInvalidKey is the error cause used when a key does not satisfy
+// the KeyRules it is validated against.
+var ErrInvalidKey = errgo.New("invalid key")
+
+// KeyRules describes the keys accepted by ValidateKey.
+type KeyRules struct {
+	// MaxLen holds the maximum length of a key in bytes. If it is
+	// zero, MaxKeyLen is used.
+	MaxLen int
+
+	// AllowEmpty holds whether the empty key is accepted.
+	AllowEmpty bool
+
+	// Allowed reports whether the given character may appear in a
+	// key. If it is nil, any character is accepted, and keys need
+	// not be valid UTF-8. Otherwise keys must be valid UTF-8.
+	Allowed func(r rune) bool
+}
+
+// ValidateKey checks the given key against the given rules. If the key
+// is too long, it returns an error with a cause of ErrKeyTooLarge; if it
+// breaks any other rule, it returns an error with a cause of
+// ErrInvalidKey.
+func ValidateKey(key string, rules KeyRules) error {
+	maxLen := rules.MaxLen
+	if maxLen == 0 {
+		maxLen = MaxKeyLen
+	}
+	if err := CheckKeyLen(key, maxLen); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrKeyTooLarge))
+	}
+	if key == "" && !rules.AllowEmpty {
+		return errgo.WithCausef(nil, ErrInvalidKey, "empty key")
+	}
+	if rules.Allowed == nil {
+		return nil
+	}
+	if !utf8.ValidString(key) {
+		return errgo.WithCausef(nil, ErrInvalidKey, "key %q is not valid UTF-8", key)
+	}
+	for i, r := range key {
+		if !rules.Allowed(r) {
+			return errgo.WithCausef(nil, ErrInvalidKey, "key %q has invalid character %q at offset %d", key, r, i)
+		}
+	}
+	return nil
+}
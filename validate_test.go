@@ -0,0 +1,80 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package simplekv_test
+
+import (
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+)
+
+func isKeyChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r == '/'
+}
+
+var validateKeyTests = []struct {
+	about       string
+	key         string
+	rules       simplekv.KeyRules
+	expectError string
+	expectCause error
+}{{
+	about: "any key",
+	key:   "a\x00\xff",
+}, {
+	about:       "empty key",
+	key:         "",
+	expectError: `empty key`,
+	expectCause: simplekv.ErrInvalidKey,
+}, {
+	about: "empty key allowed",
+	key:   "",
+	rules: simplekv.KeyRules{AllowEmpty: true},
+}, {
+	about:       "default maximum length",
+	key:         strings.Repeat("a", simplekv.MaxKeyLen+1),
+	expectError: `key of 513 bytes exceeds maximum length of 512`,
+	expectCause: simplekv.ErrKeyTooLarge,
+}, {
+	about:       "maximum length",
+	key:         "abcd",
+	rules:       simplekv.KeyRules{MaxLen: 3},
+	expectError: `key of 4 bytes exceeds maximum length of 3`,
+	expectCause: simplekv.ErrKeyTooLarge,
+}, {
+	about: "allowed characters",
+	key:   "a/b",
+	rules: simplekv.KeyRules{Allowed: isKeyChar},
+}, {
+	about:       "disallowed character",
+	key:         "a/B",
+	rules:       simplekv.KeyRules{Allowed: isKeyChar},
+	expectError: `key "a/B" has invalid character 'B' at offset 2`,
+	expectCause: simplekv.ErrInvalidKey,
+}, {
+	about:       "invalid UTF-8",
+	key:         "a\xff",
+	rules:       simplekv.KeyRules{Allowed: isKeyChar},
+	expectError: `key "a\\xff" is not valid UTF-8`,
+	expectCause: simplekv.ErrInvalidKey,
+}}
+
+func TestValidateKey(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range validateKeyTests {
+		c.Run(test.about, func(c *qt.C) {
+			err := simplekv.ValidateKey(test.key, test.rules)
+			if test.expectError == "" {
+				c.Assert(err, qt.Equals, nil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), qt.Equals, test.expectCause)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// Package validatesimplekv provides a simplekv.Store that checks keys
+// and values before passing them to another store, so that keys and
+// values that would be rejected or mishandled by some backends are
+// rejected consistently by all of them.
+package validatesimplekv
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/simplekv"
+	errgo "github.com/juju/simplekv/internal/errgo"
+	"github.com/juju/simplekv/internal/wrapkv"
+)
+
+// Option represents an option that can be passed to NewStore.
+type Option func(*kvStore)
+
+// WithMaxValueLen returns an option that makes the store reject values
+// longer than n bytes with an error with a cause of
+// simplekv.ErrValueTooLarge, before they are passed to the underlying
+// store. If the underlying store has a smaller limit, that is used
+// instead.
+func WithMaxValueLen(n int) Option {
+	return func(s *kvStore) {
+		s.maxValueLen = n
+	}
+}
+
+// NewStore returns a store that uses kv for storage but first checks
+// every key it is given with simplekv.ValidateKey using the given
+// rules. Operations on keys that are too long fail with an error with a
+// cause of simplekv.ErrKeyTooLarge; operations on keys that break any
+// other rule fail with an error with a cause of simplekv.ErrInvalidKey.
+// Prefixes passed to KeysWithPrefix and Iterate are not checked.
+//
+// The returned store implements simplekv.KeyLister and
+// simplekv.Counter if kv implements simplekv.KeyLister, and
+// simplekv.Iterable if kv does.
+func NewStore(kv simplekv.Store, rules simplekv.KeyRules, opts ...Option) simplekv.Store {
+	if rules.MaxLen == 0 || rules.MaxLen > simplekv.KeyLimit(kv) {
+		rules.MaxLen = simplekv.KeyLimit(kv)
+	}
+	s := &kvStore{
+		kv:    kv,
+		rules: rules,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if maxLen := simplekv.MaxValueLen(kv); maxLen > 0 && (s.maxValueLen == 0 || s.maxValueLen > maxLen) {
+		s.maxValueLen = maxLen
+	}
+	return wrapkv.NewStore(s, kv)
+}
+
+type kvStore struct {
+	kv    simplekv.Store
+	rules simplekv.KeyRules
+
+	// maxValueLen holds the maximum length of a value, or zero if
+	// values are not checked.
+	maxValueLen int
+}
+
+// checkKey checks the given key against the store's rules.
+func (s *kvStore) checkKey(key string) error {
+	return errgo.Mask(simplekv.ValidateKey(key, s.rules), errgo.Is(simplekv.ErrKeyTooLarge), errgo.Is(simplekv.ErrInvalidKey))
+}
+
+// checkEntry checks the given key and value.
+func (s *kvStore) checkEntry(key string, value []byte) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if s.maxValueLen > 0 {
+		return errgo.Mask(simplekv.CheckValue(value, s.maxValueLen), errgo.Is(simplekv.ErrValueTooLarge))
+	}
+	return nil
+}
+
+// checkGetVal returns a function that calls getVal and checks the
+// length of the value it returns.
+func (s *kvStore) checkGetVal(getVal func(old []byte) ([]byte, error)) func(old []byte) ([]byte, error) {
+	if s.maxValueLen == 0 {
+		return getVal
+	}
+	return func(old []byte) ([]byte, error) {
+		v, err := getVal(old)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if err := simplekv.CheckValue(v, s.maxValueLen); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(simplekv.ErrValueTooLarge))
+		}
+		return v, nil
+	}
+}
+
+// Context implements simplekv.Store.Context.
+func (s *kvStore) Context(ctx context.Context) (_ context.Context, close func()) {
+	return s.kv.Context(ctx)
+}
+
+// Get implements simplekv.Store.Get.
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := s.checkKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	v, err := s.kv.Get(ctx, key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Exists implements simplekv.Store.Exists.
+func (s *kvStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := s.checkKey(key); err != nil {
+		return false, errgo.Mask(err, errgo.Any)
+	}
+	ok, err := s.kv.Exists(ctx, key)
+	return ok, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Store.Set.
+func (s *kvStore) Set(ctx context.Context, key string, value []byte, expire time.Time) error {
+	if err := s.checkEntry(key, value); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.kv.Set(ctx, key, value, expire), errgo.Any)
+}
+
+// Update implements simplekv.Store.Update.
+func (s *kvStore) Update(ctx context.Context, key string, expire time.Time, getVal func(old []byte) ([]byte, error)) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.kv.Update(ctx, key, expire, s.checkGetVal(getVal)), errgo.Any)
+}
+
+// Touch implements simplekv.Store.Touch.
+func (s *kvStore) Touch(ctx context.Context, key string, expire time.Time) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.kv.Touch(ctx, key, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Store.Delete.
+func (s *kvStore) Delete(ctx context.Context, key string) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(s.kv.Delete(ctx, key), errgo.Any)
+}
+
+// SetTTL implements simplekv.TTLSetter.SetTTL by calling
+// simplekv.SetTTL on the underlying store.
+func (s *kvStore) SetTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := s.checkEntry(key, value); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(simplekv.SetTTL(ctx, s.kv, key, value, ttl), errgo.Any)
+}
+
+// UpdateTTL implements simplekv.TTLSetter.UpdateTTL by calling
+// simplekv.UpdateTTL on the underlying store.
+func (s *kvStore) UpdateTTL(ctx context.Context, key string, ttl time.Duration, getVal func(old []byte) ([]byte, error)) error {
+	if err := s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(simplekv.UpdateTTL(ctx, s.kv, key, ttl, s.checkGetVal(getVal)), errgo.Any)
+}
+
+// SetIfEquals implements simplekv.CompareAndSwapper.SetIfEquals by
+// calling simplekv.SetIfEquals on the underlying store.
+func (s *kvStore) SetIfEquals(ctx context.Context, key string, oldVal, newVal []byte, expire time.Time) error {
+	if err := s.checkEntry(key, newVal); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(simplekv.SetIfEquals(ctx, s.kv, key, oldVal, newVal, expire), errgo.Any)
+}
+
+// SetMulti implements simplekv.MultiSetter.SetMulti by calling
+// simplekv.SetMulti on the underlying store. No entries are written if
+// any key or value is invalid.
+func (s *kvStore) SetMulti(ctx context.Context, entries []simplekv.Entry) error {
+	for _, e := range entries {
+		if err := s.checkEntry(e.Key, e.Value); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	return errgo.Mask(simplekv.SetMulti(ctx, s.kv, entries), errgo.Any)
+}
+
+// Txn implements simplekv.Transactor.Txn by calling simplekv.Txn on
+// the underlying store.
+func (s *kvStore) Txn(ctx context.Context, f func(tx simplekv.Tx) error) error {
+	err := simplekv.Txn(ctx, s.kv, func(tx simplekv.Tx) error {
+		return errgo.Mask(f(txn{
+			s:  s,
+			tx: tx,
+		}), errgo.Any)
+	})
+	return errgo.Mask(err, errgo.Any)
+}
+
+// txn implements simplekv.Tx by checking keys and values before
+// passing them to a transaction on the underlying store.
+type txn struct {
+	s  *kvStore
+	tx simplekv.Tx
+}
+
+// Get implements simplekv.Tx.Get.
+func (tx txn) Get(key string) ([]byte, error) {
+	if err := tx.s.checkKey(key); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	v, err := tx.tx.Get(key)
+	return v, errgo.Mask(err, errgo.Any)
+}
+
+// Set implements simplekv.Tx.Set.
+func (tx txn) Set(key string, value []byte, expire time.Time) error {
+	if err := tx.s.checkEntry(key, value); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(tx.tx.Set(key, value, expire), errgo.Any)
+}
+
+// Delete implements simplekv.Tx.Delete.
+func (tx txn) Delete(key string) error {
+	if err := tx.s.checkKey(key); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return errgo.Mask(tx.tx.Delete(key), errgo.Any)
+}
+
+// SnapshotRead implements simplekv.SnapshotReader.SnapshotRead by
+// calling simplekv.SnapshotRead on the underlying store.
+func (s *kvStore) SnapshotRead(ctx context.Context, f func(tx simplekv.SnapshotTx) error) error {
+	return errgo.Mask(simplekv.SnapshotRead(ctx, s.kv, f), errgo.Any)
+}
+
+// MaxKeyLen implements simplekv.KeyLimiter.MaxKeyLen.
+func (s *kvStore) MaxKeyLen() int {
+	return s.rules.MaxLen
+}
+
+// MaxValueLen implements simplekv.ValueLimiter.MaxValueLen.
+func (s *kvStore) MaxValueLen() int {
+	return s.maxValueLen
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package validatesimplekv_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"unicode"
+
+	qt "github.com/frankban/quicktest"
+	errgo "gopkg.in/errgo.v1"
+
+	"github.com/juju/simplekv"
+	"github.com/juju/simplekv/memsimplekv"
+	"github.com/juju/simplekv/simplekvtest"
+	"github.com/juju/simplekv/validatesimplekv"
+)
+
+func TestValidateStore(t *testing.T) {
+	simplekvtest.TestStore(t, func() (simplekv.Store, error) {
+		return validatesimplekv.NewStore(memsimplekv.NewStore(), simplekv.KeyRules{
+			MaxLen: 100,
+		}, validatesimplekv.WithMaxValueLen(1000)), nil
+	})
+}
+
+func TestInvalidKeysRejected(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	mem := memsimplekv.NewStore()
+	kv := validatesimplekv.NewStore(mem, simplekv.KeyRules{
+		MaxLen:  10,
+		Allowed: unicode.IsLower,
+	})
+	c.Assert(simplekv.KeyLimit(kv), qt.Equals, 10)
+
+	err := kv.Set(ctx, "abc", []byte("v"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "aBc", []byte("v"), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `key "aBc" has invalid character 'B' at offset 1`)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey)
+	_, err = kv.Get(ctx, "")
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrInvalidKey)
+	err = simplekv.SetMulti(ctx, kv, []simplekv.Entry{{Key: "ok"}, {Key: "abcdefghijk"}})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrKeyTooLarge)
+
+	// Nothing was written by the failed calls.
+	ok, err := mem.Exists(ctx, "ok")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+	ok, err = mem.Exists(ctx, "aBc")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(ok, qt.Equals, false)
+}
+
+func TestValueTooLarge(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	kv := validatesimplekv.NewStore(memsimplekv.NewStore(), simplekv.KeyRules{}, validatesimplekv.WithMaxValueLen(3))
+	c.Assert(simplekv.MaxValueLen(kv), qt.Equals, 3)
+
+	err := kv.Set(ctx, "a", []byte("abc"), time.Time{})
+	c.Assert(err, qt.Equals, nil)
+	err = kv.Set(ctx, "a", []byte("abcd"), time.Time{})
+	c.Assert(err, qt.ErrorMatches, `value of 4 bytes exceeds maximum length of 3`)
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+	err = simplekv.Txn(ctx, kv, func(tx simplekv.Tx) error {
+		return tx.Set("b", []byte("abcd"), time.Time{})
+	})
+	c.Assert(errgo.Cause(err), qt.Equals, simplekv.ErrValueTooLarge)
+}